@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+var errAdminDisabled = errors.New("admin API key is not configured")
+
+// authorizeAdmin checks the request carries the configured admin API key as
+// "Authorization: ApiKey <key>". Admin endpoints are disabled entirely when
+// no key is configured.
+func (cfg *apiConfig) authorizeAdmin(r *http.Request) error {
+	if cfg.adminAPIKey == "" {
+		return errAdminDisabled
+	}
+
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		return errors.New("invalid admin API key")
+	}
+	return nil
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -16,7 +24,30 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
+// assetsDirSize returns the total size in bytes of the files stored under
+// the assets directory.
+func (cfg apiConfig) assetsDirSize() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(cfg.assetsRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// getAssetPath returns a random file name with extension ext, used for both
+// local assets and S3 keys.
+func getAssetPath(ext string) string {
 	base := make([]byte, 32)
 	_, err := rand.Read(base)
 
@@ -25,10 +56,92 @@ func getAssetPath(mediaType string) string {
 	}
 	id := base64.RawURLEncoding.EncodeToString(base)
 
-	ext := mediaTypeToExt(mediaType)
 	return fmt.Sprintf("%s%s", id, ext)
 }
 
+// getVideoKey builds the S3 key a video is stored under from the configured
+// key template, by default {ratio}/{random}.{ext}. S3_USER_PREFIX groups keys
+// under users/{userID}/ so bucket policies and lifecycle rules can be scoped
+// per owner.
+func (cfg apiConfig) getVideoKey(userID uuid.UUID, ratio, ext string) string {
+	return cfg.keyTemplate.render(keyTemplateValues{
+		now:    time.Now().UTC(),
+		userID: userID,
+		ratio:  ratio,
+		ext:    ext,
+	})
+}
+
+// getPreviewKey is the S3 key of the animated preview of the video at
+// videoKey, stored next to it.
+func getPreviewKey(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "-preview" + mediaTypeToExt("image/webp")
+}
+
+// getProxyKey is the S3 key of the low-resolution editing proxy of the video
+// at videoKey, kept under proxy/ so lifecycle rules can target proxies.
+func getProxyKey(videoKey string) string {
+	return "proxy/" + strings.TrimSuffix(videoKey, path.Ext(videoKey)) + ".mp4"
+}
+
+// getStoryboardKey is the S3 key of the WebVTT thumbnail track of the video
+// at videoKey, stored next to it.
+func getStoryboardKey(videoKey string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "-storyboard.vtt"
+}
+
+// getStoryboardSpriteKey is the S3 key of the sprite sheet the track at
+// storyboardKey points into.
+func getStoryboardSpriteKey(storyboardKey string) string {
+	return strings.TrimSuffix(storyboardKey, path.Ext(storyboardKey)) + mediaTypeToExt("image/jpg")
+}
+
+// getVideoURL is the reference stored for an S3 object: its CloudFront URL.
+func (cfg apiConfig) getVideoURL(key string) string {
+	return fmt.Sprintf("https://%v/%v", cfg.s3CfDistribution, key)
+}
+
+// getVideoKeyFromURL extracts the S3 key from a URL built by getVideoURL.
+func (cfg apiConfig) getVideoKeyFromURL(videoURL string) (string, bool) {
+	prefix := cfg.getVideoURL("")
+	if !strings.HasPrefix(videoURL, prefix) || len(videoURL) == len(prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(videoURL, prefix), true
+}
+
+var customKeyPattern = regexp.MustCompile(`^[A-Za-z0-9/._-]+$`)
+
+const maxCustomKeyLength = 1024
+
+// getCustomKeyPrefix is the only prefix a user may pick custom keys under,
+// so a client can never write over someone else's objects.
+func (cfg apiConfig) getCustomKeyPrefix(userID uuid.UUID) string {
+	return fmt.Sprintf("%v/%v/", strings.TrimSuffix(cfg.s3CustomKeyPrefix, "/"), userID)
+}
+
+func (cfg apiConfig) validateCustomVideoKey(userID uuid.UUID, key string) error {
+	if len(key) > maxCustomKeyLength {
+		return fmt.Errorf("key must be at most %d characters", maxCustomKeyLength)
+	}
+	if strings.HasPrefix(key, "/") {
+		return errors.New("key must not start with a slash")
+	}
+	if !customKeyPattern.MatchString(key) {
+		return errors.New("key may only contain letters, digits, '/', '.', '_' and '-'")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.New("key must not contain empty, '.' or '..' path segments")
+		}
+	}
+	prefix := cfg.getCustomKeyPrefix(userID)
+	if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+		return fmt.Errorf("key must be within %q", prefix)
+	}
+	return nil
+}
+
 func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
 	return filepath.Join(cfg.assetsRoot, assetPath)
 }
@@ -37,10 +150,61 @@ func (cfg apiConfig) getAssetURL(assetPath string) string {
 	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
 }
 
+// getAssetPathFromURL extracts the asset path from a URL built by
+// getAssetURL.
+func (cfg apiConfig) getAssetPathFromURL(assetURL string) (string, bool) {
+	prefix := cfg.getAssetURL("")
+	if !strings.HasPrefix(assetURL, prefix) {
+		return "", false
+	}
+	assetPath := strings.TrimPrefix(assetURL, prefix)
+	if assetPath == "" || strings.ContainsAny(assetPath, "/\\") {
+		return "", false
+	}
+	return assetPath, true
+}
+
+// removeAsset deletes the file behind an asset URL. URLs that don't point
+// into the assets directory are left alone, and failures are only logged
+// since an orphaned file is harmless.
+func (cfg apiConfig) removeAsset(ctx context.Context, assetURL string) {
+	assetPath, ok := cfg.getAssetPathFromURL(assetURL)
+	if !ok {
+		return
+	}
+	err := os.Remove(cfg.getAssetDiskPath(assetPath))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logf(ctx, "Couldn't remove asset %v: %v", assetPath, err)
+	}
+}
+
+// assetExtensions maps the media types stored as files or objects to their
+// extensions. Every entry must map back through extToMediaType, so each
+// extension appears once.
+var assetExtensions = map[string]string{
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"image/jpg":  ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// mediaTypeToExt returns the extension files of mediaType are stored with,
+// ".bin" for types that are never stored.
 func mediaTypeToExt(mediaType string) string {
-	parts := strings.Split(mediaType, "/")
-	if len(parts) != 2 {
-		return ".bin"
+	if ext, ok := assetExtensions[canonicalMediaType(mediaType)]; ok {
+		return ext
+	}
+	return ".bin"
+}
+
+// extToMediaType is the inverse of mediaTypeToExt. It returns
+// "application/octet-stream" for unknown extensions.
+func extToMediaType(ext string) string {
+	for mediaType, e := range assetExtensions {
+		if e == strings.ToLower(ext) {
+			return mediaType
+		}
 	}
-	return "." + parts[1]
+	return "application/octet-stream"
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMediaTypeExtRoundTrip(t *testing.T) {
+	for mediaType, ext := range assetExtensions {
+		if got := mediaTypeToExt(mediaType); got != ext {
+			t.Errorf("mediaTypeToExt(%q) = %q, want %q", mediaType, got, ext)
+		}
+		if got := extToMediaType(ext); got != mediaType {
+			t.Errorf("extToMediaType(%q) = %q, want %q", ext, got, mediaType)
+		}
+		if got := extToMediaType(strings.ToUpper(ext)); got != mediaType {
+			t.Errorf("extToMediaType(%q) = %q, want %q", strings.ToUpper(ext), got, mediaType)
+		}
+	}
+
+	if got := mediaTypeToExt("image/jpeg"); got != ".jpg" {
+		t.Errorf("mediaTypeToExt(image/jpeg) = %q, want .jpg", got)
+	}
+	if got := mediaTypeToExt("application/pdf"); got != ".bin" {
+		t.Errorf("mediaTypeToExt(application/pdf) = %q, want .bin", got)
+	}
+	if got := extToMediaType(".pdf"); got != "application/octet-stream" {
+		t.Errorf("extToMediaType(.pdf) = %q, want application/octet-stream", got)
+	}
+}
+
+func TestGetAssetPath(t *testing.T) {
+	a, b := getAssetPath(".png"), getAssetPath(".png")
+	if a == b {
+		t.Errorf("getAssetPath returned %q twice", a)
+	}
+	if path.Ext(a) != ".png" || strings.ContainsAny(a, "/\\") {
+		t.Errorf("getAssetPath(.png) = %q, want a flat name ending in .png", a)
+	}
+}
+
+func TestVideoURLRoundTrip(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	key := cfg.getVideoKey(uuid.New(), "landscape", ".mp4")
+	if !strings.HasPrefix(key, "landscape/") || path.Ext(key) != ".mp4" {
+		t.Fatalf("getVideoKey = %q, want landscape/<random>.mp4", key)
+	}
+
+	videoURL := cfg.getVideoURL(key)
+	if videoURL != "https://cdn.tubely.test/"+key {
+		t.Errorf("getVideoURL = %q", videoURL)
+	}
+	got, ok := cfg.getVideoKeyFromURL(videoURL)
+	if !ok || got != key {
+		t.Errorf("getVideoKeyFromURL(%q) = %q, %v, want %q, true", videoURL, got, ok, key)
+	}
+
+	for _, foreign := range []string{
+		"https://cdn.tubely.test/",
+		"https://other.test/" + key,
+		"http://cdn.tubely.test/" + key,
+		"https://cdn.tubely.test.evil.test/" + key,
+	} {
+		if got, ok := cfg.getVideoKeyFromURL(foreign); ok {
+			t.Errorf("getVideoKeyFromURL(%q) = %q, true, want false", foreign, got)
+		}
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	const key = "landscape/abc.mp4"
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"preview", getPreviewKey(key), "landscape/abc-preview.webp"},
+		{"proxy", getProxyKey(key), "proxy/landscape/abc.mp4"},
+		{"storyboard", getStoryboardKey(key), "landscape/abc-storyboard.vtt"},
+		{"sprite", getStoryboardSpriteKey(getStoryboardKey(key)), "landscape/abc-storyboard.jpg"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s key = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
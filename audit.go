@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditVideoCreate       = "video.create"
+	auditVideoDuplicate    = "video.duplicate"
+	auditVideoImport       = "video.import"
+	auditVideoUpload       = "video.upload"
+	auditVideoDelete       = "video.delete"
+	auditVideoTrim         = "video.trim"
+	auditVideoReplace      = "video.replace"
+	auditVideoVisibility   = "video.visibility"
+	auditVideoAttributes   = "video.attributes"
+	auditVideoThumbnail    = "video.thumbnail"
+	auditVideoAccessGrant  = "video.access_grant"
+	auditVideoAccessRevoke = "video.access_revoke"
+)
+
+var auditActions = []string{
+	auditVideoCreate,
+	auditVideoDuplicate,
+	auditVideoImport,
+	auditVideoUpload,
+	auditVideoDelete,
+	auditVideoTrim,
+	auditVideoReplace,
+	auditVideoVisibility,
+	auditVideoAttributes,
+	auditVideoThumbnail,
+	auditVideoAccessGrant,
+	auditVideoAccessRevoke,
+}
+
+// recordAudit adds an entry for a change userID made to videoID. It's called
+// once the change went through, and a failure is only logged: the change
+// stands either way.
+func (cfg *apiConfig) recordAudit(r *http.Request, userID, videoID uuid.UUID, action string) {
+	var ip string
+	if addr, ok := clientIP(r, cfg.trustedProxies); ok {
+		ip = addr.String()
+	}
+
+	err := cfg.db.CreateAuditEntry(database.AuditEntry{
+		ID:        uuid.New(),
+		CreatedAt: time.Now(),
+		UserID:    userID,
+		Action:    action,
+		VideoID:   videoID,
+		ClientIP:  ip,
+	})
+	if err != nil {
+		logf(r.Context(), "Couldn't record %s of video %v in the audit log: %v", action, videoID, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Startup checks S3_STARTUP_CHECK selects.
+const (
+	bucketCheckNone  = "none"
+	bucketCheckRead  = "read"
+	bucketCheckWrite = "write"
+)
+
+// bucketCheckTimeout bounds the whole startup check.
+const bucketCheckTimeout = 10 * time.Second
+
+// bucketCheckKey is the marker object the write check puts and deletes again.
+const bucketCheckKey = ".tubely-startup-check"
+
+// checkBucket makes sure the configured bucket is usable before the server
+// takes requests, so a typo or missing permission fails at startup rather
+// than on the first upload. The read check asks S3 for the bucket, which
+// takes s3:ListBucket, a permission the server otherwise does without; that
+// is why it's not the default. The write check also puts a small marker
+// object and deletes it again.
+func (cfg *apiConfig) checkBucket(ctx context.Context, check string) error {
+	if check == bucketCheckNone {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bucketCheckTimeout)
+	defer cancel()
+
+	_, err := cfg.store.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &cfg.s3Bucket})
+	if isAccessDenied(err) {
+		return fmt.Errorf("access denied looking up bucket %q, the %s check needs s3:ListBucket, grant it or set S3_STARTUP_CHECK=none: %w", cfg.s3Bucket, check, err)
+	}
+	if err != nil {
+		return describeBucketError(cfg.s3Bucket, "find", err)
+	}
+	if check == bucketCheckRead {
+		return nil
+	}
+
+	key := bucketCheckKey
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+		Body:   strings.NewReader("ok"),
+	})
+	if err != nil {
+		return describeBucketError(cfg.s3Bucket, "write to", err)
+	}
+	_, err = cfg.store.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return describeBucketError(cfg.s3Bucket, "delete from", err)
+	}
+	return nil
+}
+
+func isAccessDenied(err error) bool {
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden
+}
+
+// describeBucketError explains the usual reasons an operation on bucket
+// fails, going by the status code S3 answered with.
+func describeBucketError(bucket, operation string, err error) error {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			return fmt.Errorf("bucket %q doesn't exist, check S3_BUCKET: %w", bucket, err)
+		case http.StatusForbidden:
+			return fmt.Errorf("access denied trying to %s bucket %q, check the credentials and their permissions: %w", operation, bucket, err)
+		case http.StatusMovedPermanently:
+			return fmt.Errorf("bucket %q is in another region, check S3_REGION: %w", bucket, err)
+		}
+	}
+	return fmt.Errorf("couldn't %s bucket %q: %w", operation, bucket, err)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCheckBucket(t *testing.T) {
+	tests := []struct {
+		name          string
+		check         string
+		headBucketErr error
+		putErr        error
+		wantErr       string
+		wantCalls     int
+	}{
+		{"none", bucketCheckNone, fakeResponseError(http.StatusForbidden), nil, "", 0},
+		{"read", bucketCheckRead, nil, nil, "", 1},
+		{"read without ListBucket", bucketCheckRead, fakeResponseError(http.StatusForbidden), nil, "s3:ListBucket", 1},
+		{"read of a missing bucket", bucketCheckRead, fakeResponseError(http.StatusNotFound), nil, "check S3_BUCKET", 1},
+		{"write", bucketCheckWrite, nil, nil, "", 3},
+		{"write denied", bucketCheckWrite, nil, fakeResponseError(http.StatusForbidden), "access denied trying to write to", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			store.headBucketErr = tt.headBucketErr
+			store.putErr = func(*s3.PutObjectInput) error { return tt.putErr }
+
+			err := cfg.checkBucket(context.Background(), tt.check)
+
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("checkBucket: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+			}
+			calls := len(store.callsTo("HeadBucket")) + len(store.callsTo("PutObject")) + len(store.callsTo("DeleteObject"))
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls to S3, want %d", calls, tt.wantCalls)
+			}
+			if keys := store.keys(); len(keys) != 0 {
+				t.Errorf("objects left = %q", keys)
+			}
+		})
+	}
+}
+
+func TestLoadConfigStartupCheckDefault(t *testing.T) {
+	conf, err := loadConfig(testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.s3StartupCheck != bucketCheckNone {
+		t.Errorf("S3_STARTUP_CHECK defaults to %q, want none", conf.s3StartupCheck)
+	}
+}
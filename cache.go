@@ -8,3 +8,20 @@ func noCacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// cacheControlMiddleware sets a fixed Cache-Control header on every response.
+func cacheControlMiddleware(value string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getCacheControl returns the Cache-Control value stored objects are uploaded
+// with, or nil to leave it unset.
+func (cfg apiConfig) getCacheControl() *string {
+	if cfg.cacheControl == "" {
+		return nil
+	}
+	return &cfg.cacheControl
+}
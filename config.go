@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// appConfig holds every setting read from the environment at startup.
+type appConfig struct {
+	dbPath           string
+	jwtSecret        string
+	jwtPublicKey     *rsa.PublicKey
+	jwtLeeway        time.Duration
+	allowQueryToken  bool
+	verifyActiveUser bool
+	adminAPIKey      string
+	platform         string
+	filepathRoot     string
+	assetsRoot       string
+	assetsMaxBytes   int64
+	port             string
+	s3Bucket         string
+	s3Region         string
+	s3CfDistribution string
+	s3UseAccelerate  bool
+	s3StartupCheck   string
+	s3ConditionalPut bool
+
+	s3MaxIdleConns        int
+	s3MaxIdleConnsPerHost int
+	s3IdleConnTimeout     time.Duration
+	s3UploadConcurrency   int
+
+	s3UserPrefix          bool
+	keyTemplate           keyTemplate
+	s3CustomKeyPrefix     string
+	s3ObjectTags          []string
+	presignExpiry         time.Duration
+	presignRefresh        time.Duration
+	presignExpiryByRatio  map[string]time.Duration
+	shareMaxTTL           time.Duration
+	shareRestrictions     string
+	listMaxLimit          int
+	maxVideosPerUser      int
+	defaultVisibility     database.VideoVisibility
+	accountImportMaxBytes int64
+	maxVideoUploadSize    int64
+	maxImageUploadSize    int64
+	verifyDeclaredSize    bool
+	declaredSizeTolerance int64
+	cacheControl          string
+
+	allowedReferrers     []string
+	allowMissingReferrer bool
+
+	maintenanceMode       bool
+	maintenanceRetryAfter time.Duration
+
+	rateLimitPerMinute int
+	rateLimitBurst     int
+	trustedProxies     []netip.Prefix
+
+	moderationURL      string
+	moderationFailOpen bool
+
+	skipVideoProcessing bool
+	uploadPassthrough   bool
+	hdrPolicy           string
+	aspectRatioFallback string
+	squareTolerance     float64
+	detectSilence       bool
+	verifyDecode        bool
+	autoOrient          bool
+	minDuration         time.Duration
+	maxDuration         time.Duration
+	minWidth            int
+	minHeight           int
+	ffmpeg              ffmpegOptions
+	logCommandStderr    bool
+	ffmpegMaxProcesses  int
+	faststartFallback   bool
+	failedUploadsDir    string
+	maxVideoRetries     int
+
+	previewEnabled  bool
+	previewStart    time.Duration
+	previewDuration time.Duration
+	proxyEnabled    bool
+
+	storyboardInterval time.Duration
+
+	processingWorkers      int
+	processingQueueSize    int
+	processingMaxAttempts  int
+	processingRetryBackoff time.Duration
+	processingStaleAfter   time.Duration
+	processingInstance     string
+	objectDeleteGrace      time.Duration
+	orphanMinAge           time.Duration
+
+	idempotencyTTL time.Duration
+
+	thumbnailAspectRatio    string
+	thumbnailFit            string
+	thumbnailSceneThreshold float64
+	thumbnailCandidateTTL   time.Duration
+	trimReplace             bool
+}
+
+// maxPresignDuration is the longest SigV4 presigned URLs can be valid for.
+const maxPresignDuration = 7 * 24 * time.Hour
+
+// maxProcessingAttempts bounds PROCESSING_MAX_ATTEMPTS. With the retry
+// backoff capped at maxRetryBackoff, more would keep a failing upload's file
+// around for days.
+const maxProcessingAttempts = 20
+
+// loadConfig reads and validates the configuration, using defaults for
+// optional settings. Every missing or invalid variable is reported in the
+// returned error, not only the first one.
+func loadConfig(getenv func(string) string) (appConfig, error) {
+	env := &envLoader{getenv: getenv}
+
+	cfg := appConfig{
+		dbPath:           env.required("DB_PATH"),
+		jwtSecret:        env.required("JWT_SECRET"),
+		jwtLeeway:        env.nonNegativeDuration("JWT_LEEWAY", 30*time.Second, 5*time.Minute),
+		allowQueryToken:  env.bool("ALLOW_QUERY_TOKEN", false),
+		verifyActiveUser: env.bool("VERIFY_ACTIVE_USER", false),
+		adminAPIKey:      getenv("ADMIN_API_KEY"),
+		platform:         env.required("PLATFORM"),
+		filepathRoot:     env.required("FILEPATH_ROOT"),
+		assetsRoot:       env.required("ASSETS_ROOT"),
+		assetsMaxBytes:   env.int64("ASSETS_MAX_BYTES", 0, 0),
+		port:             env.required("PORT"),
+		s3Bucket:         env.required("S3_BUCKET"),
+		s3Region:         env.required("S3_REGION"),
+		s3CfDistribution: env.required("S3_CF_DISTRO"),
+		s3UseAccelerate:  env.bool("S3_USE_ACCELERATE", false),
+		s3StartupCheck:   env.oneOf("S3_STARTUP_CHECK", bucketCheckNone, bucketCheckNone, bucketCheckRead, bucketCheckWrite),
+		s3ConditionalPut: env.bool("S3_CONDITIONAL_PUT", true),
+
+		// The defaults are the SDK's own.
+		s3MaxIdleConns:        env.int("S3_MAX_IDLE_CONNS", awshttp.DefaultHTTPTransportMaxIdleConns, 0),
+		s3MaxIdleConnsPerHost: env.int("S3_MAX_IDLE_CONNS_PER_HOST", awshttp.DefaultHTTPTransportMaxIdleConnsPerHost, 0),
+		s3IdleConnTimeout:     env.duration("S3_IDLE_CONN_TIMEOUT", awshttp.DefaultHTTPTransportIdleConnTimeout, 0),
+		s3UploadConcurrency:   env.int("S3_UPLOAD_CONCURRENCY", manager.DefaultUploadConcurrency, 1),
+
+		s3UserPrefix:          env.bool("S3_USER_PREFIX", false),
+		s3CustomKeyPrefix:     env.string("S3_CUSTOM_KEY_PREFIX", "custom"),
+		presignExpiry:         env.duration("PRESIGN_EXPIRY", 15*time.Minute, maxPresignDuration),
+		presignRefresh:        env.duration("PRESIGN_REFRESH_THRESHOLD", 0, maxPresignDuration),
+		shareMaxTTL:           env.duration("SHARE_MAX_TTL", maxPresignDuration, maxPresignDuration),
+		shareRestrictions:     env.oneOf("SHARE_RESTRICTIONS", shareRestrictionsOptional, shareRestrictionsOff, shareRestrictionsOptional, shareRestrictionsRequired),
+		listMaxLimit:          env.int("LIST_MAX_LIMIT", 50, 1),
+		maxVideosPerUser:      env.int("MAX_VIDEOS_PER_USER", 0, 0),
+		accountImportMaxBytes: env.int64("ACCOUNT_IMPORT_MAX_BYTES", 10<<30, 1),
+		maxVideoUploadSize:    env.int64("MAX_VIDEO_UPLOAD_SIZE", 1<<30, 1),
+		maxImageUploadSize:    env.int64("MAX_IMAGE_UPLOAD_SIZE", 10<<20, 1),
+		verifyDeclaredSize:    env.bool("VERIFY_DECLARED_SIZE", false),
+		declaredSizeTolerance: env.int64("DECLARED_SIZE_TOLERANCE", 0, 0),
+		cacheControl:          getenv("CACHE_CONTROL"),
+
+		allowMissingReferrer: env.bool("ALLOW_MISSING_REFERRER", true),
+
+		maintenanceMode:       env.bool("MAINTENANCE_MODE", false),
+		maintenanceRetryAfter: env.duration("MAINTENANCE_RETRY_AFTER", 5*time.Minute, 0),
+
+		// 0 turns rate limiting off.
+		rateLimitPerMinute: env.int("RATE_LIMIT_PER_MINUTE", 0, 0),
+		rateLimitBurst:     env.int("RATE_LIMIT_BURST", 30, 1),
+
+		moderationURL:      getenv("MODERATION_URL"),
+		moderationFailOpen: env.bool("MODERATION_FAIL_OPEN", false),
+
+		skipVideoProcessing: env.bool("SKIP_VIDEO_PROCESSING", false),
+		uploadPassthrough:   env.bool("UPLOAD_PASSTHROUGH", false),
+		hdrPolicy:           env.oneOf("HDR_POLICY", hdrPolicyAllow, hdrPolicyAllow, hdrPolicyReject, hdrPolicyTranscode),
+		aspectRatioFallback: env.oneOf("ASPECT_RATIO_FALLBACK", aspectRatioFallbackOther, aspectRatioFallbackOther, aspectRatioFallbackReject, aspectRatioFallbackCompute),
+		squareTolerance:     env.float64("SQUARE_ASPECT_RATIO_TOLERANCE", 0.01, 0, 0.1),
+		detectSilence:       env.bool("DETECT_SILENT_AUDIO", false),
+		verifyDecode:        env.bool("VERIFY_DECODE", false),
+		autoOrient:          env.bool("AUTO_ORIENT", false),
+		minDuration:         env.duration("MIN_VIDEO_DURATION", 0, 0),
+		maxDuration:         env.duration("MAX_VIDEO_DURATION", 0, 0),
+		minWidth:            env.int("MIN_VIDEO_WIDTH", 0, 0),
+		minHeight:           env.int("MIN_VIDEO_HEIGHT", 0, 0),
+		ffmpeg: ffmpegOptions{
+			// 0 lets ffmpeg decide.
+			Threads: env.int("FFMPEG_THREADS", 2, 0),
+			Preset:  env.oneOf("FFMPEG_PRESET", "medium", ffmpegPresets...),
+		},
+		faststartFallback:  env.bool("FASTSTART_FALLBACK", false),
+		logCommandStderr:   env.bool("LOG_COMMAND_STDERR", false),
+		ffmpegMaxProcesses: env.int("FFMPEG_MAX_PROCESSES", 0, 0),
+		failedUploadsDir:   getenv("FAILED_UPLOADS_DIR"),
+		maxVideoRetries:    env.int("MAX_VIDEO_RETRIES", 3, 0),
+
+		previewEnabled:  env.bool("PREVIEW_ENABLED", false),
+		previewStart:    env.nonNegativeDuration("PREVIEW_START", time.Second, 0),
+		previewDuration: env.duration("PREVIEW_DURATION", 3*time.Second, 10*time.Second),
+		proxyEnabled:    env.bool("PROXY_ENABLED", false),
+
+		storyboardInterval: env.duration("STORYBOARD_INTERVAL", 0, time.Hour),
+
+		processingWorkers:      env.int("PROCESSING_WORKERS", 0, 0),
+		processingQueueSize:    env.int("PROCESSING_QUEUE_SIZE", 100, 1),
+		processingMaxAttempts:  env.int("PROCESSING_MAX_ATTEMPTS", 3, 1),
+		processingRetryBackoff: env.duration("PROCESSING_RETRY_BACKOFF", 5*time.Second, 0),
+		processingStaleAfter:   env.duration("PROCESSING_STALE_AFTER", time.Hour, 0),
+		processingInstance:     getenv("PROCESSING_INSTANCE"),
+		objectDeleteGrace:      env.duration("OBJECT_DELETE_GRACE", 0, 0),
+		orphanMinAge:           env.duration("ORPHAN_MIN_AGE", 24*time.Hour, 0),
+
+		idempotencyTTL: env.duration("IDEMPOTENCY_TTL", 24*time.Hour, 0),
+
+		thumbnailAspectRatio: getenv("THUMBNAIL_ASPECT_RATIO"),
+		thumbnailFit:         env.oneOf("THUMBNAIL_FIT", thumbnailFitCrop, thumbnailFitCrop, thumbnailFitPad),
+		// 0 keeps the plain thumbnail filter.
+		thumbnailSceneThreshold: env.float64("THUMBNAIL_SCENE_THRESHOLD", 0, 0, 1),
+		thumbnailCandidateTTL:   env.duration("THUMBNAIL_CANDIDATE_TTL", time.Hour, maxPresignDuration),
+		trimReplace:             env.bool("TRIM_REPLACE", false),
+	}
+
+	var err error
+	if path := getenv("JWT_PUBLIC_KEY_FILE"); path != "" {
+		cfg.jwtPublicKey, err = loadRSAPublicKey(path)
+		env.check("JWT_PUBLIC_KEY_FILE", err)
+	}
+
+	cfg.defaultVisibility, err = parseVisibility(env.string("DEFAULT_VISIBILITY", string(database.VideoVisibilityPrivate)))
+	env.check("DEFAULT_VISIBILITY", err)
+
+	cfg.s3ObjectTags, err = parseObjectTags(getenv("S3_OBJECT_TAGS"))
+	env.check("S3_OBJECT_TAGS", err)
+
+	template := defaultKeyTemplate
+	if cfg.s3UserPrefix {
+		template = userPrefixKeyTemplate
+	}
+	if v := getenv("S3_KEY_TEMPLATE"); v != "" {
+		if cfg.s3UserPrefix {
+			env.check("S3_USER_PREFIX", errors.New("can't be combined with S3_KEY_TEMPLATE, put {userID} in the template instead"))
+		}
+		template = v
+	}
+	cfg.keyTemplate, err = parseKeyTemplate(template)
+	env.check("S3_KEY_TEMPLATE", err)
+
+	cfg.allowedReferrers, err = parseAllowedReferrers(getenv("ALLOWED_REFERRERS"))
+	env.check("ALLOWED_REFERRERS", err)
+
+	cfg.trustedProxies, err = parseTrustedProxies(getenv("TRUSTED_PROXIES"))
+	env.check("TRUSTED_PROXIES", err)
+
+	cfg.presignExpiryByRatio, err = parsePresignExpiries(getenv("PRESIGN_EXPIRY_BY_RATIO"))
+	env.check("PRESIGN_EXPIRY_BY_RATIO", err)
+
+	// A cached URL with less than the threshold left is signed again, so
+	// one that starts out below it would never be reused.
+	if cfg.presignRefresh > 0 {
+		shortest := cfg.presignExpiry
+		for _, expiry := range cfg.presignExpiryByRatio {
+			shortest = min(shortest, expiry)
+		}
+		if cfg.presignRefresh >= shortest {
+			env.check("PRESIGN_REFRESH_THRESHOLD", fmt.Errorf("must be less than PRESIGN_EXPIRY and PRESIGN_EXPIRY_BY_RATIO, %v here", shortest))
+		}
+	}
+
+	// Probing needs the upload on disk, streaming it would skip it.
+	if cfg.uploadPassthrough && !cfg.skipVideoProcessing {
+		env.check("UPLOAD_PASSTHROUGH", errors.New("needs SKIP_VIDEO_PROCESSING, uploads are probed from a temp file"))
+	}
+
+	if cfg.minDuration > 0 && cfg.maxDuration > 0 && cfg.minDuration > cfg.maxDuration {
+		env.check("MIN_VIDEO_DURATION", errors.New("must not be greater than MAX_VIDEO_DURATION"))
+	}
+
+	if cfg.thumbnailAspectRatio != "" {
+		_, _, err = parseAspectRatio(cfg.thumbnailAspectRatio)
+		env.check("THUMBNAIL_ASPECT_RATIO", err)
+	}
+
+	if cfg.processingMaxAttempts > maxProcessingAttempts {
+		env.check("PROCESSING_MAX_ATTEMPTS", fmt.Errorf("must be at most %d", maxProcessingAttempts))
+	}
+
+	// Jobs of uploads are bound to the instance holding the file, which
+	// must keep its name across restarts to pick them back up.
+	if cfg.processingInstance == "" {
+		cfg.processingInstance, err = os.Hostname()
+		env.check("PROCESSING_INSTANCE", err)
+	}
+
+	if cfg.objectDeleteGrace > 0 && cfg.processingWorkers == 0 {
+		env.check("OBJECT_DELETE_GRACE", errors.New("needs background workers, set PROCESSING_WORKERS"))
+	}
+
+	// The sweep runs every half TTL, and candidates are presigned for the
+	// TTL, so a tiny one would spin the sweeper and hand out dead links.
+	if cfg.thumbnailCandidateTTL < time.Minute {
+		env.check("THUMBNAIL_CANDIDATE_TTL", errors.New("must be at least 1m"))
+	}
+
+	if cfg.orphanMinAge < time.Hour {
+		env.check("ORPHAN_MIN_AGE", errors.New("must be at least 1h, younger objects may belong to uploads still in progress"))
+	}
+
+	return cfg, errors.Join(env.errs...)
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return auth.ParseRSAPublicKey(data)
+}
+
+// envLoader reads typed environment variables, collecting every problem
+// instead of stopping at the first. Each getter returns its default when the
+// variable is unset or invalid.
+type envLoader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (l *envLoader) check(name string, err error) {
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", name, err))
+	}
+}
+
+func (l *envLoader) required(name string) string {
+	v := l.getenv(name)
+	if v == "" {
+		l.check(name, errors.New("is required"))
+	}
+	return v
+}
+
+func (l *envLoader) string(name, def string) string {
+	if v := l.getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (l *envLoader) oneOf(name, def string, allowed ...string) string {
+	v := l.getenv(name)
+	if v == "" {
+		return def
+	}
+	if !slices.Contains(allowed, v) {
+		l.check(name, fmt.Errorf("must be one of %q, got %q", allowed, v))
+		return def
+	}
+	return v
+}
+
+func (l *envLoader) bool(name string, def bool) bool {
+	v := l.getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.check(name, fmt.Errorf("must be a boolean, got %q", v))
+		return def
+	}
+	return b
+}
+
+func (l *envLoader) int(name string, def, min int) int {
+	return int(l.int64(name, int64(def), int64(min)))
+}
+
+func (l *envLoader) int64(name string, def, min int64) int64 {
+	v := l.getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < min {
+		l.check(name, fmt.Errorf("must be an integer of at least %d, got %q", min, v))
+		return def
+	}
+	return n
+}
+
+// float64 parses a number within [min, max].
+func (l *envLoader) float64(name string, def, min, max float64) float64 {
+	v := l.getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		l.check(name, fmt.Errorf("must be a number between %g and %g, got %q", min, max, v))
+		return def
+	}
+	return f
+}
+
+// duration parses a positive duration such as "15m". A max of 0 means no
+// upper bound.
+func (l *envLoader) duration(name string, def, max time.Duration) time.Duration {
+	return l.parseDuration(name, def, max, false)
+}
+
+// nonNegativeDuration is duration for settings that 0 turns off, such as a
+// tolerance, or that are offsets, for which 0 is the start.
+func (l *envLoader) nonNegativeDuration(name string, def, max time.Duration) time.Duration {
+	return l.parseDuration(name, def, max, true)
+}
+
+func (l *envLoader) parseDuration(name string, def, max time.Duration, allowZero bool) time.Duration {
+	v := l.getenv(name)
+	if v == "" {
+		return def
+	}
+	kind := "positive"
+	if allowZero {
+		kind = "non-negative"
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 || (d == 0 && !allowZero) || (max > 0 && d > max) {
+		msg := fmt.Sprintf("must be a %s duration, got %q", kind, v)
+		if max > 0 {
+			msg = fmt.Sprintf("must be a %s duration of at most %v, got %q", kind, max, v)
+		}
+		l.check(name, errors.New(msg))
+		return def
+	}
+	return d
+}
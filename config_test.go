@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// testEnv returns a getenv holding the required settings, overridden and
+// extended by overrides.
+func testEnv(overrides map[string]string) func(string) string {
+	env := map[string]string{
+		"DB_PATH":       "./tubely.db",
+		"JWT_SECRET":    "secret",
+		"PLATFORM":      "dev",
+		"FILEPATH_ROOT": "./app",
+		"ASSETS_ROOT":   "./assets",
+		"PORT":          "8091",
+		"S3_BUCKET":     "tubely-test",
+		"S3_REGION":     "us-east-1",
+		"S3_CF_DISTRO":  "cdn.tubely.test",
+	}
+	for name, value := range overrides {
+		env[name] = value
+	}
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(testEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.port != "8091" || cfg.s3Bucket != "tubely-test" {
+		t.Errorf("required settings = %q, %q, want the environment's", cfg.port, cfg.s3Bucket)
+	}
+	if cfg.presignExpiry != 15*time.Minute || cfg.maxVideoUploadSize != 1<<30 || !cfg.s3ConditionalPut || cfg.s3StartupCheck != bucketCheckNone || cfg.defaultVisibility != database.VideoVisibilityPrivate {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	_, err := loadConfig(func(string) string { return "" })
+	if err == nil {
+		t.Fatal("loadConfig accepted an empty environment")
+	}
+	for _, name := range []string{"DB_PATH", "JWT_SECRET", "PLATFORM", "FILEPATH_ROOT", "ASSETS_ROOT", "PORT", "S3_BUCKET", "S3_REGION", "S3_CF_DISTRO"} {
+		if !strings.Contains(err.Error(), name+": is required") {
+			t.Errorf("error doesn't mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+		check   func(cfg appConfig) bool
+	}{
+		{"bool", map[string]string{"SKIP_VIDEO_PROCESSING": "true"}, "", func(cfg appConfig) bool { return cfg.skipVideoProcessing }},
+		{"invalid bool", map[string]string{"SKIP_VIDEO_PROCESSING": "sometimes"}, "SKIP_VIDEO_PROCESSING: must be a boolean", nil},
+		{"int", map[string]string{"LIST_MAX_LIMIT": "10"}, "", func(cfg appConfig) bool { return cfg.listMaxLimit == 10 }},
+		{"int below its minimum", map[string]string{"LIST_MAX_LIMIT": "0"}, "LIST_MAX_LIMIT: must be an integer of at least 1", nil},
+		{"invalid int", map[string]string{"MAX_VIDEO_UPLOAD_SIZE": "1GB"}, "MAX_VIDEO_UPLOAD_SIZE: must be an integer", nil},
+		{"float", map[string]string{"SQUARE_ASPECT_RATIO_TOLERANCE": "0.05"}, "", func(cfg appConfig) bool { return cfg.squareTolerance == 0.05 }},
+		{"float out of range", map[string]string{"SQUARE_ASPECT_RATIO_TOLERANCE": "0.5"}, "SQUARE_ASPECT_RATIO_TOLERANCE: must be a number between 0 and 0.1", nil},
+		{"duration", map[string]string{"PRESIGN_EXPIRY": "1h"}, "", func(cfg appConfig) bool { return cfg.presignExpiry == time.Hour }},
+		{"invalid duration", map[string]string{"PRESIGN_EXPIRY": "15"}, "PRESIGN_EXPIRY: must be a positive duration", nil},
+		{"negative duration", map[string]string{"PROCESSING_STALE_AFTER": "-1h"}, "PROCESSING_STALE_AFTER: must be a positive duration", nil},
+		{"zero leeway", map[string]string{"JWT_LEEWAY": "0s"}, "", func(cfg appConfig) bool { return cfg.jwtLeeway == 0 }},
+		{"negative leeway", map[string]string{"JWT_LEEWAY": "-1s"}, "JWT_LEEWAY: must be a non-negative duration of at most 5m0s", nil},
+		{"leeway above its maximum", map[string]string{"JWT_LEEWAY": "10m"}, "JWT_LEEWAY: must be a non-negative duration of at most 5m0s", nil},
+		{"preview from the start", map[string]string{"PREVIEW_START": "0s"}, "", func(cfg appConfig) bool { return cfg.previewStart == 0 }},
+		{"negative preview start", map[string]string{"PREVIEW_START": "-1s"}, "PREVIEW_START: must be a non-negative duration", nil},
+		{"zero preview duration", map[string]string{"PREVIEW_DURATION": "0s"}, "PREVIEW_DURATION: must be a positive duration", nil},
+		{"duration above its maximum", map[string]string{"PRESIGN_EXPIRY": "169h"}, "PRESIGN_EXPIRY: must be a positive duration of at most 168h0m0s", nil},
+		{"one of", map[string]string{"THUMBNAIL_FIT": thumbnailFitPad}, "", func(cfg appConfig) bool { return cfg.thumbnailFit == thumbnailFitPad }},
+		{"not one of", map[string]string{"HDR_POLICY": "ignore"}, "HDR_POLICY: must be one of", nil},
+		{"default visibility", map[string]string{"DEFAULT_VISIBILITY": "unlisted"}, "", func(cfg appConfig) bool { return cfg.defaultVisibility == database.VideoVisibilityUnlisted }},
+		{"invalid default visibility", map[string]string{"DEFAULT_VISIBILITY": "friends"}, "DEFAULT_VISIBILITY: visibility must be public, unlisted or private", nil},
+		{"min duration above max", map[string]string{"MIN_VIDEO_DURATION": "2m", "MAX_VIDEO_DURATION": "1m"}, "MIN_VIDEO_DURATION: must not be greater than MAX_VIDEO_DURATION", nil},
+		{"user prefix with a key template", map[string]string{"S3_USER_PREFIX": "true", "S3_KEY_TEMPLATE": "{uuid}.{ext}"}, "S3_USER_PREFIX: can't be combined with S3_KEY_TEMPLATE", nil},
+		{"passthrough with processing", map[string]string{"UPLOAD_PASSTHROUGH": "true"}, "UPLOAD_PASSTHROUGH: needs SKIP_VIDEO_PROCESSING", nil},
+		{"passthrough", map[string]string{"UPLOAD_PASSTHROUGH": "true", "SKIP_VIDEO_PROCESSING": "true"}, "", func(cfg appConfig) bool { return cfg.uploadPassthrough }},
+		{"delete grace without workers", map[string]string{"OBJECT_DELETE_GRACE": "72h"}, "OBJECT_DELETE_GRACE: needs background workers", nil},
+		{"delete grace with workers", map[string]string{"OBJECT_DELETE_GRACE": "72h", "PROCESSING_WORKERS": "2"}, "", func(cfg appConfig) bool { return cfg.objectDeleteGrace == 72*time.Hour }},
+		{"max attempts", map[string]string{"PROCESSING_MAX_ATTEMPTS": "20"}, "", func(cfg appConfig) bool { return cfg.processingMaxAttempts == 20 }},
+		{"no attempts", map[string]string{"PROCESSING_MAX_ATTEMPTS": "0"}, "PROCESSING_MAX_ATTEMPTS: must be an integer of at least 1", nil},
+		{"too many attempts", map[string]string{"PROCESSING_MAX_ATTEMPTS": "64"}, "PROCESSING_MAX_ATTEMPTS: must be at most 20", nil},
+		{"young orphans", map[string]string{"ORPHAN_MIN_AGE": "30m"}, "ORPHAN_MIN_AGE: must be at least 1h", nil},
+		{"invalid trusted proxy", map[string]string{"TRUSTED_PROXIES": "10.0.0.0/33"}, "TRUSTED_PROXIES: invalid CIDR", nil},
+		{"invalid thumbnail aspect ratio", map[string]string{"THUMBNAIL_ASPECT_RATIO": "wide"}, "THUMBNAIL_ASPECT_RATIO:", nil},
+		{"missing public key file", map[string]string{"JWT_PUBLIC_KEY_FILE": "/nonexistent/key.pem"}, "JWT_PUBLIC_KEY_FILE:", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(testEnv(tt.env))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("%v not applied", tt.env)
+			}
+		})
+	}
+}
+
+func TestLoadConfigThumbnailCandidateTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"", false},
+		{"1m", false},
+		{"168h", false},
+		{"1ns", true},
+		{"59s", true},
+		{"169h", true},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(testEnv(map[string]string{"THUMBNAIL_CANDIDATE_TTL": tt.value}))
+		if tt.wantErr != (err != nil && strings.Contains(err.Error(), "THUMBNAIL_CANDIDATE_TTL")) {
+			t.Errorf("THUMBNAIL_CANDIDATE_TTL=%q: err = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigPresignRefreshThreshold(t *testing.T) {
+	tests := []struct {
+		threshold string
+		byRatio   string
+		wantErr   bool
+	}{
+		{"", "", false},
+		{"5m", "", false},
+		{"15m", "", true},
+		{"1h", "", true},
+		{"5m", "9:16=10m", false},
+		{"5m", "9:16=5m", true},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(testEnv(map[string]string{
+			"PRESIGN_EXPIRY":            "15m",
+			"PRESIGN_REFRESH_THRESHOLD": tt.threshold,
+			"PRESIGN_EXPIRY_BY_RATIO":   tt.byRatio,
+		}))
+		if tt.wantErr != (err != nil && strings.Contains(err.Error(), "PRESIGN_REFRESH_THRESHOLD")) {
+			t.Errorf("PRESIGN_REFRESH_THRESHOLD=%q with %q: err = %v, want error %v", tt.threshold, tt.byRatio, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// parseCustomDomain validates a domain a user's links may be served from and
+// returns it lowercased. It must be a bare, fully qualified host name: no
+// scheme, port or path.
+func parseCustomDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if len(domain) > 253 {
+		return "", errors.New("custom domain must be at most 253 characters")
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "", errors.New("custom domain must be a fully qualified host name such as videos.example.com")
+	}
+	for _, label := range labels {
+		if len(label) > 63 || !domainLabelPattern.MatchString(label) {
+			return "", errors.New("custom domain must be a host name made of letters, digits and hyphens, without a scheme, port or path")
+		}
+	}
+	return domain, nil
+}
+
+// withCustomDomain swaps the host of a presigned URL for domain, leaving it
+// as is when domain is empty. The path and query, signature included, are
+// kept as they are.
+//
+// A SigV4 signature covers the host it was made for, the bucket's, and S3
+// rejects the URL when it arrives with any other. So a custom domain only
+// works when it is a CDN whose origin is the bucket, which forwards the
+// whole query string and sends the origin's host rather than the viewer's.
+// CloudFront does so by default with an S3 origin and a cache policy
+// forwarding all query strings. Pointing a CNAME straight at the bucket
+// breaks every link.
+func withCustomDomain(rawURL, domain string) string {
+	if domain == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Host = domain
+	return u.String()
+}
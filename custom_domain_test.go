@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCustomDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{"videos.example.com", "videos.example.com", false},
+		{" Videos.Example.COM ", "videos.example.com", false},
+		{"localhost", "", true},
+		{"https://videos.example.com", "", true},
+		{"videos.example.com:8080", "", true},
+		{"videos.example.com/path", "", true},
+		{"-videos.example.com", "", true},
+		{strings.Repeat("a", 64) + ".example.com", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseCustomDomain(tt.domain)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCustomDomain(%q) = %q, %v, want %q, error %v", tt.domain, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWithCustomDomain(t *testing.T) {
+	presigned := "https://tubely-test.s3.us-east-1.amazonaws.com/landscape/a.mp4?X-Amz-Expires=900&X-Amz-Signature=abc&X-Amz-SignedHeaders=host"
+
+	if got := withCustomDomain(presigned, ""); got != presigned {
+		t.Errorf("without a domain got %q, want the URL unchanged", got)
+	}
+
+	got, err := url.Parse(withCustomDomain(presigned, "videos.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := url.Parse(presigned)
+	if got.Host != "videos.example.com" {
+		t.Errorf("host = %q, want videos.example.com", got.Host)
+	}
+	// The CDN forwards these to the bucket, they must reach it untouched
+	// for the signature to hold.
+	if got.Scheme != want.Scheme || got.Path != want.Path || got.RawQuery != want.RawQuery {
+		t.Errorf("got %q, want only the host of %q changed", got, presigned)
+	}
+}
+
+func TestHandlerVideosPresignCustomDomain(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	store.putObject("landscape/a.mp4", mp4Fixture, time.Now())
+	videoURL := cfg.getVideoURL("landscape/a.mp4")
+	video.VideoURL = &videoURL
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.SetUserCustomDomain(userID, "videos.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/presign", strings.NewReader(`{"video_ids":["`+video.ID.String()+`"]}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideosPresign(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	var res map[string]struct {
+		VideoURL string `json:"video_url"`
+	}
+	decodeResponse(t, w, &res)
+	got, err := url.Parse(res[video.ID.String()].VideoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Host != "videos.example.com" || got.Path != "/landscape/a.mp4" || got.Query().Get("X-Amz-Expires") == "" {
+		t.Errorf("video_url = %q, want the presigned URL under videos.example.com", got)
+	}
+}
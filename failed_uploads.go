@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg apiConfig) ensureFailedUploadsDir() error {
+	if cfg.failedUploadsDir == "" {
+		return nil
+	}
+	return os.MkdirAll(cfg.failedUploadsDir, 0700)
+}
+
+// retainFailedUpload keeps the raw upload at tmpPath after processing it
+// failed, so the owner can retry later. It moves the file, so tmpPath is gone
+// afterwards. Nothing is kept when FAILED_UPLOADS_DIR isn't set, and failures
+// are only logged: the video is already failed either way.
+func (cfg *apiConfig) retainFailedUpload(ctx context.Context, videoID uuid.UUID, tmpPath, mediaType, customKey string) {
+	if cfg.failedUploadsDir == "" {
+		return
+	}
+
+	path := filepath.Join(cfg.failedUploadsDir, videoID.String())
+	err := moveFile(tmpPath, path)
+	if err != nil {
+		logf(ctx, "Couldn't keep failed upload for video %v: %v", videoID, err)
+		return
+	}
+
+	err = cfg.db.SaveFailedUpload(database.FailedUpload{
+		VideoID:   videoID,
+		Path:      path,
+		MediaType: mediaType,
+		CustomKey: customKey,
+	})
+	if err != nil {
+		os.Remove(path)
+		logf(ctx, "Couldn't record failed upload for video %v: %v", videoID, err)
+	}
+}
+
+// discardFailedUpload deletes the raw upload kept for a video, if any, once
+// it has been processed or the video is gone.
+func (cfg *apiConfig) discardFailedUpload(ctx context.Context, videoID uuid.UUID) {
+	upload, err := cfg.db.GetFailedUpload(videoID)
+	if err != nil {
+		logf(ctx, "Couldn't get failed upload for video %v: %v", videoID, err)
+		return
+	}
+	if upload.VideoID == uuid.Nil {
+		return
+	}
+
+	err = os.Remove(upload.Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logf(ctx, "Couldn't remove failed upload for video %v: %v", videoID, err)
+		return
+	}
+	err = cfg.db.DeleteFailedUpload(videoID)
+	if err != nil {
+		logf(ctx, "Couldn't delete failed upload record for video %v: %v", videoID, err)
+	}
+}
+
+// moveFile renames src to dst, copying when they are on different
+// filesystems, as the temp directory often is.
+func moveFile(src, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+
+	err := copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ffmpegPool runs ffmpeg and ffprobe through runner, at most size of them at
+// once, so a burst of uploads, trims and backfill jobs can't start more
+// processes than the machine has room for. It's a commandRunner itself and
+// wraps the real one at startup, so every command goes through it. A size of
+// 0 leaves the number of processes unbounded.
+type ffmpegPool struct {
+	runner commandRunner
+	slots  chan struct{}
+}
+
+func newFFmpegPool(runner commandRunner, size int) *ffmpegPool {
+	pool := &ffmpegPool{runner: runner}
+	if size > 0 {
+		pool.slots = make(chan struct{}, size)
+	}
+	return pool
+}
+
+// acquire waits for a free slot and returns the func giving it back. It
+// gives up with ctx's error once ctx is done.
+func (p *ffmpegPool) acquire(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run waits for a slot however long it takes, ctx is only passed on. A
+// command that has started isn't given up on with its request either.
+func (p *ffmpegPool) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	release, _ := p.acquire(context.Background())
+	defer release()
+	return p.runner.Run(ctx, name, args...)
+}
+
+func (p *ffmpegPool) RunCombined(ctx context.Context, name string, args ...string) ([]byte, error) {
+	release, _ := p.acquire(context.Background())
+	defer release()
+	return p.runner.RunCombined(ctx, name, args...)
+}
+
+// probeBatchResult is what ProbeBatch found out about one input.
+type probeBatchResult struct {
+	Info videoStreamInfo
+	Err  error
+}
+
+// ProbeBatch probes each of inputs, local paths or URLs ffprobe can read,
+// like probeVideo does, and returns the results in the same order. ffprobe
+// only takes one input per run, so the inputs are probed concurrently
+// instead, as many at a time as the pool has slots. Inputs still waiting for
+// a slot when ctx is done fail with ctx's error.
+func (p *ffmpegPool) ProbeBatch(ctx context.Context, inputs []string, fallback string, squareTolerance float64) []probeBatchResult {
+	results := make([]probeBatchResult, len(inputs))
+
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := p.acquire(ctx)
+			if err != nil {
+				results[i] = probeBatchResult{Err: err}
+				return
+			}
+			defer release()
+			info, err := probeVideo(ctx, p.runner, input, fallback, squareTolerance)
+			results[i] = probeBatchResult{Info: info, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFFmpegPoolProbeBatchCancelled(t *testing.T) {
+	runner := &fakeCommandRunner{}
+	pool := newFFmpegPool(runner, 1)
+	// Every slot is taken by a long-running command.
+	release, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan []probeBatchResult)
+	go func() {
+		done <- pool.ProbeBatch(ctx, []string{"a.mp4", "b.mp4"}, aspectRatioFallbackOther, 0.01)
+	}()
+	cancel()
+
+	select {
+	case results := <-done:
+		for i, result := range results {
+			if !errors.Is(result.Err, context.Canceled) {
+				t.Errorf("result %d: err = %v, want context.Canceled", i, result.Err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProbeBatch kept waiting for a slot after its context was cancelled")
+	}
+	if probes := runner.callsTo("ffprobe"); len(probes) != 0 {
+		t.Errorf("ffprobe ran %d times, want none", len(probes))
+	}
+}
+
+func TestFFmpegPoolProbeBatch(t *testing.T) {
+	runner := &fakeCommandRunner{respond: func(name string, args []string) ([]byte, error) {
+		if args[len(args)-1] == "broken.mp4" {
+			return nil, errors.New("invalid data")
+		}
+		return ffprobeOutput(t, "12", fakeStream{CodecType: "video", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9"}), nil
+	}}
+	pool := newFFmpegPool(runner, 1)
+
+	results := pool.ProbeBatch(context.Background(), []string{"a.mp4", "broken.mp4", "c.mp4"}, aspectRatioFallbackOther, 0.01)
+
+	if len(results) != 3 || results[0].Err != nil || results[1].Err == nil || results[2].Err != nil {
+		t.Fatalf("results = %+v, want only the second to fail", results)
+	}
+	if results[0].Info.Duration != 12*time.Second || results[2].Info.AspectRatio != "16:9" {
+		t.Errorf("results = %+v, want the probed info", results)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func (cfg *apiConfig) handlerAccountStats(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	stats, err := cfg.db.GetUserStorageStats(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage stats", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
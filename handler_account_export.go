@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	accountArchiveVersion  = 1
+	accountArchiveManifest = "manifest.json"
+	// accountExportPageSize is how many videos the export reads from the
+	// database at a time.
+	accountExportPageSize = 100
+)
+
+// accountManifest describes a user's library as exported by
+// handlerAccountExport. A library archive is a zip holding:
+//
+//	manifest.json         this manifest
+//	videos/{id}{ext}      the content of each video that has any
+//	thumbnails/{id}{ext}  the thumbnail of each video that has one
+//
+// where {id} is the video's ID at export time. Each entry names its files
+// in video_file and thumbnail_file, relative to the archive root, and leaves
+// them out when the video has none. The archive can be given back to
+// handlerAccountImport as is, by the same or another account. Previews and
+// storyboards aren't exported, they're derived from the content, and so are
+// aspect_ratio, duration and has_audio again on import.
+//
+// With ?format=manifest only the manifest is returned, carrying short-lived
+// video_url and thumbnail_url links instead of files. That suits libraries
+// too large to download in one go, but it can't be imported.
+type accountManifest struct {
+	Version    int                    `json:"version"`
+	ExportedAt time.Time              `json:"exported_at"`
+	Videos     []accountManifestVideo `json:"videos"`
+}
+
+type accountManifestVideo struct {
+	ID               uuid.UUID                `json:"id"`
+	CreatedAt        time.Time                `json:"created_at"`
+	Title            string                   `json:"title"`
+	Description      string                   `json:"description"`
+	Visibility       database.VideoVisibility `json:"visibility"`
+	OriginalFilename string                   `json:"original_filename,omitempty"`
+	AspectRatio      string                   `json:"aspect_ratio,omitempty"`
+	Duration         float64                  `json:"duration,omitempty"`
+	HasAudio         bool                     `json:"has_audio"`
+	Attributes       database.VideoAttributes `json:"attributes"`
+	VideoFile        string                   `json:"video_file,omitempty"`
+	ThumbnailFile    string                   `json:"thumbnail_file,omitempty"`
+	VideoURL         string                   `json:"video_url,omitempty"`
+	ThumbnailURL     string                   `json:"thumbnail_url,omitempty"`
+}
+
+// handlerAccountExport downloads the caller's whole library, see
+// accountManifest for the format. The archive is written to the response as
+// the videos are read from S3, so nothing is buffered on the server however
+// large the library is.
+func (cfg *apiConfig) handlerAccountExport(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "zip" && format != "manifest" {
+		respondWithError(w, http.StatusBadRequest, "format must be zip or manifest", nil)
+		return
+	}
+
+	videos, err := cfg.listOwnedVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	manifest := accountManifest{
+		Version:    accountArchiveVersion,
+		ExportedAt: time.Now().UTC(),
+		Videos:     make([]accountManifestVideo, 0, len(videos)),
+	}
+
+	if format == "manifest" {
+		domain, err := cfg.db.GetUserCustomDomain(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+			return
+		}
+		for _, video := range videos {
+			entry := newAccountManifestVideo(video)
+			if video.VideoURL != nil {
+				if key, ok := cfg.getVideoKeyFromURL(*video.VideoURL); ok {
+					presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+					if err != nil {
+						respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+						return
+					}
+					entry.VideoURL = withCustomDomain(presigned.URL, domain)
+				}
+			}
+			if video.ThumbnailURL != nil {
+				entry.ThumbnailURL = *video.ThumbnailURL
+			}
+			manifest.Videos = append(manifest.Videos, entry)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		respondWithJSON(w, http.StatusOK, manifest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="tubely-export.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	for _, video := range videos {
+		entry := newAccountManifestVideo(video)
+
+		entry.VideoFile, err = cfg.exportVideoContent(r, archive, video)
+		if err == nil {
+			entry.ThumbnailFile, err = cfg.exportThumbnail(archive, video)
+		}
+		if err != nil {
+			// The status line is long gone, so the only way to tell the
+			// client is to cut the download short rather than end it with
+			// a valid looking archive.
+			logf(r.Context(), "Couldn't export video %v: %v", video.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+		manifest.Videos = append(manifest.Videos, entry)
+	}
+
+	err = writeAccountManifest(archive, manifest)
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		logf(r.Context(), "Couldn't finish export of user %v: %v", userID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// listOwnedVideos returns all of userID's own videos, newest first.
+func (cfg *apiConfig) listOwnedVideos(userID uuid.UUID) ([]database.Video, error) {
+	var videos []database.Video
+	for offset := 0; ; offset += accountExportPageSize {
+		page, err := cfg.db.GetVideos(userID, false, accountExportPageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, page...)
+		if len(page) < accountExportPageSize {
+			return videos, nil
+		}
+	}
+}
+
+func newAccountManifestVideo(video database.Video) accountManifestVideo {
+	return accountManifestVideo{
+		ID:               video.ID,
+		CreatedAt:        video.CreatedAt,
+		Title:            video.Title,
+		Description:      video.Description,
+		Visibility:       video.Visibility,
+		OriginalFilename: video.OriginalFilename,
+		AspectRatio:      video.AspectRatio,
+		Duration:         video.Duration,
+		HasAudio:         video.HasAudio,
+		Attributes:       video.Attributes,
+	}
+}
+
+// exportVideoContent copies the video's S3 object into the archive,
+// returning the file's name there. Videos without content, or whose content
+// is missing from S3, get no file.
+func (cfg *apiConfig) exportVideoContent(r *http.Request, archive *zip.Writer, video database.Video) (string, error) {
+	if video.VideoURL == nil {
+		return "", nil
+	}
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		return "", nil
+	}
+
+	obj, err := cfg.store.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if isMissingObject(err) {
+		logf(r.Context(), "Content of video %v is missing from S3, exporting it without", video.ID)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	name := "videos/" + video.ID.String() + path.Ext(key)
+	// Video is compressed already, deflating it again only costs CPU.
+	file, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: video.UpdatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, obj.Body)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// exportThumbnail copies the video's local thumbnail file into the archive,
+// returning the file's name there. Thumbnails that aren't local assets, or
+// whose file is gone, get no file.
+func (cfg *apiConfig) exportThumbnail(archive *zip.Writer, video database.Video) (string, error) {
+	if video.ThumbnailURL == nil {
+		return "", nil
+	}
+	assetPath, ok := cfg.getAssetPathFromURL(*video.ThumbnailURL)
+	if !ok {
+		return "", nil
+	}
+
+	src, err := os.Open(cfg.getAssetDiskPath(assetPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	name := "thumbnails/" + video.ID.String() + path.Ext(assetPath)
+	file, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: video.UpdatedAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, src)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func writeAccountManifest(archive *zip.Writer, manifest accountManifest) error {
+	file, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     accountArchiveManifest,
+		Method:   zip.Deflate,
+		Modified: manifest.ExportedAt,
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxAccountManifestSize bounds the manifest read from an imported archive.
+const maxAccountManifestSize = 64 << 20
+
+// handlerAccountImport recreates the videos of a library archive, as written
+// by handlerAccountExport, in the caller's account. The archive is the
+// request body. Each video gets a new ID, and its files go through the same
+// checks and processing as an upload: they're sniffed and size limited,
+// and the content is probed, processed and moderated. What the manifest says
+// about the content, such as its duration, is taken from the content itself
+// instead. The import is all or nothing: when one video fails, the ones
+// imported before it are removed again.
+func (cfg *apiConfig) handlerAccountImport(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	if !cfg.requireActiveUser(w, userID) {
+		return
+	}
+
+	// zip needs random access, so the archive is spooled to disk first.
+	tmpFile, err := os.CreateTemp("", "tubely-import-*.zip")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when creating temp file", err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	size, err := io.Copy(tmpFile, http.MaxBytesReader(w, r.Body, cfg.accountImportMaxBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Archive must be at most %d bytes", cfg.accountImportMaxBytes), err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't read archive", err)
+		return
+	}
+
+	archive, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Body must be a zip archive", err)
+		return
+	}
+	manifest, err := readAccountManifest(archive)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	// Checked up front so an import that can't fit fails before any
+	// processing. Each video checks again as it's created.
+	if cfg.maxVideosPerUser > 0 {
+		count, err := cfg.db.CountVideos(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+			return
+		}
+		if count+len(manifest.Videos) > cfg.maxVideosPerUser {
+			respondWithError(w, http.StatusForbidden, fmt.Sprintf("You can have at most %d videos", cfg.maxVideosPerUser), nil)
+			return
+		}
+	}
+
+	imported := make([]database.Video, 0, len(manifest.Videos))
+	done := false
+	defer func() {
+		if done {
+			return
+		}
+		for _, video := range imported {
+			cfg.discardImportedVideo(context.WithoutCancel(r.Context()), video)
+		}
+	}()
+
+	for _, entry := range manifest.Videos {
+		video, err := cfg.importVideo(r.Context(), archive, userID, entry)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		imported = append(imported, video)
+	}
+	done = true
+
+	for _, video := range imported {
+		cfg.recordAudit(r, userID, video.ID, auditVideoImport)
+	}
+	respondWithJSON(w, http.StatusCreated, imported)
+}
+
+// readAccountManifest reads and checks the manifest of a library archive.
+// Errors are *uploadError values.
+func readAccountManifest(archive *zip.Reader) (accountManifest, error) {
+	var manifest accountManifest
+
+	file, err := archive.Open(accountArchiveManifest)
+	if err != nil {
+		return manifest, &uploadError{http.StatusBadRequest, "Archive has no " + accountArchiveManifest, err}
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(io.LimitReader(file, maxAccountManifestSize)).Decode(&manifest)
+	if err != nil {
+		return manifest, &uploadError{http.StatusBadRequest, "Couldn't decode " + accountArchiveManifest, err}
+	}
+	if manifest.Version != accountArchiveVersion {
+		return manifest, &uploadError{http.StatusBadRequest, fmt.Sprintf("Unsupported archive version %d", manifest.Version), nil}
+	}
+	return manifest, nil
+}
+
+// importVideo creates one video of a library archive for userID. On failure
+// nothing of it is left behind. Errors are *uploadError values.
+func (cfg *apiConfig) importVideo(ctx context.Context, archive *zip.Reader, userID uuid.UUID, entry accountManifestVideo) (video database.Video, err error) {
+	visibility, err := parseVisibility(string(entry.Visibility))
+	if err != nil {
+		return video, &uploadError{http.StatusBadRequest, fmt.Sprintf("Video %v has an invalid visibility", entry.ID), nil}
+	}
+	attributes, err := mergeVideoAttributes(nil, entry.Attributes)
+	if err != nil {
+		return video, &uploadError{http.StatusBadRequest, fmt.Sprintf("Video %v: %v", entry.ID, err), err}
+	}
+
+	var thumbnail *thumbnailUpload
+	if entry.ThumbnailFile != "" {
+		thumbnail, err = readArchiveThumbnail(archive, entry, cfg.maxImageUploadSize)
+		if err != nil {
+			return video, err
+		}
+	}
+
+	var tmpPath, mediaType string
+	if entry.VideoFile != "" {
+		tmpPath, mediaType, err = extractArchiveVideo(archive, entry, cfg.maxVideoUploadSize)
+		if err != nil {
+			return video, err
+		}
+		defer os.Remove(tmpPath)
+	}
+
+	video, err = cfg.createVideoWithinLimit(database.CreateVideoParams{
+		Title:       entry.Title,
+		Description: entry.Description,
+		UserID:      userID,
+	}, visibility)
+	if err != nil {
+		return video, err
+	}
+	defer func() {
+		if err != nil {
+			cfg.discardImportedVideo(context.WithoutCancel(ctx), video)
+		}
+	}()
+
+	video.Attributes = attributes
+	video.OriginalFilename = entry.OriginalFilename
+
+	if tmpPath != "" {
+		return cfg.processUploadedVideo(ctx, video, tmpPath, mediaType, "", thumbnail)
+	}
+
+	if thumbnail != nil {
+		video, err = cfg.storeThumbnail(video, thumbnail.data, thumbnail.mediaType, nil)
+		if err != nil {
+			return video, err
+		}
+	}
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when updating video", err}
+	}
+	return video, nil
+}
+
+// createVideoWithinLimit creates a video with visibility unless its owner
+// already has MAX_VIDEOS_PER_USER of them. Errors are *uploadError values.
+func (cfg *apiConfig) createVideoWithinLimit(params database.CreateVideoParams, visibility database.VideoVisibility) (database.Video, error) {
+	unlock := cfg.idempotencyLocks.lock(videoLimitLockKey(params.UserID))
+	defer unlock()
+
+	if cfg.maxVideosPerUser > 0 {
+		count, err := cfg.db.CountVideos(params.UserID)
+		if err != nil {
+			return database.Video{}, &uploadError{http.StatusInternalServerError, "Couldn't count videos", err}
+		}
+		if count >= cfg.maxVideosPerUser {
+			return database.Video{}, &uploadError{http.StatusForbidden, fmt.Sprintf("You can have at most %d videos", cfg.maxVideosPerUser), nil}
+		}
+	}
+
+	video, err := cfg.db.CreateVideo(params, visibility)
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Couldn't create video", err}
+	}
+	return video, nil
+}
+
+// extractArchiveVideo copies the video file of entry from a library archive
+// to a temp file, which the caller must remove, and checks it like an
+// uploaded video: it must be at most maxSize bytes, and its content must
+// match the type its extension declares. Errors are *uploadError values.
+func extractArchiveVideo(archive *zip.Reader, entry accountManifestVideo, maxSize int64) (string, string, error) {
+	declared := extToMediaType(path.Ext(entry.VideoFile))
+
+	file, err := archive.Open(entry.VideoFile)
+	if err != nil {
+		return "", "", &uploadError{http.StatusBadRequest, fmt.Sprintf("Archive has no %s", entry.VideoFile), err}
+	}
+	defer file.Close()
+
+	tooLarge := &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("%s must be at most %d bytes", entry.VideoFile, maxSize), nil}
+	// The size the archive records can't be trusted, but saves extracting
+	// a file that's too large by its own account.
+	if info, err := file.Stat(); err == nil && info.Size() > maxSize {
+		return "", "", tooLarge
+	}
+
+	tmpFile, err := os.CreateTemp("", "tubely-import-*"+mediaTypeToExt(declared))
+	if err != nil {
+		return "", "", &uploadError{http.StatusInternalServerError, "Error when creating temp file", err}
+	}
+	written, err := io.Copy(tmpFile, io.LimitReader(file, maxSize+1))
+	tmpFile.Close()
+
+	fail := func(err error) (string, string, error) {
+		os.Remove(tmpFile.Name())
+		return "", "", err
+	}
+	if err != nil {
+		return fail(&uploadError{http.StatusBadRequest, fmt.Sprintf("Couldn't read %s", entry.VideoFile), err})
+	}
+	if written > maxSize {
+		return fail(tooLarge)
+	}
+	if written == 0 {
+		return fail(&uploadError{http.StatusBadRequest, fmt.Sprintf("%s is empty", entry.VideoFile), nil})
+	}
+
+	head, err := readFileHead(tmpFile.Name(), sniffLength)
+	if err != nil {
+		return fail(&uploadError{http.StatusInternalServerError, "Error when reading temp file", err})
+	}
+	mediaType, err := videoTypes.validate(declared, sniffMediaType(head))
+	if err != nil {
+		return fail(err)
+	}
+	return tmpFile.Name(), mediaType, nil
+}
+
+// readArchiveThumbnail reads the thumbnail file of entry from a library
+// archive and checks it like an uploaded thumbnail. Errors are *uploadError
+// values.
+func readArchiveThumbnail(archive *zip.Reader, entry accountManifestVideo, maxSize int64) (*thumbnailUpload, error) {
+	file, err := archive.Open(entry.ThumbnailFile)
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, fmt.Sprintf("Archive has no %s", entry.ThumbnailFile), err}
+	}
+	defer file.Close()
+
+	return readThumbnailPart(file, extToMediaType(path.Ext(entry.ThumbnailFile)), maxSize)
+}
+
+// discardImportedVideo removes a video created by an import that didn't go
+// through, with all of its objects and its thumbnail.
+func (cfg *apiConfig) discardImportedVideo(ctx context.Context, video database.Video) {
+	cfg.discardReplacedObjects(ctx, video, database.Video{})
+	if video.ThumbnailURL != nil {
+		cfg.removeAsset(ctx, *video.ThumbnailURL)
+	}
+	err := cfg.db.DeleteVideo(video.ID)
+	if err != nil {
+		logf(ctx, "Couldn't delete video %v of a failed import: %v", video.ID, err)
+	}
+}
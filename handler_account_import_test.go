@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newImportRequest zips manifest and files into a library archive and
+// posts it as token's import.
+func newImportRequest(t *testing.T, token string, entries []accountManifestVideo, files map[string][]byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	archive := zip.NewWriter(&body)
+	manifest, err := archive.Create(accountArchiveManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewEncoder(manifest).Encode(accountManifest{Version: accountArchiveVersion, Videos: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/account/import", &body)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func importEntry(videoFile string) accountManifestVideo {
+	return accountManifestVideo{
+		ID:         uuid.New(),
+		Title:      "Imported",
+		Visibility: database.VideoVisibilityPrivate,
+		VideoFile:  videoFile,
+		// Claims the content can't back up, they must not be trusted.
+		AspectRatio: "landscape",
+		Duration:    42,
+		HasAudio:    true,
+	}
+}
+
+func TestHandlerAccountImport(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+
+	w := httptest.NewRecorder()
+	cfg.handlerAccountImport(w, newImportRequest(t, token,
+		[]accountManifestVideo{importEntry("videos/a.mp4")},
+		map[string][]byte{"videos/a.mp4": mp4Fixture},
+	))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201, body %s", w.Code, w.Body)
+	}
+	var imported []database.Video
+	decodeResponse(t, w, &imported)
+	if len(imported) != 1 {
+		t.Fatalf("imported %d videos, want 1", len(imported))
+	}
+	video := getTestVideo(t, cfg, imported[0].ID)
+	if video.UserID != userID || video.VideoURL == nil {
+		t.Fatalf("imported video = %+v, want one of the importer with content", video)
+	}
+	// Processing is skipped in tests, so nothing about the content is known.
+	if video.AspectRatio != "other" || video.Duration != 0 || video.HasAudio {
+		t.Errorf("aspect ratio %q, duration %v, audio %v were taken from the manifest", video.AspectRatio, video.Duration, video.HasAudio)
+	}
+	key, _ := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if object, ok := store.object(key); !ok || object.contentType != "video/mp4" {
+		t.Errorf("object at %q = %+v, want the video/mp4 content", key, object)
+	}
+}
+
+func TestHandlerAccountImportRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantCode int
+	}{
+		{"content not matching its extension", []byte("\x89PNG\r\n\x1a\n" + string(make([]byte, 100))), http.StatusBadRequest},
+		{"empty", []byte{}, http.StatusBadRequest},
+		{"over the video size limit", append(mp4Fixture, make([]byte, 2<<20)...), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			userID, token := createTestUser(t, cfg)
+
+			// The valid first video must be removed again when the
+			// second fails.
+			w := httptest.NewRecorder()
+			cfg.handlerAccountImport(w, newImportRequest(t, token,
+				[]accountManifestVideo{importEntry("videos/a.mp4"), importEntry("videos/b.mp4")},
+				map[string][]byte{"videos/a.mp4": mp4Fixture, "videos/b.mp4": tt.data},
+			))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantCode, w.Body)
+			}
+			if count, _ := cfg.db.CountVideos(userID); count != 0 {
+				t.Errorf("%d videos left after a failed import", count)
+			}
+			if keys := store.keys(); len(keys) != 0 {
+				t.Errorf("objects left after a failed import: %q", keys)
+			}
+		})
+	}
+}
+
+func TestHandlerAccountImportVideoLimit(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	cfg.maxVideosPerUser = 2
+	userID, token := createTestUser(t, cfg)
+	createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerAccountImport(w, newImportRequest(t, token,
+		[]accountManifestVideo{importEntry("videos/a.mp4"), importEntry("videos/b.mp4")},
+		map[string][]byte{"videos/a.mp4": mp4Fixture, "videos/b.mp4": mp4Fixture},
+	))
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403, body %s", w.Code, w.Body)
+	}
+	if count, _ := cfg.db.CountVideos(userID); count != 1 {
+		t.Errorf("%d videos after a refused import, want 1", count)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (cfg *apiConfig) handlerAdminQueue(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	if cfg.jobs == nil {
+		respondWithJSON(w, http.StatusOK, queueStats{})
+		return
+	}
+
+	stats := cfg.jobs.stats()
+	stats.Backfill = cfg.backfill.snapshot()
+	respondWithJSON(w, http.StatusOK, stats)
+}
+
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (cfg *apiConfig) handlerAdminMaintenanceGet(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, maintenanceStatus{Enabled: cfg.maintenance.enabled.Load()})
+}
+
+// handlerAdminMaintenanceUpdate turns maintenance mode on or off. The switch
+// only lives in memory: a restart goes back to MAINTENANCE_MODE, and each
+// instance behind a load balancer has to be switched on its own.
+func (cfg *apiConfig) handlerAdminMaintenanceUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	var params parameters
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Enabled == nil {
+		respondWithError(w, http.StatusBadRequest, "enabled is required", nil)
+		return
+	}
+
+	cfg.maintenance.enabled.Store(*params.Enabled)
+	respondWithJSON(w, http.StatusOK, maintenanceStatus{Enabled: *params.Enabled})
+}
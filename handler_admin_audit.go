@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const auditPageSize = 100
+
+func (cfg *apiConfig) handlerAdminAudit(w http.ResponseWriter, r *http.Request) {
+	type discrepancy struct {
+		VideoID      uuid.UUID `json:"video_id"`
+		Key          string    `json:"key,omitempty"`
+		ExpectedSize int64     `json:"expected_size,omitempty"`
+		ActualSize   int64     `json:"actual_size,omitempty"`
+	}
+	type response struct {
+		Checked         int           `json:"checked"`
+		Missing         []discrepancy `json:"missing"`
+		SizeMismatches  []discrepancy `json:"size_mismatches"`
+		UnresolvableURL []discrepancy `json:"unresolvable_url"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	res := response{
+		Missing:         []discrepancy{},
+		SizeMismatches:  []discrepancy{},
+		UnresolvableURL: []discrepancy{},
+	}
+
+	// Work through the table a page at a time so a large bucket neither
+	// loads every row at once nor outlives the request.
+	ctx := r.Context()
+	afterID := uuid.Nil
+	for {
+		videos, err := cfg.db.ListAllVideoKeys(afterID, auditPageSize)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't list videos", err)
+			return
+		}
+
+		for _, video := range videos {
+			if ctx.Err() != nil {
+				respondWithError(w, http.StatusServiceUnavailable, "Audit canceled", ctx.Err())
+				return
+			}
+
+			key, ok := cfg.getVideoKeyFromURL(video.VideoURL)
+			if !ok {
+				res.UnresolvableURL = append(res.UnresolvableURL, discrepancy{VideoID: video.ID})
+				continue
+			}
+
+			head, err := cfg.store.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: &cfg.s3Bucket,
+				Key:    &key,
+			})
+			res.Checked++
+
+			if isMissingObject(err) {
+				res.Missing = append(res.Missing, discrepancy{VideoID: video.ID, Key: key})
+				continue
+			}
+			if err != nil {
+				respondWithError(w, http.StatusBadGateway, "Couldn't check video object", err)
+				return
+			}
+
+			// Videos uploaded before sizes were recorded have a size of 0.
+			size := aws.ToInt64(head.ContentLength)
+			if video.Size != 0 && size != video.Size {
+				res.SizeMismatches = append(res.SizeMismatches, discrepancy{
+					VideoID:      video.ID,
+					Key:          key,
+					ExpectedSize: video.Size,
+					ActualSize:   size,
+				})
+			}
+		}
+
+		if len(videos) < auditPageSize {
+			break
+		}
+		afterID = videos[len(videos)-1].ID
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerAdminAuditLog lists audit log entries, newest first, paginated with
+// limit and offset. They can be narrowed down with ?user_id=, ?action= and
+// an RFC 3339 ?since= (inclusive) and ?until= (exclusive).
+func (cfg *apiConfig) handlerAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, offset, err := parsePagination(query, cfg.listMaxLimit)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	var filter database.AuditLogFilter
+	if v := query.Get("user_id"); v != "" {
+		filter.UserID, err = uuid.Parse(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+			return
+		}
+	}
+	if v := query.Get("action"); v != "" {
+		if !slices.Contains(auditActions, v) {
+			msg := fmt.Sprintf("action must be one of %s", strings.Join(auditActions, ", "))
+			respondWithError(w, http.StatusBadRequest, msg, nil)
+			return
+		}
+		filter.Action = v
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		*dst, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp", err)
+			return
+		}
+	}
+
+	entries, err := cfg.db.GetAuditEntries(filter, limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get audit log", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
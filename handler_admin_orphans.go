@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// orphanScanMaxObjects bounds how many objects one cleanup lists, so a
+	// huge bucket can't keep it busy for hours. The progress reports where
+	// to start the next one.
+	orphanScanMaxObjects = 100000
+	// orphanReportMaxKeys bounds the orphaned keys the progress lists.
+	orphanReportMaxKeys = 1000
+)
+
+// orphanCleanupProgress is how far the latest orphan cleanup got. Objects are
+// counted as they're listed, orphans whether or not they could be deleted.
+type orphanCleanupProgress struct {
+	ID            uuid.UUID  `json:"id"`
+	DryRun        bool       `json:"dry_run"`
+	Prefix        string     `json:"prefix,omitempty"`
+	OlderThan     time.Time  `json:"older_than"`
+	Scanned       int        `json:"scanned"`
+	Orphaned      int        `json:"orphaned"`
+	OrphanedBytes int64      `json:"orphaned_bytes"`
+	Deleted       int        `json:"deleted"`
+	Keys          []string   `json:"keys"`
+	NextStartKey  string     `json:"next_start_after,omitempty"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	Cancelled     bool       `json:"cancelled,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// orphanCleanup tracks the one orphan cleanup that may run at a time. Like
+// the backfill, it only lives in memory.
+type orphanCleanup struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	progress *orphanCleanupProgress
+}
+
+func (o *orphanCleanup) snapshot() *orphanCleanupProgress {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.progress == nil {
+		return nil
+	}
+	progress := *o.progress
+	progress.Keys = append([]string{}, o.progress.Keys...)
+	return &progress
+}
+
+func (o *orphanCleanup) update(fn func(*orphanCleanupProgress)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fn(o.progress)
+}
+
+// handlerAdminOrphanCleanupStart looks for objects in the bucket that no
+// video, thumbnail candidate or pending deletion refers to, and deletes
+// those older than ORPHAN_MIN_AGE. With dry_run they're only reported. The
+// scan runs in the background, listing at most orphanScanMaxObjects objects
+// from start_after on within prefix; GET reports its progress and DELETE
+// cancels it.
+func (cfg *apiConfig) handlerAdminOrphanCleanupStart(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DryRun     bool   `json:"dry_run"`
+		Prefix     string `json:"prefix"`
+		StartAfter string `json:"start_after"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	var params parameters
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	cfg.orphans.mu.Lock()
+	if cfg.orphans.cancel != nil {
+		cfg.orphans.mu.Unlock()
+		respondWithError(w, http.StatusConflict, "An orphan cleanup is already running", nil)
+		return
+	}
+	// The run is claimed first, reading the known keys can take a while
+	// with a large library.
+	ctx, cancel := context.WithCancel(withRequestID(context.Background(), requestIDFromContext(r.Context())))
+	cfg.orphans.cancel = cancel
+	cfg.orphans.mu.Unlock()
+
+	known, err := cfg.knownObjectKeys()
+	if err != nil {
+		cancel()
+		cfg.orphans.mu.Lock()
+		cfg.orphans.cancel = nil
+		cfg.orphans.mu.Unlock()
+		if errors.Is(err, errUnknownObjectURL) {
+			respondWithError(w, http.StatusConflict, err.Error(), err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list known objects", err)
+		return
+	}
+
+	progress := &orphanCleanupProgress{
+		ID:        uuid.New(),
+		DryRun:    params.DryRun,
+		Prefix:    params.Prefix,
+		OlderThan: time.Now().UTC().Add(-cfg.orphanMinAge),
+		Keys:      []string{},
+		StartedAt: time.Now().UTC(),
+	}
+	cfg.orphans.mu.Lock()
+	cfg.orphans.progress = progress
+	cfg.orphans.mu.Unlock()
+
+	go cfg.runOrphanCleanup(ctx, params.StartAfter, known)
+
+	respondWithJSON(w, http.StatusAccepted, cfg.orphans.snapshot())
+}
+
+func (cfg *apiConfig) handlerAdminOrphanCleanupGet(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	progress := cfg.orphans.snapshot()
+	if progress == nil {
+		respondWithError(w, http.StatusNotFound, "No orphan cleanup has run", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, progress)
+}
+
+// handlerAdminOrphanCleanupCancel stops the running orphan cleanup after the
+// object it's on. Objects already deleted stay deleted.
+func (cfg *apiConfig) handlerAdminOrphanCleanupCancel(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	cfg.orphans.mu.Lock()
+	cancel := cfg.orphans.cancel
+	cfg.orphans.mu.Unlock()
+	if cancel == nil {
+		respondWithError(w, http.StatusNotFound, "No orphan cleanup is running", nil)
+		return
+	}
+	cancel()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// errUnknownObjectURL is returned by knownObjectKeys when a video refers to
+// an object by a URL getVideoKeyFromURL can't make a key of, as happens to
+// every video stored before S3_CF_DISTRO changed.
+var errUnknownObjectURL = errors.New("a video refers to an object URL outside the configured distribution, refusing to tell orphans apart")
+
+// knownObjectKeys returns the keys of every object something refers to:
+// videos' content, previews, storyboards with their sprites and proxies,
+// thumbnail candidates, the objects of deleted videos still waiting out
+// OBJECT_DELETE_GRACE, and the startup check's marker. A single stored URL
+// it can't read fails it with errUnknownObjectURL, since the object behind
+// it would otherwise look orphaned.
+func (cfg *apiConfig) knownObjectKeys() (map[string]bool, error) {
+	known := map[string]bool{bucketCheckKey: true}
+
+	urls, err := cfg.db.GetVideoObjectURLs()
+	if err != nil {
+		return nil, err
+	}
+	for _, objectURL := range urls {
+		key, ok := cfg.getVideoKeyFromURL(objectURL)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownObjectURL, objectURL)
+		}
+		known[key] = true
+		if path.Ext(key) == ".vtt" {
+			known[getStoryboardSpriteKey(key)] = true
+		}
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(uuid.Nil, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		known[candidate.S3Key] = true
+	}
+
+	jobs, err := cfg.db.GetPendingJobsOfKind(jobKindDeleteObjects)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		var payload deleteObjectsJob
+		if json.Unmarshal(job.Payload, &payload) != nil {
+			continue
+		}
+		for _, key := range payload.Keys {
+			known[key] = true
+		}
+	}
+
+	return known, nil
+}
+
+// runOrphanCleanup lists the bucket page by page and reports, or deletes,
+// every object older than the cutoff that isn't in known. known was read
+// before the scan started, so before deleting a page's orphans it is read
+// again: a video deleted meanwhile with OBJECT_DELETE_GRACE must keep its
+// objects until the grace period is over.
+func (cfg *apiConfig) runOrphanCleanup(ctx context.Context, startAfter string, known map[string]bool) {
+	progress := cfg.orphans.snapshot()
+
+	input := &s3.ListObjectsV2Input{Bucket: &cfg.s3Bucket}
+	if progress.Prefix != "" {
+		input.Prefix = &progress.Prefix
+	}
+	if startAfter != "" {
+		input.StartAfter = &startAfter
+	}
+	paginator := s3.NewListObjectsV2Paginator(cfg.store, input)
+
+	var err error
+	scanned, lastKey, limited := 0, "", false
+	for !limited && paginator.HasMorePages() {
+		var page *s3.ListObjectsV2Output
+		page, err = paginator.NextPage(ctx)
+		if err != nil {
+			break
+		}
+
+		var orphans []types.Object
+		for _, object := range page.Contents {
+			if scanned == orphanScanMaxObjects {
+				cfg.orphans.update(func(p *orphanCleanupProgress) { p.NextStartKey = lastKey })
+				limited = true
+				break
+			}
+			scanned, lastKey = scanned+1, *object.Key
+			cfg.orphans.update(func(p *orphanCleanupProgress) { p.Scanned++ })
+
+			if !known[*object.Key] && object.LastModified != nil && object.LastModified.Before(progress.OlderThan) {
+				orphans = append(orphans, object)
+			}
+		}
+
+		if len(orphans) > 0 && !progress.DryRun {
+			known, err = cfg.knownObjectKeys()
+			if err != nil {
+				break
+			}
+		}
+		for _, object := range orphans {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			key := *object.Key
+			if known[key] {
+				continue
+			}
+			deleted := false
+			if !progress.DryRun {
+				deleted = cfg.deleteObject(ctx, key)
+				cfg.objectInfoCache.delete(key)
+			}
+			cfg.orphans.update(func(p *orphanCleanupProgress) {
+				p.Orphaned++
+				if object.Size != nil {
+					p.OrphanedBytes += *object.Size
+				}
+				if deleted {
+					p.Deleted++
+				}
+				if len(p.Keys) < orphanReportMaxKeys {
+					p.Keys = append(p.Keys, key)
+				}
+			})
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logf(ctx, "Orphan cleanup %v stopped: %v", progress.ID, err)
+	}
+	cfg.orphans.mu.Lock()
+	defer cfg.orphans.mu.Unlock()
+	cfg.orphans.cancel()
+	cfg.orphans.cancel = nil
+	finishedAt := time.Now().UTC()
+	cfg.orphans.progress.FinishedAt = &finishedAt
+	if errors.Is(err, context.Canceled) {
+		cfg.orphans.progress.Cancelled = true
+	} else if err != nil {
+		cfg.orphans.progress.Error = err.Error()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// runTestOrphanCleanup runs a cleanup of the whole bucket to completion the
+// way handlerAdminOrphanCleanupStart starts one, with known as the keys
+// read before the scan.
+func runTestOrphanCleanup(t *testing.T, cfg *apiConfig, known map[string]bool) *orphanCleanupProgress {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.orphans.cancel = cancel
+	cfg.orphans.progress = &orphanCleanupProgress{
+		ID:        uuid.New(),
+		OlderThan: time.Now().Add(-cfg.orphanMinAge),
+		Keys:      []string{},
+		StartedAt: time.Now(),
+	}
+	cfg.runOrphanCleanup(ctx, "", known)
+	return cfg.orphans.snapshot()
+}
+
+func TestRunOrphanCleanup(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	old := time.Now().Add(-48 * time.Hour)
+	store.putObject("landscape/referenced.mp4", mp4Fixture, old)
+	store.putObject("landscape/orphan.mp4", mp4Fixture, old)
+	store.putObject("landscape/recent.mp4", mp4Fixture, time.Now())
+	video.VideoURL = aws.String(cfg.getVideoURL("landscape/referenced.mp4"))
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := cfg.knownObjectKeys()
+	if err != nil {
+		t.Fatalf("knownObjectKeys: %v", err)
+	}
+	progress := runTestOrphanCleanup(t, cfg, known)
+
+	if progress.Error != "" || progress.Scanned != 3 || progress.Orphaned != 1 || progress.Deleted != 1 {
+		t.Errorf("progress = %+v, want 3 scanned and 1 orphan deleted", progress)
+	}
+	want := []string{"landscape/recent.mp4", "landscape/referenced.mp4"}
+	if keys := store.keys(); strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("objects left = %q, want %q", keys, want)
+	}
+}
+
+func TestRunOrphanCleanupKeepsObjectsDeletedMeanwhile(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	store.putObject("landscape/deleted.mp4", mp4Fixture, time.Now().Add(-48*time.Hour))
+
+	// The video was deleted with a grace period after the scan read the
+	// known keys, its objects are now only referred to by the pending job.
+	known, err := cfg.knownObjectKeys()
+	if err != nil {
+		t.Fatalf("knownObjectKeys: %v", err)
+	}
+	payload, _ := json.Marshal(deleteObjectsJob{Keys: []string{"landscape/deleted.mp4"}})
+	err = cfg.db.CreateJob(database.Job{ID: uuid.New(), Kind: jobKindDeleteObjects, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := runTestOrphanCleanup(t, cfg, known)
+
+	if progress.Orphaned != 0 || progress.Deleted != 0 {
+		t.Errorf("progress = %+v, want no orphans", progress)
+	}
+	if _, ok := store.object("landscape/deleted.mp4"); !ok {
+		t.Error("object awaiting its grace period was deleted")
+	}
+}
+
+func TestHandlerAdminOrphanCleanupUnknownURL(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.adminAPIKey = "admin-key"
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	store.putObject("landscape/moved.mp4", mp4Fixture, time.Now().Add(-48*time.Hour))
+	video.VideoURL = aws.String("https://old-distribution.test/landscape/moved.mp4")
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/orphans", strings.NewReader(`{}`))
+	r.Header.Set("Authorization", "ApiKey admin-key")
+	w := httptest.NewRecorder()
+	cfg.handlerAdminOrphanCleanupStart(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409, body %s", w.Code, w.Body)
+	}
+	if cfg.orphans.cancel != nil {
+		t.Error("a cleanup was started")
+	}
+	if _, ok := store.object("landscape/moved.mp4"); !ok {
+		t.Error("object behind the unreadable URL was deleted")
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobKindReprocessVideo = "reprocess_video"
+
+// backfillRetryDelay is how long a backfill waits for room in a full queue
+// before enqueueing again.
+const backfillRetryDelay = time.Second
+
+// reprocessProbeBatchSize is how many videos a missing_duration job probes
+// together. Other filters reprocess one video per job.
+const reprocessProbeBatchSize = 10
+
+// reprocessVideoJob is the payload of a jobKindReprocessVideo job. Jobs
+// queued before videos were batched carry a single VideoID.
+type reprocessVideoJob struct {
+	VideoID    uuid.UUID                `json:"video_id,omitempty"`
+	VideoIDs   []uuid.UUID              `json:"video_ids,omitempty"`
+	Filter     database.ReprocessFilter `json:"filter"`
+	BackfillID uuid.UUID                `json:"backfill_id"`
+}
+
+func (job reprocessVideoJob) videoIDs() []uuid.UUID {
+	if job.VideoID != uuid.Nil {
+		return append([]uuid.UUID{job.VideoID}, job.VideoIDs...)
+	}
+	return job.VideoIDs
+}
+
+// backfillProgress is how far the latest backfill got, in videos. Videos are
+// counted as their job finishes, skipped ones included.
+type backfillProgress struct {
+	ID         uuid.UUID                `json:"id"`
+	Filter     database.ReprocessFilter `json:"filter"`
+	Total      int                      `json:"total"`
+	Enqueued   int                      `json:"enqueued"`
+	Completed  int                      `json:"completed"`
+	Failed     int                      `json:"failed"`
+	StartedAt  time.Time                `json:"started_at"`
+	FinishedAt *time.Time               `json:"finished_at,omitempty"`
+	Error      string                   `json:"error,omitempty"`
+}
+
+// backfill tracks the one reprocessing backfill that may run at a time. It
+// only lives in memory: jobs already enqueued survive a restart like any
+// other, and running the backfill again enqueues whatever still matches.
+type backfill struct {
+	mu       sync.Mutex
+	running  bool
+	progress *backfillProgress
+}
+
+func (b *backfill) snapshot() *backfillProgress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.progress == nil {
+		return nil
+	}
+	progress := *b.progress
+	return &progress
+}
+
+// update applies fn to the progress of backfill id, if it's still the
+// latest one.
+func (b *backfill) update(id uuid.UUID, fn func(*backfillProgress)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.progress != nil && b.progress.ID == id {
+		fn(b.progress)
+	}
+}
+
+// handlerAdminReprocessAll backfills ready videos matching a filter, such
+// as videos missing their duration, by reprocessing each on the background
+// workers. With dry_run the matching videos are only counted. Progress is
+// reported by GET /api/admin/queue.
+func (cfg *apiConfig) handlerAdminReprocessAll(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Filter database.ReprocessFilter `json:"filter"`
+		DryRun bool                     `json:"dry_run"`
+	}
+	type response struct {
+		Filter   database.ReprocessFilter `json:"filter"`
+		DryRun   bool                     `json:"dry_run"`
+		Matching int                      `json:"matching"`
+		ID       *uuid.UUID               `json:"id,omitempty"`
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	var params parameters
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Filter.Valid() {
+		msg := fmt.Sprintf("filter must be %s, %s or %s", database.ReprocessMissingDuration, database.ReprocessMissingPreview, database.ReprocessMissingStoryboard)
+		respondWithError(w, http.StatusBadRequest, msg, nil)
+		return
+	}
+
+	ids, err := cfg.db.GetVideoIDsToReprocess(params.Filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list videos", err)
+		return
+	}
+	res := response{Filter: params.Filter, DryRun: params.DryRun, Matching: len(ids)}
+	if params.DryRun {
+		respondWithJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if cfg.skipVideoProcessing {
+		respondWithError(w, http.StatusNotImplemented, "Reprocessing needs video processing, which is disabled", nil)
+		return
+	}
+	if cfg.jobs == nil {
+		respondWithError(w, http.StatusNotImplemented, "Reprocessing needs background workers, set PROCESSING_WORKERS", nil)
+		return
+	}
+
+	cfg.backfill.mu.Lock()
+	if cfg.backfill.running {
+		cfg.backfill.mu.Unlock()
+		respondWithError(w, http.StatusConflict, "A backfill is already running", nil)
+		return
+	}
+	progress := &backfillProgress{
+		ID:        uuid.New(),
+		Filter:    params.Filter,
+		Total:     len(ids),
+		StartedAt: time.Now().UTC(),
+	}
+	cfg.backfill.running = true
+	cfg.backfill.progress = progress
+	cfg.backfill.mu.Unlock()
+
+	// The request is done long before the backfill is, only its ID is kept.
+	go cfg.feedBackfill(withRequestID(context.Background(), requestIDFromContext(r.Context())), progress.ID, params.Filter, ids)
+
+	res.ID = &progress.ID
+	respondWithJSON(w, http.StatusAccepted, res)
+}
+
+// feedBackfill enqueues reprocessing jobs for ids, waiting for room whenever
+// the queue is full so the backfill never crowds out uploads for long. The
+// workers bound how many jobs run at once.
+func (cfg *apiConfig) feedBackfill(ctx context.Context, id uuid.UUID, filter database.ReprocessFilter, ids []uuid.UUID) {
+	batchSize := 1
+	if filter == database.ReprocessMissingDuration {
+		batchSize = reprocessProbeBatchSize
+	}
+
+	var err error
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+		for {
+			err = cfg.jobs.enqueue(ctx, jobKindReprocessVideo, reprocessVideoJob{
+				VideoIDs:   batch,
+				Filter:     filter,
+				BackfillID: id,
+			})
+			if !errors.Is(err, errQueueFull) {
+				break
+			}
+			time.Sleep(backfillRetryDelay)
+		}
+		if err != nil {
+			break
+		}
+		cfg.backfill.update(id, func(p *backfillProgress) { p.Enqueued += len(batch) })
+	}
+
+	if err != nil {
+		logf(ctx, "Backfill %v stopped: %v", id, err)
+	}
+	cfg.backfill.mu.Lock()
+	defer cfg.backfill.mu.Unlock()
+	cfg.backfill.running = false
+	if cfg.backfill.progress != nil && cfg.backfill.progress.ID == id {
+		finishedAt := time.Now().UTC()
+		cfg.backfill.progress.FinishedAt = &finishedAt
+		if err != nil {
+			cfg.backfill.progress.Error = err.Error()
+		}
+	}
+}
+
+// reprocessVideoJobHandler runs jobKindReprocessVideo jobs. Videos that no
+// longer match the backfill's filter, because they were reprocessed or
+// changed since, are skipped.
+func (cfg *apiConfig) reprocessVideoJobHandler() jobHandler {
+	decode := func(payload []byte) (reprocessVideoJob, error) {
+		var job reprocessVideoJob
+		err := json.Unmarshal(payload, &job)
+		return job, err
+	}
+
+	return jobHandler{
+		run: func(ctx context.Context, payload []byte) error {
+			job, err := decode(payload)
+			if err != nil {
+				return &permanentJobError{err: fmt.Errorf("couldn't decode job payload: %w", err)}
+			}
+
+			ids := job.videoIDs()
+			var videos []database.Video
+			for _, videoID := range ids {
+				video, err := cfg.db.GetVideo(videoID)
+				if err != nil {
+					return err
+				}
+				if video.ID != uuid.Nil && job.Filter.Matches(video) {
+					videos = append(videos, video)
+				}
+			}
+
+			// Progress is only counted once the whole job went through, a
+			// retry counts its videos again.
+			failed := 0
+			if job.Filter == database.ReprocessMissingDuration {
+				failed, err = cfg.reprocessDurations(ctx, videos)
+				if err != nil {
+					return err
+				}
+			} else {
+				for _, video := range videos {
+					err = cfg.reprocessVideo(ctx, video, job.Filter)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			cfg.backfill.update(job.BackfillID, func(p *backfillProgress) {
+				p.Completed += len(ids) - failed
+				p.Failed += failed
+			})
+			return nil
+		},
+		onFailure: func(ctx context.Context, payload []byte, err error) {
+			job, decodeErr := decode(payload)
+			if decodeErr != nil {
+				return
+			}
+			cfg.backfill.update(job.BackfillID, func(p *backfillProgress) { p.Failed += len(job.videoIDs()) })
+		},
+	}
+}
+
+// reprocessDurations probes videos together, straight from S3 through
+// presigned URLs since ffprobe only reads what it needs, and fills in their
+// duration and stream details. Videos that can't be probed are logged and
+// counted as failed, those whose content is gone marked missing as well; the
+// error is only for failures that are worth retrying the whole batch for.
+func (cfg *apiConfig) reprocessDurations(ctx context.Context, videos []database.Video) (failed int, err error) {
+	var probed []database.Video
+	var keys, inputs []string
+	for _, video := range videos {
+		key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+		if !ok {
+			logf(ctx, "Couldn't resolve location of video %v", video.ID)
+			failed++
+			continue
+		}
+		presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+		if err != nil {
+			return failed, err
+		}
+		probed = append(probed, video)
+		keys = append(keys, key)
+		inputs = append(inputs, presigned.URL)
+	}
+
+	results := cfg.ffmpegPool.ProbeBatch(ctx, inputs, cfg.aspectRatioFallback, cfg.squareTolerance)
+	if ctx.Err() != nil {
+		return failed, ctx.Err()
+	}
+	for i, result := range results {
+		video := probed[i]
+		if result.Err != nil {
+			_, headErr := cfg.headObject(ctx, keys[i])
+			if isMissingObject(headErr) {
+				logf(ctx, "Content of video %v is missing", video.ID)
+				cfg.markVideoMissing(ctx, video.ID, keys[i])
+				failed++
+				continue
+			}
+			logf(ctx, "Couldn't probe video %v: %v", video.ID, result.Err)
+			failed++
+			continue
+		}
+
+		video.Duration = result.Info.Duration.Seconds()
+		video.HasAudio = result.Info.HasAudio
+		video.PixFmt = result.Info.PixFmt
+		video.ColorTransfer = result.Info.ColorTransfer
+		err := cfg.saveVideo(&video)
+		if err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// reprocessVideo fills in the preview or storyboard filter found missing
+// from video, working on a copy of its stored content.
+func (cfg *apiConfig) reprocessVideo(ctx context.Context, video database.Video, filter database.ReprocessFilter) error {
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		return &permanentJobError{err: fmt.Errorf("couldn't resolve location of video %v", video.ID)}
+	}
+
+	tmpPath, err := cfg.downloadObject(ctx, key)
+	if isMissingObject(err) {
+		cfg.markVideoMissing(ctx, video.ID, key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	switch filter {
+	case database.ReprocessMissingPreview:
+		video = cfg.uploadPreview(ctx, video, tmpPath, key, video.AspectRatio)
+	case database.ReprocessMissingStoryboard:
+		video = cfg.uploadStoryboard(ctx, video, tmpPath, key, video.AspectRatio)
+	}
+
+	return cfg.saveVideo(&video)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestReprocessDurationsMissingContent(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.ffmpegPool = newFFmpegPool(&fakeCommandRunner{respond: func(string, []string) ([]byte, error) {
+		return nil, errors.New("404 Not Found")
+	}}, 1)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+	store.mu.Lock()
+	delete(store.objects, key)
+	store.mu.Unlock()
+
+	failed, err := cfg.reprocessDurations(context.Background(), []database.Video{video})
+	if err != nil {
+		t.Fatalf("reprocessDurations: %v", err)
+	}
+	if failed != 1 {
+		t.Errorf("failed = %d, want the missing video counted", failed)
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.Status != database.VideoStatusMissing {
+		t.Errorf("status = %q, want missing", saved.Status)
+	}
+}
+
+func TestReprocessDurationsCancelled(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	cfg.ffmpegPool = newFFmpegPool(&fakeCommandRunner{}, 1)
+	userID, token := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, userID, token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cfg.reprocessDurations(ctx, []database.Video{video})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled so the batch is retried", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobKindDeleteObjects = "delete_objects"
+
+// deleteObjectsJob is the payload of a jobKindDeleteObjects job: the S3
+// objects of a deleted video, along with the video as it was so it can be
+// restored until they're gone. The video's thumbnail goes with them.
+type deleteObjectsJob struct {
+	Video database.Video `json:"video"`
+	Keys  []string       `json:"keys"`
+}
+
+// deleteObjectsJobHandler runs jobKindDeleteObjects jobs once
+// OBJECT_DELETE_GRACE has passed.
+func (cfg *apiConfig) deleteObjectsJobHandler() jobHandler {
+	return jobHandler{
+		run: func(ctx context.Context, payload []byte) error {
+			var job deleteObjectsJob
+			err := json.Unmarshal(payload, &job)
+			if err != nil {
+				return &permanentJobError{err: fmt.Errorf("couldn't decode job payload: %w", err)}
+			}
+			err = cfg.deleteObjects(ctx, job.Keys)
+			if err != nil {
+				return err
+			}
+			if job.Video.ThumbnailURL != nil {
+				cfg.removeAsset(ctx, *job.Video.ThumbnailURL)
+			}
+			return nil
+		},
+		onFailure: func(ctx context.Context, payload []byte, err error) {
+			var job deleteObjectsJob
+			if json.Unmarshal(payload, &job) != nil {
+				return
+			}
+			logf(ctx, "Gave up deleting objects %q, they're now orphans: %v", job.Keys, err)
+		},
+	}
+}
+
+// deleteObjects deletes the objects at keys, stopping at the first failure.
+// Deleting an object that's already gone succeeds.
+func (cfg *apiConfig) deleteObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		_, err := cfg.store.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return err
+		}
+		cfg.objectInfoCache.delete(key)
+	}
+	return nil
+}
+
+// handlerAdminVideoRestore brings back a video deleted less than
+// OBJECT_DELETE_GRACE ago, cancelling the deletion of its objects. The video
+// gets its old ID back; its shares and access grants are gone for good.
+func (cfg *apiConfig) handlerAdminVideoRestore(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	jobs, err := cfg.db.GetPendingJobsOfKind(jobKindDeleteObjects)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list pending deletions", err)
+		return
+	}
+	var jobID uuid.UUID
+	var deletion deleteObjectsJob
+	for _, job := range jobs {
+		var payload deleteObjectsJob
+		if json.Unmarshal(job.Payload, &payload) == nil && payload.Video.ID == videoID {
+			jobID, deletion = job.ID, payload
+			break
+		}
+	}
+	if jobID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No pending deletion for this video", nil)
+		return
+	}
+
+	cancelled, err := cfg.db.CancelJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel deletion", err)
+		return
+	}
+	if !cancelled {
+		respondWithError(w, http.StatusConflict, "The video's content is already being deleted", nil)
+		return
+	}
+
+	video, err := cfg.db.RestoreVideo(deletion.Video)
+	if err != nil {
+		// The deletion is cancelled, so the content is kept whatever
+		// happens to the row.
+		logf(r.Context(), "Couldn't restore video %v, its objects are kept: %v", videoID, err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
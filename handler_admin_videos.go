@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// adminProbeTimeout bounds downloading and probing a video for
+// handlerAdminVideoProbe.
+const adminProbeTimeout = 2 * time.Minute
+
+// handlerAdminVideoProbe returns ffprobe's full stream and format report on
+// a video's stored content, for debugging playback and metadata issues.
+func (cfg *apiConfig) handlerAdminVideoProbe(w http.ResponseWriter, r *http.Request) {
+	type probeResult struct {
+		output []byte
+		err    error
+	}
+
+	err := cfg.authorizeAdmin(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no content", nil)
+		return
+	}
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve video location", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), adminProbeTimeout)
+	defer cancel()
+
+	tmpPath, err := cfg.downloadObject(ctx, key)
+	if isMissingObject(err) {
+		respondWithError(w, http.StatusNotFound, "Video content not found", err)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		respondWithError(w, http.StatusGatewayTimeout, "Downloading the video took too long", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't download video", err)
+		return
+	}
+
+	// The runner can't be cancelled, so on timeout ffprobe is left to
+	// finish on its own and removes the file once it has.
+	done := make(chan probeResult, 1)
+	go func() {
+		defer os.Remove(tmpPath)
+		output, err := cfg.commands.Run(r.Context(), "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", tmpPath)
+		done <- probeResult{output, err}
+	}()
+
+	var result probeResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		respondWithError(w, http.StatusGatewayTimeout, "Probing the video took too long", ctx.Err())
+		return
+	}
+	if result.err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when probing video", result.err)
+		return
+	}
+
+	// Like parseVideoMeta, skip anything printed around the JSON object.
+	start := bytes.IndexByte(result.output, '{')
+	end := bytes.LastIndexByte(result.output, '}')
+	if start == -1 || end < start || !json.Valid(result.output[start:end+1]) {
+		respondWithError(w, http.StatusInternalServerError, "ffprobe output isn't valid JSON", errInvalidVideoMetadata)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, json.RawMessage(result.output[start:end+1]))
+}
+
+// downloadObject copies the object at key to a temp file, returning its
+// path. The caller removes the file.
+func (cfg *apiConfig) downloadObject(ctx context.Context, key string) (string, error) {
+	obj, err := cfg.store.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	tmpFile, err := os.CreateTemp("", "tubely-probe-*"+path.Ext(key))
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, obj.Body)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
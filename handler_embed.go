@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultEmbedWidth  = 640
+	defaultEmbedHeight = 360
+)
+
+// handlerVideoEmbed answers oEmbed consumers such as WordPress. They can't
+// authenticate, so any published public or unlisted video can be embedded by
+// whoever knows its ID; the player points at the CDN URL so the embed doesn't
+// expire.
+func (cfg *apiConfig) handlerVideoEmbed(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version         string `json:"version"`
+		Type            string `json:"type"`
+		ProviderName    string `json:"provider_name"`
+		Title           string `json:"title"`
+		HTML            string `json:"html"`
+		Width           int    `json:"width"`
+		Height          int    `json:"height"`
+		ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+		ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+		ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	// The spec has providers that don't do XML answer 501.
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		respondWithError(w, http.StatusNotImplemented, "Only the json format is supported", nil)
+		return
+	}
+
+	maxWidth, err := parseEmbedMaxDimension(r, "maxwidth")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maxwidth", err)
+		return
+	}
+	maxHeight, err := parseEmbedMaxDimension(r, "maxheight")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maxheight", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.VideoURL == nil || video.Status != database.VideoStatusReady || video.Visibility == database.VideoVisibilityPrivate {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	width, height := embedDimensions(video)
+	width, height = scaleToFit(width, height, maxWidth, maxHeight)
+
+	res := response{
+		Version:      "1.0",
+		Type:         "video",
+		ProviderName: "Tubely",
+		Title:        video.Title,
+		Width:        width,
+		Height:       height,
+		HTML: fmt.Sprintf(`<video src="%s" width="%d" height="%d" controls></video>`,
+			html.EscapeString(*video.VideoURL), width, height),
+	}
+	if video.ThumbnailURL != nil {
+		res.ThumbnailURL = *video.ThumbnailURL
+		res.ThumbnailWidth = video.ThumbnailWidth
+		res.ThumbnailHeight = video.ThumbnailHeight
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func parseEmbedMaxDimension(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+// embedDimensions picks the player size: the stored thumbnail size when known,
+// which matches the video's frame, or a default matching its aspect ratio.
+func embedDimensions(video database.Video) (int, int) {
+	if video.ThumbnailWidth > 0 && video.ThumbnailHeight > 0 {
+		return video.ThumbnailWidth, video.ThumbnailHeight
+	}
+	switch video.AspectRatio {
+	case "portrait":
+		return defaultEmbedHeight, defaultEmbedWidth
+	case "square":
+		return defaultEmbedHeight, defaultEmbedHeight
+	}
+	return defaultEmbedWidth, defaultEmbedHeight
+}
+
+// scaleToFit shrinks width x height, keeping its ratio, so it fits within
+// maxWidth and maxHeight. A zero maximum means no limit.
+func scaleToFit(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = max(1, height*maxWidth/width)
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = max(1, width*maxHeight/height)
+		height = maxHeight
+	}
+	return width, height
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	playVariantVideo      = "video"
+	playVariantThumbnail  = "thumbnail"
+	playVariantPreview    = "preview"
+	playVariantDownload   = "download"
+	playVariantStoryboard = "storyboard"
+)
+
+// handlerVideoPlay gives a video a permanent, access-controlled URL by
+// redirecting to a freshly presigned one on every request. Pass
+// ?variant=thumbnail or ?variant=preview for the thumbnail or animated preview
+// instead, or ?variant=download for the video as an attachment named after
+// the uploaded file. Since the target is short-lived, the redirect itself
+// must never be cached.
+//
+// With ?format=json the URL is returned instead of followed, together with
+// the object's size and whether S3 serves byte ranges for it, so players can
+// plan their initial buffering.
+//
+// ?quality=720p asks for the video or download in that rendition. When the
+// video doesn't have it, the closest one it has is served instead, or the
+// original; the quality served is in X-Video-Quality and, along with the
+// qualities available, in the JSON response.
+//
+// ?proxy=true plays the video's low-resolution editing proxy, stored when
+// PROXY_ENABLED is set, instead of the full file. The proxy is also the
+// video's 360p rendition.
+//
+// ?variant=storyboard serves the video's WebVTT thumbnail track itself
+// rather than redirecting to it: the stored track names its sprite sheet by
+// an unsigned URL, which is swapped for a presigned one on the way out.
+func (cfg *apiConfig) handlerVideoPlay(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL           string     `json:"url"`
+		ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+		ContentLength int64      `json:"content_length,omitempty"`
+		ContentType   string     `json:"content_type,omitempty"`
+		AcceptRanges  string     `json:"accept_ranges,omitempty"`
+		Quality       string     `json:"quality,omitempty"`
+		Qualities     []string   `json:"qualities,omitempty"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	variant := r.URL.Query().Get("variant")
+	if variant == "" {
+		variant = playVariantVideo
+	}
+	if variant != playVariantVideo && variant != playVariantThumbnail && variant != playVariantPreview && variant != playVariantDownload && variant != playVariantStoryboard {
+		respondWithError(w, http.StatusBadRequest, "variant must be video, thumbnail, preview, download or storyboard", nil)
+		return
+	}
+
+	// Cuts down on other sites hotlinking videos, the presigned URL behind
+	// the redirect still works for whoever gets hold of it.
+	if !cfg.referrerAllowed(r) {
+		respondWithError(w, http.StatusForbidden, "Linking to this video from other sites isn't allowed", nil)
+		return
+	}
+
+	quality := r.URL.Query().Get("quality")
+	if quality != "" && !validQuality(quality) {
+		respondWithError(w, http.StatusBadRequest, "quality must be original or one of "+strings.Join(renditionQualities, ", "), nil)
+		return
+	}
+	if quality != "" && variant != playVariantVideo && variant != playVariantDownload {
+		respondWithError(w, http.StatusBadRequest, "quality only applies to the video and download variants", nil)
+		return
+	}
+
+	proxy := false
+	if v := r.URL.Query().Get("proxy"); v != "" {
+		proxy, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "proxy must be a boolean", err)
+			return
+		}
+	}
+	if proxy && (variant != playVariantVideo || quality != "") {
+		respondWithError(w, http.StatusBadRequest, "proxy only applies to the video variant and can't be combined with quality", nil)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" {
+		respondWithError(w, http.StatusBadRequest, "format must be json", nil)
+		return
+	}
+	if format != "" && variant == playVariantStoryboard {
+		respondWithError(w, http.StatusBadRequest, "format doesn't apply to the storyboard variant", nil)
+		return
+	}
+
+	// Links such as QR codes can't carry a header, so ?token= is honoured
+	// when ALLOW_QUERY_TOKEN is set. Public and unlisted videos need neither.
+	userID, err := cfg.optionalUserID(auth.GetMediaToken(r, cfg.allowQueryToken))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+
+	canAccess, err := cfg.canAccessVideo(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !canAccess || video.Status == database.VideoStatusRejected {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if variant == playVariantStoryboard {
+		cfg.serveStoryboard(w, r, video)
+		return
+	}
+
+	var res response
+	switch variant {
+	case playVariantThumbnail:
+		// Thumbnails are served from local assets, there is nothing to sign.
+		if video.ThumbnailURL == nil {
+			respondWithError(w, http.StatusNotFound, "Video has no thumbnail", nil)
+			return
+		}
+		res.URL = *video.ThumbnailURL
+	default:
+		objectURL, missing := video.VideoURL, "Video has no content"
+		if variant == playVariantPreview {
+			objectURL, missing = video.PreviewURL, "Video has no preview"
+		}
+		if proxy {
+			objectURL, missing = video.ProxyURL, "Video has no proxy"
+		}
+		if objectURL == nil {
+			respondWithError(w, http.StatusNotFound, missing, nil)
+			return
+		}
+		if variant != playVariantPreview && !proxy {
+			res.Qualities = availableQualities(video)
+			res.Quality = qualityOriginal
+			if quality != "" {
+				res.Quality = resolveQuality(quality, res.Qualities)
+				objectURL = qualityURL(video, res.Quality)
+			}
+			w.Header().Set("X-Video-Quality", res.Quality)
+		}
+		key, ok := cfg.getVideoKeyFromURL(*objectURL)
+		if !ok {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't resolve video location", nil)
+			return
+		}
+		var opts presignOptions
+		if variant == playVariantDownload {
+			opts.ContentDisposition = downloadDisposition(video, key)
+		}
+		presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), opts)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+			return
+		}
+		domain, err := cfg.db.GetUserCustomDomain(video.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+			return
+		}
+		res.URL = withCustomDomain(presigned.URL, domain)
+		res.ExpiresAt = &presigned.ExpiresAt
+
+		if format == "json" {
+			info, err := cfg.headObject(r.Context(), key)
+			if isMissingObject(err) {
+				if variant != playVariantPreview && !proxy && userID == video.UserID {
+					cfg.markVideoMissing(r.Context(), video.ID, key)
+				}
+				respondWithError(w, http.StatusNotFound, "Video content not found", err)
+				return
+			}
+			if err != nil {
+				respondWithError(w, http.StatusBadGateway, "Couldn't get video details", err)
+				return
+			}
+			res.ContentLength = info.ContentLength
+			res.ContentType = info.ContentType
+			res.AcceptRanges = info.AcceptRanges
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "json" {
+		respondWithJSON(w, http.StatusOK, res)
+		return
+	}
+	http.Redirect(w, r, res.URL, http.StatusFound)
+}
+
+// downloadDisposition builds an attachment Content-Disposition named after
+// the uploaded file, or after the video ID for uploads that sent no name.
+func downloadDisposition(video database.Video, key string) string {
+	filename := video.OriginalFilename
+	if filename == "" {
+		filename = video.ID.String() + path.Ext(key)
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+// markVideoMissing records that the content of a video, found missing at
+// key, is gone from S3, so its owner can see it needs uploading again. Only
+// the owner's requests and background work may call it, or any viewer
+// could flip the status of a public video on a transient error.
+//
+// The video is read again and only marked when it's still ready or flagged
+// with its content at key, and the row is written only if nothing changed
+// it meanwhile: a replacement that just moved the video elsewhere must not
+// leave it marked missing. Failures are only logged, the caller answers
+// with a 404 either way.
+func (cfg *apiConfig) markVideoMissing(ctx context.Context, videoID uuid.UUID, key string) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		logf(ctx, "Couldn't mark video %v as missing: %v", videoID, err)
+		return
+	}
+	if video.Status != database.VideoStatusReady && video.Status != database.VideoStatusFlagged {
+		return
+	}
+	if video.VideoURL == nil {
+		return
+	}
+	if current, ok := cfg.getVideoKeyFromURL(*video.VideoURL); !ok || current != key {
+		return
+	}
+
+	logf(ctx, "Content of video %v is missing from S3", video.ID)
+	video.Status = database.VideoStatusMissing
+	err = cfg.db.UpdateVideo(&video)
+	if err != nil {
+		logf(ctx, "Couldn't mark video %v as missing: %v", video.ID, err)
+	}
+}
+
+// serveStoryboard writes video's storyboard track with the sprite sheet it
+// points at presigned, under the owner's custom domain when they have one.
+func (cfg *apiConfig) serveStoryboard(w http.ResponseWriter, r *http.Request, video database.Video) {
+	keys := cfg.storyboardKeys(video.StoryboardURL)
+	if keys == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no storyboard", nil)
+		return
+	}
+	key, spriteKey := keys[0], keys[1]
+
+	obj, err := cfg.store.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if isMissingObject(err) {
+		respondWithError(w, http.StatusNotFound, "Storyboard not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get storyboard", err)
+		return
+	}
+	defer obj.Body.Close()
+	vtt, err := io.ReadAll(io.LimitReader(obj.Body, maxStoryboardTrackSize))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get storyboard", err)
+		return
+	}
+
+	sprite, err := cfg.presignObject(spriteKey, cfg.presignExpiryFor(video), presignOptions{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign storyboard", err)
+		return
+	}
+	domain, err := cfg.db.GetUserCustomDomain(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+		return
+	}
+	vtt = bytes.ReplaceAll(vtt, []byte(cfg.getVideoURL(spriteKey)), []byte(withCustomDomain(sprite.URL, domain)))
+
+	// The presigned URLs inside expire, so the track mustn't outlive them
+	// in a cache.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/vtt")
+	w.WriteHeader(http.StatusOK)
+	w.Write(vtt)
+}
+
+// storyboardPath is where clients fetch videoID's storyboard track, with
+// its sprite presigned.
+func storyboardPath(videoID uuid.UUID) string {
+	return "/api/videos/" + videoID.String() + "/play?variant=" + playVariantStoryboard
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newPlayRequest(t *testing.T, videoID uuid.UUID, token, query string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+videoID.String()+"/play"+query, nil)
+	r.SetPathValue("videoID", videoID.String())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestHandlerVideoPlayMissingContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		asOwner    bool
+		wantStatus database.VideoStatus
+	}{
+		{"owner", true, database.VideoStatusMissing},
+		{"viewer", false, database.VideoStatusReady},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			ownerID, ownerToken := createTestUser(t, cfg)
+			_, viewerToken := createTestUser(t, cfg)
+			video, key := uploadTestVideo(t, cfg, ownerID, ownerToken, formPart{name: "visibility", data: []byte("public")})
+			store.mu.Lock()
+			delete(store.objects, key)
+			store.mu.Unlock()
+
+			token := viewerToken
+			if tt.asOwner {
+				token = ownerToken
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, token, "?format=json"))
+
+			var res struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, w, &res)
+			if w.Code != http.StatusNotFound || res.Error != "Video content not found" {
+				t.Fatalf("status = %d, body %s, want 404 for the missing content", w.Code, w.Body)
+			}
+			if saved := getTestVideo(t, cfg, video.ID); saved.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", saved.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMarkVideoMissingIsConditional(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+
+	// The content moved since it was found missing.
+	cfg.markVideoMissing(context.Background(), video.ID, "landscape/elsewhere.mp4")
+	if saved := getTestVideo(t, cfg, video.ID); saved.Status != database.VideoStatusReady {
+		t.Errorf("status = %q after a stale key, want ready", saved.Status)
+	}
+
+	// Being processed, its content is about to change.
+	video.Status = database.VideoStatusProcessing
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+	cfg.markVideoMissing(context.Background(), video.ID, key)
+	if saved := getTestVideo(t, cfg, video.ID); saved.Status != database.VideoStatusProcessing {
+		t.Errorf("status = %q while processing, want processing", saved.Status)
+	}
+}
+
+func TestHandlerVideoPlayFlagged(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	ownerID, ownerToken := createTestUser(t, cfg)
+	_, viewerToken := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, ownerID, ownerToken, formPart{name: "visibility", data: []byte("public")})
+	video.Status = database.VideoStatusFlagged
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"owner", ownerToken, http.StatusFound},
+		{"viewer", viewerToken, http.StatusNotFound},
+		{"anonymous", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, query := range []string{"", "?variant=download"} {
+				w := httptest.NewRecorder()
+				cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, tt.token, query))
+				if w.Code != tt.wantStatus {
+					t.Errorf("%q: status = %d, want %d, body %s", query, w.Code, tt.wantStatus, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxPresignBatchSize = 100
+
+func (cfg *apiConfig) handlerVideosPresign(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoIDs []uuid.UUID `json:"video_ids"`
+		// IncludeHead adds a presigned HEAD URL for each video, so clients
+		// can check its size before downloading.
+		IncludeHead bool `json:"include_head"`
+	}
+	type presignedVideo struct {
+		VideoURL     string  `json:"video_url"`
+		VideoHeadURL *string `json:"video_head_url,omitempty"`
+		PreviewURL   *string `json:"preview_url"`
+		// StoryboardURL is where the video's WebVTT thumbnail track is
+		// served with its sprite presigned. It's this server's path, as a
+		// presigned track would point at an unsigned sprite, so private
+		// videos need the caller's token to fetch it.
+		StoryboardURL *string   `json:"storyboard_url,omitempty"`
+		ThumbnailURL  *string   `json:"thumbnail_url"`
+		ExpiresAt     time.Time `json:"expires_at"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if len(params.VideoIDs) > maxPresignBatchSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d videos can be presigned at once", maxPresignBatchSize), nil)
+		return
+	}
+
+	// Only the caller's own videos are presigned, so their domain applies
+	// to the whole batch.
+	domain, err := cfg.db.GetUserCustomDomain(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+		return
+	}
+
+	// IDs that don't exist, aren't owned by the caller or have no playable
+	// content are left out of the response instead of failing the batch.
+	res := map[uuid.UUID]presignedVideo{}
+	for _, videoID := range params.VideoIDs {
+		if _, ok := res[videoID]; ok {
+			continue
+		}
+
+		video, err := cfg.db.GetVideo(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.UserID != userID || video.VideoURL == nil || video.Status == database.VideoStatusRejected {
+			continue
+		}
+
+		key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+		if !ok {
+			continue
+		}
+
+		presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+			return
+		}
+
+		entry := presignedVideo{
+			VideoURL:     withCustomDomain(presigned.URL, domain),
+			ThumbnailURL: video.ThumbnailURL,
+			ExpiresAt:    presigned.ExpiresAt,
+		}
+		if params.IncludeHead {
+			head, err := cfg.presignHeadObject(key, cfg.presignExpiryFor(video))
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+				return
+			}
+			headURL := withCustomDomain(head.URL, domain)
+			entry.VideoHeadURL = &headURL
+			entry.ExpiresAt = earliest(entry.ExpiresAt, head.ExpiresAt)
+		}
+		if video.PreviewURL != nil {
+			if previewKey, ok := cfg.getVideoKeyFromURL(*video.PreviewURL); ok {
+				preview, err := cfg.presignObject(previewKey, cfg.presignExpiryFor(video), presignOptions{})
+				if err != nil {
+					respondWithError(w, http.StatusInternalServerError, "Couldn't presign preview", err)
+					return
+				}
+				previewURL := withCustomDomain(preview.URL, domain)
+				entry.PreviewURL = &previewURL
+				entry.ExpiresAt = earliest(entry.ExpiresAt, preview.ExpiresAt)
+			}
+		}
+		if cfg.storyboardKeys(video.StoryboardURL) != nil {
+			storyboardURL := storyboardPath(video.ID)
+			entry.StoryboardURL = &storyboardURL
+		}
+		res[videoID] = entry
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const defaultShareTTL = time.Hour
+
+// Values of SHARE_RESTRICTIONS.
+const (
+	shareRestrictionsOff      = "off"
+	shareRestrictionsOptional = "optional"
+	shareRestrictionsRequired = "required"
+)
+
+// restrictedShareRedirectTTL is how long the presigned URL a restricted
+// share link redirects to stays valid. It only has to last until the client
+// follows the redirect.
+const restrictedShareRedirectTTL = time.Minute
+
+// handlerVideoShare creates a presigned link meant to be handed out, unlike
+// the short-lived URLs clients get for playback. Every link created is
+// recorded for auditing.
+//
+// ?allowed_ip= (an address or CIDR range) and ?allowed_referrer= (a host or
+// origin) restrict who can follow the link. S3 can only enforce such
+// conditions through a bucket policy, not in a presigned URL, so a
+// restricted link is this server's /api/shares/{shareID} path instead,
+// which checks them on every request before redirecting to S3. The referrer
+// is taken from the Origin or Referer header, which only browsers can be
+// trusted to send truthfully: outside of one it's trivially spoofed, so it
+// keeps the link from being embedded elsewhere rather than secret.
+func (cfg *apiConfig) handlerVideoShare(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		URL        string    `json:"url"`
+		ExpiresAt  time.Time `json:"expires_at"`
+		TTLSeconds int64     `json:"ttl_seconds"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	ttl := defaultShareTTL
+	if ttlString := r.URL.Query().Get("ttl"); ttlString != "" {
+		ttl, err = time.ParseDuration(ttlString)
+		if err != nil || ttl <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid ttl", err)
+			return
+		}
+	}
+	if ttl > cfg.shareMaxTTL {
+		ttl = cfg.shareMaxTTL
+	}
+
+	allowedIP, allowedReferrer, err := parseShareRestrictions(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	restricted := allowedIP != "" || allowedReferrer != ""
+	if restricted && cfg.shareRestrictions == shareRestrictionsOff {
+		respondWithError(w, http.StatusBadRequest, "Share links can't be restricted on this server", nil)
+		return
+	}
+	if !restricted && cfg.shareRestrictions == shareRestrictionsRequired {
+		respondWithError(w, http.StatusBadRequest, "Share links must be restricted with allowed_ip or allowed_referrer", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't share this video", nil)
+		return
+	}
+	if video.VideoURL == nil || video.Status == database.VideoStatusRejected {
+		respondWithError(w, http.StatusConflict, "Video has no content to share", nil)
+		return
+	}
+	if video.Status == database.VideoStatusFlagged {
+		respondWithError(w, http.StatusConflict, "Video can't be shared until it's reviewed", nil)
+		return
+	}
+
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	domain, err := cfg.db.GetUserCustomDomain(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if restricted {
+		link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+			VideoID:         videoID,
+			UserID:          userID,
+			TTLSeconds:      int64(ttl.Seconds()),
+			AllowedIP:       allowedIP,
+			AllowedReferrer: allowedReferrer,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't record share link", err)
+			return
+		}
+		respondWithJSON(w, http.StatusCreated, response{
+			URL:        "/api/shares/" + link.ID.String(),
+			ExpiresAt:  expiresAt,
+			TTLSeconds: int64(ttl.Seconds()),
+		})
+		return
+	}
+
+	url, err := generatePresignedURL(cfg.store, cfg.s3Bucket, key, ttl, presignOptions{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return
+	}
+
+	_, err = cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:    videoID,
+		UserID:     userID,
+		TTLSeconds: int64(ttl.Seconds()),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record share link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		URL:        withCustomDomain(url, domain),
+		ExpiresAt:  expiresAt,
+		TTLSeconds: int64(ttl.Seconds()),
+	})
+}
+
+// parseShareRestrictions reads the allowed_ip and allowed_referrer query
+// parameters, returning the IP as a CIDR prefix and the referrer as a host.
+func parseShareRestrictions(r *http.Request) (allowedIP, allowedReferrer string, err error) {
+	if v := r.URL.Query().Get("allowed_ip"); v != "" {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(v)
+			if addrErr != nil {
+				return "", "", errors.New("allowed_ip must be an IP address or CIDR range")
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		allowedIP = prefix.Masked().String()
+	}
+	if v := r.URL.Query().Get("allowed_referrer"); v != "" {
+		hosts, err := parseAllowedReferrers(v)
+		if err != nil || len(hosts) != 1 {
+			return "", "", errors.New("allowed_referrer must be a single host or origin")
+		}
+		allowedReferrer = hosts[0]
+	}
+	return allowedIP, allowedReferrer, nil
+}
+
+// handlerShareFollow serves restricted share links. It checks the link
+// hasn't expired and the request comes from the allowed IP range and site,
+// then redirects to a presigned URL for the video that's only valid for
+// restrictedShareRedirectTTL. Following the link doesn't need a token.
+func (cfg *apiConfig) handlerShareFollow(w http.ResponseWriter, r *http.Request) {
+	shareID, err := uuid.Parse(r.PathValue("shareID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	link, err := cfg.db.GetShareLink(shareID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	// Unrestricted links were handed out as presigned URLs, they can't be
+	// followed here.
+	if link.ID == uuid.Nil || (link.AllowedIP == "" && link.AllowedReferrer == "") {
+		respondWithError(w, http.StatusNotFound, "Share link not found", nil)
+		return
+	}
+	remaining := time.Until(link.CreatedAt.Add(time.Duration(link.TTLSeconds) * time.Second))
+	if remaining <= 0 {
+		respondWithError(w, http.StatusGone, "Share link has expired", nil)
+		return
+	}
+
+	if link.AllowedIP != "" {
+		prefix, err := netip.ParsePrefix(link.AllowedIP)
+		ip, ok := clientIP(r, cfg.trustedProxies)
+		if err != nil || !ok || !prefix.Contains(ip) {
+			respondWithError(w, http.StatusForbidden, "This link can't be used from your network", nil)
+			return
+		}
+	}
+	if link.AllowedReferrer != "" {
+		host, ok := referrerHost(r)
+		if !ok || host != link.AllowedReferrer {
+			respondWithError(w, http.StatusForbidden, "This link can't be used from this site", nil)
+			return
+		}
+	}
+
+	video, err := cfg.db.GetVideo(link.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Links made before the video was flagged stop working until it's
+	// reviewed.
+	if video.ID == uuid.Nil || video.VideoURL == nil || video.Status == database.VideoStatusRejected || video.Status == database.VideoStatusFlagged {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video object", nil)
+		return
+	}
+
+	domain, err := cfg.db.GetUserCustomDomain(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+		return
+	}
+
+	url, err := generatePresignedURL(cfg.store, cfg.s3Bucket, key, min(remaining, restrictedShareRedirectTTL), presignOptions{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, withCustomDomain(url, domain), http.StatusFound)
+}
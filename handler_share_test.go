@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newShareFollowRequest(shareID uuid.UUID, remoteAddr string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/api/shares/"+shareID.String(), nil)
+	r.SetPathValue("shareID", shareID.String())
+	r.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestHandlerShareFollow(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	cfg.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+
+	createLink := func(allowedIP, allowedReferrer string) uuid.UUID {
+		link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+			VideoID:         video.ID,
+			UserID:          userID,
+			TTLSeconds:      3600,
+			AllowedIP:       allowedIP,
+			AllowedReferrer: allowedReferrer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link.ID
+	}
+	ipLink := createLink("203.0.113.0/24", "")
+	referrerLink := createLink("", "example.com")
+	unrestricted := createLink("", "")
+
+	tests := []struct {
+		name       string
+		link       uuid.UUID
+		remoteAddr string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"IP in range", ipLink, "203.0.113.7:1234", nil, http.StatusFound},
+		{"IP out of range", ipLink, "198.51.100.7:1234", nil, http.StatusForbidden},
+		{"IP in range through a trusted proxy", ipLink, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, http.StatusFound},
+		{"forwarded IP from an untrusted peer", ipLink, "198.51.100.7:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, http.StatusForbidden},
+		{"allowed Referer", referrerLink, "198.51.100.7:1234", map[string]string{"Referer": "https://example.com/page"}, http.StatusFound},
+		{"allowed Origin", referrerLink, "198.51.100.7:1234", map[string]string{"Origin": "https://EXAMPLE.com"}, http.StatusFound},
+		{"other site", referrerLink, "198.51.100.7:1234", map[string]string{"Referer": "https://elsewhere.test/"}, http.StatusForbidden},
+		{"no referrer", referrerLink, "198.51.100.7:1234", nil, http.StatusForbidden},
+		{"unrestricted link", unrestricted, "203.0.113.7:1234", nil, http.StatusNotFound},
+		{"unknown link", uuid.New(), "203.0.113.7:1234", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cfg.handlerShareFollow(w, newShareFollowRequest(tt.link, tt.remoteAddr, tt.headers))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusFound {
+				return
+			}
+			location := w.Header().Get("Location")
+			if !strings.Contains(location, "/"+key+"?") || !strings.Contains(location, "X-Amz-Expires=60") {
+				t.Errorf("Location = %q, want a one minute presigned URL for %q", location, key)
+			}
+		})
+	}
+}
+
+func TestHandlerShareFollowExpired(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, userID, token)
+	link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:    video.ID,
+		UserID:     userID,
+		TTLSeconds: -1,
+		AllowedIP:  "203.0.113.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerShareFollow(w, newShareFollowRequest(link.ID, "203.0.113.7:1234", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("status = %d, want 410", w.Code)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// thumbnailCandidatePrefix is the S3 prefix candidate frames are stored
+	// under until they're picked or expire.
+	thumbnailCandidatePrefix = "tmp/thumbnail-candidates/"
+
+	defaultThumbnailCandidates = 4
+	maxThumbnailCandidates     = 10
+)
+
+type thumbnailCandidate struct {
+	ID        uuid.UUID `json:"id"`
+	URL       string    `json:"url"`
+	Timestamp float64   `json:"timestamp"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handlerThumbnailCandidatesCreate extracts ?count= frames spread evenly over
+// a video, stores them in S3 and returns presigned URLs to them, so the owner
+// can pick one as the thumbnail with handlerThumbnailCandidateSelect. Earlier
+// candidates of the video are discarded, and unpicked ones expire after
+// THUMBNAIL_CANDIDATE_TTL.
+func (cfg *apiConfig) handlerThumbnailCandidatesCreate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Candidates []thumbnailCandidate `json:"candidates"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	count := defaultThumbnailCandidates
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxThumbnailCandidates {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", maxThumbnailCandidates), err)
+			return
+		}
+		count = n
+	}
+
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no content", nil)
+		return
+	}
+	if video.Duration <= 0 {
+		respondWithError(w, http.StatusConflict, "Video duration is unknown", nil)
+		return
+	}
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resolve video location", nil)
+		return
+	}
+
+	unlock := cfg.idempotencyLocks.lock("thumbnail-candidates:" + video.ID.String())
+	defer unlock()
+
+	cfg.discardThumbnailCandidates(r.Context(), video.ID, time.Now())
+
+	// ffmpeg reads the video straight from S3, seeking to each timestamp
+	// with range requests.
+	source, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+		return
+	}
+
+	duration := time.Duration(video.Duration * float64(time.Second))
+	res := response{Candidates: []thumbnailCandidate{}}
+	for i := 1; i <= count; i++ {
+		at := duration * time.Duration(i) / time.Duration(count+1)
+		candidate, err := cfg.createThumbnailCandidate(r.Context(), video, source.URL, at)
+		if err != nil {
+			cfg.discardThumbnailCandidates(r.Context(), video.ID, time.Now())
+			respondWithUploadError(w, err)
+			return
+		}
+		res.Candidates = append(res.Candidates, candidate)
+	}
+
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+// createThumbnailCandidate extracts the frame at a timestamp of the video at
+// source and stores it as a candidate. Errors are *uploadError values.
+func (cfg *apiConfig) createThumbnailCandidate(ctx context.Context, video database.Video, source string, at time.Duration) (thumbnailCandidate, error) {
+	frame, err := extractFrameAt(ctx, cfg.commands, source, at)
+	if err != nil {
+		return thumbnailCandidate{}, &uploadError{http.StatusInternalServerError, "Couldn't extract thumbnail candidate", err}
+	}
+
+	id := uuid.New()
+	key := fmt.Sprintf("%s%v/%v.jpg", thumbnailCandidatePrefix, video.ID, id)
+	contentType := "image/jpeg"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &cfg.s3Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(frame),
+		ContentType: &contentType,
+	})
+	if err != nil {
+		return thumbnailCandidate{}, &uploadError{http.StatusInternalServerError, "Couldn't store thumbnail candidate", err}
+	}
+
+	createdAt := time.Now()
+	err = cfg.db.CreateThumbnailCandidate(database.ThumbnailCandidate{
+		ID:        id,
+		VideoID:   video.ID,
+		S3Key:     key,
+		Timestamp: at.Seconds(),
+		CreatedAt: createdAt,
+	})
+	if err != nil {
+		cfg.deleteObject(ctx, key)
+		return thumbnailCandidate{}, &uploadError{http.StatusInternalServerError, "Couldn't save thumbnail candidate", err}
+	}
+
+	presigned, err := cfg.presignObject(key, cfg.thumbnailCandidateTTL, presignOptions{})
+	if err != nil {
+		return thumbnailCandidate{}, &uploadError{http.StatusInternalServerError, "Couldn't presign thumbnail candidate", err}
+	}
+
+	return thumbnailCandidate{
+		ID:        id,
+		URL:       presigned.URL,
+		Timestamp: at.Seconds(),
+		ExpiresAt: createdAt.Add(cfg.thumbnailCandidateTTL),
+	}, nil
+}
+
+// handlerThumbnailCandidateSelect makes one of the video's candidates its
+// thumbnail and discards the rest.
+func (cfg *apiConfig) handlerThumbnailCandidateSelect(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CandidateID uuid.UUID `json:"candidate_id"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	candidate, err := cfg.db.GetThumbnailCandidate(params.CandidateID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidate", err)
+		return
+	}
+	if candidate.ID == uuid.Nil || candidate.VideoID != video.ID || time.Since(candidate.CreatedAt) > cfg.thumbnailCandidateTTL {
+		respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", nil)
+		return
+	}
+
+	obj, err := cfg.store.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &candidate.S3Key,
+	})
+	if isMissingObject(err) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch thumbnail candidate", err)
+		return
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj.Body, cfg.maxImageUploadSize))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch thumbnail candidate", err)
+		return
+	}
+
+	// Same as a thumbnail upload, the old file is only removed once the
+	// video points at the new one.
+	previousURL := video.ThumbnailURL
+
+	video, err = cfg.storeThumbnail(video, data, "image/jpg", nil)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		cfg.removeAsset(r.Context(), *video.ThumbnailURL)
+		respondWithError(w, http.StatusInternalServerError, "Error when updating thumbnail", err)
+		return
+	}
+
+	if previousURL != nil && *previousURL != *video.ThumbnailURL {
+		cfg.removeAsset(r.Context(), *previousURL)
+	}
+
+	cfg.discardThumbnailCandidates(r.Context(), video.ID, time.Now())
+
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoThumbnail)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// discardThumbnailCandidates deletes the candidates of videoID, or of every
+// video when videoID is uuid.Nil, created before createdBefore. Failures are
+// only logged, a candidate whose object couldn't be deleted is kept so a
+// later sweep tries again.
+func (cfg *apiConfig) discardThumbnailCandidates(ctx context.Context, videoID uuid.UUID, createdBefore time.Time) {
+	candidates, err := cfg.db.GetThumbnailCandidates(videoID, createdBefore)
+	if err != nil {
+		logf(ctx, "Couldn't list thumbnail candidates: %v", err)
+		return
+	}
+
+	for _, candidate := range candidates {
+		if !cfg.deleteObject(ctx, candidate.S3Key) {
+			continue
+		}
+		err = cfg.db.DeleteThumbnailCandidate(candidate.ID)
+		if err != nil {
+			logf(ctx, "Couldn't delete thumbnail candidate %v: %v", candidate.ID, err)
+		}
+	}
+}
+
+// sweepThumbnailCandidates discards expired candidates until ctx is done.
+func (cfg *apiConfig) sweepThumbnailCandidates(ctx context.Context) {
+	ticker := time.NewTicker(cfg.thumbnailCandidateTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cfg.discardThumbnailCandidates(ctx, uuid.Nil, time.Now().Add(-cfg.thumbnailCandidateTTL))
+		}
+	}
+}
+
+// deleteObject removes key from the bucket, logging failures. It reports
+// whether the object is gone.
+func (cfg *apiConfig) deleteObject(ctx context.Context, key string) bool {
+	_, err := cfg.store.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		logf(ctx, "Couldn't delete object %v: %v", key, err)
+		return false
+	}
+	return true
+}
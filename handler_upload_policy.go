@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// directUploadPrefix is the S3 prefix browsers POST videos under. Objects
+// that never get finalized stay there, so the bucket should expire it with a
+// lifecycle rule.
+const directUploadPrefix = "direct-uploads/"
+
+// getDirectUploadPrefix is the prefix an upload policy for a video lets the
+// browser write under.
+func getDirectUploadPrefix(userID, videoID uuid.UUID) string {
+	return fmt.Sprintf("%s%v/%v/", directUploadPrefix, userID, videoID)
+}
+
+// handlerUploadPolicyCreate returns a signed S3 POST policy letting the
+// browser upload a video straight to the bucket, skipping the server for the
+// transfer. The policy only allows keys under the video's direct upload
+// prefix, a video/ Content-Type and sizes up to the usual upload limit. Once
+// the POST went through, the client calls handlerUploadPolicyFinalize with
+// the key.
+func (cfg *apiConfig) handlerUploadPolicyCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+	type response struct {
+		URL       string            `json:"url"`
+		Fields    map[string]string `json:"fields"`
+		Key       string            `json:"key"`
+		MaxSize   int64             `json:"max_size"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.requireActiveUser(w, video.UserID) {
+		return
+	}
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	mediaType, err := videoTypes.validate(params.ContentType, "")
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	prefix := getDirectUploadPrefix(video.UserID, video.ID)
+	key := prefix + getAssetPath(mediaTypeToExt(mediaType))
+	expiresAt := time.Now().Add(cfg.presignExpiry)
+
+	presigned, err := cfg.store.PresignPostObject(r.Context(), &s3.PutObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}, cfg.presignExpiry, []any{
+		[]any{"starts-with", "$key", prefix},
+		[]any{"starts-with", "$Content-Type", "video/"},
+		[]any{"content-length-range", 1, cfg.maxVideoUploadSize},
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload policy", err)
+		return
+	}
+	presigned.Values["Content-Type"] = mediaType
+
+	respondWithJSON(w, http.StatusOK, response{
+		URL:       presigned.URL,
+		Fields:    presigned.Values,
+		Key:       key,
+		MaxSize:   cfg.maxVideoUploadSize,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handlerUploadPolicyFinalize records a video the browser POSTed with a
+// policy from handlerUploadPolicyCreate. The object is checked against the
+// same limits as a regular upload; with processing disabled it is published
+// where it is, otherwise it's fetched and goes through the usual pipeline and
+// the uploaded object is removed. The transfer to S3 may well outlast the
+// access token; the uploaded object stays put when finalizing fails on an
+// expired token, so the client refreshes and finalizes again. An optional
+// visibility is set on the video like a regular upload's field.
+func (cfg *apiConfig) handlerUploadPolicyFinalize(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key        string `json:"key"`
+		Visibility string `json:"visibility"`
+	}
+
+	video, unlock, ok := cfg.beginVideoUpload(w, r, true)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	prefix := getDirectUploadPrefix(video.UserID, video.ID)
+	if !strings.HasPrefix(params.Key, prefix) || len(params.Key) == len(prefix) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("key must be within %q", prefix), nil)
+		return
+	}
+
+	visibility := video.Visibility
+	if params.Visibility != "" {
+		visibility, err = parseVisibility(params.Visibility)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+	defer cfg.auditUploadVisibility(r, video.ID, video.Visibility, visibility)
+	video.Visibility = visibility
+
+	info, err := cfg.store.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &params.Key,
+	})
+	if isMissingObject(err) {
+		respondWithError(w, http.StatusNotFound, "Upload not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get upload details", err)
+		return
+	}
+
+	// Whatever doesn't pass is deleted right away, it's of no use to anyone.
+	reject := func(err error) {
+		cfg.deleteObject(r.Context(), params.Key)
+		respondWithUploadError(w, err)
+	}
+
+	var size int64
+	if info.ContentLength != nil {
+		size = *info.ContentLength
+	}
+	if size == 0 {
+		reject(&uploadError{http.StatusBadRequest, "Video file is empty", nil})
+		return
+	}
+	if size > cfg.maxVideoUploadSize {
+		reject(&uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Video must be at most %d bytes", cfg.maxVideoUploadSize), nil})
+		return
+	}
+
+	var contentType string
+	if info.ContentType != nil {
+		contentType = *info.ContentType
+	}
+	mediaType, err := videoTypes.validate(contentType, "")
+	if err != nil {
+		reject(err)
+		return
+	}
+
+	if cfg.skipVideoProcessing {
+		video.Size = size
+		video.AspectRatio = "other"
+
+		video, err = cfg.checkStoredDuration(r.Context(), video, params.Key)
+		if err != nil {
+			reject(err)
+			return
+		}
+
+		video, err = cfg.publishVideo(r.Context(), video, params.Key, mediaType)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+
+		cfg.recordIdempotencyKey(r, video, http.StatusOK)
+		cfg.recordAudit(r, video.UserID, video.ID, auditVideoUpload)
+		respondWithJSON(w, http.StatusOK, video)
+		return
+	}
+
+	tmpPath, err := cfg.downloadDirectUpload(r, params.Key, mediaType)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
+
+	head, err := readFileHead(tmpPath, sniffLength)
+	if err == nil {
+		mediaType, err = videoTypes.validate(mediaType, sniffMediaType(head))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		reject(err)
+		return
+	}
+
+	// The temp file holds the upload from here on, and a failed upload is
+	// retained from it like any other.
+	cfg.deleteObject(r.Context(), params.Key)
+
+	cfg.finishVideoUpload(w, r, video, tmpPath, mediaType, "", nil)
+}
+
+// downloadDirectUpload copies the object at key, a video of mediaType, to a
+// temp file with the matching extension, returning its path. Errors are
+// *uploadError values.
+func (cfg *apiConfig) downloadDirectUpload(r *http.Request, key, mediaType string) (string, error) {
+	obj, err := cfg.store.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if isMissingObject(err) {
+		return "", &uploadError{http.StatusNotFound, "Upload not found", err}
+	}
+	if err != nil {
+		return "", &uploadError{http.StatusBadGateway, "Couldn't fetch upload", err}
+	}
+	defer obj.Body.Close()
+
+	tmpFile, err := os.CreateTemp("", "tubely-upload-*"+mediaTypeToExt(mediaType))
+	if err != nil {
+		return "", &uploadError{http.StatusInternalServerError, "Error when creating temp file", err}
+	}
+	defer tmpFile.Close()
+
+	_, err = io.Copy(tmpFile, io.LimitReader(obj.Body, cfg.maxVideoUploadSize))
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", &uploadError{http.StatusBadGateway, "Couldn't fetch upload", err}
+	}
+
+	return tmpFile.Name(), nil
+}
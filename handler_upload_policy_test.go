@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestUploadExpiredToken(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	expired, err := auth.MakeJWT(userID, cfg.jwtSecret, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The browser has sent the video to S3 with its policy, the token
+	// expired in the meantime.
+	key := getDirectUploadPrefix(userID, video.ID) + "video.mp4"
+	store.putObject(key, mp4Fixture, time.Now())
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload_policy/finalize", strings.NewReader(`{"key":"`+key+`"}`))
+	r.Header.Set("Authorization", "Bearer "+expired)
+	r.SetPathValue("videoID", video.ID.String())
+	w := httptest.NewRecorder()
+	cfg.handlerUploadPolicyFinalize(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("finalize status = %d, want 401", w.Code)
+	}
+	var finalized struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, w, &finalized)
+	if !strings.Contains(finalized.Error, "mid-upload") {
+		t.Errorf("finalize error = %q, want the mid-upload message", finalized.Error)
+	}
+	if _, ok := store.object(key); !ok {
+		t.Error("uploaded object was deleted, the client can't finalize again")
+	}
+
+	// Nothing was received yet when an upload starts with an expired token.
+	w = httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, expired, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("upload status = %d, want 401", w.Code)
+	}
+	var started struct {
+		Error string `json:"error"`
+	}
+	decodeResponse(t, w, &started)
+	if strings.Contains(started.Error, "mid-upload") {
+		t.Errorf("upload error = %q, want the generic one", started.Error)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
 	"io"
-	"mime"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -25,17 +31,32 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	if !cfg.requireActiveUser(w, userID) {
+		return
+	}
+
+	logf(r.Context(), "uploading thumbnail for video %v by user %v", videoID, userID)
 
 	const maxMemory = 10 << 20
 
-	r.ParseMultipartForm(maxMemory)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxImageUploadSize+maxMultipartOverhead)
+	err = r.ParseMultipartForm(maxMemory)
+	defer removeMultipartForm(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Thumbnail must be at most %d bytes", cfg.maxImageUploadSize), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse multipart form", err)
+		return
+	}
 
 	thumbFile, header, err := r.FormFile("thumbnail")
 	if err != nil {
@@ -43,17 +64,15 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	defer thumbFile.Close()
-	defer r.MultipartForm.RemoveAll()
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
-
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+	if header.Size > cfg.maxImageUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Thumbnail must be at most %d bytes", cfg.maxImageUploadSize), nil)
 		return
 	}
 
-	if mediaType != "image/jpg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+	crop, err := parseThumbnailCrop(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
@@ -69,34 +88,193 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	assetPath := getAssetPath(mediaTypeToExt(mediaType))
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
+	data, err := io.ReadAll(thumbFile)
 
-	file, err := os.Create(assetDiskPath)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to read thumbnail", err)
+		return
+	}
+
+	mediaType, err := thumbnailTypes.validate(header.Header.Get("Content-Type"), sniffMediaType(data))
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when storing thumbnail", err)
+		respondWithUploadError(w, err)
 		return
 	}
 
-	defer file.Close()
+	// Clients retrying an upload send the same file again, there's nothing
+	// to rewrite then.
+	if video.ThumbnailURL != nil && video.ThumbnailHash == thumbnailHash(data, crop) {
+		respondWithJSON(w, http.StatusOK, video)
+		return
+	}
+
+	// The new thumbnail always gets a fresh file, and the old one is only
+	// removed once nothing references it, so a failure at any step leaves the
+	// video with a working thumbnail.
+	previousURL := video.ThumbnailURL
 
-	_, err = io.Copy(file, thumbFile)
+	video, err = cfg.storeThumbnail(video, data, mediaType, crop)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when storing thumbnail", err)
+		respondWithUploadError(w, err)
 		return
 	}
 
-	url := cfg.getAssetURL(assetPath)
-	video.ThumbnailURL = &url
-
-	err = cfg.db.UpdateVideo(video)
+	err = cfg.saveVideo(&video)
 
 	if err != nil {
+		cfg.removeAsset(r.Context(), *video.ThumbnailURL)
 		respondWithError(w, http.StatusInternalServerError, "Error when updating thumbnail", err)
 		return
 	}
 
+	if previousURL != nil && *previousURL != *video.ThumbnailURL {
+		cfg.removeAsset(r.Context(), *previousURL)
+	}
+
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoThumbnail)
 	respondWithJSON(w, 200, video)
 }
+
+// parseThumbnailCrop reads the optional x, y, width and height form fields
+// of a thumbnail upload, the rectangle to crop the image to in its pixels as
+// displayed. It returns nil when none of them are given.
+func parseThumbnailCrop(r *http.Request) (*image.Rectangle, error) {
+	fields := []string{"x", "y", "width", "height"}
+	values := make([]int, len(fields))
+	given := 0
+	for i, field := range fields {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer", field)
+		}
+		values[i] = n
+		given++
+	}
+
+	switch {
+	case given == 0:
+		return nil, nil
+	case given < len(fields):
+		return nil, errors.New("x, y, width and height must be given together")
+	case values[0] < 0 || values[1] < 0:
+		return nil, errors.New("x and y can't be negative")
+	case values[2] <= 0 || values[3] <= 0:
+		return nil, errors.New("width and height must be positive")
+	}
+	rect := image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+	return &rect, nil
+}
+
+// storeThumbnail writes an uploaded or generated thumbnail to the assets
+// directory, applying the configured orientation and aspect ratio handling,
+// and points video at it. A crop rectangle, when given, is applied once the
+// image is upright and before its aspect ratio is fitted. The caller
+// persists the video. Errors are *uploadError values.
+func (cfg *apiConfig) storeThumbnail(video database.Video, data []byte, mediaType string, crop *image.Rectangle) (database.Video, error) {
+	if cfg.assetsMaxBytes > 0 {
+		usage, err := cfg.assetsDirSize()
+
+		if err != nil {
+			return video, &uploadError{http.StatusInternalServerError, "Error when checking storage usage", err}
+		}
+
+		if usage+int64(len(data)) > cfg.assetsMaxBytes {
+			return video, &uploadError{http.StatusInsufficientStorage, "Not enough storage left for thumbnail", nil}
+		}
+	}
+
+	orientation := 1
+	if cfg.autoOrient && mediaType != "image/png" {
+		orientation = jpegOrientation(data)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return video, &uploadError{http.StatusBadRequest, "Unable to decode thumbnail", err}
+	}
+
+	// Re-encoding drops the EXIF data, so the image is turned upright
+	// first. A crop is in the pixels of the upright image as well.
+	img = orientImage(img, orientation)
+
+	if crop != nil {
+		bounds := img.Bounds()
+		if !crop.Add(bounds.Min).In(bounds) {
+			return video, &uploadError{http.StatusBadRequest, fmt.Sprintf("Crop rectangle must lie within the %dx%d image", bounds.Dx(), bounds.Dy()), nil}
+		}
+		img = cropImage(img, crop.Add(bounds.Min))
+	}
+
+	assetPath := getAssetPath(mediaTypeToExt(mediaType))
+	assetDiskPath := cfg.getAssetDiskPath(assetPath)
+
+	file, err := os.Create(assetDiskPath)
+
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when storing thumbnail", err}
+	}
+
+	defer file.Close()
+
+	stored := false
+	defer func() {
+		if !stored {
+			os.Remove(assetDiskPath)
+		}
+	}()
+
+	if cfg.thumbnailAspectRatio == "" && orientation == 1 && crop == nil {
+		_, err = file.Write(data)
+
+		if err != nil {
+			return video, &uploadError{http.StatusInternalServerError, "Error when storing thumbnail", err}
+		}
+	} else {
+		if cfg.thumbnailAspectRatio != "" {
+			ratioW, ratioH, _ := parseAspectRatio(cfg.thumbnailAspectRatio)
+			img = fitImageToAspectRatio(img, ratioW, ratioH, cfg.thumbnailFit == thumbnailFitPad)
+		}
+
+		err = encodeImage(file, img, mediaType)
+
+		if err != nil {
+			return video, &uploadError{http.StatusInternalServerError, "Error when storing thumbnail", err}
+		}
+	}
+
+	video.ThumbnailWidth = img.Bounds().Dx()
+	video.ThumbnailHeight = img.Bounds().Dy()
+
+	// Built from the image just decoded so it isn't read a second time.
+	video.ThumbnailPlaceholder, err = encodePlaceholder(img)
+
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when generating thumbnail placeholder", err}
+	}
+
+	url := cfg.getAssetURL(assetPath)
+	video.ThumbnailURL = &url
+	video.ThumbnailHash = thumbnailHash(data, crop)
+	stored = true
+
+	return video, nil
+}
+
+// thumbnailHash identifies a thumbnail by its content as uploaded and the
+// crop applied to it, so a repeated upload of the same file can be
+// recognized.
+func thumbnailHash(data []byte, crop *image.Rectangle) string {
+	hash := sha256.New()
+	hash.Write(data)
+	if crop != nil {
+		fmt.Fprintf(hash, "\x00%v", *crop)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// pngFixture encodes a blank image of the given size as a PNG.
+func pngFixture(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseThumbnailCrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		want    *image.Rectangle
+		wantErr bool
+	}{
+		{"no crop", url.Values{}, nil, false},
+		{"crop", url.Values{"x": {"10"}, "y": {"5"}, "width": {"40"}, "height": {"20"}}, &image.Rectangle{Min: image.Pt(10, 5), Max: image.Pt(50, 25)}, false},
+		{"missing field", url.Values{"x": {"10"}, "y": {"5"}, "width": {"40"}}, nil, true},
+		{"not a number", url.Values{"x": {"ten"}, "y": {"5"}, "width": {"40"}, "height": {"20"}}, nil, true},
+		{"negative origin", url.Values{"x": {"-1"}, "y": {"5"}, "width": {"40"}, "height": {"20"}}, nil, true},
+		{"empty rectangle", url.Values{"x": {"10"}, "y": {"5"}, "width": {"0"}, "height": {"20"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			got, err := parseThumbnailCrop(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("crop = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreThumbnailCrop(t *testing.T) {
+	data := pngFixture(t, 100, 50)
+
+	tests := []struct {
+		name       string
+		crop       *image.Rectangle
+		wantWidth  int
+		wantHeight int
+		wantErr    bool
+	}{
+		{"no crop", nil, 100, 50, false},
+		{"within the image", &image.Rectangle{Min: image.Pt(10, 5), Max: image.Pt(50, 25)}, 40, 20, false},
+		{"whole image", &image.Rectangle{Max: image.Pt(100, 50)}, 100, 50, false},
+		{"out of bounds", &image.Rectangle{Min: image.Pt(80, 0), Max: image.Pt(120, 20)}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			userID, _ := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			video, err := cfg.storeThumbnail(video, data, "image/png", tt.crop)
+			if tt.wantErr {
+				var uploadErr *uploadError
+				if !errors.As(err, &uploadErr) || uploadErr.code != http.StatusBadRequest {
+					t.Fatalf("err = %v, want a 400", err)
+				}
+				entries, _ := os.ReadDir(cfg.assetsRoot)
+				for _, entry := range entries {
+					t.Errorf("asset %s was left behind", entry.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("storeThumbnail: %v", err)
+			}
+			if video.ThumbnailWidth != tt.wantWidth || video.ThumbnailHeight != tt.wantHeight {
+				t.Errorf("thumbnail is %dx%d, want %dx%d", video.ThumbnailWidth, video.ThumbnailHeight, tt.wantWidth, tt.wantHeight)
+			}
+			entries, err := os.ReadDir(cfg.assetsRoot)
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("assets = %v, %v, want the thumbnail", entries, err)
+			}
+			stored, err := os.ReadFile(cfg.getAssetDiskPath(entries[0].Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(stored))
+			if err != nil {
+				t.Fatalf("stored thumbnail doesn't decode: %v", err)
+			}
+			if img.Bounds().Dx() != tt.wantWidth || img.Bounds().Dy() != tt.wantHeight {
+				t.Errorf("stored image is %v, want %dx%d", img.Bounds(), tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadThumbnailSkipsIdenticalUpload(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	upload := func(data []byte) database.Video {
+		t.Helper()
+		thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: data}
+		r := newMultipartRequest(t, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, thumbnail)
+		r.SetPathValue("videoID", video.ID.String())
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+		}
+		return getTestVideo(t, cfg, video.ID)
+	}
+	assetFiles := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(cfg.assetsRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	data := pngFixture(t, 64, 36)
+	first := upload(data)
+	second := upload(data)
+	if files := assetFiles(); files != 1 {
+		t.Errorf("%d thumbnail files after a repeated upload, want 1", files)
+	}
+	if *second.ThumbnailURL != *first.ThumbnailURL || !second.UpdatedAt.Equal(first.UpdatedAt) {
+		t.Errorf("repeated upload changed the video: %v at %v, was %v at %v",
+			*second.ThumbnailURL, second.UpdatedAt, *first.ThumbnailURL, first.UpdatedAt)
+	}
+
+	third := upload(pngFixture(t, 32, 18))
+	if *third.ThumbnailURL == *first.ThumbnailURL {
+		t.Error("a different thumbnail kept the old URL")
+	}
+	if files := assetFiles(); files != 1 {
+		t.Errorf("%d thumbnail files after replacing it, want 1", files)
+	}
+}
+
+func TestHandlerUploadThumbnailReplace(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: data}
+		r := newMultipartRequest(t, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, thumbnail)
+		r.SetPathValue("videoID", video.ID.String())
+		w := httptest.NewRecorder()
+		cfg.handlerUploadThumbnail(w, r)
+		return w
+	}
+	currentAsset := func() string {
+		t.Helper()
+		saved := getTestVideo(t, cfg, video.ID)
+		if saved.ThumbnailURL == nil {
+			t.Fatal("video has no thumbnail")
+		}
+		assetPath, ok := cfg.getAssetPathFromURL(*saved.ThumbnailURL)
+		if !ok {
+			t.Fatalf("thumbnail %q isn't an asset", *saved.ThumbnailURL)
+		}
+		return assetPath
+	}
+
+	if w := upload(pngFixture(t, 64, 36)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	oldAsset := currentAsset()
+
+	// A replacement that can't be stored leaves the old thumbnail in place.
+	if w := upload([]byte("\x89PNG\r\n\x1a\nnot really a png")); w.Code != http.StatusBadRequest {
+		t.Fatalf("broken replacement status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	if asset := currentAsset(); asset != oldAsset {
+		t.Errorf("thumbnail after a broken replacement = %q, want %q", asset, oldAsset)
+	}
+	if assets := assetFiles(t, cfg); !slices.Equal(assets, []string{oldAsset}) {
+		t.Errorf("assets after a broken replacement = %q, want only %q", assets, oldAsset)
+	}
+
+	// A stored one gets a file of its own, and the old one is removed.
+	if w := upload(pngFixture(t, 32, 18)); w.Code != http.StatusOK {
+		t.Fatalf("replacement status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	newAsset := currentAsset()
+	if newAsset == oldAsset {
+		t.Fatalf("replacement reused the asset %q", oldAsset)
+	}
+	if assets := assetFiles(t, cfg); !slices.Equal(assets, []string{newAsset}) {
+		t.Errorf("assets after the replacement = %q, want only %q", assets, newAsset)
+	}
+}
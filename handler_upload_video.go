@@ -1,204 +1,1259 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
+	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
-func getVideoAspectRatio(filepath string) (string, error) {
-	command := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filepath)
-	var buffer bytes.Buffer
-	var meta VideoMeta
-	command.Stdout = &buffer
-	err := command.Run()
+// maxMultipartOverhead is the room a multipart body gets beyond the files it
+// carries, for boundaries, part headers and small fields such as key.
+const maxMultipartOverhead = 1 << 20
 
+func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+	video, unlock, ok := cfg.beginVideoUpload(w, r, false)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if cfg.uploadPassthrough && cfg.skipVideoProcessing {
+		cfg.uploadVideoPassthrough(w, r, video)
+		return
+	}
+
+	cfg.receiveVideoForm(w, r, video, cfg.finishVideoUpload)
+}
+
+// receiveVideoForm reads the multipart video upload of r into a temp file,
+// along with an optional thumbnail, custom key and visibility, and hands it
+// to finish, which takes ownership of the temp file. The visibility is set on
+// the video finish saves; without one the video keeps its own.
+func (cfg *apiConfig) receiveVideoForm(w http.ResponseWriter, r *http.Request, video database.Video, finish func(w http.ResponseWriter, r *http.Request, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload)) {
+	// The form may carry a thumbnail along with the video.
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadSize+cfg.maxImageUploadSize+maxMultipartOverhead)
+	err := r.ParseMultipartForm(cfg.maxVideoUploadSize)
+	defer removeMultipartForm(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video must be at most %d bytes", cfg.maxVideoUploadSize), err)
+		return
+	}
 	if err != nil {
-		return "", err
+		respondWithError(w, http.StatusBadRequest, "Unable to parse multipart form", err)
+		return
 	}
 
-	err = json.Unmarshal(buffer.Bytes(), &meta)
+	uploadedVideo, header, err := r.FormFile("video")
+	if errors.Is(err, http.ErrMissingFile) {
+		respondWithError(w, http.StatusBadRequest, "No video field in request", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		return
+	}
+
+	defer uploadedVideo.Close()
+
+	if header.Size == 0 {
+		respondWithError(w, http.StatusBadRequest, "Video file is empty", nil)
+		return
+	}
+	if header.Size > cfg.maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video must be at most %d bytes", cfg.maxVideoUploadSize), nil)
+		return
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := uploadedVideo.ReadAt(head, 0)
+
+	if err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Unable to read video", err)
+		return
+	}
+
+	mediaType, err := videoTypes.validate(header.Header.Get("Content-Type"), sniffMediaType(head[:n]))
 
 	if err != nil {
-		return "", err
+		respondWithUploadError(w, err)
+		return
 	}
 
-	for _, streamInfo := range meta.Streams {
-		if streamInfo.CodecType != "video" {
-			continue
+	video.OriginalFilename = header.Filename
+
+	customKey := r.FormValue("key")
+	if customKey != "" {
+		err = cfg.validateCustomVideoKey(video.UserID, customKey)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid key: %v", err), err)
+			return
 		}
+	}
 
-		if streamInfo.DisplayAspectRatio == "16:9" || streamInfo.DisplayAspectRatio == "9:16" {
-			return streamInfo.DisplayAspectRatio, nil
+	visibility := video.Visibility
+	if value := r.FormValue("visibility"); value != "" {
+		visibility, err = parseVisibility(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
 		}
 	}
+	defer cfg.auditUploadVisibility(r, video.ID, video.Visibility, visibility)
+	video.Visibility = visibility
 
-	return "other", nil
-}
+	thumbnail, err := readThumbnailFormFile(r, cfg.maxImageUploadSize)
 
-func processVideoForFastStart(filepath string) (string, error) {
-	output := filepath + ".processing"
-	command := exec.Command("ffmpeg", "-i", filepath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", output)
+	if err != nil {
+		respondWithUploadError(w, err)
+		return
+	}
 
-	err := command.Run()
+	tmpFile, err := os.CreateTemp("", "tubely-upload-*"+mediaTypeToExt(mediaType))
 
 	if err != nil {
-		return "", err
+		respondWithError(w, http.StatusInternalServerError, "Error when creating temp file", err)
+		return
 	}
 
-	fileInfo, err := os.Stat(output)
+	written, err := io.Copy(tmpFile, uploadedVideo)
+	tmpFile.Close()
+
 	if err != nil {
-		return "", fmt.Errorf("could not stat processed file: %v", err)
+		os.Remove(tmpFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error when writing temp video file", err)
+		return
 	}
-	if fileInfo.Size() == 0 {
-		return "", fmt.Errorf("processed file is empty")
+
+	if cfg.verifyDeclaredSize {
+		err = checkDeclaredSize(header, written, cfg.declaredSizeTolerance)
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			respondWithUploadError(w, err)
+			return
+		}
 	}
 
-	return output, nil
+	finish(w, r, video, tmpFile.Name(), mediaType, customKey, thumbnail)
 }
 
-func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
+// checkDeclaredSize compares the size a multipart file part claims in its
+// own Content-Length header against the bytes actually received. Buggy
+// uploaders that truncate the body are caught here rather than by ffprobe
+// later on. Parts without the header are only compared against the size
+// the form recorded, which is counted from the same bytes, so for them the
+// check only catches a short copy to the temp file. Errors are *uploadError
+// values.
+func checkDeclaredSize(header *multipart.FileHeader, received, tolerance int64) error {
+	declared := header.Size
+	if v := header.Header.Get("Content-Length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return &uploadError{http.StatusBadRequest, "Invalid Content-Length on video part", err}
+		}
+		declared = n
+	}
+
+	diff := declared - received
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("Declared size mismatch: expected %d bytes, received %d", declared, received), nil}
+	}
+	return nil
+}
+
+// removeMultipartForm deletes the temp files a parsed multipart form spilled
+// to disk. It's a no-op when parsing failed before a form was set, so it can
+// be deferred right after ParseMultipartForm.
+func removeMultipartForm(r *http.Request) {
+	if r.MultipartForm != nil {
+		r.MultipartForm.RemoveAll()
+	}
+}
+
+// beginVideoUpload authenticates an upload request and loads the video it
+// targets. When the request carries an Idempotency-Key it is locked for the
+// rest of the request and, if it was already used, the earlier result is
+// answered right away. ok is false once a response was written; otherwise
+// the caller must call unlock when done.
+//
+// The token is checked once, before the body is read: a multi-GB upload
+// that outlasts the token's lifetime still goes through. Steps that come
+// after a long transfer, such as finalizing a direct upload, pass
+// afterTransfer and do need a valid token; an expired one gets a distinct
+// 401 telling the client to refresh and retry the step.
+func (cfg *apiConfig) beginVideoUpload(w http.ResponseWriter, r *http.Request, afterTransfer bool) (video database.Video, unlock func(), ok bool) {
+	noop := func() {}
+
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
+		return video, noop, false
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
+		return video, noop, false
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
+	if afterTransfer && errors.Is(err, auth.ErrTokenExpired) {
+		respondWithError(w, http.StatusUnauthorized, "Token expired mid-upload, refresh it and retry this step", err)
+		return video, noop, false
+	}
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
+		return video, noop, false
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	if !cfg.requireActiveUser(w, userID) {
+		return video, noop, false
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "No video corresponding to videoID", err)
-		return
+		return video, noop, false
 	}
 
 	if video.UserID != userID {
 		respondWithError(w, http.StatusUnauthorized, "User is not the owner of the video", err)
+		return video, noop, false
+	}
+
+	unlock = noop
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		unlock = cfg.idempotencyLocks.lock(userID.String() + "/" + idempotencyKey)
+
+		record, err := cfg.db.GetIdempotencyKey(userID, idempotencyKey)
+
+		if err != nil {
+			unlock()
+			respondWithError(w, http.StatusInternalServerError, "Error when checking Idempotency-Key", err)
+			return video, noop, false
+		}
+
+		if record.Key != "" && time.Since(record.CreatedAt) < cfg.idempotencyTTL {
+			defer unlock()
+
+			if record.VideoID != videoID {
+				respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for another video", nil)
+				return video, noop, false
+			}
+
+			video, err := cfg.db.GetVideo(videoID)
+
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Error when fetching video", err)
+				return video, noop, false
+			}
+
+			respondWithJSON(w, record.Status, video)
+			return video, noop, false
+		}
+	}
+
+	logf(r.Context(), "uploading video %v by user %v", videoID, userID)
+
+	return video, unlock, true
+}
+
+// finishVideoUpload processes an upload written to the temp file at tmpPath,
+// on the background workers when they are enabled, and answers the request.
+// It takes ownership of the temp file.
+func (cfg *apiConfig) finishVideoUpload(w http.ResponseWriter, r *http.Request, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload) {
+	if cfg.jobs != nil {
+		cfg.enqueueVideoProcessing(w, r, video, tmpPath, mediaType, customKey, thumbnail)
 		return
 	}
+	defer os.Remove(tmpPath)
 
-	fmt.Println("uploading video", videoID, "by user", userID)
+	video, err := cfg.processUploadedVideo(r.Context(), video, tmpPath, mediaType, customKey, thumbnail)
 
-	uploadLimit := 1 << 30
+	if err != nil {
+		if uploadErrorCode(err) >= 500 {
+			cfg.markVideoFailed(r.Context(), video, err)
+			cfg.retainFailedUpload(r.Context(), video.ID, tmpPath, mediaType, customKey)
+		}
+		respondWithUploadError(w, err)
+		return
+	}
 
-	r.ParseMultipartForm(int64(uploadLimit))
+	cfg.recordIdempotencyKey(r, video, http.StatusOK)
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoUpload)
+	respondWithJSON(w, 200, video)
+}
+
+// processVideoJob is the payload of a jobKindProcessVideo job. Path is a
+// temp file on the disk of the instance that took the upload, so these jobs
+// are local to it. A thumbnail sent along with the upload is carried inline
+// so it survives a restart as well.
+type processVideoJob struct {
+	VideoID            uuid.UUID `json:"video_id"`
+	Path               string    `json:"path"`
+	MediaType          string    `json:"media_type"`
+	CustomKey          string    `json:"custom_key"`
+	Thumbnail          []byte    `json:"thumbnail,omitempty"`
+	ThumbnailMediaType string    `json:"thumbnail_media_type,omitempty"`
+}
+
+// enqueueVideoProcessing hands an uploaded temp file over to the background
+// workers and answers right away with the video in the processing state. The
+// job owns the temp file from here on and keeps it until it either succeeds or
+// has failed for good, when server side failures retain it for a retry.
+func (cfg *apiConfig) enqueueVideoProcessing(w http.ResponseWriter, r *http.Request, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload) {
+	video.Status = database.VideoStatusProcessing
+
+	err := cfg.saveVideo(&video)
 
-	uploadedVideo, header, err := r.FormFile("video")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		os.Remove(tmpPath)
+		respondWithError(w, http.StatusInternalServerError, "Error when updating video", err)
 		return
 	}
 
-	defer uploadedVideo.Close()
-	defer r.MultipartForm.RemoveAll()
+	payload := processVideoJob{
+		VideoID:   video.ID,
+		Path:      tmpPath,
+		MediaType: mediaType,
+		CustomKey: customKey,
+	}
+	if thumbnail != nil {
+		payload.Thumbnail = thumbnail.data
+		payload.ThumbnailMediaType = thumbnail.mediaType
+	}
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	err = cfg.jobs.enqueue(r.Context(), jobKindProcessVideo, payload)
 
+	if errors.Is(err, errQueueFull) {
+		os.Remove(tmpPath)
+		respondWithError(w, http.StatusServiceUnavailable, "Too many videos are being processed, try again later", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+		os.Remove(tmpPath)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+	cfg.recordIdempotencyKey(r, video, http.StatusAccepted)
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoUpload)
+	respondWithJSON(w, http.StatusAccepted, video)
+}
+
+// processVideoJobHandler runs jobKindProcessVideo jobs. Client errors such as
+// unparsable metadata aren't retried, and neither is a job whose temp file is
+// gone, as happens when a restart wiped the temp directory.
+func (cfg *apiConfig) processVideoJobHandler() jobHandler {
+	decode := func(payload []byte) (processVideoJob, error) {
+		var job processVideoJob
+		err := json.Unmarshal(payload, &job)
+		return job, err
+	}
+
+	return jobHandler{
+		run: func(ctx context.Context, payload []byte) error {
+			job, err := decode(payload)
+			if err != nil {
+				return &permanentJobError{err: fmt.Errorf("couldn't decode job payload: %w", err)}
+			}
+
+			video, err := cfg.db.GetVideo(job.VideoID)
+			if err != nil {
+				return err
+			}
+			if video.ID == uuid.Nil {
+				// Deleted while queued, there is nothing left to process.
+				os.Remove(job.Path)
+				return nil
+			}
+
+			_, err = os.Stat(job.Path)
+			if err != nil {
+				return &permanentJobError{err: &uploadError{http.StatusGone, "Uploaded video was lost before it could be processed", err}}
+			}
+
+			var thumbnail *thumbnailUpload
+			if job.Thumbnail != nil {
+				thumbnail = &thumbnailUpload{data: job.Thumbnail, mediaType: job.ThumbnailMediaType}
+			}
+
+			_, err = cfg.processUploadedVideo(ctx, video, job.Path, job.MediaType, job.CustomKey, thumbnail)
+			if err != nil {
+				if uploadErrorCode(err) < 500 {
+					return &permanentJobError{err: err}
+				}
+				return err
+			}
+			os.Remove(job.Path)
+			return nil
+		},
+		onFailure: func(ctx context.Context, payload []byte, err error) {
+			job, decodeErr := decode(payload)
+			if decodeErr != nil {
+				return
+			}
+			video, getErr := cfg.db.GetVideo(job.VideoID)
+			if getErr != nil || video.ID == uuid.Nil {
+				os.Remove(job.Path)
+				return
+			}
+			cfg.markVideoFailed(ctx, video, err)
+			if uploadErrorCode(err) >= 500 {
+				cfg.retainFailedUpload(ctx, video.ID, job.Path, job.MediaType, job.CustomKey)
+			}
+			os.Remove(job.Path)
+		},
+		local: true,
+	}
+}
+
+// uploadError carries the response an upload pipeline failure maps to when
+// the pipeline runs within the request.
+type uploadError struct {
+	code int
+	msg  string
+	err  error
+}
+
+func (e *uploadError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+// uploadErrorCode returns the status code err maps to, 500 for errors that
+// aren't an *uploadError.
+func uploadErrorCode(err error) int {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		return uploadErr.code
+	}
+	return http.StatusInternalServerError
+}
+
+// markVideoFailed records that processing video failed and why. Only the
+// client-facing message is stored, the underlying error is logged.
+func (cfg *apiConfig) markVideoFailed(ctx context.Context, video database.Video, err error) {
+	logf(ctx, "Processing video %v failed: %v", video.ID, err)
+
+	video.Status = database.VideoStatusFailed
+	video.FailureReason = "Error when processing video"
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		video.FailureReason = uploadErr.msg
+	}
+
+	updateErr := cfg.saveVideo(&video)
+	if updateErr != nil {
+		logf(ctx, "Couldn't mark video %v as failed: %v", video.ID, updateErr)
+	}
+}
+
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		respondWithError(w, uploadErr.code, uploadErr.msg, uploadErr.err)
 		return
 	}
+	respondWithError(w, http.StatusInternalServerError, "Error when processing video", err)
+}
+
+// processUploadedVideo probes and processes the upload stored at tmpPath,
+// sends it to S3 and publishes it on the video. An uploaded thumbnail is
+// stored along the way; without one, and if the video has none yet, one is
+// generated from a frame when ffmpeg processing is enabled.
+func (cfg *apiConfig) processUploadedVideo(ctx context.Context, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload) (database.Video, error) {
+	original := video
+	ratio := "other"
+	uploadPath := tmpPath
+
+	// Issues that don't stop the upload are collected for the owner to see.
+	video.Warnings = database.VideoWarnings{}
+
+	if !cfg.skipVideoProcessing {
+		info, err := probeVideo(ctx, cfg.commands, tmpPath, cfg.aspectRatioFallback, cfg.squareTolerance)
+
+		if errors.Is(err, errInvalidVideoMetadata) {
+			return video, &uploadError{http.StatusBadRequest, "Could not parse video metadata", err}
+		}
+
+		if errors.Is(err, errUnknownAspectRatio) {
+			return video, &uploadError{http.StatusBadRequest, "Only 16:9 and 9:16 videos are supported", err}
+		}
+
+		if err != nil {
+			return video, &uploadError{http.StatusInternalServerError, "Error when fetching video ratio", err}
+		}
+
+		err = cfg.checkResolution(info)
+		if err != nil {
+			return video, err
+		}
+
+		if cfg.verifyDecode {
+			err = verifyVideoDecodes(ctx, cfg.commands, tmpPath)
+
+			if errors.Is(err, errCorruptVideo) {
+				return video, &uploadError{http.StatusBadRequest, "Video file is corrupt", err}
+			}
+
+			if err != nil {
+				return video, &uploadError{http.StatusInternalServerError, "Error when checking video", err}
+			}
+		}
+
+		// Once a quarter-turn is baked in, the frames swap orientation.
+		reorient := cfg.autoOrient && info.Rotation != 0
+		if reorient && info.Rotation != 180 {
+			switch info.AspectRatio {
+			case "16:9":
+				info.AspectRatio = "9:16"
+			case "9:16":
+				info.AspectRatio = "16:9"
+			}
+		}
+
+		ratio = aspectRatioNames[info.AspectRatio]
+
+		video.PixFmt = info.PixFmt
+		video.ColorTransfer = info.ColorTransfer
+
+		video.Duration = info.Duration.Seconds()
+
+		err = cfg.checkDuration(info.Duration)
+		if err != nil {
+			return video, err
+		}
+
+		video.HasAudio = info.HasAudio
+		video.AudioWarning = ""
+		if !info.HasAudio {
+			video.AudioWarning = audioWarningMissing
+		} else if cfg.detectSilence {
+			video.AudioWarning = detectSilentAudio(ctx, cfg.commands, tmpPath)
+		}
+		if code, ok := audioWarningCodes[video.AudioWarning]; ok {
+			video.Warnings = append(video.Warnings, videoWarning(code))
+		}
+		if info.CodecName == "hevc" {
+			video.Warnings = append(video.Warnings, videoWarning(warningHEVC))
+		}
+		if ratio == "other" {
+			video.Warnings = append(video.Warnings, videoWarning(warningUnusualAspectRatio))
+		}
+
+		hdr := info.isHDR()
+		if hdr && cfg.hdrPolicy == hdrPolicyReject {
+			return video, &uploadError{http.StatusBadRequest, "HDR and 10-bit videos are not supported, please upload an 8-bit SDR video", nil}
+		}
+		if hdr && cfg.hdrPolicy == hdrPolicyAllow {
+			video.Warnings = append(video.Warnings, videoWarning(warningHDR))
+		}
+
+		// WebM has no moov atom to move to the front, so unless it needs
+		// transcoding it is stored as uploaded. Transcoding to SDR applies
+		// the rotation as well.
+		var process func(context.Context, commandRunner, string, ffmpegOptions, videoStreamInfo) (string, error)
+		fastStartOnly := false
+		switch {
+		case hdr && cfg.hdrPolicy == hdrPolicyTranscode:
+			process = transcodeToSDR
+			mediaType = "video/mp4"
+			video.PixFmt = "yuv420p"
+			video.ColorTransfer = "bt709"
+			video.Warnings = append(video.Warnings, videoWarning(warningHDRTranscoded))
+		case reorient:
+			process = autoOrientVideo
+			mediaType = "video/mp4"
+		case mediaType == "video/mp4":
+			process = processVideoForFastStart
+			fastStartOnly = true
+		}
+
+		video.Unoptimized = false
+		if process != nil {
+			processed, err := process(ctx, cfg.commands, tmpPath, cfg.ffmpeg, info)
+
+			// Without faststart the video still plays, it just can't start
+			// before it's fully downloaded. Other processing can't be skipped.
+			if err != nil && fastStartOnly && cfg.faststartFallback {
+				logf(ctx, "Warning: faststart processing failed for video %v, storing it unoptimized: %v", video.ID, err)
+				video.Unoptimized = true
+				video.Warnings = append(video.Warnings, videoWarning(warningUnoptimized))
+			} else if err != nil {
+				return video, &uploadError{http.StatusInternalServerError, "Error when converting video for streaming", err}
+			} else {
+				defer os.Remove(processed)
+				uploadPath = processed
+			}
+		}
+	}
 
-	tmpFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	uploadFile, err := os.Open(uploadPath)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when creating temp file", err)
-		return
+		return video, &uploadError{http.StatusInternalServerError, "Error when reading processed video", err}
+	}
+	defer uploadFile.Close()
+
+	key := customKey
+	if key == "" {
+		key = cfg.getVideoKey(video.UserID, ratio, mediaTypeToExt(mediaType))
 	}
 
-	_, err = io.Copy(tmpFile, uploadedVideo)
+	uploadInfo, err := uploadFile.Stat()
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when writing temp video file", err)
-		return
+		return video, &uploadError{http.StatusInternalServerError, "Error when reading processed video", err}
 	}
 
-	tmpFile.Seek(0, io.SeekStart)
+	video.Size = uploadInfo.Size()
+	video.AspectRatio = ratio
 
-	ratio, err := getVideoAspectRatio(tmpFile.Name())
+	input := &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         uploadFile,
+		ContentType:  &mediaType,
+		Tagging:      cfg.getObjectTagging(video.UserID, ratio, mediaType),
+		CacheControl: cfg.getCacheControl(),
+	}
+	// Generated keys are meant to be unique, so an object already there
+	// means a key generation bug or a race, and must not be clobbered.
+	// Custom keys are their owner's to reuse.
+	var uploadID string
+	if customKey == "" && cfg.s3ConditionalPut {
+		uploadID = uuid.NewString()
+		input.IfNoneMatch = aws.String("*")
+		input.Metadata = map[string]string{uploadIDMetadataKey: uploadID}
+	}
+	_, err = cfg.store.PutObject(ctx, input)
 
+	if input.IfNoneMatch != nil && isExistingObject(err) {
+		// The SDK retries a PutObject whose response got lost, and the
+		// retry is refused because the first attempt did store the object.
+		// That object carries this upload's ID.
+		if !cfg.isOwnUpload(ctx, key, uploadID) {
+			return video, &uploadError{http.StatusConflict, "An object already exists at the video's key", err}
+		}
+		err = nil
+	}
+	// Storage is upstream of us, so its failures are reported as 502.
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when fetching video ratio", err)
-		return
+		// A PutObject that timed out may still have stored the object. The
+		// next attempt generates another key, so this one would be left
+		// behind for every retry. Custom keys are reused by retries and may
+		// hold content of the owner's that must not be lost.
+		if customKey == "" {
+			cfg.deleteObject(context.WithoutCancel(ctx), key)
+		}
+		return video, &uploadError{http.StatusBadGateway, "Error when sending file to s3", err}
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
 
-	if ratio == "16:9" {
-		ratio = "landscape"
-	} else if ratio == "9:16" {
-		ratio = "portrait"
+	video = cfg.uploadPreview(ctx, video, tmpPath, key, ratio)
+	video = cfg.uploadStoryboard(ctx, video, tmpPath, key, ratio)
+	video = cfg.uploadProxy(ctx, video, tmpPath, key, ratio)
+
+	stored := video
+	videoURL := cfg.getVideoURL(key)
+	stored.VideoURL = &videoURL
+
+	// Stored only once the video is, so a failed upload leaves no orphaned
+	// thumbnail behind.
+	video, err = cfg.setUploadThumbnail(ctx, video, thumbnail, tmpPath)
+
+	// What was stored is discarded on failure, so the video is handed back
+	// as it was rather than pointing at deleted objects.
+	if err != nil {
+		cfg.discardUploadedObjects(ctx, stored, original)
+		return original, err
 	}
+	stored.ThumbnailURL = video.ThumbnailURL
 
-	processed, err := processVideoForFastStart(tmpFile.Name())
+	video, err = cfg.publishVideo(ctx, video, key, mediaType)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when converting video for streaming", err)
-		return
+		cfg.discardUploadedObjects(ctx, stored, original)
+		return original, err
+	}
+
+	cfg.discardReplacedThumbnail(ctx, original, video)
+	cfg.discardFailedUpload(ctx, video.ID)
+	return video, nil
+}
+
+// checkResolution rejects videos smaller than MIN_VIDEO_WIDTH by
+// MIN_VIDEO_HEIGHT. The minimum is given for landscape videos and applies
+// turned on its side to portrait ones, so a 480p minimum holds both ways.
+func (cfg *apiConfig) checkResolution(info videoStreamInfo) error {
+	if cfg.minWidth == 0 && cfg.minHeight == 0 {
+		return nil
+	}
+	if info.Width == 0 || info.Height == 0 {
+		return &uploadError{http.StatusBadRequest, "Could not determine video resolution", nil}
+	}
+
+	long, short := max(info.Width, info.Height), min(info.Width, info.Height)
+	if long < cfg.minWidth || short < cfg.minHeight {
+		msg := fmt.Sprintf("Video resolution too low, it must be at least %dx%d", cfg.minWidth, cfg.minHeight)
+		return &uploadError{http.StatusBadRequest, msg, nil}
+	}
+	return nil
+}
+
+// uploadPreview stores an animated preview next to the video object at
+// videoKey when previews are enabled. Previews are a nicety, so failures are
+// only logged and leave the video without one.
+func (cfg *apiConfig) uploadPreview(ctx context.Context, video database.Video, tmpPath, videoKey, ratio string) database.Video {
+	video.PreviewURL = nil
+	if !cfg.previewEnabled || cfg.skipVideoProcessing {
+		return video
+	}
+
+	previewPath, err := generatePreview(ctx, cfg.commands, tmpPath, cfg.ffmpeg, cfg.previewStart, cfg.previewDuration)
+	if err != nil {
+		logf(ctx, "Couldn't generate preview for video %v: %v", video.ID, err)
+		return video
+	}
+	defer os.Remove(previewPath)
+
+	previewFile, err := os.Open(previewPath)
+	if err != nil {
+		logf(ctx, "Couldn't read preview for video %v: %v", video.ID, err)
+		return video
+	}
+	defer previewFile.Close()
+
+	key := getPreviewKey(videoKey)
+	mediaType := "image/webp"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         previewFile,
+		ContentType:  &mediaType,
+		Tagging:      cfg.getObjectTagging(video.UserID, ratio, mediaType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		logf(ctx, "Couldn't upload preview for video %v: %v", video.ID, err)
+		return video
+	}
+
+	previewURL := cfg.getVideoURL(key)
+	video.PreviewURL = &previewURL
+	return video
+}
+
+// uploadProxy stores a low-resolution proxy of the video at videoKey for
+// editors to scrub, when PROXY_ENABLED is set. Like previews, proxies are a
+// nicety, so failures are only logged and leave the video without one.
+func (cfg *apiConfig) uploadProxy(ctx context.Context, video database.Video, tmpPath, videoKey, ratio string) database.Video {
+	video.ProxyURL = nil
+	if !cfg.proxyEnabled || cfg.skipVideoProcessing {
+		return video
+	}
+
+	proxyPath, err := generateProxy(ctx, cfg.commands, tmpPath, cfg.ffmpeg)
+	if err != nil {
+		logf(ctx, "Couldn't generate proxy for video %v: %v", video.ID, err)
+		return video
+	}
+	defer os.Remove(proxyPath)
+
+	proxyFile, err := os.Open(proxyPath)
+	if err != nil {
+		logf(ctx, "Couldn't read proxy for video %v: %v", video.ID, err)
+		return video
+	}
+	defer proxyFile.Close()
+
+	key := getProxyKey(videoKey)
+	mediaType := "video/mp4"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         proxyFile,
+		ContentType:  &mediaType,
+		Tagging:      cfg.getObjectTagging(video.UserID, ratio, mediaType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		logf(ctx, "Couldn't upload proxy for video %v: %v", video.ID, err)
+		return video
+	}
+
+	proxyURL := cfg.getVideoURL(key)
+	video.ProxyURL = &proxyURL
+	return video
+}
+
+type thumbnailUpload struct {
+	data      []byte
+	mediaType string
+}
+
+// readThumbnailFormFile reads the optional "thumbnail" field sent along with
+// a video. It returns nil when the field is absent.
+func readThumbnailFormFile(r *http.Request, maxSize int64) (*thumbnailUpload, error) {
+	file, header, err := r.FormFile("thumbnail")
+
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
 	}
-	defer os.Remove(processed)
 
-	processedFile, err := os.Open(processed)
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "Unable to parse thumbnail form file", err}
+	}
+	defer file.Close()
+
+	return readThumbnailPart(file, header.Header.Get("Content-Type"), maxSize)
+}
+
+func readThumbnailPart(part io.Reader, contentType string, maxSize int64) (*thumbnailUpload, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxSize+1))
+
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "Unable to read thumbnail", err}
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Thumbnail must be at most %d bytes", maxSize), nil}
+	}
+
+	mediaType, err := thumbnailTypes.validate(contentType, sniffMediaType(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &thumbnailUpload{data: data, mediaType: mediaType}, nil
+}
+
+// setUploadThumbnail stores the thumbnail uploaded with a video, or falls back
+// to a frame of the video at tmpPath. Failing to generate a frame doesn't fail
+// the upload.
+func (cfg *apiConfig) setUploadThumbnail(ctx context.Context, video database.Video, thumbnail *thumbnailUpload, tmpPath string) (database.Video, error) {
+	if thumbnail != nil {
+		return cfg.storeThumbnail(video, thumbnail.data, thumbnail.mediaType, nil)
+	}
+
+	if video.ThumbnailURL != nil || cfg.skipVideoProcessing || tmpPath == "" {
+		return video, nil
+	}
+
+	frame, err := cfg.extractAutoThumbnail(ctx, video, tmpPath)
+
+	if err != nil {
+		logf(ctx, "Couldn't extract a thumbnail frame for video %v: %v", video.ID, err)
+		return video, nil
+	}
+
+	generated, err := cfg.storeThumbnail(video, frame, "image/jpg", nil)
+
+	if err != nil {
+		logf(ctx, "Couldn't store generated thumbnail for video %v: %v", video.ID, err)
+		return video, nil
+	}
+
+	return generated, nil
+}
+
+// extractAutoThumbnail picks the frame generated thumbnails are made of: the
+// first scene change when THUMBNAIL_SCENE_THRESHOLD is set, otherwise, or
+// when there is none, whatever ffmpeg's thumbnail filter picks.
+func (cfg *apiConfig) extractAutoThumbnail(ctx context.Context, video database.Video, tmpPath string) ([]byte, error) {
+	if cfg.thumbnailSceneThreshold > 0 {
+		frame, err := extractSceneFrame(ctx, cfg.commands, tmpPath, cfg.thumbnailSceneThreshold)
+		if err == nil {
+			return frame, nil
+		}
+		if !errors.Is(err, errNoSceneChange) {
+			logf(ctx, "Scene detection failed for video %v, falling back to the thumbnail filter: %v", video.ID, err)
+		}
+	}
+	return extractThumbnailFrame(ctx, cfg.commands, tmpPath)
+}
+
+// uploadVideoPassthrough streams the "video" part of the multipart body
+// straight into S3 without touching local disk. It can only be used when
+// ffprobe and faststart processing are disabled, since both need a seekable
+// file.
+func (cfg *apiConfig) uploadVideoPassthrough(w http.ResponseWriter, r *http.Request, video database.Video) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadSize+cfg.maxImageUploadSize+maxMultipartOverhead)
 
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when converting video for streaming", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to parse multipart body", err)
 		return
 	}
 
-	defer processedFile.Close()
+	customKey := ""
+	visibility := video.Visibility
+	var thumbnail *thumbnailUpload
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			respondWithError(w, http.StatusBadRequest, "No video field in request", http.ErrMissingFile)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse multipart body", err)
+			return
+		}
+		// The key, visibility and thumbnail fields have to be sent before
+		// the video, since the video is uploaded as soon as it's read;
+		// checkTrailingParts refuses them after it.
+		if part.FormName() == "thumbnail" {
+			thumbnail, err = readThumbnailPart(part, part.Header.Get("Content-Type"), cfg.maxImageUploadSize)
+			part.Close()
+			if err != nil {
+				respondWithUploadError(w, err)
+				return
+			}
+			continue
+		}
+		if part.FormName() == "key" {
+			value, err := io.ReadAll(io.LimitReader(part, maxCustomKeyLength+1))
+			part.Close()
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Unable to parse multipart body", err)
+				return
+			}
+			customKey = string(value)
+			err = cfg.validateCustomVideoKey(video.UserID, customKey)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid key: %v", err), err)
+				return
+			}
+			continue
+		}
+		if part.FormName() == "visibility" {
+			value, err := io.ReadAll(io.LimitReader(part, maxVisibilityLength+1))
+			part.Close()
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Unable to parse multipart body", err)
+				return
+			}
+			visibility, err = parseVisibility(string(value))
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error(), err)
+				return
+			}
+			continue
+		}
+		if part.FormName() != "video" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		defer cfg.auditUploadVisibility(r, video.ID, video.Visibility, visibility)
+		video.Visibility = visibility
+
+		// Checked before anything is sent so an empty object is never stored.
+		buffered := bufio.NewReaderSize(part, sniffLength)
+		head, err := buffered.Peek(sniffLength)
+		if len(head) == 0 && err == io.EOF {
+			respondWithError(w, http.StatusBadRequest, "Video file is empty", nil)
+			return
+		}
 
-	key := fmt.Sprintf("%v/%v", ratio, getAssetPath(mediaType))
+		mediaType, err := videoTypes.validate(part.Header.Get("Content-Type"), sniffMediaType(head))
+
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+
+		video.OriginalFilename = part.FileName()
+
+		key := customKey
+		if key == "" {
+			key = cfg.getVideoKey(video.UserID, "other", mediaTypeToExt(mediaType))
+		}
 
-	_, err = cfg.s3Client.PutObject(context.Background(),
-		&s3.PutObjectInput{
-			Bucket:      &cfg.s3Bucket,
-			Key:         &key,
-			Body:        processedFile,
-			ContentType: &mediaType,
+		body := &countingReader{r: buffered}
+		err = cfg.store.Upload(r.Context(), &s3.PutObjectInput{
+			Bucket:       &cfg.s3Bucket,
+			Key:          &key,
+			Body:         body,
+			ContentType:  &mediaType,
+			Tagging:      cfg.getObjectTagging(video.UserID, "other", mediaType),
+			CacheControl: cfg.getCacheControl(),
 		})
 
+		if err != nil {
+			err = &uploadError{http.StatusBadGateway, "Error when sending file to s3", err}
+			cfg.markVideoFailed(r.Context(), video, err)
+			respondWithUploadError(w, err)
+			return
+		}
+
+		video.Size = body.n
+		video.AspectRatio = "other"
+
+		original := video
+		stored := video
+		videoURL := cfg.getVideoURL(key)
+		stored.VideoURL = &videoURL
+
+		err = checkTrailingParts(reader)
+
+		if err != nil {
+			cfg.discardUploadedObjects(r.Context(), stored, original)
+			respondWithUploadError(w, err)
+			return
+		}
+
+		video, err = cfg.checkStoredDuration(r.Context(), video, key)
+
+		if err != nil {
+			cfg.discardUploadedObjects(r.Context(), stored, original)
+			respondWithUploadError(w, err)
+			return
+		}
+
+		video, err = cfg.setUploadThumbnail(r.Context(), video, thumbnail, "")
+
+		if err != nil {
+			cfg.discardUploadedObjects(r.Context(), stored, original)
+			respondWithUploadError(w, err)
+			return
+		}
+		stored.ThumbnailURL = video.ThumbnailURL
+
+		video, err = cfg.publishVideo(r.Context(), video, key, mediaType)
+
+		if err != nil {
+			cfg.discardUploadedObjects(r.Context(), stored, original)
+			respondWithUploadError(w, err)
+			return
+		}
+		cfg.discardReplacedThumbnail(r.Context(), original, video)
+
+		cfg.recordIdempotencyKey(r, video, http.StatusOK)
+		cfg.recordAudit(r, video.UserID, video.ID, auditVideoUpload)
+		respondWithJSON(w, 200, video)
+		return
+	}
+}
+
+// checkTrailingParts reads what is left of a passthrough upload after the
+// video part. The key, visibility and thumbnail fields come too late to be
+// used by then, and are refused rather than dropped: a visibility quietly
+// ignored would leave a video public that was meant to be private. Errors
+// are *uploadError values.
+func checkTrailingParts(reader *multipart.Reader) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &uploadError{http.StatusBadRequest, "Unable to parse multipart body", err}
+		}
+		name := part.FormName()
+		part.Close()
+		switch name {
+		case "key", "visibility", "thumbnail":
+			return &uploadError{http.StatusBadRequest, fmt.Sprintf("The %s field must be sent before the video", name), nil}
+		}
+	}
+}
+
+// auditUploadVisibility records auditVideoVisibility for an upload that
+// asked for visibility on a video that had another one before, once the
+// request is done and if the video was saved with it. Failed uploads may
+// have saved it too.
+func (cfg *apiConfig) auditUploadVisibility(r *http.Request, videoID uuid.UUID, before, requested database.VideoVisibility) {
+	if requested == before {
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when sending file to s3", err)
+		logf(r.Context(), "Couldn't check the visibility of video %v: %v", videoID, err)
 		return
 	}
+	if video.Visibility == requested {
+		cfg.recordAudit(r, video.UserID, video.ID, auditVideoVisibility)
+	}
+}
+
+// checkDuration applies MIN_VIDEO_DURATION and MAX_VIDEO_DURATION to a
+// probed duration. Errors are *uploadError values.
+func (cfg *apiConfig) checkDuration(duration time.Duration) error {
+	if cfg.minDuration == 0 && cfg.maxDuration == 0 {
+		return nil
+	}
+	switch {
+	case duration == 0:
+		return &uploadError{http.StatusBadRequest, "Could not determine video duration", nil}
+	case cfg.minDuration > 0 && duration < cfg.minDuration:
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("Video too short, it must be at least %v", cfg.minDuration), nil}
+	case cfg.maxDuration > 0 && duration > cfg.maxDuration:
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("Video too long, it must be at most %v", cfg.maxDuration), nil}
+	}
+	return nil
+}
+
+// checkStoredDuration applies the duration limits to an upload that never
+// touched the disk. When limits are set, the stored object is probed
+// straight from S3 through a presigned URL, as reprocessDurations does, and
+// its duration recorded on video. Errors are *uploadError values.
+func (cfg *apiConfig) checkStoredDuration(ctx context.Context, video database.Video, key string) (database.Video, error) {
+	if cfg.minDuration == 0 && cfg.maxDuration == 0 {
+		return video, nil
+	}
+
+	presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+	if err != nil {
+		return video, &uploadError{http.StatusBadGateway, "Couldn't read back the stored video", err}
+	}
+	info, err := probeVideo(ctx, cfg.commands, presigned.URL, aspectRatioFallbackOther, cfg.squareTolerance)
+	if err != nil {
+		logf(ctx, "Couldn't probe stored video %v: %v", video.ID, err)
+		return video, &uploadError{http.StatusBadRequest, "Could not determine video duration", err}
+	}
+	err = cfg.checkDuration(info.Duration)
+	if err != nil {
+		return video, err
+	}
+	video.Duration = info.Duration.Seconds()
+	return video, nil
+}
+
+// discardUploadedObjects deletes the objects and thumbnail an upload that
+// failed after storing them left behind: those of stored, the video as it
+// would have been published, that original, the video before the upload,
+// didn't already reference. A custom key reused for the same video is
+// overwritten in place and kept.
+func (cfg *apiConfig) discardUploadedObjects(ctx context.Context, stored, original database.Video) {
+	cfg.discardReplacedObjects(context.WithoutCancel(ctx), stored, original)
+	cfg.discardReplacedThumbnail(ctx, stored, original)
+}
+
+// discardReplacedThumbnail is discardReplacedObjects for the thumbnail file,
+// removing old's once current no longer references it.
+func (cfg *apiConfig) discardReplacedThumbnail(ctx context.Context, old, current database.Video) {
+	if old.ThumbnailURL != nil && (current.ThumbnailURL == nil || *old.ThumbnailURL != *current.ThumbnailURL) {
+		cfg.removeAsset(ctx, *old.ThumbnailURL)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// publishVideo runs moderation on an uploaded object and points the video at
+// it. Rejected content is never served, so its objects are deleted once the
+// video no longer points at them.
+func (cfg *apiConfig) publishVideo(ctx context.Context, video database.Video, key, mediaType string) (database.Video, error) {
+	videoURL := cfg.getVideoURL(key)
 
-	videoURL := fmt.Sprintf("https://%v/%v", cfg.s3CfDistribution, key)
+	status, err := cfg.moderateVideo(ctx, video.ID, videoURL, mediaType)
 
+	if err != nil {
+		return video, &uploadError{http.StatusBadGateway, "Error when moderating video", err}
+	}
+
+	video.Status = status
+	video.FailureReason = ""
 	video.VideoURL = &videoURL
+	rejected := video
+	if status == database.VideoStatusRejected {
+		video.VideoURL = nil
+		video.PreviewURL = nil
+		video.StoryboardURL = nil
+		video.ProxyURL = nil
+	}
 
-	err = cfg.db.UpdateVideo(video)
+	err = cfg.saveVideo(&video)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error when updating video", err)
+		return video, &uploadError{http.StatusInternalServerError, "Error when updating video", err}
+	}
+
+	if status == database.VideoStatusRejected {
+		cfg.discardReplacedObjects(context.WithoutCancel(ctx), rejected, video)
+	}
+
+	return video, nil
+}
+
+// recordIdempotencyKey remembers which video a request's Idempotency-Key
+// produced, and the status it was answered with, so retries get the same
+// result.
+func (cfg *apiConfig) recordIdempotencyKey(r *http.Request, video database.Video, status int) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
 		return
 	}
 
-	respondWithJSON(w, 200, video)
+	err := cfg.db.DeleteIdempotencyKeysBefore(time.Now().Add(-cfg.idempotencyTTL))
+	if err != nil {
+		logf(r.Context(), "Couldn't delete expired idempotency keys: %v", err)
+	}
+
+	_, err = cfg.db.CreateIdempotencyKey(database.CreateIdempotencyKeyParams{
+		Key:     idempotencyKey,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Status:  status,
+	})
+	if err != nil {
+		logf(r.Context(), "Couldn't record Idempotency-Key for video %v: %v", video.ID, err)
+	}
+}
+
+// uploadIDMetadataKey is the object metadata conditional uploads tag their
+// object with, to recognize it when a retry finds it already there.
+const uploadIDMetadataKey = "tubely-upload-id"
+
+// isOwnUpload reports whether the object at key was stored by the upload
+// with uploadID.
+func (cfg *apiConfig) isOwnUpload(ctx context.Context, key, uploadID string) bool {
+	head, err := cfg.store.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		logf(ctx, "Couldn't check the object already at %v: %v", key, err)
+		return false
+	}
+	return head.Metadata[uploadIDMetadataKey] == uploadID
 }
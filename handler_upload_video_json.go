@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxJSONUploadOverhead bounds everything in a JSON upload besides the
+// encoded video.
+const maxJSONUploadOverhead = 64 << 10
+
+var errUploadTooLarge = errors.New("decoded upload exceeds the size limit")
+
+// jsonUploadFields are the fields of a JSON upload other than its data.
+type jsonUploadFields struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	Key         string `json:"key"`
+	Visibility  string `json:"visibility"`
+}
+
+// handlerUploadVideoJSON is handlerUploadVideo for clients that can only send
+// JSON. The body is an object with the video base64 encoded in "data", its
+// media type in "content_type", and optionally "filename", a custom "key"
+// and a "visibility" to set on the video. The data is decoded straight into the temp file as the body
+// streams in, so the video is never held in memory.
+func (cfg *apiConfig) handlerUploadVideoJSON(w http.ResponseWriter, r *http.Request) {
+	video, unlock, ok := cfg.beginVideoUpload(w, r, false)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	maxBody := int64(base64.StdEncoding.EncodedLen(int(cfg.maxVideoUploadSize))) + maxJSONUploadOverhead
+	body := http.MaxBytesReader(w, r.Body, maxBody)
+
+	tmpFile, err := os.CreateTemp("", "tubely-upload-*")
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when creating temp file", err)
+		return
+	}
+
+	fields, size, err := decodeJSONUpload(body, tmpFile, cfg.maxVideoUploadSize)
+	tmpFile.Close()
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errUploadTooLarge) || errors.As(err, &maxBytesErr) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Video must be at most %d bytes", cfg.maxVideoUploadSize), err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode upload", err)
+		return
+	}
+
+	fail := func(err error) {
+		os.Remove(tmpFile.Name())
+		respondWithUploadError(w, err)
+	}
+
+	if size == 0 {
+		fail(&uploadError{http.StatusBadRequest, "Video file is empty", nil})
+		return
+	}
+
+	head, err := readFileHead(tmpFile.Name(), sniffLength)
+
+	if err != nil {
+		fail(&uploadError{http.StatusInternalServerError, "Error when reading temp video file", err})
+		return
+	}
+
+	mediaType, err := videoTypes.validate(fields.ContentType, sniffMediaType(head))
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if fields.Key != "" {
+		err = cfg.validateCustomVideoKey(video.UserID, fields.Key)
+
+		if err != nil {
+			fail(&uploadError{http.StatusBadRequest, fmt.Sprintf("Invalid key: %v", err), err})
+			return
+		}
+	}
+
+	visibility := video.Visibility
+	if fields.Visibility != "" {
+		visibility, err = parseVisibility(fields.Visibility)
+		if err != nil {
+			fail(&uploadError{http.StatusBadRequest, err.Error(), err})
+			return
+		}
+	}
+	defer cfg.auditUploadVisibility(r, video.ID, video.Visibility, visibility)
+	video.Visibility = visibility
+
+	video.OriginalFilename = fields.Filename
+
+	// The media type is only known once the data is in, so that's when the
+	// temp file gets its extension.
+	tmpPath := tmpFile.Name() + mediaTypeToExt(mediaType)
+	err = os.Rename(tmpFile.Name(), tmpPath)
+	if err != nil {
+		fail(&uploadError{http.StatusInternalServerError, "Error when writing temp video file", err})
+		return
+	}
+
+	cfg.finishVideoUpload(w, r, video, tmpPath, mediaType, fields.Key, nil)
+}
+
+// decodeJSONUpload reads a JSON upload object from body, base64 decoding its
+// "data" field into dst and returning the other fields along with the
+// decoded size. Decoding more than maxSize bytes fails with
+// errUploadTooLarge.
+//
+// encoding/json can only hand over whole strings, so the data string is read
+// off the raw body instead, and parsing picks up again after it.
+func decodeJSONUpload(body io.Reader, dst io.Writer, maxSize int64) (jsonUploadFields, int64, error) {
+	var fields jsonUploadFields
+	var size int64
+	seenData := false
+
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err != nil {
+		return fields, 0, err
+	}
+	if tok != json.Delim('{') {
+		return fields, 0, errors.New("upload must be a JSON object")
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fields, 0, err
+		}
+		name, _ := tok.(string)
+
+		switch name {
+		case "content_type":
+			err = dec.Decode(&fields.ContentType)
+		case "filename":
+			err = dec.Decode(&fields.Filename)
+		case "key":
+			err = dec.Decode(&fields.Key)
+		case "visibility":
+			err = dec.Decode(&fields.Visibility)
+		case "data":
+			if seenData {
+				return fields, 0, errors.New("duplicate data field")
+			}
+			seenData = true
+			size, dec, err = decodeBase64Field(io.MultiReader(dec.Buffered(), body), dst, maxSize)
+			if err == nil && dec == nil {
+				// data was the last field.
+				return fields, size, nil
+			}
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return fields, 0, err
+		}
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return fields, 0, err
+	}
+	if !seenData {
+		return fields, 0, errors.New("missing data field")
+	}
+	return fields, size, nil
+}
+
+// decodeBase64Field decodes the JSON string value at the start of rest, which
+// follows a field name, into dst. It returns a decoder for the fields after
+// it, or nil when the object ends with it.
+func decodeBase64Field(rest io.Reader, dst io.Writer, maxSize int64) (int64, *json.Decoder, error) {
+	br := bufio.NewReader(rest)
+
+	for _, want := range []byte{':', '"'} {
+		c, err := skipSpace(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c != want {
+			return 0, nil, errors.New("data must be a base64 string")
+		}
+	}
+
+	data := base64.NewDecoder(base64.StdEncoding, &jsonStringReader{r: br})
+	size, err := io.Copy(dst, io.LimitReader(data, maxSize+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxSize {
+		return 0, nil, errUploadTooLarge
+	}
+
+	c, err := skipSpace(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch c {
+	case '}':
+		return size, nil, nil
+	case ',':
+		// Resume as if the remaining fields made up an object of their own.
+		dec := json.NewDecoder(io.MultiReader(strings.NewReader("{"), br))
+		_, err = dec.Token()
+		return size, dec, err
+	default:
+		return 0, nil, errors.New("invalid JSON after data")
+	}
+}
+
+func skipSpace(br *bufio.Reader) (byte, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, nil
+		}
+	}
+}
+
+// jsonStringReader reads the contents of a JSON string up to its closing
+// quote. Escapes a base64 string may legitimately contain, "\/" and line
+// breaks, are unescaped; any other escape is an error.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (s *jsonStringReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		switch c {
+		case '"':
+			s.done = true
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		case '\\':
+			escaped, err := s.r.ReadByte()
+			if err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			switch escaped {
+			case '/':
+				c = '/'
+			case 'n', 'r':
+				c = '\n'
+			default:
+				return n, fmt.Errorf("unexpected escape \\%c in base64 data", escaped)
+			}
+		}
+
+		p[n] = c
+		n++
+		// Stop at what's buffered rather than blocking on the network for
+		// a full buffer.
+		if s.r.Buffered() == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+// readFileHead returns up to n bytes from the start of the file at path.
+func readFileHead(path string, n int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, n)
+	read, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:read], nil
+}
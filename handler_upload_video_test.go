@@ -0,0 +1,1447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestHandlerUploadVideoStoresObject(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+
+	puts := store.callsTo("PutObject")
+	if len(puts) != 1 {
+		t.Fatalf("PutObject calls = %q, want one", puts)
+	}
+	key := puts[0]
+	if !strings.HasPrefix(key, "other/") || !strings.HasSuffix(key, ".mp4") {
+		t.Errorf("key = %q, want other/*.mp4", key)
+	}
+	object, _ := store.object(key)
+	if object.contentType != "video/mp4" {
+		t.Errorf("content type = %q, want video/mp4", object.contentType)
+	}
+	if !bytes.Equal(object.data, mp4Fixture) {
+		t.Errorf("stored %d bytes, want the %d uploaded", len(object.data), len(mp4Fixture))
+	}
+
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.VideoURL == nil || *saved.VideoURL != cfg.getVideoURL(key) {
+		t.Errorf("video_url = %v, want %q", saved.VideoURL, cfg.getVideoURL(key))
+	}
+	if saved.Status != database.VideoStatusReady {
+		t.Errorf("status = %q, want ready", saved.Status)
+	}
+}
+
+func TestHandlerUploadVideoRejectsOtherOwners(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	ownerID, _ := createTestUser(t, cfg)
+	_, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, ownerID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+	if puts := store.callsTo("PutObject"); len(puts) != 0 {
+		t.Errorf("PutObject calls = %q, want none", puts)
+	}
+}
+
+func TestHandlerUploadVideoPutObjectFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	cfg, store := newTestAPIConfig(t)
+	store.putErr = func(*s3.PutObjectInput) error { return errors.New("connection reset") }
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502, body %s", w.Code, w.Body)
+	}
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.Status != database.VideoStatusFailed || saved.FailureReason != "Error when sending file to s3" {
+		t.Errorf("video is %q with reason %q, want failed with the S3 error", saved.Status, saved.FailureReason)
+	}
+	if saved.VideoURL != nil {
+		t.Errorf("video_url = %q, want none", *saved.VideoURL)
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("temp file %s was left behind", entry.Name())
+	}
+}
+
+func TestHandlerUploadVideoThumbnailFailureDeletesObject(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// Sniffs as a PNG but doesn't decode, which only fails once the video
+	// is stored.
+	thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: []byte("\x89PNG\r\n\x1a\nnot really")}
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	puts := store.callsTo("PutObject")
+	if len(puts) != 1 {
+		t.Fatalf("PutObject calls = %q, want one", puts)
+	}
+	if keys := store.keys(); len(keys) != 0 {
+		t.Errorf("objects left in the bucket: %q", keys)
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.VideoURL != nil {
+		t.Errorf("video_url = %q, want none", *saved.VideoURL)
+	}
+}
+
+func TestProcessVideoJobRetryLeavesOneObject(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	tmpPath := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(tmpPath, mp4Fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(processVideoJob{VideoID: video.ID, Path: tmpPath, MediaType: "video/mp4"})
+
+	// The first attempt times out after S3 stored the object.
+	store.putErr = func(params *s3.PutObjectInput) error {
+		store.objects[*params.Key] = fakeObject{data: mp4Fixture, lastModified: time.Now()}
+		return context.DeadlineExceeded
+	}
+	handler := cfg.processVideoJobHandler()
+	if err := handler.run(context.Background(), payload); err == nil {
+		t.Fatal("first attempt succeeded, want the S3 error")
+	}
+	store.putErr = nil
+	if err := handler.run(context.Background(), payload); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+
+	saved := getTestVideo(t, cfg, video.ID)
+	key, _ := cfg.getVideoKeyFromURL(*saved.VideoURL)
+	if keys := store.keys(); len(keys) != 1 || keys[0] != key {
+		t.Errorf("objects = %q, want only the retry's %q", keys, key)
+	}
+}
+
+func TestHandlerUploadVideoConditionalPutRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		metadata   func(params *s3.PutObjectInput) map[string]string
+		wantStatus int
+	}{
+		// The first attempt stored the object but its response was lost,
+		// so the SDK's retry is refused.
+		{"own earlier attempt", func(params *s3.PutObjectInput) map[string]string { return params.Metadata }, http.StatusOK},
+		{"someone else's object", func(*s3.PutObjectInput) map[string]string { return nil }, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.s3ConditionalPut = true
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			existing := []byte("already there")
+			store.putErr = func(params *s3.PutObjectInput) error {
+				store.objects[*params.Key] = fakeObject{data: existing, metadata: tt.metadata(params), lastModified: time.Now()}
+				return nil
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			puts := store.callsTo("PutObject")
+			if len(puts) != 1 {
+				t.Fatalf("PutObject calls = %q, want one", puts)
+			}
+			if _, ok := store.object(puts[0]); !ok {
+				t.Error("object at the key was deleted")
+			}
+			saved := getTestVideo(t, cfg, video.ID)
+			if tt.wantStatus == http.StatusOK && (saved.VideoURL == nil || *saved.VideoURL != cfg.getVideoURL(puts[0])) {
+				t.Errorf("video_url = %v, want %q", saved.VideoURL, cfg.getVideoURL(puts[0]))
+			}
+			if tt.wantStatus != http.StatusOK && saved.VideoURL != nil {
+				t.Errorf("video_url = %q, want none", *saved.VideoURL)
+			}
+		})
+	}
+}
+
+func TestCheckDeclaredSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength string
+		formSize      int64
+		received      int64
+		tolerance     int64
+		wantErr       bool
+	}{
+		{"no Content-Length", "", 100, 100, 0, false},
+		{"matching Content-Length", "100", 100, 100, 0, false},
+		{"truncated body", "150", 100, 100, 0, true},
+		{"within the tolerance", "105", 100, 100, 10, false},
+		{"past the tolerance", "111", 100, 100, 10, true},
+		{"invalid Content-Length", "lots", 100, 100, 0, true},
+		{"short copy", "", 100, 60, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := &multipart.FileHeader{Header: textproto.MIMEHeader{}, Size: tt.formSize}
+			if tt.contentLength != "" {
+				header.Header.Set("Content-Length", tt.contentLength)
+			}
+			err := checkDeclaredSize(header, tt.received, tt.tolerance)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			var uploadErr *uploadError
+			if err != nil && (!errors.As(err, &uploadErr) || uploadErr.code != http.StatusBadRequest) {
+				t.Errorf("err = %v, want a 400 uploadError", err)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoPassthroughDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		duration   string
+		wantStatus int
+	}{
+		{"within the limits", "30", http.StatusOK},
+		{"too short", "2", http.StatusBadRequest},
+		{"too long", "120", http.StatusBadRequest},
+		{"unknown", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.uploadPassthrough = true
+			cfg.minDuration = 5 * time.Second
+			cfg.maxDuration = time.Minute
+			runner := &fakeCommandRunner{respond: ffprobeResponder(ffprobeOutput(t, tt.duration,
+				fakeStream{CodecType: "video", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9"}))}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			probes := runner.callsTo("ffprobe")
+			if len(probes) != 1 || !strings.HasPrefix(probes[0][len(probes[0])-1], "https://") {
+				t.Errorf("ffprobe runs = %q, want one on a presigned URL", probes)
+			}
+			saved := getTestVideo(t, cfg, video.ID)
+			if tt.wantStatus == http.StatusOK {
+				if saved.Duration != 30 {
+					t.Errorf("duration = %v, want 30", saved.Duration)
+				}
+				return
+			}
+			if keys := store.keys(); len(keys) != 0 {
+				t.Errorf("objects left in the bucket: %q", keys)
+			}
+			if saved.VideoURL != nil {
+				t.Errorf("video_url = %q, want none", *saved.VideoURL)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoVisibility(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility string
+		want       database.VideoVisibility
+		wantStatus int
+	}{
+		{"public", "public", database.VideoVisibilityPublic, http.StatusOK},
+		{"unlisted", "unlisted", database.VideoVisibilityUnlisted, http.StatusOK},
+		{"private", "private", database.VideoVisibilityPrivate, http.StatusOK},
+		{"omitted", "", database.VideoVisibilityPublic, http.StatusOK},
+		{"invalid", "friends", database.VideoVisibilityPublic, http.StatusBadRequest},
+	}
+	for _, passthrough := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s passthrough=%v", tt.name, passthrough), func(t *testing.T) {
+				cfg, _ := newTestAPIConfig(t)
+				cfg.uploadPassthrough = passthrough
+				cfg.defaultVisibility = database.VideoVisibilityUnlisted
+				userID, token := createTestUser(t, cfg)
+				video := createTestVideo(t, cfg, userID)
+				video.Visibility = database.VideoVisibilityPublic
+				if err := cfg.db.UpdateVideo(&video); err != nil {
+					t.Fatal(err)
+				}
+
+				parts := []formPart{videoPart(mp4Fixture)}
+				if tt.visibility != "" {
+					parts = append([]formPart{{name: "visibility", data: []byte(tt.visibility)}}, parts...)
+				}
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, parts...))
+
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if saved := getTestVideo(t, cfg, video.ID); saved.Visibility != tt.want {
+					t.Errorf("visibility = %q, want %q", saved.Visibility, tt.want)
+				}
+				audits, err := cfg.db.GetAuditEntries(database.AuditLogFilter{Action: auditVideoVisibility}, 10, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantAudits := 0
+				if tt.want != database.VideoVisibilityPublic {
+					wantAudits = 1
+				}
+				if len(audits) != wantAudits {
+					t.Errorf("%d visibility audit entries, want %d", len(audits), wantAudits)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlerUploadVideoPassthroughTrailingVisibility(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.uploadPassthrough = true
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	video.Visibility = database.VideoVisibilityPublic
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), formPart{name: "visibility", data: []byte("private")}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.VideoURL != nil {
+		t.Errorf("video_url = %q, want none", *saved.VideoURL)
+	}
+	if keys := store.keys(); len(keys) != 0 {
+		t.Errorf("objects left in the bucket: %q", keys)
+	}
+}
+
+func TestUploadProxy(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+
+	cfg.skipVideoProcessing = false
+	cfg.proxyEnabled = true
+	proxyData := []byte("low resolution proxy")
+	cfg.commands = &fakeCommandRunner{respond: ffmpegOutputResponder(proxyData)}
+	tmpPath := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(tmpPath, mp4Fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	video = cfg.uploadProxy(context.Background(), video, tmpPath, key, "landscape")
+
+	proxyKey := getProxyKey(key)
+	object, ok := store.object(proxyKey)
+	if !ok || !bytes.Equal(object.data, proxyData) || object.contentType != "video/mp4" {
+		t.Fatalf("proxy object at %q = %+v, %v, want the generated MP4", proxyKey, object, ok)
+	}
+	if video.ProxyURL == nil || *video.ProxyURL != cfg.getVideoURL(proxyKey) {
+		t.Fatalf("proxy_url = %v, want %q", video.ProxyURL, cfg.getVideoURL(proxyKey))
+	}
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, token, "?proxy=true"))
+	if w.Code != http.StatusFound {
+		t.Fatalf("play status = %d, want 302, body %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); !strings.Contains(location, "/"+proxyKey+"?") {
+		t.Errorf("Location = %q, want a presigned URL for %q", location, proxyKey)
+	}
+}
+
+func TestHandlerUploadVideoFaststartFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		fallback   bool
+		wantStatus int
+	}{
+		{"fallback on", true, http.StatusOK},
+		{"fallback off", false, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.faststartFallback = tt.fallback
+			probe := ffprobeOutput(t, "30",
+				fakeStream{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"},
+				fakeStream{CodecType: "audio", CodecName: "aac"})
+			cfg.commands = &fakeCommandRunner{respond: func(name string, args []string) ([]byte, error) {
+				if name == "ffprobe" {
+					return probe, nil
+				}
+				if slices.Contains(args, "faststart") {
+					return nil, errors.New("exit status 1")
+				}
+				return nil, nil
+			}}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			saved := getTestVideo(t, cfg, video.ID)
+			if !tt.fallback {
+				if saved.VideoURL != nil {
+					t.Errorf("video_url = %q, want none", *saved.VideoURL)
+				}
+				return
+			}
+
+			key, ok := cfg.getVideoKeyFromURL(*saved.VideoURL)
+			if !ok {
+				t.Fatalf("video_url = %q, not one of ours", *saved.VideoURL)
+			}
+			object, _ := store.object(key)
+			if !bytes.Equal(object.data, mp4Fixture) {
+				t.Errorf("stored %d bytes, want the %d uploaded", len(object.data), len(mp4Fixture))
+			}
+			if !saved.Unoptimized {
+				t.Error("unoptimized = false, want true")
+			}
+			if !slices.Contains(saved.Warnings, videoWarning(warningUnoptimized)) {
+				t.Errorf("warnings = %v, want %q", saved.Warnings, warningUnoptimized)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoMinResolution(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		wantStatus    int
+	}{
+		{"landscape at the minimum", 1280, 720, http.StatusOK},
+		{"portrait at the minimum", 720, 1280, http.StatusOK},
+		{"above the minimum", 1920, 1080, http.StatusOK},
+		{"too narrow", 854, 480, http.StatusBadRequest},
+		{"portrait too narrow", 480, 854, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.minWidth = 1280
+			cfg.minHeight = 720
+			probe := ffprobeOutput(t, "30",
+				fakeStream{CodecType: "video", CodecName: "h264", Width: tt.width, Height: tt.height, PixFmt: "yuv420p"},
+				fakeStream{CodecType: "audio", CodecName: "aac"})
+			runner := &fakeCommandRunner{respond: processingResponder(probe, mp4Fixture)}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, w, &resp)
+			if resp.Error != "Video resolution too low, it must be at least 1280x720" {
+				t.Errorf("error = %q", resp.Error)
+			}
+			if puts := store.callsTo("PutObject"); len(puts) != 0 {
+				t.Errorf("PutObject calls = %q, want none", puts)
+			}
+			if ffmpeg := runner.callsTo("ffmpeg"); len(ffmpeg) != 0 {
+				t.Errorf("ffmpeg ran %d times before the check, want none", len(ffmpeg))
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoWarnings(t *testing.T) {
+	h264 := fakeStream{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"}
+	hevc := fakeStream{CodecType: "video", CodecName: "hevc", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"}
+	aac := fakeStream{CodecType: "audio", CodecName: "aac"}
+	tests := []struct {
+		name    string
+		streams []fakeStream
+		want    []string
+	}{
+		{"none", []fakeStream{h264, aac}, nil},
+		{"hevc", []fakeStream{hevc, aac}, []string{warningHEVC}},
+		{"no audio", []fakeStream{h264}, []string{warningNoAudio}},
+		{"hevc without audio", []fakeStream{hevc}, []string{warningNoAudio, warningHEVC}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.commands = &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30", tt.streams...), mp4Fixture)}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+			}
+			var resp map[string]json.RawMessage
+			decodeResponse(t, w, &resp)
+			if _, ok := resp["warnings"]; ok != (tt.want != nil) {
+				t.Errorf("response has warnings = %v, want %v", ok, tt.want != nil)
+			}
+
+			var codes []string
+			for _, warning := range getTestVideo(t, cfg, video.ID).Warnings {
+				if warning.Message == "" {
+					t.Errorf("warning %q has no message", warning.Code)
+				}
+				codes = append(codes, warning.Code)
+			}
+			if !slices.Equal(codes, tt.want) {
+				t.Errorf("warnings = %q, want %q", codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoWarningsReset(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	cfg.skipVideoProcessing = false
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+	for _, codec := range []string{"hevc", "h264"} {
+		cfg.commands = &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30",
+			fakeStream{CodecType: "video", CodecName: codec, Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"},
+			fakeStream{CodecType: "audio", CodecName: "aac"}), mp4Fixture)}
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s upload status = %d, want 200, body %s", codec, w.Code, w.Body)
+		}
+	}
+
+	if warnings := getTestVideo(t, cfg, video.ID).Warnings; len(warnings) != 0 {
+		t.Errorf("warnings = %v after a clean re-upload, want none", warnings)
+	}
+}
+
+func TestUploadInvalidMultipart(t *testing.T) {
+	bodies := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"not multipart", "application/json", `{"video": "clip.mp4"}`},
+		{"no boundary", "multipart/form-data", "--x\r\n\r\n--x--\r\n"},
+		{"truncated", "multipart/form-data; boundary=x", "--x\r\nContent-Disposition: form-data; name=\"video\"; filename=\"clip.mp4\"\r\n\r\npartial"},
+	}
+	handlers := []struct {
+		name    string
+		target  string
+		handler func(*apiConfig) http.HandlerFunc
+	}{
+		{"video", "/api/video_upload/", func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo }},
+		{"thumbnail", "/api/thumbnail_upload/", func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadThumbnail }},
+	}
+	for _, h := range handlers {
+		for _, b := range bodies {
+			t.Run(h.name+" "+b.name, func(t *testing.T) {
+				cfg, store := newTestAPIConfig(t)
+				userID, token := createTestUser(t, cfg)
+				video := createTestVideo(t, cfg, userID)
+
+				r := httptest.NewRequest(http.MethodPost, h.target+video.ID.String(), strings.NewReader(b.body))
+				r.SetPathValue("videoID", video.ID.String())
+				r.Header.Set("Content-Type", b.contentType)
+				r.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				h.handler(cfg)(w, r)
+
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+				}
+				var resp struct {
+					Error string `json:"error"`
+				}
+				decodeResponse(t, w, &resp)
+				if resp.Error != "Unable to parse multipart form" {
+					t.Errorf("error = %q, want the multipart parse error", resp.Error)
+				}
+				if puts := store.callsTo("PutObject"); len(puts) != 0 {
+					t.Errorf("PutObject calls = %q, want none", puts)
+				}
+			})
+		}
+	}
+}
+
+func TestUploadMissingFieldRemovesTempFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// Larger than either handler keeps in memory, so the part spills to a
+	// temp file.
+	wrongField := formPart{name: "file", filename: "clip.mp4", contentType: "video/mp4", data: bytes.Repeat([]byte{0}, 11<<20)}
+	cfg.maxImageUploadSize = 32 << 20
+	for _, target := range []string{"/api/video_upload/", "/api/thumbnail_upload/"} {
+		r := newMultipartRequest(t, http.MethodPost, target+video.ID.String(), token, wrongField)
+		r.SetPathValue("videoID", video.ID.String())
+		w := httptest.NewRecorder()
+		if strings.Contains(target, "video") {
+			cfg.handlerUploadVideo(w, r)
+		} else {
+			cfg.handlerUploadThumbnail(w, r)
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want 400, body %s", target, w.Code, w.Body)
+		}
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("temp file %s was left behind", entry.Name())
+	}
+}
+
+func TestUploadSizeLimits(t *testing.T) {
+	const videoLimit, imageLimit = 1 << 20, 1 << 10
+	largeVideo := append(bytes.Clone(mp4Fixture), make([]byte, videoLimit)...)
+	largeImage := append(pngFixture(t, 16, 16), make([]byte, imageLimit)...)
+	largeThumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: largeImage}
+
+	tests := []struct {
+		name    string
+		request func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request
+		handler func(*apiConfig) http.HandlerFunc
+		wantMsg string
+	}{
+		{
+			name: "video upload over the video limit",
+			request: func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request {
+				return newUploadRequest(t, video.ID, token, videoPart(largeVideo))
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo },
+			wantMsg: fmt.Sprintf("Video must be at most %d bytes", videoLimit),
+		},
+		{
+			name: "video upload with a thumbnail over the image limit",
+			request: func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request {
+				return newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), largeThumbnail)
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo },
+			wantMsg: fmt.Sprintf("Thumbnail must be at most %d bytes", imageLimit),
+		},
+		{
+			name: "thumbnail upload over the image limit",
+			request: func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request {
+				r := newMultipartRequest(t, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, largeThumbnail)
+				r.SetPathValue("videoID", video.ID.String())
+				return r
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadThumbnail },
+			wantMsg: fmt.Sprintf("Thumbnail must be at most %d bytes", imageLimit),
+		},
+		{
+			name: "thumbnail upload within the video limit",
+			request: func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request {
+				thumbnail := largeThumbnail
+				thumbnail.data = append(pngFixture(t, 16, 16), make([]byte, videoLimit/2)...)
+				r := newMultipartRequest(t, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, thumbnail)
+				r.SetPathValue("videoID", video.ID.String())
+				return r
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadThumbnail },
+			wantMsg: fmt.Sprintf("Thumbnail must be at most %d bytes", imageLimit),
+		},
+		{
+			name: "imported thumbnail over the image limit",
+			request: func(t *testing.T, cfg *apiConfig, video database.Video, token string) *http.Request {
+				entry := importEntry("")
+				entry.ThumbnailFile = "thumbnails/a.png"
+				return newImportRequest(t, token, []accountManifestVideo{entry}, map[string][]byte{"thumbnails/a.png": largeImage})
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerAccountImport },
+			wantMsg: fmt.Sprintf("Thumbnail must be at most %d bytes", imageLimit),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.maxVideoUploadSize = videoLimit
+			cfg.maxImageUploadSize = imageLimit
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			tt.handler(cfg)(w, tt.request(t, cfg, video, token))
+
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("status = %d, want 413, body %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, w, &resp)
+			if resp.Error != tt.wantMsg {
+				t.Errorf("error = %q, want %q", resp.Error, tt.wantMsg)
+			}
+			if keys := store.keys(); len(keys) != 0 {
+				t.Errorf("objects left in the bucket: %q", keys)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoNearSquare(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.skipVideoProcessing = false
+	cfg.commands = &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30",
+		fakeStream{CodecType: "video", CodecName: "h264", Width: 1080, Height: 1082, DisplayAspectRatio: "540:541", PixFmt: "yuv420p"},
+		fakeStream{CodecType: "audio", CodecName: "aac"}), mp4Fixture)}
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 64)}
+
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	if keys := store.keys(); len(keys) != 1 || !strings.HasPrefix(keys[0], "square/") {
+		t.Errorf("keys = %q, want one under square/", keys)
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.AspectRatio != "square" {
+		t.Errorf("aspect ratio = %q, want square", saved.AspectRatio)
+	}
+}
+
+func TestHandlerUploadVideoHDR(t *testing.T) {
+	pq := fakeStream{CodecType: "video", CodecName: "hevc", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p10le", ColorTransfer: "smpte2084"}
+	hlg := pq
+	hlg.ColorTransfer = "arib-std-b67"
+	tenBitSDR := pq
+	tenBitSDR.ColorTransfer = "bt709"
+
+	tests := []struct {
+		name       string
+		policy     string
+		stream     fakeStream
+		wantStatus int
+		wantFilter string
+		wantCodes  []string
+	}{
+		{"PQ tone mapped", hdrPolicyTranscode, pq, http.StatusOK, toneMapFilter, []string{warningHEVC, warningHDRTranscoded}},
+		{"HLG tone mapped", hdrPolicyTranscode, hlg, http.StatusOK, toneMapFilter, []string{warningHEVC, warningHDRTranscoded}},
+		{"10-bit SDR only reduced", hdrPolicyTranscode, tenBitSDR, http.StatusOK, "format=yuv420p", []string{warningHEVC, warningHDRTranscoded}},
+		{"allowed as is", hdrPolicyAllow, pq, http.StatusOK, "", []string{warningHEVC, warningHDR}},
+		{"rejected", hdrPolicyReject, pq, http.StatusBadRequest, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.hdrPolicy = tt.policy
+			runner := &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30", tt.stream, fakeStream{CodecType: "audio", CodecName: "aac"}), mp4Fixture)}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var filters []string
+			for _, args := range runner.callsTo("ffmpeg") {
+				if i := slices.Index(args, "-vf"); i >= 0 {
+					filters = append(filters, args[i+1])
+				}
+			}
+			if tt.wantFilter == "" && len(filters) != 0 {
+				t.Errorf("ffmpeg filters = %q, want the video kept as is", filters)
+			}
+			if tt.wantFilter != "" && !slices.Equal(filters, []string{tt.wantFilter}) {
+				t.Errorf("ffmpeg filters = %q, want %q", filters, tt.wantFilter)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			saved := getTestVideo(t, cfg, video.ID)
+			var codes []string
+			for _, warning := range saved.Warnings {
+				codes = append(codes, warning.Code)
+			}
+			if !slices.Equal(codes, tt.wantCodes) {
+				t.Errorf("warnings = %q, want %q", codes, tt.wantCodes)
+			}
+			if tt.wantFilter != "" && (saved.PixFmt != "yuv420p" || saved.ColorTransfer != "bt709") {
+				t.Errorf("stored as %s/%s, want yuv420p/bt709", saved.PixFmt, saved.ColorTransfer)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoWebM(t *testing.T) {
+	vp9 := fakeStream{CodecType: "video", CodecName: "vp9", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"}
+	rotated := vp9
+	rotated.Tags.Rotate = "90"
+	hdr := vp9
+	hdr.PixFmt, hdr.ColorTransfer = "yuv420p10le", "smpte2084"
+
+	tests := []struct {
+		name          string
+		video, audio  fakeStream
+		wantMediaType string
+		wantAudio     []string
+	}{
+		{"stored as uploaded", vp9, fakeStream{CodecType: "audio", CodecName: "opus"}, "video/webm", nil},
+		{"rotated with Opus", rotated, fakeStream{CodecType: "audio", CodecName: "opus"}, "video/mp4", []string{"-c:a", "aac"}},
+		{"rotated with Vorbis", rotated, fakeStream{CodecType: "audio", CodecName: "vorbis"}, "video/mp4", []string{"-c:a", "aac"}},
+		{"HDR with Vorbis", hdr, fakeStream{CodecType: "audio", CodecName: "vorbis"}, "video/mp4", []string{"-c:a", "aac"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.autoOrient = true
+			cfg.hdrPolicy = hdrPolicyTranscode
+			runner := &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30", tt.video, tt.audio), mp4Fixture)}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			webm := formPart{name: "video", filename: "clip.webm", contentType: "video/webm", data: webmFixture}
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, webm, thumbnail))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+			}
+			keys := store.keys()
+			if len(keys) != 1 {
+				t.Fatalf("keys = %q, want one", keys)
+			}
+			object, _ := store.object(keys[0])
+			if object.contentType != tt.wantMediaType || filepath.Ext(keys[0]) != mediaTypeToExt(tt.wantMediaType) {
+				t.Errorf("stored %q as %s, want %s", keys[0], object.contentType, tt.wantMediaType)
+			}
+
+			calls := runner.callsTo("ffmpeg")
+			if tt.wantAudio == nil {
+				if len(calls) != 0 {
+					t.Errorf("ffmpeg runs = %q, want none", calls)
+				}
+				return
+			}
+			if len(calls) != 1 {
+				t.Fatalf("ffmpeg runs = %q, want one", calls)
+			}
+			i := slices.Index(calls[0], "-c:a")
+			if i < 0 || !slices.Equal(calls[0][i:i+2], tt.wantAudio) {
+				t.Errorf("ffmpeg args = %q, want audio %q", calls[0], tt.wantAudio)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoAutoOrient(t *testing.T) {
+	landscape := fakeStream{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"}
+	rotateTag := func(stream fakeStream, rotate string) fakeStream {
+		stream.Tags.Rotate = rotate
+		return stream
+	}
+	displayMatrix := func(stream fakeStream, rotation int) fakeStream {
+		stream.SideDataList = []fakeSideData{{SideDataType: "Display Matrix", Rotation: rotation}}
+		return stream
+	}
+	aac := fakeStream{CodecType: "audio", CodecName: "aac"}
+	opus := fakeStream{CodecType: "audio", CodecName: "opus"}
+	mp4 := videoPart(mp4Fixture)
+	webm := formPart{name: "video", filename: "clip.webm", contentType: "video/webm", data: webmFixture}
+
+	tests := []struct {
+		name       string
+		autoOrient bool
+		part       formPart
+		streams    []fakeStream
+		wantRatio  string
+		wantAudio  string
+		reencoded  bool
+	}{
+		{"rotate tag", true, mp4, []fakeStream{rotateTag(landscape, "90"), aac}, "portrait", "copy", true},
+		{"display matrix", true, mp4, []fakeStream{displayMatrix(landscape, -90), aac}, "portrait", "copy", true},
+		{"upside down", true, mp4, []fakeStream{rotateTag(landscape, "180"), aac}, "landscape", "copy", true},
+		{"rotated WebM", true, webm, []fakeStream{rotateTag(landscape, "270"), opus}, "portrait", "aac", true},
+		{"switched off", false, mp4, []fakeStream{rotateTag(landscape, "90"), aac}, "landscape", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.autoOrient = tt.autoOrient
+			runner := &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30", tt.streams...), mp4Fixture)}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, tt.part, thumbnail))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+			}
+			if saved := getTestVideo(t, cfg, video.ID); saved.AspectRatio != tt.wantRatio {
+				t.Errorf("aspect ratio = %q, want %q", saved.AspectRatio, tt.wantRatio)
+			}
+			if keys := store.keys(); len(keys) != 1 || !strings.HasPrefix(keys[0], tt.wantRatio+"/") {
+				t.Errorf("keys = %q, want one under %s/", keys, tt.wantRatio)
+			}
+
+			var reencoded bool
+			for _, args := range runner.callsTo("ffmpeg") {
+				if !slices.Contains(args, "rotate=0") {
+					continue
+				}
+				reencoded = true
+				if i := slices.Index(args, "-c:a"); i < 0 || args[i+1] != tt.wantAudio {
+					t.Errorf("ffmpeg args = %q, want audio %s", args, tt.wantAudio)
+				}
+			}
+			if reencoded != tt.reencoded {
+				t.Errorf("re-encoded = %v, want %v", reencoded, tt.reencoded)
+			}
+		})
+	}
+}
+
+func TestUploadTempFileExtension(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func(t *testing.T, video database.Video, token string) *http.Request
+		handler func(*apiConfig) http.HandlerFunc
+		wantExt string
+	}{
+		{
+			name: "multipart mp4",
+			request: func(t *testing.T, video database.Video, token string) *http.Request {
+				return newUploadRequest(t, video.ID, token, videoPart(mp4Fixture))
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo },
+			wantExt: ".mp4",
+		},
+		{
+			name: "multipart WebM",
+			request: func(t *testing.T, video database.Video, token string) *http.Request {
+				return newUploadRequest(t, video.ID, token, formPart{name: "video", filename: "clip.webm", contentType: "video/webm", data: webmFixture})
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo },
+			wantExt: ".webm",
+		},
+		{
+			name: "JSON WebM",
+			request: func(t *testing.T, video database.Video, token string) *http.Request {
+				body, err := json.Marshal(map[string]any{"content_type": "video/webm", "data": webmFixture})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String()+"/json", bytes.NewReader(body))
+				r.SetPathValue("videoID", video.ID.String())
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Authorization", "Bearer "+token)
+				return r
+			},
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideoJSON },
+			wantExt: ".webm",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			t.Setenv("TMPDIR", tmpDir)
+
+			cfg, _ := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			runner := &fakeCommandRunner{respond: processingResponder(ffprobeOutput(t, "30",
+				fakeStream{CodecType: "video", CodecName: "vp9", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"},
+				fakeStream{CodecType: "audio", CodecName: "aac"}), mp4Fixture)}
+			cfg.commands = runner
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			tt.handler(cfg)(w, tt.request(t, video, token))
+
+			probes := runner.callsTo("ffprobe")
+			if len(probes) == 0 {
+				t.Fatalf("ffprobe never ran, status %d, body %s", w.Code, w.Body)
+			}
+			input := probes[0][len(probes[0])-1]
+			if filepath.Dir(input) != tmpDir || !strings.HasPrefix(filepath.Base(input), "tubely-upload-") || filepath.Ext(input) != tt.wantExt {
+				t.Errorf("ffprobe input = %q, want tubely-upload-*%s in the temp dir", input, tt.wantExt)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoIdempotencyKeyConcurrent(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	recorders := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		r := newUploadRequest(t, video.ID, token, videoPart(mp4Fixture))
+		r.Header.Set("Idempotency-Key", "upload-1")
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			cfg.handlerUploadVideo(w, r)
+		}(recorders[i])
+	}
+	wg.Wait()
+
+	if puts := store.callsTo("PutObject"); len(puts) != 1 {
+		t.Errorf("PutObject calls = %q, want one", puts)
+	}
+	first, second := recorders[0], recorders[1]
+	if first.Code != http.StatusOK || second.Code != first.Code {
+		t.Fatalf("statuses = %d and %d, want 200 twice", first.Code, second.Code)
+	}
+	var firstVideo, secondVideo database.Video
+	decodeResponse(t, first, &firstVideo)
+	decodeResponse(t, second, &secondVideo)
+	if firstVideo.VideoURL == nil || secondVideo.VideoURL == nil || *firstVideo.VideoURL != *secondVideo.VideoURL {
+		t.Errorf("video_urls = %v and %v, want the same one", firstVideo.VideoURL, secondVideo.VideoURL)
+	}
+}
+
+func TestHandlerUploadVideoIdempotencyKeyReplaysStatus(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.jobs = newJobQueue(cfg.db, "test", 1, 10, 3, time.Millisecond)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	for _, attempt := range []string{"first", "replay"} {
+		r := newUploadRequest(t, video.ID, token, videoPart(mp4Fixture))
+		r.Header.Set("Idempotency-Key", "upload-1")
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, r)
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s status = %d, want 202, body %s", attempt, w.Code, w.Body)
+		}
+	}
+	if stats := cfg.jobs.stats(); stats.Pending != 1 {
+		t.Errorf("%d jobs pending, want one", stats.Pending)
+	}
+	if puts := store.callsTo("PutObject"); len(puts) != 0 {
+		t.Errorf("PutObject calls = %q, want none before processing", puts)
+	}
+}
+
+func TestHandlerUploadVideoMissingOrEmpty(t *testing.T) {
+	tests := []struct {
+		name       string
+		parts      []formPart
+		wantStatus int
+		wantError  string
+	}{
+		{"missing", []formPart{{name: "title", data: []byte("clip")}}, http.StatusBadRequest, "No video field in request"},
+		{"empty", []formPart{videoPart(nil)}, http.StatusBadRequest, "Video file is empty"},
+		{"uploaded", []formPart{videoPart(mp4Fixture)}, http.StatusOK, ""},
+	}
+	for _, passthrough := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s passthrough=%v", tt.name, passthrough), func(t *testing.T) {
+				cfg, store := newTestAPIConfig(t)
+				cfg.uploadPassthrough = passthrough
+				userID, token := createTestUser(t, cfg)
+				video := createTestVideo(t, cfg, userID)
+
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, tt.parts...))
+
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if tt.wantStatus == http.StatusOK {
+					if saved := getTestVideo(t, cfg, video.ID); saved.VideoURL == nil {
+						t.Error("video_url not set")
+					}
+					return
+				}
+				var resp struct {
+					Error string `json:"error"`
+				}
+				decodeResponse(t, w, &resp)
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				if puts := store.callsTo("PutObject"); len(puts) != 0 {
+					t.Errorf("PutObject calls = %q, want none", puts)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlerUploadVideoVerifyDecode(t *testing.T) {
+	decodeFailure := &commandError{name: "ffmpeg", err: &exec.ExitError{}, stderr: "Invalid NAL unit size"}
+	tests := []struct {
+		name       string
+		output     string
+		err        error
+		wantStatus int
+		wantError  string
+	}{
+		{"clean", "", nil, http.StatusOK, ""},
+		{"decode errors on stderr", "[h264 @ 0x5581] error while decoding MB 12 30", nil, http.StatusBadRequest, "Video file is corrupt"},
+		{"ffmpeg fails", "[mov,mp4 @ 0x5581] moov atom not found", decodeFailure, http.StatusBadRequest, "Video file is corrupt"},
+		{"ffmpeg doesn't start", "", exec.ErrNotFound, http.StatusInternalServerError, "Error when checking video"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.skipVideoProcessing = false
+			cfg.verifyDecode = true
+			process := processingResponder(ffprobeOutput(t, "30",
+				fakeStream{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", PixFmt: "yuv420p"},
+				fakeStream{CodecType: "audio", CodecName: "aac"}), mp4Fixture)
+			cfg.commands = &fakeCommandRunner{respond: func(name string, args []string) ([]byte, error) {
+				if name == "ffmpeg" && args[len(args)-2] == "null" {
+					return []byte(tt.output), tt.err
+				}
+				return process(name, args)
+			}}
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var resp struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, w, &resp)
+			if resp.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+			}
+			if puts := store.callsTo("PutObject"); len(puts) != 0 {
+				t.Errorf("PutObject calls = %q, want none", puts)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+	}{
+		{"configured", "public, max-age=31536000, immutable"},
+		{"unset", ""},
+	}
+	for _, passthrough := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s passthrough=%v", tt.name, passthrough), func(t *testing.T) {
+				cfg, store := newTestAPIConfig(t)
+				cfg.uploadPassthrough = passthrough
+				cfg.cacheControl = tt.cacheControl
+				userID, token := createTestUser(t, cfg)
+				video := createTestVideo(t, cfg, userID)
+
+				w := httptest.NewRecorder()
+				cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+				}
+				keys := store.keys()
+				if len(keys) != 1 {
+					t.Fatalf("keys = %q, want one", keys)
+				}
+				if object, _ := store.object(keys[0]); object.cacheControl != tt.cacheControl {
+					t.Errorf("Cache-Control = %q, want %q", object.cacheControl, tt.cacheControl)
+				}
+			})
+		}
+	}
+}
+
+func TestUploadVisibilityEveryPath(t *testing.T) {
+	paths := []struct {
+		name    string
+		handler func(cfg *apiConfig) http.HandlerFunc
+		request func(t *testing.T, store *fakeObjectStore, video database.Video, token, visibility string) *http.Request
+	}{
+		{
+			name:    "multipart",
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideo },
+			request: func(t *testing.T, store *fakeObjectStore, video database.Video, token, visibility string) *http.Request {
+				parts := []formPart{videoPart(mp4Fixture)}
+				if visibility != "" {
+					parts = append(parts, formPart{name: "visibility", data: []byte(visibility)})
+				}
+				return newUploadRequest(t, video.ID, token, parts...)
+			},
+		},
+		{
+			name:    "JSON",
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadVideoJSON },
+			request: func(t *testing.T, store *fakeObjectStore, video database.Video, token, visibility string) *http.Request {
+				fields := map[string]any{"content_type": "video/mp4", "data": mp4Fixture}
+				if visibility != "" {
+					fields["visibility"] = visibility
+				}
+				body, err := json.Marshal(fields)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String()+"/json", bytes.NewReader(body))
+				r.SetPathValue("videoID", video.ID.String())
+				r.Header.Set("Authorization", "Bearer "+token)
+				return r
+			},
+		},
+		{
+			name:    "upload policy",
+			handler: func(cfg *apiConfig) http.HandlerFunc { return cfg.handlerUploadPolicyFinalize },
+			request: func(t *testing.T, store *fakeObjectStore, video database.Video, token, visibility string) *http.Request {
+				key := getDirectUploadPrefix(video.UserID, video.ID) + "video.mp4"
+				store.mu.Lock()
+				store.objects[key] = fakeObject{data: mp4Fixture, contentType: "video/mp4", lastModified: time.Now()}
+				store.mu.Unlock()
+				body, err := json.Marshal(map[string]string{"key": key, "visibility": visibility})
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/upload_policy/finalize", bytes.NewReader(body))
+				r.SetPathValue("videoID", video.ID.String())
+				r.Header.Set("Authorization", "Bearer "+token)
+				return r
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		visibility string
+		wantStatus int
+		want       database.VideoVisibility
+	}{
+		{"omitted keeps the current one", "", http.StatusOK, database.VideoVisibilityPrivate},
+		{"set", "unlisted", http.StatusOK, database.VideoVisibilityUnlisted},
+		{"invalid", "friends", http.StatusBadRequest, database.VideoVisibilityPrivate},
+	}
+	for _, path := range paths {
+		for _, tt := range tests {
+			t.Run(path.name+" "+tt.name, func(t *testing.T) {
+				cfg, store := newTestAPIConfig(t)
+				cfg.defaultVisibility = database.VideoVisibilityPublic
+				userID, token := createTestUser(t, cfg)
+				video := createTestVideo(t, cfg, userID)
+
+				w := httptest.NewRecorder()
+				path.handler(cfg)(w, path.request(t, store, video, token, tt.visibility))
+
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+				}
+				if saved := getTestVideo(t, cfg, video.ID); saved.Visibility != tt.want {
+					t.Errorf("visibility = %q, want %q", saved.Visibility, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlerVideoMetaCreateDefaultVisibility(t *testing.T) {
+	for _, visibility := range []database.VideoVisibility{database.VideoVisibilityPrivate, database.VideoVisibilityPublic} {
+		cfg, _ := newTestAPIConfig(t)
+		cfg.defaultVisibility = visibility
+		_, token := createTestUser(t, cfg)
+
+		r := httptest.NewRequest(http.MethodPost, "/api/videos", strings.NewReader(`{"title":"New video"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.handlerVideoMetaCreate(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status = %d, want 201, body %s", w.Code, w.Body)
+		}
+		var created database.Video
+		decodeResponse(t, w, &created)
+		if saved := getTestVideo(t, cfg, created.ID); saved.Visibility != visibility {
+			t.Errorf("visibility = %q, want DEFAULT_VISIBILITY %q", saved.Visibility, visibility)
+		}
+
+		// Uploading without a visibility field leaves it alone.
+		w = httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(t, created.ID, token, videoPart(mp4Fixture)))
+		if saved := getTestVideo(t, cfg, created.ID); w.Code != http.StatusOK || saved.Visibility != visibility {
+			t.Errorf("after upload: status %d, visibility %q, want 200 and %q", w.Code, saved.Visibility, visibility)
+		}
+	}
+}
+
+// failingModerator fails every request, as an unreachable moderation
+// service would.
+type failingModerator struct{}
+
+func (failingModerator) Moderate(ctx context.Context, req moderationRequest) (moderationVerdict, error) {
+	return "", errors.New("moderation service unavailable")
+}
+
+func TestHandlerUploadVideoThumbnailCleanup(t *testing.T) {
+	for _, passthrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("passthrough=%v", passthrough), func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			userID, token := createTestUser(t, cfg)
+			video, _, oldAsset := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+			cfg.uploadPassthrough = passthrough
+			thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 32, 18)}
+
+			// A failed re-upload removes the thumbnail it stored and keeps
+			// the video's.
+			cfg.moderator = failingModerator{}
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, thumbnail, videoPart(mp4Fixture)))
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("failed upload status = %d, want 502, body %s", w.Code, w.Body)
+			}
+			if assets := assetFiles(t, cfg); !slices.Equal(assets, []string{oldAsset}) {
+				t.Errorf("assets after a failed upload = %q, want only %q", assets, oldAsset)
+			}
+			if saved := getTestVideo(t, cfg, video.ID); *saved.ThumbnailURL != *video.ThumbnailURL {
+				t.Errorf("thumbnail after a failed upload = %q, want %q", *saved.ThumbnailURL, *video.ThumbnailURL)
+			}
+
+			// A successful one removes the thumbnail it replaced.
+			cfg.moderator = nil
+			w = httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, thumbnail, videoPart(mp4Fixture)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("upload status = %d, want 200, body %s", w.Code, w.Body)
+			}
+			saved := getTestVideo(t, cfg, video.ID)
+			newAsset, _ := cfg.getAssetPathFromURL(*saved.ThumbnailURL)
+			if assets := assetFiles(t, cfg); newAsset == oldAsset || !slices.Equal(assets, []string{newAsset}) {
+				t.Errorf("assets after the upload = %q, want only the new %q", assets, newAsset)
+			}
+		})
+	}
+}
+
+// assetFiles lists the files in the assets directory.
+func assetFiles(t *testing.T, cfg *apiConfig) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
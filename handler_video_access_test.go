@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newAccessRequest(t *testing.T, method string, videoID uuid.UUID, token, user, body string) *http.Request {
+	t.Helper()
+
+	target := "/api/videos/" + videoID.String() + "/access"
+	if user != "" {
+		target += "/" + user
+	}
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.SetPathValue("videoID", videoID.String())
+	r.SetPathValue("userID", user)
+	return r
+}
+
+func TestHandlerVideoAccessGrantHidesUnknownEmails(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	ownerID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, ownerID)
+	viewerID, _ := createTestUser(t, cfg)
+	viewer, err := cfg.db.GetUser(viewerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := httptest.NewRecorder()
+	cfg.handlerVideoAccessGrant(known, newAccessRequest(t, http.MethodPost, video.ID, token, "", `{"email":"`+viewer.Email+`"}`))
+	unknown := httptest.NewRecorder()
+	cfg.handlerVideoAccessGrant(unknown, newAccessRequest(t, http.MethodPost, video.ID, token, "", `{"email":"nobody@tubely.test"}`))
+
+	if known.Code != http.StatusNoContent || unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Errorf("known email got %d %q, unknown got %d %q, want the same 204", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+	share, err := cfg.db.GetVideoShare(video.ID, viewerID)
+	if err != nil || share.VideoID != video.ID {
+		t.Errorf("video wasn't shared with the known user: %+v, %v", share, err)
+	}
+}
+
+func TestHandlerVideoAccessRevokeByEmail(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	ownerID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, ownerID)
+	viewerID, _ := createTestUser(t, cfg)
+	viewer, err := cfg.db.GetUser(viewerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.CreateVideoShare(video.ID, viewerID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{viewer.Email, "nobody@tubely.test"} {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoAccessRevoke(w, newAccessRequest(t, http.MethodDelete, video.ID, token, user, ""))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("revoking %s: status = %d, want 204, body %s", user, w.Code, w.Body)
+		}
+	}
+	share, err := cfg.db.GetVideoShare(video.ID, viewerID)
+	if err != nil || share.VideoID != uuid.Nil {
+		t.Errorf("share still there after revoking: %+v, %v", share, err)
+	}
+}
+
+func TestFlaggedVideoHiddenFromNonOwners(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	ownerID, ownerToken := createTestUser(t, cfg)
+	viewerID, viewerToken := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, ownerID, ownerToken, formPart{name: "visibility", data: []byte("public")})
+	if _, err := cfg.db.CreateVideoShare(video.ID, viewerID); err != nil {
+		t.Fatal(err)
+	}
+	link, err := cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		VideoID:         video.ID,
+		UserID:          ownerID,
+		TTLSeconds:      3600,
+		AllowedReferrer: "example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video.Status = database.VideoStatusFlagged
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		for _, tt := range []struct {
+			token      string
+			wantStatus int
+		}{
+			{ownerToken, http.StatusOK},
+			{viewerToken, http.StatusNotFound},
+			{"", http.StatusNotFound},
+		} {
+			r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+			r.SetPathValue("videoID", video.ID.String())
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerVideoGet(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+		}
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		for _, tt := range []struct {
+			token string
+			query string
+			want  int
+		}{
+			{ownerToken, "", 1},
+			{viewerToken, "?user_id=" + ownerID.String(), 0},
+			{viewerToken, "?shared=true", 0},
+		} {
+			w := httptest.NewRecorder()
+			cfg.handlerVideosRetrieve(w, newVideosRequest(t, tt.token, tt.query, ""))
+			var res []database.Video
+			decodeResponse(t, w, &res)
+			if w.Code != http.StatusOK || len(res) != tt.want {
+				t.Errorf("%q: status = %d with %d videos, want 200 with %d", tt.query, w.Code, len(res), tt.want)
+			}
+		}
+	})
+
+	t.Run("share creation", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/share", nil)
+		r.SetPathValue("videoID", video.ID.String())
+		r.Header.Set("Authorization", "Bearer "+ownerToken)
+		w := httptest.NewRecorder()
+		cfg.handlerVideoShare(w, r)
+		if w.Code != http.StatusConflict {
+			t.Errorf("status = %d, want 409, body %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("share link", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		cfg.handlerShareFollow(w, newShareFollowRequest(link.ID, "198.51.100.7:1234", map[string]string{"Referer": "https://example.com/"}))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404, body %s", w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	maxVideoAttributes         = 50
+	maxVideoAttributeKeyLength = 64
+	maxVideoAttributeValueSize = 1 << 10
+	// maxVideoAttributesSize bounds the stored object as a whole, and so
+	// the size of every video response.
+	maxVideoAttributesSize = 16 << 10
+)
+
+var attributeKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// handlerVideoAttributesUpdate merges the JSON object in the body into the
+// video's attributes: keys set to null are removed, any other value replaces
+// the current one, and keys left out are kept.
+func (cfg *apiConfig) handlerVideoAttributesUpdate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVideoAttributesSize)).Decode(&patch)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Attributes must be a JSON object", err)
+		return
+	}
+
+	unlock := cfg.idempotencyLocks.lock("attributes:" + video.ID.String())
+	defer unlock()
+
+	// Re-read under the lock so concurrent merges don't drop each other's
+	// keys.
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+
+	attributes, err := mergeVideoAttributes(video.Attributes, patch)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	video.Attributes = attributes
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoAttributes)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// mergeVideoAttributes applies patch to current, returning the result
+// without modifying current. It fails when a key or value is out of bounds
+// or the result would grow too large.
+func mergeVideoAttributes(current database.VideoAttributes, patch map[string]json.RawMessage) (database.VideoAttributes, error) {
+	merged := database.VideoAttributes{}
+	for key, value := range current {
+		merged[key] = value
+	}
+
+	for key, value := range patch {
+		if len(key) > maxVideoAttributeKeyLength || !attributeKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("attribute keys must be 1 to %d letters, digits, '_', '.', ':' or '-', got %q", maxVideoAttributeKeyLength, key)
+		}
+
+		var compact bytes.Buffer
+		err := json.Compact(&compact, value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q isn't valid JSON", key)
+		}
+		if compact.String() == "null" {
+			delete(merged, key)
+			continue
+		}
+		if compact.Len() > maxVideoAttributeValueSize {
+			return nil, fmt.Errorf("attribute %q must be at most %d bytes", key, maxVideoAttributeValueSize)
+		}
+		merged[key] = json.RawMessage(compact.Bytes())
+	}
+
+	if len(merged) > maxVideoAttributes {
+		return nil, fmt.Errorf("a video can have at most %d attributes", maxVideoAttributes)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxVideoAttributesSize {
+		return nil, fmt.Errorf("attributes must be at most %d bytes in total", maxVideoAttributesSize)
+	}
+	return merged, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// jobKindReplaceVideo jobs carry a processVideoJob payload.
+const jobKindReplaceVideo = "replace_video"
+
+// videoContentLockKey is the lock held while a video's content is being
+// swapped out, by a trim or a replacement, so only one runs at a time.
+func videoContentLockKey(videoID uuid.UUID) string {
+	return "content:" + videoID.String()
+}
+
+// handlerVideoContentReplace swaps the content of a ready video for a new
+// upload, sent as a multipart form like to handlerUploadVideo. The video
+// keeps its ID, title, thumbnail and everything else that isn't derived from
+// the content. The upload goes through the full pipeline to a new key, and
+// the old objects are only deleted once the video points at the new ones.
+// The video is processing meanwhile; should the replacement fail, it's back
+// to ready with its old content and the failure as its failure reason.
+func (cfg *apiConfig) handlerVideoContentReplace(w http.ResponseWriter, r *http.Request) {
+	video, unlock, ok := cfg.beginVideoUpload(w, r, false)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	contentUnlock := cfg.idempotencyLocks.lock(videoContentLockKey(video.ID))
+	defer contentUnlock()
+
+	// Re-read under the lock, a concurrent trim or replacement may have
+	// started meanwhile.
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Only ready videos can have their content replaced", nil)
+		return
+	}
+
+	// A replacement keeps the video's visibility unless it asks for another.
+	cfg.receiveVideoForm(w, r, video, cfg.finishContentReplace)
+}
+
+// finishContentReplace is finishVideoUpload for replacements. It takes
+// ownership of the temp file.
+func (cfg *apiConfig) finishContentReplace(w http.ResponseWriter, r *http.Request, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload) {
+	// Uploading over the current key would overwrite the content being
+	// replaced before the new one is known to be good, and a failure would
+	// then delete it.
+	if currentKey, ok := cfg.getVideoKeyFromURL(*video.VideoURL); ok && customKey == currentKey {
+		os.Remove(tmpPath)
+		respondWithError(w, http.StatusBadRequest, "Invalid key: the replacement must be stored under a different key than the current content", nil)
+		return
+	}
+
+	video.Status = database.VideoStatusProcessing
+	err := cfg.saveVideo(&video)
+	if err != nil {
+		os.Remove(tmpPath)
+		respondWithError(w, http.StatusInternalServerError, "Error when updating video", err)
+		return
+	}
+
+	if cfg.jobs != nil {
+		payload := processVideoJob{
+			VideoID:   video.ID,
+			Path:      tmpPath,
+			MediaType: mediaType,
+			CustomKey: customKey,
+		}
+		if thumbnail != nil {
+			payload.Thumbnail = thumbnail.data
+			payload.ThumbnailMediaType = thumbnail.mediaType
+		}
+
+		err = cfg.jobs.enqueue(r.Context(), jobKindReplaceVideo, payload)
+		if err != nil {
+			os.Remove(tmpPath)
+			cfg.restoreReplacedVideo(r.Context(), video.ID, err)
+			if errors.Is(err, errQueueFull) {
+				respondWithError(w, http.StatusServiceUnavailable, "Too many videos are being processed, try again later", err)
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+			return
+		}
+
+		cfg.recordIdempotencyKey(r, video, http.StatusAccepted)
+		cfg.recordAudit(r, video.UserID, video.ID, auditVideoReplace)
+		respondWithJSON(w, http.StatusAccepted, video)
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	video, err = cfg.replaceVideoContent(r.Context(), video, tmpPath, mediaType, customKey, thumbnail)
+	if err != nil {
+		cfg.restoreReplacedVideo(r.Context(), video.ID, err)
+		respondWithUploadError(w, err)
+		return
+	}
+
+	cfg.recordIdempotencyKey(r, video, http.StatusOK)
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoReplace)
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// replaceVideoJobHandler runs jobKindReplaceVideo jobs, retrying them like
+// jobKindProcessVideo ones.
+func (cfg *apiConfig) replaceVideoJobHandler() jobHandler {
+	decode := func(payload []byte) (processVideoJob, error) {
+		var job processVideoJob
+		err := json.Unmarshal(payload, &job)
+		return job, err
+	}
+
+	return jobHandler{
+		run: func(ctx context.Context, payload []byte) error {
+			job, err := decode(payload)
+			if err != nil {
+				return &permanentJobError{err: fmt.Errorf("couldn't decode job payload: %w", err)}
+			}
+
+			video, err := cfg.db.GetVideo(job.VideoID)
+			if err != nil {
+				return err
+			}
+			if video.ID == uuid.Nil {
+				os.Remove(job.Path)
+				return nil
+			}
+
+			_, err = os.Stat(job.Path)
+			if err != nil {
+				return &permanentJobError{err: &uploadError{http.StatusGone, "Uploaded video was lost before it could be processed", err}}
+			}
+
+			var thumbnail *thumbnailUpload
+			if job.Thumbnail != nil {
+				thumbnail = &thumbnailUpload{data: job.Thumbnail, mediaType: job.ThumbnailMediaType}
+			}
+
+			_, err = cfg.replaceVideoContent(ctx, video, job.Path, job.MediaType, job.CustomKey, thumbnail)
+			if err != nil {
+				if uploadErrorCode(err) < 500 {
+					return &permanentJobError{err: err}
+				}
+				return err
+			}
+			os.Remove(job.Path)
+			return nil
+		},
+		onFailure: func(ctx context.Context, payload []byte, err error) {
+			job, decodeErr := decode(payload)
+			if decodeErr != nil {
+				return
+			}
+			os.Remove(job.Path)
+			cfg.restoreReplacedVideo(ctx, job.VideoID, err)
+		},
+		local: true,
+	}
+}
+
+// replaceVideoContent runs the upload at tmpPath through the upload pipeline
+// for video and, once the video points at the result, deletes the objects of
+// its previous content. Errors are *uploadError values.
+func (cfg *apiConfig) replaceVideoContent(ctx context.Context, video database.Video, tmpPath, mediaType, customKey string, thumbnail *thumbnailUpload) (database.Video, error) {
+	old := video
+	video, err := cfg.processUploadedVideo(ctx, video, tmpPath, mediaType, customKey, thumbnail)
+	if err != nil {
+		return video, err
+	}
+	cfg.discardReplacedObjects(ctx, old, video)
+	return video, nil
+}
+
+// restoreReplacedVideo puts a video whose replacement failed back to ready.
+// Its old content is untouched until a replacement succeeds. The failure is
+// kept as the video's failure reason so its owner can see what happened.
+func (cfg *apiConfig) restoreReplacedVideo(ctx context.Context, videoID uuid.UUID, err error) {
+	logf(ctx, "Replacing content of video %v failed: %v", videoID, err)
+
+	// Re-read, the pipeline may have saved the video before it failed.
+	video, getErr := cfg.db.GetVideo(videoID)
+	if getErr != nil || video.ID == uuid.Nil {
+		return
+	}
+
+	msg := "Replacing content failed"
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		msg = uploadErr.msg
+	}
+
+	video.Status = database.VideoStatusReady
+	video.FailureReason = msg
+	updateErr := cfg.saveVideo(&video)
+	if updateErr != nil {
+		logf(ctx, "Couldn't restore video %v after a failed replacement: %v", video.ID, updateErr)
+	}
+}
+
+// discardReplacedObjects deletes the content, preview, proxy and storyboard
+// objects of old that the video no longer references now that it's been
+// saved as current. Objects current overwrote in place are kept.
+func (cfg *apiConfig) discardReplacedObjects(ctx context.Context, old, current database.Video) {
+	if old.VideoURL != nil && (current.VideoURL == nil || *old.VideoURL != *current.VideoURL) {
+		if key, ok := cfg.getVideoKeyFromURL(*old.VideoURL); ok {
+			cfg.deleteObject(ctx, key)
+			cfg.objectInfoCache.delete(key)
+		}
+	}
+	if old.PreviewURL != nil && (current.PreviewURL == nil || *old.PreviewURL != *current.PreviewURL) {
+		if previewKey, ok := cfg.getVideoKeyFromURL(*old.PreviewURL); ok {
+			cfg.deleteObject(ctx, previewKey)
+		}
+	}
+	if old.ProxyURL != nil && (current.ProxyURL == nil || *old.ProxyURL != *current.ProxyURL) {
+		if proxyKey, ok := cfg.getVideoKeyFromURL(*old.ProxyURL); ok {
+			cfg.deleteObject(ctx, proxyKey)
+		}
+	}
+	if old.StoryboardURL != nil && (current.StoryboardURL == nil || *old.StoryboardURL != *current.StoryboardURL) {
+		for _, storyboardKey := range cfg.storyboardKeys(old.StoryboardURL) {
+			cfg.deleteObject(ctx, storyboardKey)
+		}
+	}
+}
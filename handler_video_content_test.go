@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// uploadTestVideo uploads mp4Fixture as a new video of userID's, returning
+// it ready and the key of its content.
+func uploadTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID, token string, parts ...formPart) (database.Video, string) {
+	t.Helper()
+
+	video := createTestVideo(t, cfg, userID)
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, append([]formPart{videoPart(mp4Fixture)}, parts...)...))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	video = getTestVideo(t, cfg, video.ID)
+	key, _ := cfg.getVideoKeyFromURL(*video.VideoURL)
+	return video, key
+}
+
+func newContentReplaceRequest(t *testing.T, videoID uuid.UUID, token string, parts ...formPart) *http.Request {
+	t.Helper()
+
+	r := newMultipartRequest(t, http.MethodPut, "/api/videos/"+videoID.String()+"/content", token, parts...)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func TestHandlerVideoContentReplace(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, oldKey := uploadTestVideo(t, cfg, userID, token)
+
+	// The old object may only go once the video no longer refers to it.
+	var urlAtDelete *string
+	store.deleteErr = func(key string) error {
+		if key == oldKey {
+			urlAtDelete = getTestVideo(t, cfg, video.ID).VideoURL
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoContentReplace(w, newContentReplaceRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	saved := getTestVideo(t, cfg, video.ID)
+	newKey, _ := cfg.getVideoKeyFromURL(*saved.VideoURL)
+	if newKey == oldKey || saved.Status != database.VideoStatusReady {
+		t.Fatalf("video is %s at %q, want ready at a new key", saved.Status, newKey)
+	}
+	if urlAtDelete == nil || *urlAtDelete != *saved.VideoURL {
+		t.Errorf("old object deleted while the video pointed at %v", urlAtDelete)
+	}
+	if keys := store.keys(); len(keys) != 1 || keys[0] != newKey {
+		t.Errorf("objects = %q, want only %q", keys, newKey)
+	}
+}
+
+func TestHandlerVideoContentReplaceRejectsCurrentKey(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	key := cfg.getCustomKeyPrefix(userID) + "clip.mp4"
+	video, _ := uploadTestVideo(t, cfg, userID, token, formPart{name: "key", data: []byte(key)})
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoContentReplace(w, newContentReplaceRequest(t, video.ID, token, videoPart(mp4Fixture), formPart{name: "key", data: []byte(key)}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	if puts := store.callsTo("PutObject"); len(puts) != 1 {
+		t.Errorf("PutObject calls = %q, want only the first upload", puts)
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.Status != database.VideoStatusReady || *saved.VideoURL != *video.VideoURL {
+		t.Errorf("video = %s at %v, want it untouched", saved.Status, *saved.VideoURL)
+	}
+}
+
+func TestHandlerVideoContentReplaceThumbnailFailure(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, oldKey := uploadTestVideo(t, cfg, userID, token)
+
+	thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: []byte("\x89PNG\r\n\x1a\nnot really")}
+	w := httptest.NewRecorder()
+	cfg.handlerVideoContentReplace(w, newContentReplaceRequest(t, video.ID, token, videoPart(mp4Fixture), thumbnail))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.Status != database.VideoStatusReady || *saved.VideoURL != *video.VideoURL {
+		t.Errorf("video = %s at %v, want ready on its old content", saved.Status, *saved.VideoURL)
+	}
+	if keys := store.keys(); len(keys) != 1 || keys[0] != oldKey {
+		t.Errorf("objects = %q, want only the old %q", keys, oldKey)
+	}
+}
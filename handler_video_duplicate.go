@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerVideoDuplicate creates a private copy of one of the caller's ready
+// videos, with its own copies of the video, preview, proxy, storyboard and
+// thumbnail so either can be changed or deleted without affecting the other.
+// The objects are copied within the bucket, so none of the bytes go through
+// the server. Shares aren't carried over.
+func (cfg *apiConfig) handlerVideoDuplicate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if !cfg.requireActiveUser(w, video.UserID) {
+		return
+	}
+
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Only ready videos can be duplicated", nil)
+		return
+	}
+	videoKey, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, "Video isn't stored in the bucket", nil)
+		return
+	}
+
+	unlock := cfg.idempotencyLocks.lock(videoLimitLockKey(video.UserID))
+	defer unlock()
+	if !cfg.checkVideoLimit(w, video.UserID) {
+		return
+	}
+
+	// Whatever was copied is removed again if the duplicate isn't saved.
+	var copiedKeys []string
+	var copiedThumbnail string
+	saved := false
+	defer func() {
+		if saved {
+			return
+		}
+		for _, key := range copiedKeys {
+			cfg.deleteObject(context.WithoutCancel(r.Context()), key)
+		}
+		if copiedThumbnail != "" {
+			cfg.removeAsset(r.Context(), copiedThumbnail)
+		}
+	}()
+
+	duplicate := video
+	duplicate.Visibility = database.VideoVisibilityPrivate
+	duplicate.RetryCount = 0
+
+	newVideoKey := cfg.getVideoKey(video.UserID, video.AspectRatio, path.Ext(videoKey))
+	err := cfg.store.Copy(r.Context(), cfg.s3Bucket, videoKey, newVideoKey)
+	if isMissingObject(err) {
+		respondWithError(w, http.StatusConflict, "Video content is missing", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't copy video", err)
+		return
+	}
+	copiedKeys = append(copiedKeys, newVideoKey)
+	newVideoURL := cfg.getVideoURL(newVideoKey)
+	duplicate.VideoURL = &newVideoURL
+
+	// A preview is optional, so a missing one is left off the duplicate.
+	duplicate.PreviewURL = nil
+	if video.PreviewURL != nil {
+		if previewKey, ok := cfg.getVideoKeyFromURL(*video.PreviewURL); ok {
+			newPreviewKey := getPreviewKey(newVideoKey)
+			err = cfg.store.Copy(r.Context(), cfg.s3Bucket, previewKey, newPreviewKey)
+			if err != nil && !isMissingObject(err) {
+				respondWithError(w, http.StatusBadGateway, "Couldn't copy preview", err)
+				return
+			}
+			if err == nil {
+				copiedKeys = append(copiedKeys, newPreviewKey)
+				newPreviewURL := cfg.getVideoURL(newPreviewKey)
+				duplicate.PreviewURL = &newPreviewURL
+			}
+		}
+	}
+
+	duplicate.ProxyURL = nil
+	if video.ProxyURL != nil {
+		if proxyKey, ok := cfg.getVideoKeyFromURL(*video.ProxyURL); ok {
+			newProxyKey := getProxyKey(newVideoKey)
+			err = cfg.store.Copy(r.Context(), cfg.s3Bucket, proxyKey, newProxyKey)
+			if err != nil && !isMissingObject(err) {
+				respondWithError(w, http.StatusBadGateway, "Couldn't copy proxy", err)
+				return
+			}
+			if err == nil {
+				copiedKeys = append(copiedKeys, newProxyKey)
+				newProxyURL := cfg.getVideoURL(newProxyKey)
+				duplicate.ProxyURL = &newProxyURL
+			}
+		}
+	}
+
+	duplicate.StoryboardURL = nil
+	if keys := cfg.storyboardKeys(video.StoryboardURL); keys != nil {
+		newStoryboardKey := getStoryboardKey(newVideoKey)
+		err = cfg.copyStoryboard(r.Context(), duplicate, keys[0], newStoryboardKey)
+		if err != nil && !isMissingObject(err) {
+			respondWithError(w, http.StatusBadGateway, "Couldn't copy storyboard", err)
+			return
+		}
+		if err == nil {
+			copiedKeys = append(copiedKeys, newStoryboardKey, getStoryboardSpriteKey(newStoryboardKey))
+			newStoryboardURL := cfg.getVideoURL(newStoryboardKey)
+			duplicate.StoryboardURL = &newStoryboardURL
+		}
+	}
+
+	if video.ThumbnailURL != nil {
+		thumbnailURL, err := cfg.copyThumbnailAsset(*video.ThumbnailURL)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		if thumbnailURL != *video.ThumbnailURL {
+			copiedThumbnail = thumbnailURL
+		}
+		duplicate.ThumbnailURL = &thumbnailURL
+	}
+
+	duplicate, err = cfg.db.CopyVideo(duplicate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		return
+	}
+	saved = true
+
+	cfg.recordAudit(r, duplicate.UserID, duplicate.ID, auditVideoDuplicate)
+	respondWithJSON(w, http.StatusCreated, duplicate)
+}
+
+// copyStoryboard copies the storyboard track at srcKey and its sprite to
+// dstKey. The track names its sprite by URL, so it's rewritten to point at
+// the copy rather than copied as is.
+func (cfg *apiConfig) copyStoryboard(ctx context.Context, video database.Video, srcKey, dstKey string) error {
+	srcSpriteKey, dstSpriteKey := getStoryboardSpriteKey(srcKey), getStoryboardSpriteKey(dstKey)
+
+	obj, err := cfg.store.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &srcKey,
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	vtt, err := io.ReadAll(io.LimitReader(obj.Body, maxStoryboardTrackSize))
+	if err != nil {
+		return err
+	}
+
+	err = cfg.store.Copy(ctx, cfg.s3Bucket, srcSpriteKey, dstSpriteKey)
+	if err != nil {
+		return err
+	}
+
+	vtt = bytes.ReplaceAll(vtt, []byte(cfg.getVideoURL(srcSpriteKey)), []byte(cfg.getVideoURL(dstSpriteKey)))
+	mediaType := "text/vtt"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &dstKey,
+		Body:         bytes.NewReader(vtt),
+		ContentType:  &mediaType,
+		Tagging:      cfg.getObjectTagging(video.UserID, video.AspectRatio, mediaType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		cfg.deleteObject(ctx, dstSpriteKey)
+		return err
+	}
+	return nil
+}
+
+// copyThumbnailAsset copies the local thumbnail file behind thumbnailURL,
+// returning the copy's URL. Thumbnails that aren't local assets are shared
+// as is. Errors are *uploadError values.
+func (cfg *apiConfig) copyThumbnailAsset(thumbnailURL string) (string, error) {
+	assetPath, ok := cfg.getAssetPathFromURL(thumbnailURL)
+	if !ok {
+		return thumbnailURL, nil
+	}
+
+	src, err := os.Open(cfg.getAssetDiskPath(assetPath))
+	if err != nil {
+		return "", &uploadError{http.StatusInternalServerError, "Error when copying thumbnail", err}
+	}
+	defer src.Close()
+
+	if cfg.assetsMaxBytes > 0 {
+		info, err := src.Stat()
+		if err != nil {
+			return "", &uploadError{http.StatusInternalServerError, "Error when copying thumbnail", err}
+		}
+		usage, err := cfg.assetsDirSize()
+		if err != nil {
+			return "", &uploadError{http.StatusInternalServerError, "Error when checking storage usage", err}
+		}
+		if usage+info.Size() > cfg.assetsMaxBytes {
+			return "", &uploadError{http.StatusInsufficientStorage, "Not enough storage left for thumbnail", nil}
+		}
+	}
+
+	newAssetPath := getAssetPath(path.Ext(assetPath))
+	dst, err := os.Create(cfg.getAssetDiskPath(newAssetPath))
+	if err != nil {
+		return "", &uploadError{http.StatusInternalServerError, "Error when copying thumbnail", err}
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", &uploadError{http.StatusInternalServerError, "Error when copying thumbnail", err}
+	}
+
+	return cfg.getAssetURL(newAssetPath), nil
+}
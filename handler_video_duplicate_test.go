@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newDuplicateRequest(t *testing.T, videoID uuid.UUID, token string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/"+videoID.String()+"/duplicate", nil)
+	r.SetPathValue("videoID", videoID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestHandlerVideoDuplicate(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key, assetPath := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+	video.Visibility = database.VideoVisibilityPublic
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatalf("UpdateVideo: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoDuplicate(w, newDuplicateRequest(t, video.ID, token))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201, body %s", w.Code, w.Body)
+	}
+	var duplicate database.Video
+	decodeResponse(t, w, &duplicate)
+	if duplicate.ID == video.ID {
+		t.Fatal("duplicate has the original's ID")
+	}
+
+	// The row is inserted with its final fields rather than created and
+	// then updated.
+	saved := getTestVideo(t, cfg, duplicate.ID)
+	if saved.Version != 0 {
+		t.Errorf("version = %d, want 0", saved.Version)
+	}
+	if saved.Visibility != database.VideoVisibilityPrivate {
+		t.Errorf("visibility = %q, want private", saved.Visibility)
+	}
+	if saved.Status != database.VideoStatusReady {
+		t.Errorf("status = %q, want ready", saved.Status)
+	}
+	if saved.Title != video.Title || saved.Duration != video.Duration || saved.AspectRatio != video.AspectRatio || saved.Size != video.Size {
+		t.Errorf("duplicate = %+v, want the fields of %+v", saved, video)
+	}
+
+	if saved.VideoURL == nil || *saved.VideoURL == *video.VideoURL {
+		t.Fatalf("video_url = %v, want a copy of %q", saved.VideoURL, *video.VideoURL)
+	}
+	newKey, _ := cfg.getVideoKeyFromURL(*saved.VideoURL)
+	if _, ok := store.object(newKey); !ok {
+		t.Errorf("copied video %q isn't stored", newKey)
+	}
+	if _, ok := store.object(key); !ok {
+		t.Errorf("original video %q is gone", key)
+	}
+
+	if saved.ThumbnailURL == nil || *saved.ThumbnailURL == *video.ThumbnailURL {
+		t.Fatalf("thumbnail_url = %v, want a copy of %q", saved.ThumbnailURL, *video.ThumbnailURL)
+	}
+	newAssetPath, _ := cfg.getAssetPathFromURL(*saved.ThumbnailURL)
+	if files := assetFiles(t, cfg); !slices.Contains(files, assetPath) || !slices.Contains(files, newAssetPath) {
+		t.Errorf("assets = %q, want %q and %q", files, assetPath, newAssetPath)
+	}
+}
+
+func TestHandlerVideoDuplicateNotReady(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoDuplicate(w, newDuplicateRequest(t, video.ID, token))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409, body %s", w.Code, w.Body)
+	}
+	if copies := store.callsTo("Copy"); len(copies) != 0 {
+		t.Errorf("Copy calls = %q, want none", copies)
+	}
+}
+
+func TestHandlerVideoDuplicateCleanup(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, _, assetPath := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+	keys := store.keys()
+
+	// The video is copied before the thumbnail turns out to be missing.
+	if err := os.Remove(cfg.getAssetDiskPath(assetPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoDuplicate(w, newDuplicateRequest(t, video.ID, token))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500, body %s", w.Code, w.Body)
+	}
+	if copies := store.callsTo("Copy"); len(copies) == 0 {
+		t.Fatal("nothing was copied")
+	}
+	if got := store.keys(); !slices.Equal(got, keys) {
+		t.Errorf("objects = %q, want %q", got, keys)
+	}
+	if count, err := cfg.db.CountVideos(userID); err != nil || count != 1 {
+		t.Errorf("CountVideos = %d, %v, want 1", count, err)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,7 +23,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -34,16 +38,72 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	}
 	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	unlock := cfg.idempotencyLocks.lock(videoLimitLockKey(userID))
+	defer unlock()
+	if !cfg.checkVideoLimit(w, userID) {
+		return
+	}
+
+	// Videos start out with DEFAULT_VISIBILITY, uploads only change it when
+	// asked to.
+	video, err := cfg.db.CreateVideo(params.CreateVideoParams, cfg.defaultVisibility)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
 
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoCreate)
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
+// videoLimitLockKey is the lock held from checking userID's video count
+// until their new video exists, so concurrent requests can't both take the
+// last free slot.
+func videoLimitLockKey(userID uuid.UUID) string {
+	return "videos:" + userID.String()
+}
+
+// checkVideoLimit responds with 403 and returns false when userID already has
+// as many videos as maxVideosPerUser allows.
+func (cfg *apiConfig) checkVideoLimit(w http.ResponseWriter, userID uuid.UUID) bool {
+	if cfg.maxVideosPerUser == 0 {
+		return true
+	}
+
+	count, err := cfg.db.CountVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+		return false
+	}
+	if count >= cfg.maxVideosPerUser {
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf("You can have at most %d videos", cfg.maxVideosPerUser), nil)
+		return false
+	}
+	return true
+}
+
+// handlerVideoMetaDelete removes a video's row, its S3 objects and its
+// thumbnail, answering with what it deleted. With ?dryRun=true nothing is
+// deleted, and the same response lists what would have been. With
+// OBJECT_DELETE_GRACE set the objects and thumbnail are only deleted once it
+// has passed, see handlerAdminVideoRestore.
+//
+// The row goes first: objects left behind by a failure after that are
+// orphans the orphan cleanup finds, whereas a row outliving its objects
+// would be a video that can't play. A delayed deletion is scheduled before
+// the row goes, so the orphan cleanup knows to keep the objects meanwhile.
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		DryRun   bool        `json:"dry_run"`
+		VideoIDs []uuid.UUID `json:"video_ids"`
+		S3Keys   []string    `json:"s3_keys"`
+		// Assets are the files under the assets directory, the thumbnail.
+		Assets []string `json:"assets"`
+		// DeleteAfter is when the objects will be deleted, when that's
+		// delayed.
+		DeleteAfter *time.Time `json:"delete_after,omitempty"`
+	}
+
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -51,12 +111,21 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "dryRun must be a boolean", err)
+			return
+		}
+	}
+
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -72,15 +141,82 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	res := response{
+		DryRun:   dryRun,
+		VideoIDs: []uuid.UUID{videoID},
+		S3Keys:   []string{},
+		Assets:   []string{},
+	}
+	for _, objectURL := range []*string{video.VideoURL, video.PreviewURL, video.ProxyURL} {
+		if objectURL == nil {
+			continue
+		}
+		if key, ok := cfg.getVideoKeyFromURL(*objectURL); ok {
+			res.S3Keys = append(res.S3Keys, key)
+		}
+	}
+	res.S3Keys = append(res.S3Keys, cfg.storyboardKeys(video.StoryboardURL)...)
+	if video.ThumbnailURL != nil {
+		if assetPath, ok := cfg.getAssetPathFromURL(*video.ThumbnailURL); ok {
+			res.Assets = append(res.Assets, assetPath)
+		}
+	}
+
+	if cfg.objectDeleteGrace > 0 {
+		deleteAfter := time.Now().UTC().Add(cfg.objectDeleteGrace)
+		res.DeleteAfter = &deleteAfter
+	}
+	if dryRun {
+		respondWithJSON(w, http.StatusOK, res)
+		return
+	}
+
+	var deletionJobID uuid.UUID
+	if res.DeleteAfter != nil {
+		deletionJobID, err = cfg.jobs.enqueueAfter(r.Context(), jobKindDeleteObjects, deleteObjectsJob{
+			Video: video,
+			Keys:  res.S3Keys,
+		}, *res.DeleteAfter)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't schedule deletion of video content", err)
+			return
+		}
+	}
+
+	// Both are found through rows DeleteVideo removes.
+	cfg.discardFailedUpload(r.Context(), videoID)
+	cfg.discardThumbnailCandidates(r.Context(), videoID, time.Now())
+
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
+		// The video stays, so its content must as well.
+		if deletionJobID != uuid.Nil {
+			_, cancelErr := cfg.db.CancelJob(deletionJobID)
+			if cancelErr != nil {
+				logf(r.Context(), "Couldn't cancel deletion of the content of video %v: %v", videoID, cancelErr)
+			}
+		}
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	if deletionJobID == uuid.Nil {
+		err = cfg.deleteObjects(context.WithoutCancel(r.Context()), res.S3Keys)
+		if err != nil {
+			logf(r.Context(), "Couldn't delete the content of deleted video %v: %v", videoID, err)
+		}
+		if video.ThumbnailURL != nil {
+			cfg.removeAsset(r.Context(), *video.ThumbnailURL)
+		}
+	}
+
+	cfg.recordAudit(r, userID, videoID, auditVideoDelete)
+	respondWithJSON(w, http.StatusOK, res)
 }
 
+// handlerVideoGet returns a video. The route also answers HEAD, with the
+// video's status in X-Video-Status and its last update in Last-Modified but
+// no body, so clients can poll for readiness cheaply.
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -89,32 +225,300 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Public and unlisted videos can be fetched without logging in.
+	userID, err := cfg.optionalUserID(auth.GetBearerToken(r.Header))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 
+	canAccess, err := cfg.canAccessVideo(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video access", err)
+		return
+	}
+	if !canAccess {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	w.Header().Set("X-Video-Status", string(video.Status))
+	if checkNotModified(w, r, makeETag(video.ID, video.UpdatedAt.UnixNano()), video.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// HEAD goes through the same response as GET, so its Content-Type and
+	// Content-Length match. The server leaves the body out.
 	respondWithJSON(w, http.StatusOK, video)
 }
 
+// handlerVideosRetrieve lists videos. ?include_urls=true adds each playable
+// video's presigned content URL and when it expires, and
+// ?include_previews=true its presigned previews. Both come from the presign
+// cache, so a listing fetched again soon after hands out the same URLs
+// rather than signing every one anew.
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	limit, offset, err := parsePagination(r.URL.Query(), cfg.listMaxLimit)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	includeShared := false
+	if v := r.URL.Query().Get("shared"); v != "" {
+		includeShared, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "shared must be a boolean", err)
+			return
+		}
+	}
+
+	// ?user_id= lists someone else's videos, of which only the public ones
+	// are visible.
+	ownerID := userID
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		ownerID, err = uuid.Parse(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+			return
+		}
+	}
+	publicOnly := ownerID != userID
+
+	includePreviews := false
+	if v := r.URL.Query().Get("include_previews"); v != "" {
+		includePreviews, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "include_previews must be a boolean", err)
+			return
+		}
+	}
+
+	includeURLs := false
+	if v := r.URL.Query().Get("include_urls"); v != "" {
+		includeURLs, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "include_urls must be a boolean", err)
+			return
+		}
+	}
+	presign := includePreviews || includeURLs
+
+	// Polling clients can skip the listing entirely when nothing changed.
+	// Not with presigned URLs, though: they expire whether or not the videos
+	// changed, and a client revalidating a cached page could be left holding
+	// dead ones.
+	if !presign {
+		notModified, err := cfg.checkVideosNotModified(w, r, userID, ownerID, includeShared, limit, offset)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+			return
+		}
+		if notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	var videos []database.Video
+	if publicOnly {
+		videos, err = cfg.db.GetPublicVideos(ownerID, limit, offset)
+	} else {
+		videos, err = cfg.db.GetVideos(userID, includeShared, limit, offset)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	if !presign {
+		respondWithJSON(w, http.StatusOK, videos)
+		return
+	}
+
+	type presignedListedVideo struct {
+		database.Video
+		URLs     *videoURLs     `json:"urls,omitempty"`
+		Previews *videoPreviews `json:"previews,omitempty"`
+	}
+	res := make([]presignedListedVideo, len(videos))
+	domains := map[uuid.UUID]string{}
+	for i, video := range videos {
+		res[i].Video = video
+		domain, ok := domains[video.UserID]
+		if !ok {
+			domain, err = cfg.db.GetUserCustomDomain(video.UserID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't get custom domain", err)
+				return
+			}
+			domains[video.UserID] = domain
+		}
+		if includeURLs {
+			res[i].URLs, err = cfg.presignVideoURLs(video, domain)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't presign video", err)
+				return
+			}
+		}
+		if includePreviews {
+			res[i].Previews, err = cfg.presignPreviews(video, domain)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't presign previews", err)
+				return
+			}
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// checkVideosNotModified is checkNotModified for a page of videos, its ETag
+// made of the listing's parameters and a summary of the videos it covers.
+func (cfg *apiConfig) checkVideosNotModified(w http.ResponseWriter, r *http.Request, userID, ownerID uuid.UUID, includeShared bool, limit, offset int) (bool, error) {
+	var count int
+	var lastUpdated string
+	var err error
+	if ownerID != userID {
+		count, lastUpdated, err = cfg.db.GetPublicVideosVersion(ownerID)
+	} else {
+		count, lastUpdated, err = cfg.db.GetVideosVersion(userID, includeShared)
+	}
+	if err != nil {
+		return false, err
+	}
+	return checkNotModified(w, r, makeETag(userID, ownerID, includeShared, limit, offset, count, lastUpdated), time.Time{}), nil
+}
+
+// videoURLs is a video's presigned content URL in ?include_urls=true
+// listings. ExpiresAt is when the URL stops working, for clients to list
+// again before then.
+type videoURLs struct {
+	VideoURL  string    `json:"video_url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presignVideoURLs presigns video's content for ?include_urls=true listings,
+// or returns nil when it has none that can be played. The URL comes from the
+// presign cache and is only signed again once it nears expiry.
+func (cfg *apiConfig) presignVideoURLs(video database.Video, domain string) (*videoURLs, error) {
+	if video.VideoURL == nil || video.Status == database.VideoStatusRejected {
+		return nil, nil
+	}
+	key, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		return nil, nil
+	}
+	presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &videoURLs{VideoURL: withCustomDomain(presigned.URL, domain), ExpiresAt: presigned.ExpiresAt}, nil
+}
+
+// videoPreviews are the presigned URLs a browsing client needs to preview a
+// video without playing it: the short preview clip and the storyboard
+// sprite sheet with the WebVTT track mapping playback times onto it. Both
+// are made at upload, and the sprite never has more than maxStoryboardTiles
+// frames however long the video is. The track is served by this server, see
+// storyboardPath, so that it can point at the presigned sprite.
+type videoPreviews struct {
+	PreviewURL    *string   `json:"preview_url,omitempty"`
+	StoryboardURL *string   `json:"storyboard_url,omitempty"`
+	SpriteURL     *string   `json:"sprite_url,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// presignPreviews presigns video's previews for ?include_previews=true
+// listings, or returns nil when it has none. The URLs come from the presign
+// cache, so listing the same page again doesn't sign anything.
+func (cfg *apiConfig) presignPreviews(video database.Video, domain string) (*videoPreviews, error) {
+	var previews videoPreviews
+	presign := func(key string) (*string, error) {
+		presigned, err := cfg.presignObject(key, cfg.presignExpiryFor(video), presignOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if previews.ExpiresAt.IsZero() || presigned.ExpiresAt.Before(previews.ExpiresAt) {
+			previews.ExpiresAt = presigned.ExpiresAt
+		}
+		presignedURL := withCustomDomain(presigned.URL, domain)
+		return &presignedURL, nil
+	}
+
+	var err error
+	if video.PreviewURL != nil {
+		if previewKey, ok := cfg.getVideoKeyFromURL(*video.PreviewURL); ok {
+			previews.PreviewURL, err = presign(previewKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if keys := cfg.storyboardKeys(video.StoryboardURL); keys != nil {
+		storyboardURL := storyboardPath(video.ID)
+		previews.StoryboardURL = &storyboardURL
+		previews.SpriteURL, err = presign(keys[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if previews.ExpiresAt.IsZero() {
+		return nil, nil
+	}
+	return &previews, nil
+}
+
+// handlerVideoMetadataExport returns the owner's full stored record for a
+// video, plus the S3 keys behind its URLs, as a downloadable JSON file for
+// backup and migration tooling.
+func (cfg *apiConfig) handlerVideoMetadataExport(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.Video
+		S3Key           string `json:"s3_key,omitempty"`
+		PreviewS3Key    string `json:"preview_s3_key,omitempty"`
+		StoryboardS3Key string `json:"storyboard_s3_key,omitempty"`
+		ProxyS3Key      string `json:"proxy_s3_key,omitempty"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	res := response{Video: video}
+	if video.VideoURL != nil {
+		res.S3Key, _ = cfg.getVideoKeyFromURL(*video.VideoURL)
+	}
+	if video.PreviewURL != nil {
+		res.PreviewS3Key, _ = cfg.getVideoKeyFromURL(*video.PreviewURL)
+	}
+	if video.StoryboardURL != nil {
+		res.StoryboardS3Key, _ = cfg.getVideoKeyFromURL(*video.StoryboardURL)
+	}
+	if video.ProxyURL != nil {
+		res.ProxyS3Key, _ = cfg.getVideoKeyFromURL(*video.ProxyURL)
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", video.ID.String()+".json"))
+	respondWithJSON(w, http.StatusOK, res)
 }
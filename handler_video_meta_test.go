@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newVideosRequest(t *testing.T, token, query, etag string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/videos"+query, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	return r
+}
+
+func TestHandlerVideosRetrieveConditional(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	store.putObject("landscape/a-preview.webp", []byte("preview"), time.Now())
+	video.PreviewURL = aws.String(cfg.getVideoURL("landscape/a-preview.webp"))
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("without previews", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, "", ""))
+		etag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || etag == "" {
+			t.Fatalf("status = %d with ETag %q, want 200 with one", w.Code, etag)
+		}
+
+		w = httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, "", etag))
+		if w.Code != http.StatusNotModified {
+			t.Errorf("revalidation status = %d, want 304", w.Code)
+		}
+	})
+
+	t.Run("with previews", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, "?include_previews=true", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			t.Errorf("ETag = %q, want none since the presigned URLs expire", etag)
+		}
+		var res []struct {
+			Previews *videoPreviews `json:"previews"`
+		}
+		decodeResponse(t, w, &res)
+		if len(res) != 1 || res[0].Previews == nil || res[0].Previews.PreviewURL == nil {
+			t.Fatalf("response = %s, want the presigned preview", w.Body)
+		}
+
+		w = httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, "?include_previews=true", "*"))
+		if w.Code != http.StatusOK {
+			t.Errorf("revalidation status = %d, want 200 with fresh URLs", w.Code)
+		}
+	})
+}
+
+func TestHandlerVideosRetrieveURLs(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.presignCache = newPresignCache(5 * time.Minute)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+	createTestVideo(t, cfg, userID)
+
+	list := func() *videoURLs {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, "?include_urls=true", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			t.Errorf("ETag = %q, want none since the presigned URLs expire", etag)
+		}
+		var res []struct {
+			ID   uuid.UUID  `json:"id"`
+			URLs *videoURLs `json:"urls"`
+		}
+		decodeResponse(t, w, &res)
+		var urls *videoURLs
+		for _, listed := range res {
+			if listed.ID == video.ID {
+				urls = listed.URLs
+			} else if listed.URLs != nil {
+				t.Errorf("video %v without content has URLs %+v", listed.ID, listed.URLs)
+			}
+		}
+		if urls == nil {
+			t.Fatalf("response = %s, want the uploaded video's URLs", w.Body)
+		}
+		return urls
+	}
+
+	// A miss signs the URL.
+	first := list()
+	if first.VideoURL != fakePresignedURL(cfg.s3Bucket, key, cfg.presignExpiry) || time.Until(first.ExpiresAt) < cfg.presignExpiry-time.Minute {
+		t.Errorf("first listing URLs = %+v, want %v signed for %v", first, key, cfg.presignExpiry)
+	}
+	if presigns := store.callsTo("PresignGetObject"); len(presigns) != 1 {
+		t.Fatalf("presigned %d times, want once", len(presigns))
+	}
+
+	// A hit hands out the same URL with what's left of its lifetime.
+	if hit := list(); *hit != *first {
+		t.Errorf("cached listing URLs = %+v, want %+v", hit, first)
+	}
+	if presigns := store.callsTo("PresignGetObject"); len(presigns) != 1 {
+		t.Errorf("presigned %d times, want once with a cache hit", len(presigns))
+	}
+
+	// Near expiry, it's signed again.
+	cfg.presignCache.set(key, presignedURL{URL: "near-expiry", ExpiresAt: time.Now().Add(4 * time.Minute)})
+	refreshed := list()
+	if refreshed.VideoURL == "near-expiry" || !refreshed.ExpiresAt.After(time.Now().Add(cfg.presignExpiry-time.Minute)) {
+		t.Errorf("near expiry listing URLs = %+v, want a fresh URL", refreshed)
+	}
+	if presigns := store.callsTo("PresignGetObject"); len(presigns) != 2 {
+		t.Errorf("presigned %d times, want twice after a refresh", len(presigns))
+	}
+}
+
+func newDeleteVideoRequest(t *testing.T, videoID uuid.UUID, token, query string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/videos/"+videoID.String()+query, nil)
+	r.SetPathValue("videoID", videoID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// deleteResponse is the body of handlerVideoMetaDelete, dry run or not.
+type deleteResponse struct {
+	DryRun bool     `json:"dry_run"`
+	S3Keys []string `json:"s3_keys"`
+	Assets []string `json:"assets"`
+}
+
+// uploadTestVideoWithThumbnail uploads a video along with a thumbnail,
+// returning it, the key of its content and the asset path of its thumbnail.
+func uploadTestVideoWithThumbnail(t *testing.T, cfg *apiConfig, userID uuid.UUID, token string) (database.Video, string, string) {
+	t.Helper()
+
+	thumbnail := formPart{name: "thumbnail", filename: "thumb.png", contentType: "image/png", data: pngFixture(t, 64, 36)}
+	video, key := uploadTestVideo(t, cfg, userID, token, thumbnail)
+	if video.ThumbnailURL == nil {
+		t.Fatal("video has no thumbnail")
+	}
+	assetPath, ok := cfg.getAssetPathFromURL(*video.ThumbnailURL)
+	if !ok {
+		t.Fatalf("thumbnail %q isn't an asset", *video.ThumbnailURL)
+	}
+	return video, key, assetPath
+}
+
+func TestHandlerVideoMetaDelete(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key, assetPath := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+
+	// The row must be gone before its objects are.
+	rowAtDelete := true
+	store.deleteErr = func(string) error {
+		rowAtDelete = getTestVideo(t, cfg, video.ID).ID != uuid.Nil
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(w, newDeleteVideoRequest(t, video.ID, token, ""))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	var res deleteResponse
+	decodeResponse(t, w, &res)
+	if res.DryRun || !slices.Equal(res.S3Keys, []string{key}) || !slices.Equal(res.Assets, []string{assetPath}) {
+		t.Errorf("response = %+v, want %q and %q deleted", res, key, assetPath)
+	}
+	if getTestVideo(t, cfg, video.ID).ID != uuid.Nil {
+		t.Error("video row is still there")
+	}
+	if _, ok := store.object(key); ok {
+		t.Error("video object is still there")
+	}
+	if _, err := os.Stat(cfg.getAssetDiskPath(assetPath)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("thumbnail is still there: %v", err)
+	}
+	if rowAtDelete {
+		t.Error("object deleted while the row still referred to it")
+	}
+}
+
+func TestHandlerVideoMetaDeleteDryRun(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key, assetPath := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoMetaDelete(w, newDeleteVideoRequest(t, video.ID, token, "?dryRun=true"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	var res deleteResponse
+	decodeResponse(t, w, &res)
+	if !res.DryRun || !slices.Equal(res.S3Keys, []string{key}) || !slices.Equal(res.Assets, []string{assetPath}) {
+		t.Errorf("response = %+v, want a dry run listing %q and %q", res, key, assetPath)
+	}
+	if getTestVideo(t, cfg, video.ID).ID == uuid.Nil {
+		t.Error("dry run deleted the video")
+	}
+	if _, ok := store.object(key); !ok {
+		t.Error("dry run deleted the object")
+	}
+	if _, err := os.Stat(cfg.getAssetDiskPath(assetPath)); err != nil {
+		t.Errorf("dry run deleted the thumbnail: %v", err)
+	}
+}
+
+func TestDeleteObjectsJobRemovesThumbnail(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key, assetPath := uploadTestVideoWithThumbnail(t, cfg, userID, token)
+
+	payload, err := json.Marshal(deleteObjectsJob{Video: video, Keys: []string{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.deleteObjectsJobHandler().run(context.Background(), payload); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, ok := store.object(key); ok {
+		t.Error("video object is still there")
+	}
+	if _, err := os.Stat(cfg.getAssetDiskPath(assetPath)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("thumbnail is still there: %v", err)
+	}
+}
+
+func TestHandlerVideoGetHead(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, userID, token)
+
+	// Through a real server, which is what leaves the body out of HEAD
+	// responses.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	fetch := func(method string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/api/videos/"+video.ID.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("%s: reading body: %v", method, err)
+		}
+		return res, body
+	}
+
+	get, getBody := fetch(http.MethodGet)
+	head, headBody := fetch(http.MethodHead)
+	if get.StatusCode != http.StatusOK || head.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, HEAD status = %d, want 200", get.StatusCode, head.StatusCode)
+	}
+	if len(getBody) == 0 {
+		t.Error("GET body is empty")
+	}
+	if len(headBody) != 0 {
+		t.Errorf("HEAD body = %q, want none", headBody)
+	}
+	if got := head.Header.Get("X-Video-Status"); got != string(database.VideoStatusReady) {
+		t.Errorf("X-Video-Status = %q, want %q", got, database.VideoStatusReady)
+	}
+	if head.Header.Get("ETag") == "" {
+		t.Error("HEAD response has no ETag")
+	}
+	get.Header.Del("Date")
+	head.Header.Del("Date")
+	if !reflect.DeepEqual(head.Header, get.Header) {
+		t.Errorf("HEAD headers = %v, want the GET ones %v", head.Header, get.Header)
+	}
+}
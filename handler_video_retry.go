@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoRetry processes a failed video again from the raw upload kept
+// when it failed, without the owner having to upload it again. Each video
+// can only be retried maxVideoRetries times.
+func (cfg *apiConfig) handlerVideoRetry(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	// Held until the video has left the failed state, so concurrent retries
+	// can't both start.
+	unlock := cfg.idempotencyLocks.lock("retry:" + video.ID.String())
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.Status != database.VideoStatusFailed {
+		respondWithError(w, http.StatusConflict, "Only failed videos can be retried", nil)
+		return
+	}
+	if video.RetryCount >= cfg.maxVideoRetries {
+		respondWithError(w, http.StatusTooManyRequests, "This video can't be retried any more, upload it again", nil)
+		return
+	}
+
+	upload, err := cfg.db.GetFailedUpload(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get failed upload", err)
+		return
+	}
+	if upload.VideoID == uuid.Nil {
+		respondWithError(w, http.StatusGone, "The original upload is no longer available, upload it again", nil)
+		return
+	}
+
+	// Processing consumes its input, so it gets a copy and the kept upload
+	// survives until a retry succeeds.
+	tmpFile, err := os.CreateTemp("", "tubely-retry-*"+mediaTypeToExt(upload.MediaType))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when creating temp file", err)
+		return
+	}
+	tmpFile.Close()
+
+	err = copyFile(upload.Path, tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error when reading failed upload", err)
+		return
+	}
+
+	video.RetryCount++
+	video.FailureReason = ""
+
+	if cfg.jobs != nil {
+		cfg.enqueueVideoProcessing(w, r, video, tmpFile.Name(), upload.MediaType, upload.CustomKey, nil)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+
+	video.Status = database.VideoStatusProcessing
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when updating video", err)
+		return
+	}
+	video, err = cfg.processUploadedVideo(r.Context(), video, tmpFile.Name(), upload.MediaType, upload.CustomKey, nil)
+	if err != nil {
+		cfg.markVideoFailed(r.Context(), video, err)
+		respondWithUploadError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
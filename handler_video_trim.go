@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobKindTrimVideo = "trim_video"
+
+// trimVideoJob is the payload of a jobKindTrimVideo job. Start and End are
+// in seconds.
+type trimVideoJob struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Start   float64   `json:"start"`
+	End     float64   `json:"end"`
+}
+
+// handlerVideoTrim cuts a ready video down to the part between start and end,
+// given in seconds. The trim runs on the background workers when they are
+// enabled, the video is processing meanwhile and back to ready once done.
+func (cfg *apiConfig) handlerVideoTrim(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	var params parameters
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if cfg.skipVideoProcessing {
+		respondWithError(w, http.StatusNotImplemented, "Trimming needs video processing, which is disabled", nil)
+		return
+	}
+
+	unlock := cfg.idempotencyLocks.lock(videoContentLockKey(video.ID))
+	defer unlock()
+
+	// Re-read under the lock, a concurrent trim may have started meanwhile.
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.Status != database.VideoStatusReady || video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Only ready videos can be trimmed", nil)
+		return
+	}
+	if video.Duration <= 0 {
+		respondWithError(w, http.StatusConflict, "Video duration is unknown", nil)
+		return
+	}
+
+	switch {
+	case params.Start < 0 || params.End > video.Duration:
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("start and end must be within the video's %gs", video.Duration), nil)
+		return
+	case params.End <= params.Start:
+		respondWithError(w, http.StatusBadRequest, "end must be after start", nil)
+		return
+	case cfg.minDuration > 0 && params.End-params.Start < cfg.minDuration.Seconds():
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Trimmed video too short, it must be at least %v", cfg.minDuration), nil)
+		return
+	}
+
+	video.Status = database.VideoStatusProcessing
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error when updating video", err)
+		return
+	}
+
+	if cfg.jobs != nil {
+		err = cfg.jobs.enqueue(r.Context(), jobKindTrimVideo, trimVideoJob{
+			VideoID: video.ID,
+			Start:   params.Start,
+			End:     params.End,
+		})
+		if err != nil {
+			cfg.restoreTrimmedVideo(r.Context(), video, err)
+			if errors.Is(err, errQueueFull) {
+				respondWithError(w, http.StatusServiceUnavailable, "Too many videos are being processed, try again later", err)
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for trimming", err)
+			return
+		}
+		cfg.recordAudit(r, video.UserID, video.ID, auditVideoTrim)
+		respondWithJSON(w, http.StatusAccepted, video)
+		return
+	}
+
+	trimmed, err := cfg.trimStoredVideo(r.Context(), video, params.Start, params.End)
+	if err != nil {
+		cfg.restoreTrimmedVideo(r.Context(), video, err)
+		respondWithUploadError(w, err)
+		return
+	}
+
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoTrim)
+	respondWithJSON(w, http.StatusOK, trimmed)
+}
+
+// trimVideoJobHandler runs jobKindTrimVideo jobs. Client errors such as an
+// empty clip aren't retried.
+func (cfg *apiConfig) trimVideoJobHandler() jobHandler {
+	decode := func(payload []byte) (trimVideoJob, error) {
+		var job trimVideoJob
+		err := json.Unmarshal(payload, &job)
+		return job, err
+	}
+
+	return jobHandler{
+		run: func(ctx context.Context, payload []byte) error {
+			job, err := decode(payload)
+			if err != nil {
+				return &permanentJobError{err: fmt.Errorf("couldn't decode job payload: %w", err)}
+			}
+
+			video, err := cfg.db.GetVideo(job.VideoID)
+			if err != nil {
+				return err
+			}
+			if video.ID == uuid.Nil {
+				return nil
+			}
+
+			_, err = cfg.trimStoredVideo(ctx, video, job.Start, job.End)
+			if err != nil && uploadErrorCode(err) < 500 {
+				return &permanentJobError{err: err}
+			}
+			return err
+		},
+		onFailure: func(ctx context.Context, payload []byte, err error) {
+			job, decodeErr := decode(payload)
+			if decodeErr != nil {
+				return
+			}
+			video, getErr := cfg.db.GetVideo(job.VideoID)
+			if getErr != nil || video.ID == uuid.Nil {
+				return
+			}
+			cfg.restoreTrimmedVideo(ctx, video, err)
+		},
+	}
+}
+
+// restoreTrimmedVideo puts a video whose trim failed back to ready, the
+// original content is untouched until a trim succeeds, or to missing when
+// the trim found the original gone. The failure is kept as the video's
+// failure reason so its owner can see what happened.
+func (cfg *apiConfig) restoreTrimmedVideo(ctx context.Context, video database.Video, err error) {
+	logf(ctx, "Trimming video %v failed: %v", video.ID, err)
+
+	msg := "Trimming failed"
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		msg = uploadErr.msg
+	}
+
+	video.Status = database.VideoStatusReady
+	if isMissingObject(err) {
+		video.Status = database.VideoStatusMissing
+	}
+	video.FailureReason = msg
+	updateErr := cfg.saveVideo(&video)
+	if updateErr != nil {
+		logf(ctx, "Couldn't restore video %v after a failed trim: %v", video.ID, updateErr)
+	}
+}
+
+// trimStoredVideo cuts the video's stored content down to the part between
+// start and end seconds and publishes the result. The trimmed video goes to
+// a new key and the old objects are deleted afterwards, unless TRIM_REPLACE
+// is set and it overwrites the original object instead. Errors are
+// *uploadError values.
+func (cfg *apiConfig) trimStoredVideo(ctx context.Context, video database.Video, start, end float64) (database.Video, error) {
+	oldKey, ok := cfg.getVideoKeyFromURL(*video.VideoURL)
+	if !ok {
+		return video, &uploadError{http.StatusInternalServerError, "Couldn't resolve video location", nil}
+	}
+
+	info, err := cfg.headObject(ctx, oldKey)
+	if isMissingObject(err) {
+		return video, &uploadError{http.StatusNotFound, "Video content not found", err}
+	}
+	if err != nil {
+		return video, &uploadError{http.StatusBadGateway, "Couldn't get video details", err}
+	}
+	ext := path.Ext(oldKey)
+	mediaType := info.ContentType
+	if mediaType == "" {
+		mediaType = extToMediaType(ext)
+	}
+
+	// Like thumbnail candidates, ffmpeg reads the original straight from S3.
+	source, err := cfg.presignObject(oldKey, cfg.presignExpiryFor(video), presignOptions{})
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Couldn't presign video", err}
+	}
+
+	toDuration := func(seconds float64) time.Duration {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	trimmedPath, err := trimVideo(ctx, cfg.commands, source.URL, toDuration(start), toDuration(end-start), ext)
+	if errors.Is(err, errEmptyTrim) {
+		return video, &uploadError{http.StatusBadRequest, "Trimmed video would be empty", err}
+	}
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when trimming video", err}
+	}
+	defer os.Remove(trimmedPath)
+
+	probed, err := probeVideo(ctx, cfg.commands, trimmedPath, cfg.aspectRatioFallback, cfg.squareTolerance)
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when probing trimmed video", err}
+	}
+	if probed.Duration <= 0 {
+		return video, &uploadError{http.StatusBadRequest, "Trimmed video would be empty", nil}
+	}
+
+	trimmedFile, err := os.Open(trimmedPath)
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when reading trimmed video", err}
+	}
+	defer trimmedFile.Close()
+
+	stat, err := trimmedFile.Stat()
+	if err != nil {
+		return video, &uploadError{http.StatusInternalServerError, "Error when reading trimmed video", err}
+	}
+
+	key := oldKey
+	if !cfg.trimReplace {
+		key = path.Dir(oldKey) + "/" + getAssetPath(ext)
+	}
+
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         trimmedFile,
+		ContentType:  &mediaType,
+		Tagging:      cfg.getObjectTagging(video.UserID, video.AspectRatio, mediaType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		return video, &uploadError{http.StatusBadGateway, "Error when sending file to s3", err}
+	}
+	cfg.objectInfoCache.delete(key)
+
+	old := video
+	video.Size = stat.Size()
+	video.Duration = probed.Duration.Seconds()
+	video = cfg.uploadPreview(ctx, video, trimmedPath, key, video.AspectRatio)
+	video = cfg.uploadStoryboard(ctx, video, trimmedPath, key, video.AspectRatio)
+	video = cfg.uploadProxy(ctx, video, trimmedPath, key, video.AspectRatio)
+
+	video, err = cfg.publishVideo(ctx, video, key, mediaType)
+	if err != nil {
+		return video, err
+	}
+
+	cfg.discardReplacedObjects(ctx, old, video)
+	return video, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// maxVisibilityLength is more than the longest of videoVisibilities, so
+// reading a form field can stop there.
+const maxVisibilityLength = 16
+
+var videoVisibilities = []database.VideoVisibility{
+	database.VideoVisibilityPublic,
+	database.VideoVisibilityUnlisted,
+	database.VideoVisibilityPrivate,
+}
+
+// errInvalidVisibility is returned by parseVisibility for anything but one
+// of videoVisibilities.
+var errInvalidVisibility = errors.New("visibility must be public, unlisted or private")
+
+func parseVisibility(value string) (database.VideoVisibility, error) {
+	visibility := database.VideoVisibility(value)
+	if !slices.Contains(videoVisibilities, visibility) {
+		return "", errInvalidVisibility
+	}
+	return visibility, nil
+}
+
+func (cfg *apiConfig) handlerVideoVisibilityUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility database.VideoVisibility `json:"visibility"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	_, err = parseVisibility(string(params.Visibility))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	video.Visibility = params.Visibility
+	err = cfg.saveVideo(&video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	cfg.recordAudit(r, video.UserID, video.ID, auditVideoVisibility)
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+)
+
+// keyedMutex serializes work per key, so concurrent requests sharing an
+// Idempotency-Key are handled one after the other and the later ones see
+// the first one's result.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: map[string]*keyedLock{},
+	}
+}
+
+// lock blocks until key is free and returns the function releasing it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -22,6 +23,11 @@ const (
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// ErrTokenExpired is matched by errors.Is for tokens that were valid but
+// have expired, so callers can tell clients to refresh rather than log in
+// again.
+var ErrTokenExpired = jwt.ErrTokenExpired
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -49,12 +55,62 @@ func MakeJWT(
 	return token.SignedString(signingKey)
 }
 
+// VerificationKeys are the keys access tokens may be signed with: HS256
+// tokens are checked against HMACSecret, and RS256 ones, issued by services
+// that don't share the secret, against RSAPublicKey. A token using any other
+// algorithm, or one whose key isn't set, is rejected.
+//
+// Leeway is how far the exp and nbf claims may be off to absorb clock
+// drift between the issuing and validating servers. It works both ways: a
+// token stays usable for up to Leeway after it expires, so a leaked token is
+// too, and a revoked session only ends once its token is past exp plus
+// Leeway. Keep it to seconds.
+type VerificationKeys struct {
+	HMACSecret   string
+	RSAPublicKey *rsa.PublicKey
+	Leeway       time.Duration
+}
+
+// validSigningMethods is the allowlist of JWT algorithms. Checking a
+// token's alg header against it, and picking the key by that alg, stops an
+// RS256 public key from being used as an HMAC secret.
+var validSigningMethods = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+}
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key or certificate.
+func ParseRSAPublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	return jwt.ParseRSAPublicKeyFromPEM(pemData)
+}
+
 func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	return ValidateJWTWithKeys(tokenString, VerificationKeys{HMACSecret: tokenSecret})
+}
+
+func ValidateJWTWithKeys(tokenString string, keys VerificationKeys) (uuid.UUID, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		func(token *jwt.Token) (interface{}, error) {
+			switch token.Method.Alg() {
+			case jwt.SigningMethodHS256.Alg():
+				if keys.HMACSecret == "" {
+					return nil, errors.New("HS256 tokens are not accepted")
+				}
+				return []byte(keys.HMACSecret), nil
+			case jwt.SigningMethodRS256.Alg():
+				if keys.RSAPublicKey == nil {
+					return nil, errors.New("RS256 tokens are not accepted")
+				}
+				return keys.RSAPublicKey, nil
+			default:
+				return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+			}
+		},
+		jwt.WithValidMethods(validSigningMethods),
+		jwt.WithLeeway(keys.Leeway),
 	)
 	if err != nil {
 		return uuid.Nil, err
@@ -93,6 +149,27 @@ func GetBearerToken(headers http.Header) (string, error) {
 	return splitAuth[1], nil
 }
 
+// GetMediaToken extracts the access token for endpoints consumed by media
+// elements such as <video src>, which can't set an Authorization header. The
+// header is preferred; when allowQuery is set the token may instead be passed
+// as ?token=.
+//
+// Query tokens end up in server and proxy access logs, browser history and
+// Referer headers sent to third parties, so anyone who sees such a URL can
+// reuse the token until it expires. Only enable it for short-lived tokens.
+func GetMediaToken(r *http.Request, allowQuery bool) (string, error) {
+	token, err := GetBearerToken(r.Header)
+	if err == nil || !errors.Is(err, ErrNoAuthHeaderIncluded) || !allowQuery {
+		return token, err
+	}
+
+	token = r.URL.Query().Get("token")
+	if token == "" {
+		return "", ErrNoAuthHeaderIncluded
+	}
+	return token, nil
+}
+
 func MakeRefreshToken() (string, error) {
 	token := make([]byte, 32)
 	_, err := rand.Read(token)
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func accessClaims(userID uuid.UUID, expiresIn time.Duration) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    string(TokenTypeAccess),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		Subject:   userID.String(),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, claims jwt.Claims, key any) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing %s token: %v", method.Alg(), err)
+	}
+	return token
+}
+
+func TestValidateJWTWithKeys(t *testing.T) {
+	const secret = "test-secret"
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	publicKey, err := ParseRSAPublicKey(publicPEM)
+	if err != nil {
+		t.Fatalf("ParseRSAPublicKey: %v", err)
+	}
+
+	userID := uuid.New()
+	claims := accessClaims(userID, time.Hour)
+	both := VerificationKeys{HMACSecret: secret, RSAPublicKey: publicKey}
+	hs256, err := MakeJWT(userID, secret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		keys    VerificationKeys
+		wantErr bool
+	}{
+		{"HS256 with the secret", hs256, both, false},
+		{"HS256 with another secret", hs256, VerificationKeys{HMACSecret: "other"}, true},
+		{"HS256 without a secret", hs256, VerificationKeys{RSAPublicKey: publicKey}, true},
+		{"RS256 with the public key", signToken(t, jwt.SigningMethodRS256, claims, privateKey), both, false},
+		{"RS256 signed by another key", signToken(t, jwt.SigningMethodRS256, claims, otherKey), both, true},
+		{"RS256 without a public key", signToken(t, jwt.SigningMethodRS256, claims, privateKey), VerificationKeys{HMACSecret: secret}, true},
+		// The public key is no secret, an HS256 token keyed with it must
+		// not pass for one signed by the private key.
+		{"HS256 keyed with the public key", signToken(t, jwt.SigningMethodHS256, claims, publicPEM), both, true},
+		{"HS256 keyed with the public key, RSA only", signToken(t, jwt.SigningMethodHS256, claims, publicPEM), VerificationKeys{RSAPublicKey: publicKey}, true},
+		{"HS512", signToken(t, jwt.SigningMethodHS512, claims, []byte(secret)), both, true},
+		{"none", signToken(t, jwt.SigningMethodNone, claims, jwt.UnsafeAllowNoneSignatureType), both, true},
+		{"wrong issuer", signToken(t, jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "someone-else", Subject: userID.String()}, []byte(secret)), both, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateJWTWithKeys(tt.token, tt.keys)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("token accepted for %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateJWTWithKeys: %v", err)
+			}
+			if got != userID {
+				t.Errorf("user ID = %v, want %v", got, userID)
+			}
+		})
+	}
+}
+
+func TestValidateJWTWithKeysLeeway(t *testing.T) {
+	const secret = "test-secret"
+	userID := uuid.New()
+	keys := VerificationKeys{HMACSecret: secret, Leeway: 30 * time.Second}
+
+	expired := accessClaims(userID, -10*time.Second)
+	longExpired := accessClaims(userID, -time.Minute)
+	notYetValid := accessClaims(userID, time.Hour)
+	notYetValid.NotBefore = jwt.NewNumericDate(time.Now().Add(10 * time.Second))
+	longNotYetValid := accessClaims(userID, time.Hour)
+	longNotYetValid.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name    string
+		claims  jwt.RegisteredClaims
+		keys    VerificationKeys
+		wantErr bool
+	}{
+		{"expired within the leeway", expired, keys, false},
+		{"expired past the leeway", longExpired, keys, true},
+		{"expired without leeway", expired, VerificationKeys{HMACSecret: secret}, true},
+		{"not yet valid within the leeway", notYetValid, keys, false},
+		{"not yet valid past the leeway", longNotYetValid, keys, true},
+		{"not yet valid without leeway", notYetValid, VerificationKeys{HMACSecret: secret}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJWTWithKeys(signToken(t, jwt.SigningMethodHS256, tt.claims, []byte(secret)), tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	_, err := ValidateJWTWithKeys(signToken(t, jwt.SigningMethodHS256, longExpired, []byte(secret)), keys)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v, want ErrTokenExpired", err)
+	}
+}
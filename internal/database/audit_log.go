@@ -0,0 +1,80 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEntry records a change a user made. VideoID is uuid.Nil for actions
+// that don't target a video.
+type AuditEntry struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uuid.UUID `json:"user_id"`
+	Action    string    `json:"action"`
+	VideoID   uuid.UUID `json:"video_id"`
+	ClientIP  string    `json:"client_ip"`
+}
+
+// AuditLogFilter narrows GetAuditEntries down. Zero fields match everything;
+// Since is inclusive and Until exclusive.
+type AuditLogFilter struct {
+	UserID uuid.UUID
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (c Client) CreateAuditEntry(entry AuditEntry) error {
+	query := `
+	INSERT INTO audit_log (
+		id,
+		created_at,
+		user_id,
+		action,
+		video_id,
+		client_ip
+	) VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, entry.ID, entry.CreatedAt.UTC(), entry.UserID, entry.Action, entry.VideoID, entry.ClientIP)
+	return err
+}
+
+// GetAuditEntries lists the entries matching filter, newest first.
+func (c Client) GetAuditEntries(filter AuditLogFilter, limit, offset int) ([]AuditEntry, error) {
+	query := `
+	SELECT id, created_at, user_id, action, video_id, client_ip
+	FROM audit_log
+	WHERE (? OR user_id = ?)
+		AND (? OR action = ?)
+		AND (? OR created_at >= ?)
+		AND (? OR created_at < ?)
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query,
+		filter.UserID == uuid.Nil, filter.UserID,
+		filter.Action == "", filter.Action,
+		filter.Since.IsZero(), filter.Since.UTC(),
+		filter.Until.IsZero(), filter.Until.UTC(),
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.CreatedAt, &entry.UserID, &entry.Action, &entry.VideoID, &entry.ClientIP)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
@@ -72,10 +72,242 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		ttl_seconds INTEGER NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	videoShareTable := `
+	CREATE TABLE IF NOT EXISTS video_shares (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoShareTable)
+	if err != nil {
+		return err
+	}
+
+	idempotencyKeyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, key),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(idempotencyKeyTable)
+	if err != nil {
+		return err
+	}
+
+	failedUploadTable := `
+	CREATE TABLE IF NOT EXISTS failed_uploads (
+		video_id TEXT PRIMARY KEY,
+		path TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		custom_key TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(failedUploadTable)
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		request_id TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		claimed_at TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+
+	thumbnailCandidateTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_candidates (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		s3_key TEXT NOT NULL,
+		timestamp REAL NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(thumbnailCandidateTable)
+	if err != nil {
+		return err
+	}
+
+	// Entries outlive the videos and users they mention, so there are no
+	// foreign keys.
+	auditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		user_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		client_ip TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.Exec(auditLogTable)
+	if err != nil {
+		return err
+	}
+
+	videoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"status", "TEXT NOT NULL DEFAULT 'draft'"},
+		{"pix_fmt", "TEXT NOT NULL DEFAULT ''"},
+		{"color_transfer", "TEXT NOT NULL DEFAULT ''"},
+		{"thumbnail_width", "INTEGER NOT NULL DEFAULT 0"},
+		{"thumbnail_height", "INTEGER NOT NULL DEFAULT 0"},
+		{"size", "INTEGER NOT NULL DEFAULT 0"},
+		{"aspect_ratio", "TEXT NOT NULL DEFAULT ''"},
+		{"thumbnail_placeholder", "TEXT NOT NULL DEFAULT ''"},
+		{"has_audio", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"audio_warning", "TEXT NOT NULL DEFAULT ''"},
+		{"failure_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"preview_url", "TEXT"},
+		{"duration", "REAL NOT NULL DEFAULT 0"},
+		{"original_filename", "TEXT NOT NULL DEFAULT ''"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'private'"},
+		{"retry_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"unoptimized", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"attributes", "TEXT NOT NULL DEFAULT '{}'"},
+		{"warnings", "TEXT NOT NULL DEFAULT '[]'"},
+		{"storyboard_url", "TEXT"},
+		{"version", "INTEGER NOT NULL DEFAULT 0"},
+		{"thumbnail_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"proxy_url", "TEXT"},
+	}
+	for _, col := range videoColumns {
+		err = c.addColumnIfNotExists("videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.addColumnIfNotExists("users", "disabled", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "custom_domain", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "run_after", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "instance", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("share_links", "allowed_ip", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("share_links", "allowed_referrer", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("idempotency_keys", "status", "INTEGER NOT NULL DEFAULT 200")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addColumnIfNotExists lets existing databases pick up columns added after
+// their tables were first created.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			dfltValue  sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
 func (c Client) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM audit_log"); err != nil {
+		return fmt.Errorf("failed to reset table audit_log: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM thumbnail_candidates"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_candidates: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM failed_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table failed_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_shares"); err != nil {
+		return fmt.Errorf("failed to reset table video_shares: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM idempotency_keys"); err != nil {
+		return fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM share_links"); err != nil {
+		return fmt.Errorf("failed to reset table share_links: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
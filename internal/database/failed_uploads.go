@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FailedUpload is a raw upload kept after processing failed, so the video
+// can be processed again without the client sending it a second time.
+type FailedUpload struct {
+	VideoID   uuid.UUID
+	Path      string
+	MediaType string
+	CustomKey string
+	CreatedAt time.Time
+}
+
+// SaveFailedUpload records where a video's raw upload was kept, replacing
+// any earlier record for the video.
+func (c Client) SaveFailedUpload(upload FailedUpload) error {
+	query := `
+	INSERT OR REPLACE INTO failed_uploads (
+		video_id,
+		path,
+		media_type,
+		custom_key,
+		created_at
+	) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, upload.VideoID, upload.Path, upload.MediaType, upload.CustomKey)
+	return err
+}
+
+// GetFailedUpload returns the zero FailedUpload when none was kept.
+func (c Client) GetFailedUpload(videoID uuid.UUID) (FailedUpload, error) {
+	query := `
+	SELECT video_id, path, media_type, custom_key, created_at
+	FROM failed_uploads
+	WHERE video_id = ?
+	`
+
+	var upload FailedUpload
+	err := c.db.QueryRow(query, videoID).Scan(&upload.VideoID, &upload.Path, &upload.MediaType, &upload.CustomKey, &upload.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return FailedUpload{}, nil
+		}
+		return FailedUpload{}, err
+	}
+
+	return upload, nil
+}
+
+func (c Client) DeleteFailedUpload(videoID uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM failed_uploads WHERE video_id = ?", videoID)
+	return err
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type IdempotencyKey struct {
+	CreatedAt time.Time `json:"created_at"`
+	CreateIdempotencyKeyParams
+}
+
+type CreateIdempotencyKeyParams struct {
+	Key     string    `json:"key"`
+	UserID  uuid.UUID `json:"user_id"`
+	VideoID uuid.UUID `json:"video_id"`
+	// Status is the HTTP status the request was answered with, which
+	// replays answer with as well.
+	Status int `json:"status"`
+}
+
+// CreateIdempotencyKey records a processed key, replacing any expired record
+// the same user left under that key.
+func (c Client) CreateIdempotencyKey(params CreateIdempotencyKeyParams) (IdempotencyKey, error) {
+	query := `
+	INSERT OR REPLACE INTO idempotency_keys (
+		key,
+		user_id,
+		video_id,
+		status,
+		created_at
+	) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, params.Key, params.UserID, params.VideoID, params.Status)
+	if err != nil {
+		return IdempotencyKey{}, err
+	}
+
+	return c.GetIdempotencyKey(params.UserID, params.Key)
+}
+
+func (c Client) GetIdempotencyKey(userID uuid.UUID, key string) (IdempotencyKey, error) {
+	query := `
+	SELECT key, user_id, video_id, status, created_at
+	FROM idempotency_keys
+	WHERE user_id = ? AND key = ?
+	`
+	var record IdempotencyKey
+	err := c.db.QueryRow(query, userID, key).
+		Scan(&record.Key, &record.UserID, &record.VideoID, &record.Status, &record.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyKey{}, nil
+		}
+		return IdempotencyKey{}, err
+	}
+	return record, nil
+}
+
+func (c Client) DeleteIdempotencyKeysBefore(before time.Time) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE created_at < ?
+	`
+	_, err := c.db.Exec(query, before.UTC().Format(time.DateTime))
+	return err
+}
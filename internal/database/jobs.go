@@ -0,0 +1,175 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusPending    JobStatus = "pending"
+	JobStatusProcessing JobStatus = "processing"
+)
+
+// Job is a unit of background work persisted so it survives a restart.
+// Payload is opaque to the database, its format depends on Kind. A job with
+// RunAfter set can't be claimed before then. A job with Instance set can
+// only be claimed by that instance, for payloads that refer to its disk.
+type Job struct {
+	ID        uuid.UUID
+	Kind      string
+	Payload   []byte
+	Status    JobStatus
+	Attempts  int
+	RequestID string
+	Instance  string
+	CreatedAt time.Time
+	ClaimedAt *time.Time
+	RunAfter  *time.Time
+}
+
+// claimableBy is the condition on a job that the instance passed as its
+// parameter may claim.
+const claimableBy = "instance IN ('', ?)"
+
+// CreateJob records a new pending job.
+func (c Client) CreateJob(job Job) error {
+	query := `
+	INSERT INTO jobs (
+		id,
+		kind,
+		payload,
+		status,
+		attempts,
+		request_id,
+		instance,
+		created_at,
+		run_after
+	) VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	var runAfter *time.Time
+	if job.RunAfter != nil {
+		utc := job.RunAfter.UTC()
+		runAfter = &utc
+	}
+	_, err := c.db.Exec(query, job.ID, job.Kind, string(job.Payload), JobStatusPending, job.Attempts, job.RequestID, job.Instance, runAfter)
+	return err
+}
+
+// ClaimJob moves a pending job to processing for instance and counts the
+// attempt. It reports false when the job isn't pending anymore, which
+// happens when another worker or instance claimed it first or it was
+// cancelled, for jobs that aren't due yet, and for jobs bound to another
+// instance.
+func (c Client) ClaimJob(id uuid.UUID, instance string) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, claimed_at = ?, attempts = attempts + 1
+	WHERE id = ? AND status = ? AND (run_after IS NULL OR run_after <= ?) AND ` + claimableBy + `
+	`
+	now := time.Now().UTC()
+	res, err := c.db.Exec(query, JobStatusProcessing, now, id, JobStatusPending, now, instance)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseJob puts a claimed job back to pending so it can be claimed again
+// from runAfter on.
+func (c Client) ReleaseJob(id uuid.UUID, runAfter time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, claimed_at = NULL, run_after = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusPending, runAfter.UTC(), id)
+	return err
+}
+
+func (c Client) DeleteJob(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM jobs WHERE id = ?", id)
+	return err
+}
+
+// CancelJob deletes a job that hasn't been claimed yet. It reports false
+// when the job is gone or already being run.
+func (c Client) CancelJob(id uuid.UUID) (bool, error) {
+	res, err := c.db.Exec("DELETE FROM jobs WHERE id = ? AND status = ?", id, JobStatusPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseStaleJobs puts the jobs instance may claim that were claimed before
+// claimedBefore back to pending, assuming the instance that claimed them is
+// gone, and returns them.
+func (c Client) ReleaseStaleJobs(claimedBefore time.Time, instance string) ([]Job, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, claimed_at = NULL
+	WHERE status = ? AND claimed_at < ? AND ` + claimableBy + `
+	RETURNING id, kind, payload, status, attempts, request_id, instance, created_at, claimed_at, run_after
+	`
+	rows, err := c.db.Query(query, JobStatusPending, JobStatusProcessing, claimedBefore.UTC(), instance)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+// GetPendingJobs lists the pending jobs instance may claim, oldest first.
+func (c Client) GetPendingJobs(instance string) ([]Job, error) {
+	return c.getPendingJobs(claimableBy, instance)
+}
+
+// GetPendingJobsOfKind lists pending jobs of kind, whichever instance they
+// are bound to, oldest first.
+func (c Client) GetPendingJobsOfKind(kind string) ([]Job, error) {
+	return c.getPendingJobs("kind = ?", kind)
+}
+
+func (c Client) getPendingJobs(condition string, arg any) ([]Job, error) {
+	query := `
+	SELECT id, kind, payload, status, attempts, request_id, instance, created_at, claimed_at, run_after
+	FROM jobs
+	WHERE status = ? AND ` + condition + `
+	ORDER BY created_at
+	`
+
+	rows, err := c.db.Query(query, JobStatusPending, arg)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+func scanJobs(rows *sql.Rows) ([]Job, error) {
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var job Job
+		var payload string
+		err := rows.Scan(&job.ID, &job.Kind, &payload, &job.Status, &job.Attempts, &job.RequestID, &job.Instance, &job.CreatedAt, &job.ClaimedAt, &job.RunAfter)
+		if err != nil {
+			return nil, err
+		}
+		job.Payload = []byte(payload)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestClaimJobRunAfter(t *testing.T) {
+	c := newTestClient(t)
+
+	tests := []struct {
+		name      string
+		runAfter  *time.Time
+		wantClaim bool
+	}{
+		{"no run_after", nil, true},
+		{"run_after passed", ptr(time.Now().Add(-time.Minute)), true},
+		{"run_after ahead", ptr(time.Now().Add(time.Hour)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := uuid.New()
+			err := c.CreateJob(Job{ID: id, Kind: "test", Payload: []byte("{}"), RunAfter: tt.runAfter})
+			if err != nil {
+				t.Fatalf("CreateJob: %v", err)
+			}
+			claimed, err := c.ClaimJob(id, "a")
+			if err != nil {
+				t.Fatalf("ClaimJob: %v", err)
+			}
+			if claimed != tt.wantClaim {
+				t.Errorf("claimed = %v, want %v", claimed, tt.wantClaim)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestReleaseStaleJobs(t *testing.T) {
+	c := newTestClient(t)
+
+	id := uuid.New()
+	if err := c.CreateJob(Job{ID: id, Kind: "test", Payload: []byte(`{"n":1}`)}); err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+	if claimed, err := c.ClaimJob(id, "a"); err != nil || !claimed {
+		t.Fatalf("ClaimJob = %v, %v", claimed, err)
+	}
+
+	released, err := c.ReleaseStaleJobs(time.Now().Add(-time.Minute), "a")
+	if err != nil || len(released) != 0 {
+		t.Fatalf("job claimed just now released: %+v, %v", released, err)
+	}
+
+	released, err = c.ReleaseStaleJobs(time.Now().Add(time.Minute), "a")
+	if err != nil {
+		t.Fatalf("ReleaseStaleJobs: %v", err)
+	}
+	if len(released) != 1 {
+		t.Fatalf("released %+v, want the claimed job", released)
+	}
+	job := released[0]
+	if job.ID != id || job.Status != JobStatusPending || job.ClaimedAt != nil || job.Attempts != 1 || string(job.Payload) != `{"n":1}` {
+		t.Errorf("released job = %+v, want it pending again after one attempt", job)
+	}
+}
+
+func TestJobInstance(t *testing.T) {
+	c := newTestClient(t)
+
+	shared, bound := uuid.New(), uuid.New()
+	if err := c.CreateJob(Job{ID: shared, Kind: "test", Payload: []byte("{}")}); err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+	if err := c.CreateJob(Job{ID: bound, Kind: "test", Payload: []byte("{}"), Instance: "a"}); err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+
+	for instance, want := range map[string]int{"a": 2, "b": 1} {
+		pending, err := c.GetPendingJobs(instance)
+		if err != nil || len(pending) != want {
+			t.Errorf("GetPendingJobs(%q) = %+v, %v, want %d job(s)", instance, pending, err, want)
+		}
+	}
+	if pending, err := c.GetPendingJobsOfKind("test"); err != nil || len(pending) != 2 {
+		t.Errorf("GetPendingJobsOfKind = %+v, %v, want both jobs", pending, err)
+	}
+
+	if claimed, err := c.ClaimJob(bound, "b"); err != nil || claimed {
+		t.Errorf("ClaimJob by another instance = %v, %v, want false", claimed, err)
+	}
+	if claimed, err := c.ClaimJob(shared, "b"); err != nil || !claimed {
+		t.Errorf("ClaimJob of an unbound job = %v, %v, want true", claimed, err)
+	}
+	if claimed, err := c.ClaimJob(bound, "a"); err != nil || !claimed {
+		t.Errorf("ClaimJob by its instance = %v, %v, want true", claimed, err)
+	}
+
+	released, err := c.ReleaseStaleJobs(time.Now().Add(time.Minute), "b")
+	if err != nil || len(released) != 1 || released[0].ID != shared {
+		t.Errorf("ReleaseStaleJobs by another instance = %+v, %v, want only the unbound job", released, err)
+	}
+	released, err = c.ReleaseStaleJobs(time.Now().Add(time.Minute), "a")
+	if err != nil || len(released) != 1 || released[0].ID != bound || released[0].Instance != "a" {
+		t.Errorf("ReleaseStaleJobs by its instance = %+v, %v, want the bound job", released, err)
+	}
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ReprocessFilter picks the ready videos a backfill applies to, by what
+// they're missing. A video stops matching once it has been reprocessed, so
+// running the same backfill again only picks up what's left.
+type ReprocessFilter string
+
+const (
+	ReprocessMissingDuration   ReprocessFilter = "missing_duration"
+	ReprocessMissingPreview    ReprocessFilter = "missing_preview"
+	ReprocessMissingStoryboard ReprocessFilter = "missing_storyboard"
+)
+
+var reprocessConditions = map[ReprocessFilter]string{
+	ReprocessMissingDuration:   "duration <= 0",
+	ReprocessMissingPreview:    "preview_url IS NULL",
+	ReprocessMissingStoryboard: "storyboard_url IS NULL",
+}
+
+// Valid reports whether f is one of the known filters.
+func (f ReprocessFilter) Valid() bool {
+	_, ok := reprocessConditions[f]
+	return ok
+}
+
+// Matches reports whether video still needs reprocessing under f.
+func (f ReprocessFilter) Matches(video Video) bool {
+	if video.Status != VideoStatusReady || video.VideoURL == nil {
+		return false
+	}
+	switch f {
+	case ReprocessMissingDuration:
+		return video.Duration <= 0
+	case ReprocessMissingPreview:
+		return video.PreviewURL == nil
+	case ReprocessMissingStoryboard:
+		return video.StoryboardURL == nil
+	}
+	return false
+}
+
+// GetVideoIDsToReprocess lists the ready videos matching filter, oldest
+// first.
+func (c Client) GetVideoIDsToReprocess(filter ReprocessFilter) ([]uuid.UUID, error) {
+	condition, ok := reprocessConditions[filter]
+	if !ok {
+		return nil, fmt.Errorf("unknown reprocess filter %q", filter)
+	}
+
+	rows, err := c.db.Query(`
+	SELECT id
+	FROM videos
+	WHERE status = ? AND video_url IS NOT NULL AND `+condition+`
+	ORDER BY created_at
+	`, VideoStatusReady)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ShareLink struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateShareLinkParams
+}
+
+type CreateShareLinkParams struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	UserID     uuid.UUID `json:"user_id"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+	// AllowedIP, a CIDR prefix, and AllowedReferrer, a host, restrict who
+	// can follow the link. Empty means anyone.
+	AllowedIP       string `json:"allowed_ip,omitempty"`
+	AllowedReferrer string `json:"allowed_referrer,omitempty"`
+}
+
+func (c Client) CreateShareLink(params CreateShareLinkParams) (ShareLink, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO share_links (
+		id,
+		created_at,
+		video_id,
+		user_id,
+		ttl_seconds,
+		allowed_ip,
+		allowed_referrer
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.UserID, params.TTLSeconds, params.AllowedIP, params.AllowedReferrer)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	return c.GetShareLink(id)
+}
+
+func (c Client) GetShareLink(id uuid.UUID) (ShareLink, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		video_id,
+		user_id,
+		ttl_seconds,
+		allowed_ip,
+		allowed_referrer
+	FROM share_links
+	WHERE id = ?
+	`
+
+	var link ShareLink
+	err := c.db.QueryRow(query, id).Scan(
+		&link.ID,
+		&link.CreatedAt,
+		&link.VideoID,
+		&link.UserID,
+		&link.TTLSeconds,
+		&link.AllowedIP,
+		&link.AllowedReferrer,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+
+	return link, nil
+}
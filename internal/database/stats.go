@@ -0,0 +1,75 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+type StorageUsage struct {
+	VideoCount int64 `json:"video_count"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+type UserStorageStats struct {
+	StorageUsage
+	ByStatus      map[VideoStatus]StorageUsage `json:"by_status"`
+	ByAspectRatio map[string]StorageUsage      `json:"by_aspect_ratio"`
+}
+
+func (c Client) GetUserStorageStats(userID uuid.UUID) (UserStorageStats, error) {
+	stats := UserStorageStats{
+		ByStatus:      map[VideoStatus]StorageUsage{},
+		ByAspectRatio: map[string]StorageUsage{},
+	}
+
+	query := `
+	SELECT status, COUNT(*), COALESCE(SUM(size), 0)
+	FROM videos
+	WHERE user_id = ?
+	GROUP BY status
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return UserStorageStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status VideoStatus
+		var usage StorageUsage
+		if err := rows.Scan(&status, &usage.VideoCount, &usage.TotalBytes); err != nil {
+			return UserStorageStats{}, err
+		}
+		stats.ByStatus[status] = usage
+		stats.VideoCount += usage.VideoCount
+		stats.TotalBytes += usage.TotalBytes
+	}
+	if err := rows.Err(); err != nil {
+		return UserStorageStats{}, err
+	}
+
+	query = `
+	SELECT aspect_ratio, COUNT(*), COALESCE(SUM(size), 0)
+	FROM videos
+	WHERE user_id = ? AND aspect_ratio != ''
+	GROUP BY aspect_ratio
+	`
+	rows, err = c.db.Query(query, userID)
+	if err != nil {
+		return UserStorageStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ratio string
+		var usage StorageUsage
+		if err := rows.Scan(&ratio, &usage.VideoCount, &usage.TotalBytes); err != nil {
+			return UserStorageStats{}, err
+		}
+		stats.ByAspectRatio[ratio] = usage
+	}
+	if err := rows.Err(); err != nil {
+		return UserStorageStats{}, err
+	}
+
+	return stats, nil
+}
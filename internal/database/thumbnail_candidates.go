@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ThumbnailCandidate is a frame extracted from a video and stored in S3 for
+// its owner to pick as the thumbnail. Timestamp is in seconds.
+type ThumbnailCandidate struct {
+	ID        uuid.UUID
+	VideoID   uuid.UUID
+	S3Key     string
+	Timestamp float64
+	CreatedAt time.Time
+}
+
+func (c Client) CreateThumbnailCandidate(candidate ThumbnailCandidate) error {
+	query := `
+	INSERT INTO thumbnail_candidates (
+		id,
+		video_id,
+		s3_key,
+		timestamp,
+		created_at
+	) VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, candidate.ID, candidate.VideoID, candidate.S3Key, candidate.Timestamp, candidate.CreatedAt.UTC())
+	return err
+}
+
+// GetThumbnailCandidate returns the zero ThumbnailCandidate when there is
+// none with id.
+func (c Client) GetThumbnailCandidate(id uuid.UUID) (ThumbnailCandidate, error) {
+	query := `
+	SELECT id, video_id, s3_key, timestamp, created_at
+	FROM thumbnail_candidates
+	WHERE id = ?
+	`
+
+	var candidate ThumbnailCandidate
+	err := c.db.QueryRow(query, id).Scan(&candidate.ID, &candidate.VideoID, &candidate.S3Key, &candidate.Timestamp, &candidate.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ThumbnailCandidate{}, nil
+		}
+		return ThumbnailCandidate{}, err
+	}
+
+	return candidate, nil
+}
+
+// GetThumbnailCandidates lists the candidates of videoID, or of every video
+// when videoID is uuid.Nil, that were created before createdBefore.
+func (c Client) GetThumbnailCandidates(videoID uuid.UUID, createdBefore time.Time) ([]ThumbnailCandidate, error) {
+	query := `
+	SELECT id, video_id, s3_key, timestamp, created_at
+	FROM thumbnail_candidates
+	WHERE (? OR video_id = ?) AND created_at < ?
+	ORDER BY created_at, timestamp
+	`
+
+	rows, err := c.db.Query(query, videoID == uuid.Nil, videoID, createdBefore.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []ThumbnailCandidate{}
+	for rows.Next() {
+		var candidate ThumbnailCandidate
+		err := rows.Scan(&candidate.ID, &candidate.VideoID, &candidate.S3Key, &candidate.Timestamp, &candidate.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, rows.Err()
+}
+
+func (c Client) DeleteThumbnailCandidate(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM thumbnail_candidates WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// VideoAttributes holds custom data integrators attach to a video, such as
+// campaign IDs or external references. Values are arbitrary JSON. It is
+// stored as a JSON object in the attributes column.
+type VideoAttributes map[string]json.RawMessage
+
+// MarshalJSON renders a video without attributes as an empty object rather
+// than null.
+func (a VideoAttributes) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]json.RawMessage(a))
+}
+
+func (a VideoAttributes) Value() (driver.Value, error) {
+	data, err := a.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a *VideoAttributes) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+		*a = VideoAttributes{}
+		return nil
+	default:
+		return fmt.Errorf("unsupported attributes type %T", src)
+	}
+
+	attributes := VideoAttributes{}
+	err := json.Unmarshal(data, &attributes)
+	if err != nil {
+		return err
+	}
+	*a = attributes
+	return nil
+}
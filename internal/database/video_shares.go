@@ -0,0 +1,62 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoShare struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateVideoShare grants userID read access to a video. Granting access
+// twice is a no-op.
+func (c Client) CreateVideoShare(videoID, userID uuid.UUID) (VideoShare, error) {
+	query := `
+	INSERT OR IGNORE INTO video_shares (
+		video_id,
+		user_id,
+		created_at
+	) VALUES (?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, videoID, userID)
+	if err != nil {
+		return VideoShare{}, err
+	}
+
+	return c.GetVideoShare(videoID, userID)
+}
+
+// GetVideoShare returns the zero VideoShare when userID has no access.
+func (c Client) GetVideoShare(videoID, userID uuid.UUID) (VideoShare, error) {
+	query := `
+	SELECT video_id, user_id, created_at
+	FROM video_shares
+	WHERE video_id = ? AND user_id = ?
+	`
+
+	var share VideoShare
+	err := c.db.QueryRow(query, videoID, userID).Scan(&share.VideoID, &share.UserID, &share.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoShare{}, nil
+		}
+		return VideoShare{}, err
+	}
+
+	return share, nil
+}
+
+func (c Client) DeleteVideoShare(videoID, userID uuid.UUID) error {
+	query := `
+	DELETE FROM video_shares
+	WHERE video_id = ? AND user_id = ?
+	`
+	_, err := c.db.Exec(query, videoID, userID)
+	return err
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// VideoWarning is a non-fatal issue found while processing a video, such as
+// a codec some browsers can't play. Code is stable for clients to match on,
+// Message is meant for people.
+type VideoWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// VideoWarnings is stored as a JSON array in the warnings column.
+type VideoWarnings []VideoWarning
+
+func (w VideoWarnings) Value() (driver.Value, error) {
+	if w == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]VideoWarning(w))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (w *VideoWarnings) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+		*w = VideoWarnings{}
+		return nil
+	default:
+		return fmt.Errorf("unsupported warnings type %T", src)
+	}
+
+	warnings := VideoWarnings{}
+	err := json.Unmarshal(data, &warnings)
+	if err != nil {
+		return err
+	}
+	*w = warnings
+	return nil
+}
@@ -3,18 +3,76 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type VideoStatus string
+
+const (
+	VideoStatusDraft      VideoStatus = "draft"
+	VideoStatusProcessing VideoStatus = "processing"
+	VideoStatusReady      VideoStatus = "ready"
+	VideoStatusFailed     VideoStatus = "failed"
+	VideoStatusFlagged    VideoStatus = "flagged"
+	VideoStatusRejected   VideoStatus = "rejected"
+	// VideoStatusMissing marks a video whose content turned out to be gone
+	// from S3.
+	VideoStatusMissing VideoStatus = "missing"
+)
+
+// VideoVisibility controls who besides the owner can see a video. Public
+// videos are listed on their owner's profile, unlisted ones are reachable by
+// anyone with the ID, and private ones only by the owner and the users it is
+// shared with.
+type VideoVisibility string
+
+const (
+	VideoVisibilityPublic   VideoVisibility = "public"
+	VideoVisibilityUnlisted VideoVisibility = "unlisted"
+	VideoVisibilityPrivate  VideoVisibility = "private"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                   uuid.UUID       `json:"id"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+	ThumbnailURL         *string         `json:"thumbnail_url"`
+	ThumbnailWidth       int             `json:"thumbnail_width"`
+	ThumbnailHeight      int             `json:"thumbnail_height"`
+	ThumbnailPlaceholder string          `json:"thumbnail_placeholder"`
+	VideoURL             *string         `json:"video_url"`
+	PreviewURL           *string         `json:"preview_url"`
+	StoryboardURL        *string         `json:"storyboard_url"`
+	ProxyURL             *string         `json:"proxy_url"`
+	Status               VideoStatus     `json:"status"`
+	Visibility           VideoVisibility `json:"visibility"`
+	PixFmt               string          `json:"pix_fmt"`
+	ColorTransfer        string          `json:"color_transfer"`
+	Size                 int64           `json:"size"`
+	AspectRatio          string          `json:"aspect_ratio"`
+	Duration             float64         `json:"duration"`
+	HasAudio             bool            `json:"has_audio"`
+	AudioWarning         string          `json:"audio_warning"`
+	FailureReason        string          `json:"failure_reason"`
+	OriginalFilename     string          `json:"original_filename"`
+	RetryCount           int             `json:"retry_count"`
+	Unoptimized          bool            `json:"unoptimized"`
+	Attributes           VideoAttributes `json:"attributes"`
+	Warnings             VideoWarnings   `json:"warnings,omitempty"`
+	// ThumbnailHash is the SHA-256 of the thumbnail as uploaded, before any
+	// re-encoding.
+	ThumbnailHash string `json:"-"`
+	// Version counts the updates to the row, see UpdateVideo.
+	Version int `json:"-"`
 	CreateVideoParams
+
+	// loaded is the row as it was read, for RebaseVideo to tell which
+	// fields were changed since.
+	loaded *Video
 }
 
 type CreateVideoParams struct {
@@ -23,23 +81,97 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_width,
+		thumbnail_height,
+		thumbnail_placeholder,
+		thumbnail_hash,
 		video_url,
-		user_id
+		preview_url,
+		storyboard_url,
+		proxy_url,
+		status,
+		visibility,
+		pix_fmt,
+		color_transfer,
+		size,
+		aspect_ratio,
+		duration,
+		has_audio,
+		audio_warning,
+		failure_reason,
+		original_filename,
+		retry_count,
+		unoptimized,
+		attributes,
+		warnings,
+		version,
+		user_id`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailWidth,
+		&video.ThumbnailHeight,
+		&video.ThumbnailPlaceholder,
+		&video.ThumbnailHash,
+		&video.VideoURL,
+		&video.PreviewURL,
+		&video.StoryboardURL,
+		&video.ProxyURL,
+		&video.Status,
+		&video.Visibility,
+		&video.PixFmt,
+		&video.ColorTransfer,
+		&video.Size,
+		&video.AspectRatio,
+		&video.Duration,
+		&video.HasAudio,
+		&video.AudioWarning,
+		&video.FailureReason,
+		&video.OriginalFilename,
+		&video.RetryCount,
+		&video.Unoptimized,
+		&video.Attributes,
+		&video.Warnings,
+		&video.Version,
+		&video.UserID,
+	)
+	loaded := video
+	video.loaded = &loaded
+	return video, err
+}
+
+// GetVideos lists the videos owned by userID, along with the ones shared
+// with them when includeShared is set. Shared videos that were flagged or
+// rejected by moderation are left out.
+func (c Client) GetVideos(userID uuid.UUID, includeShared bool, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
+		OR (? AND id IN (SELECT video_id FROM video_shares WHERE user_id = ?) AND status NOT IN (?, ?))
 	ORDER BY created_at DESC
+	LIMIT ? OFFSET ?
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, userID, includeShared, userID, VideoStatusFlagged, VideoStatusRejected, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +179,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,7 +189,80 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+// GetVideosVersion summarizes the videos GetVideos would list for userID as
+// their count and latest update, which changes whenever the list does.
+func (c Client) GetVideosVersion(userID uuid.UUID, includeShared bool) (int, string, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(MAX(updated_at), '')
+	FROM videos
+	WHERE user_id = ?
+		OR (? AND id IN (SELECT video_id FROM video_shares WHERE user_id = ?) AND status NOT IN (?, ?))
+	`
+
+	var count int
+	var lastUpdated string
+	err := c.db.QueryRow(query, userID, includeShared, userID, VideoStatusFlagged, VideoStatusRejected).Scan(&count, &lastUpdated)
+	if err != nil {
+		return 0, "", err
+	}
+	return count, lastUpdated, nil
+}
+
+// CountVideos returns how many videos userID owns.
+func (c Client) CountVideos(userID uuid.UUID) (int, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM videos WHERE user_id = ?", userID).Scan(&count)
+	return count, err
+}
+
+// GetPublicVideos lists ownerID's public videos, newest first, leaving out
+// the ones flagged or rejected by moderation.
+func (c Client) GetPublicVideos(ownerID uuid.UUID, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND visibility = ? AND status NOT IN (?, ?)
+	ORDER BY created_at DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query, ownerID, VideoVisibilityPublic, VideoStatusFlagged, VideoStatusRejected, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetPublicVideosVersion is GetVideosVersion for GetPublicVideos.
+func (c Client) GetPublicVideosVersion(ownerID uuid.UUID) (int, string, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(MAX(updated_at), '')
+	FROM videos
+	WHERE user_id = ? AND visibility = ? AND status NOT IN (?, ?)
+	`
+
+	var count int
+	var lastUpdated string
+	err := c.db.QueryRow(query, ownerID, VideoVisibilityPublic, VideoStatusFlagged, VideoStatusRejected).Scan(&count, &lastUpdated)
+	if err != nil {
+		return 0, "", err
+	}
+	return count, lastUpdated, nil
+}
+
+// CreateVideo creates a draft video with the given visibility.
+func (c Client) CreateVideo(params CreateVideoParams, visibility VideoVisibility) (Video, error) {
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +271,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		status,
+		visibility,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err := c.db.Exec(query, id, params.Title, params.Description, VideoStatusDraft, visibility, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -86,31 +284,123 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+// RestoreVideo recreates a deleted video from a copy taken before it was
+// deleted, under its old ID. Its shares and other rows deleted along with
+// it aren't restored.
+func (c Client) RestoreVideo(video Video) (Video, error) {
+	query := `
+	INSERT INTO videos (
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		status,
+		visibility,
+		user_id
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, video.ID, video.CreatedAt, video.Title, video.Description, video.Status, video.Visibility, video.UserID)
+	if err != nil {
+		return Video{}, err
+	}
+
+	inserted, err := c.GetVideo(video.ID)
+	if err != nil {
+		return Video{}, err
+	}
+	video.Version = inserted.Version
+	err = c.UpdateVideo(&video)
+	if err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(video.ID)
+}
+
+// CopyVideo inserts a new video with all of video's fields but its ID,
+// timestamps and version, so the copy is never seen half filled in.
+func (c Client) CopyVideo(video Video) (Video, error) {
+	id := uuid.New()
 	query := `
-	SELECT
+	INSERT INTO videos (
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_width,
+		thumbnail_height,
+		thumbnail_placeholder,
+		thumbnail_hash,
 		video_url,
+		preview_url,
+		storyboard_url,
+		proxy_url,
+		status,
+		visibility,
+		pix_fmt,
+		color_transfer,
+		size,
+		aspect_ratio,
+		duration,
+		has_audio,
+		audio_warning,
+		failure_reason,
+		original_filename,
+		retry_count,
+		unoptimized,
+		attributes,
+		warnings,
 		user_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id,
+		video.Title,
+		video.Description,
+		&video.ThumbnailURL,
+		video.ThumbnailWidth,
+		video.ThumbnailHeight,
+		video.ThumbnailPlaceholder,
+		video.ThumbnailHash,
+		&video.VideoURL,
+		&video.PreviewURL,
+		&video.StoryboardURL,
+		&video.ProxyURL,
+		video.Status,
+		video.Visibility,
+		video.PixFmt,
+		video.ColorTransfer,
+		video.Size,
+		video.AspectRatio,
+		video.Duration,
+		video.HasAudio,
+		video.AudioWarning,
+		video.FailureReason,
+		video.OriginalFilename,
+		video.RetryCount,
+		video.Unoptimized,
+		video.Attributes,
+		video.Warnings,
+		video.UserID,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+
+	return c.GetVideo(id)
+}
+
+func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +411,240 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// ErrVideoConflict is returned by UpdateVideo when the row was updated since
+// the video was read.
+var ErrVideoConflict = errors.New("video was updated concurrently")
+
+// UpdateVideo saves video, provided the row is still at video.Version,
+// and bumps the version of both. If another update got in first it fails
+// with ErrVideoConflict, and so it does when the video was deleted.
+func (c Client) UpdateVideo(video *Video) error {
 	query := `
 	UPDATE videos
 	SET
+		updated_at = ?,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		thumbnail_width = ?,
+		thumbnail_height = ?,
+		thumbnail_placeholder = ?,
+		thumbnail_hash = ?,
 		video_url = ?,
+		preview_url = ?,
+		storyboard_url = ?,
+		proxy_url = ?,
+		status = ?,
+		visibility = ?,
+		pix_fmt = ?,
+		color_transfer = ?,
+		size = ?,
+		aspect_ratio = ?,
+		duration = ?,
+		has_audio = ?,
+		audio_warning = ?,
+		failure_reason = ?,
+		original_filename = ?,
+		retry_count = ?,
+		unoptimized = ?,
+		attributes = ?,
+		warnings = ?,
+		version = version + 1,
 		user_id = ?
-	WHERE id = ?
+	WHERE id = ? AND version = ?
 	`
 
-	_, err := c.db.Exec(
+	// Sub-second precision lets clients polling with conditional requests
+	// see updates that land within the same second.
+	updatedAt := time.Now().UTC()
+	res, err := c.db.Exec(
 		query,
+		updatedAt,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		video.ThumbnailWidth,
+		video.ThumbnailHeight,
+		video.ThumbnailPlaceholder,
+		video.ThumbnailHash,
 		&video.VideoURL,
+		&video.PreviewURL,
+		&video.StoryboardURL,
+		&video.ProxyURL,
+		video.Status,
+		video.Visibility,
+		video.PixFmt,
+		video.ColorTransfer,
+		video.Size,
+		video.AspectRatio,
+		video.Duration,
+		video.HasAudio,
+		video.AudioWarning,
+		video.FailureReason,
+		video.OriginalFilename,
+		video.RetryCount,
+		video.Unoptimized,
+		video.Attributes,
+		video.Warnings,
 		video.UserID,
 		video.ID,
+		video.Version,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrVideoConflict
+	}
+
+	video.UpdatedAt = updatedAt
+	video.Version++
+	loaded := *video
+	loaded.loaded = nil
+	video.loaded = &loaded
+	return nil
+}
+
+// RebaseVideo applies the changes made to video since it was read onto
+// current, a fresh read of the same row, so an update that failed with
+// ErrVideoConflict can be retried without undoing the one that got in
+// first. A field the other update changed to something else than video did
+// can't be merged, and RebaseVideo fails with ErrVideoConflict rather than
+// pick a winner. Fields holding maps or slices must be replaced rather than
+// modified in place for their changes to be seen.
+func RebaseVideo(video, current Video) (Video, error) {
+	if video.loaded == nil {
+		return video, nil
+	}
+	rebased := current
+	err := applyChangedFields(reflect.ValueOf(&rebased).Elem(), reflect.ValueOf(*video.loaded), reflect.ValueOf(video))
+	if err != nil {
+		return Video{}, err
+	}
+	return rebased, nil
+}
+
+// applyChangedFields copies the exported fields that differ between base and
+// changed into dst, descending into embedded structs. Bookkeeping fields
+// are left as dst has them. A field dst changed from base as well, to
+// another value, is a conflict.
+func applyChangedFields(dst, base, changed reflect.Value) error {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch field.Name {
+		case "ID", "CreatedAt", "UpdatedAt", "Version":
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			err := applyChangedFields(dst.Field(i), base.Field(i), changed.Field(i))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		baseValue, changedValue, dstValue := base.Field(i).Interface(), changed.Field(i).Interface(), dst.Field(i).Interface()
+		if reflect.DeepEqual(baseValue, changedValue) || reflect.DeepEqual(changedValue, dstValue) {
+			continue
+		}
+		if !reflect.DeepEqual(baseValue, dstValue) {
+			return fmt.Errorf("%w: %s changed on both sides", ErrVideoConflict, field.Name)
+		}
+		dst.Field(i).Set(changed.Field(i))
+	}
+	return nil
 }
 
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	_, err := c.db.Exec("DELETE FROM video_shares WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	err = c.DeleteFailedUpload(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec("DELETE FROM thumbnail_candidates WHERE video_id = ?", id)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.db.Exec(query, id)
 	return err
 }
+
+type VideoKey struct {
+	ID       uuid.UUID
+	VideoURL string
+	Size     int64
+}
+
+// ListAllVideoKeys returns up to limit videos with stored content, across all
+// users, ordered by ID and starting after afterID. Pass uuid.Nil for the
+// first page and the last returned ID for the next ones.
+func (c Client) ListAllVideoKeys(afterID uuid.UUID, limit int) ([]VideoKey, error) {
+	query := `
+	SELECT id, video_url, size
+	FROM videos
+	WHERE video_url IS NOT NULL AND id > ?
+	ORDER BY id
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []VideoKey{}
+	for rows.Next() {
+		var key VideoKey
+		if err := rows.Scan(&key.ID, &key.VideoURL, &key.Size); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetVideoObjectURLs lists every S3 object URL stored on a video: content,
+// preview, storyboard and proxy, across all users.
+func (c Client) GetVideoObjectURLs() ([]string, error) {
+	rows, err := c.db.Query(`
+	SELECT video_url, preview_url, storyboard_url, proxy_url
+	FROM videos
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var videoURL, previewURL, storyboardURL, proxyURL *string
+		err := rows.Scan(&videoURL, &previewURL, &storyboardURL, &proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range []*string{videoURL, previewURL, storyboardURL, proxyURL} {
+			if u != nil {
+				urls = append(urls, *u)
+			}
+		}
+	}
+	return urls, rows.Err()
+}
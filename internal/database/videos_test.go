@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func newTestVideo(t *testing.T, c Client) Video {
+	t.Helper()
+
+	user, err := c.CreateUser(CreateUserParams{Email: uuid.NewString() + "@tubely.test", Password: "unused"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := c.CreateVideo(CreateVideoParams{Title: "Test video", UserID: user.ID}, VideoVisibilityPrivate)
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
+
+func TestRebaseVideo(t *testing.T) {
+	c := newTestClient(t)
+	video := newTestVideo(t, c)
+
+	first, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := first
+
+	thumbnailURL := "http://localhost:8091/assets/thumb.png"
+	first.ThumbnailURL = &thumbnailURL
+	first.Status = VideoStatusReady
+	if err := c.UpdateVideo(&first); err != nil {
+		t.Fatalf("UpdateVideo: %v", err)
+	}
+
+	t.Run("different fields", func(t *testing.T) {
+		changed := second
+		changed.Title = "Renamed"
+		if err := c.UpdateVideo(&changed); !errors.Is(err, ErrVideoConflict) {
+			t.Fatalf("UpdateVideo of a stale video = %v, want ErrVideoConflict", err)
+		}
+		current, _ := c.GetVideo(video.ID)
+		rebased, err := RebaseVideo(changed, current)
+		if err != nil {
+			t.Fatalf("RebaseVideo: %v", err)
+		}
+		if rebased.Title != "Renamed" || rebased.ThumbnailURL == nil || rebased.Status != VideoStatusReady {
+			t.Errorf("rebased = %+v, want both updates", rebased)
+		}
+	})
+
+	t.Run("same change on both sides", func(t *testing.T) {
+		changed := second
+		changed.Status = VideoStatusReady
+		current, _ := c.GetVideo(video.ID)
+		if _, err := RebaseVideo(changed, current); err != nil {
+			t.Errorf("RebaseVideo: %v", err)
+		}
+	})
+
+	t.Run("different changes to a field", func(t *testing.T) {
+		changed := second
+		changed.Status = VideoStatusFailed
+		current, _ := c.GetVideo(video.ID)
+		if _, err := RebaseVideo(changed, current); !errors.Is(err, ErrVideoConflict) {
+			t.Errorf("RebaseVideo = %v, want ErrVideoConflict", err)
+		}
+	})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobKindProcessVideo = "process_video"
+
+// maxRetryBackoff caps the delay before a failed job is retried, which
+// otherwise doubles with every attempt.
+const maxRetryBackoff = time.Hour
+
+var errQueueFull = errors.New("job queue is full")
+
+type job struct {
+	id         uuid.UUID
+	kind       string
+	payload    []byte
+	enqueuedAt time.Time
+	attempt    int
+	requestID  string
+	runAfter   *time.Time
+}
+
+// jobHandler runs jobs of one kind. onFailure is called once a job has failed
+// for good. Both get the payload the job was enqueued with, since a job
+// recovered after a restart has nothing else to go on. Jobs of a local kind
+// refer to files on the disk of the instance that enqueued them and only run
+// there.
+type jobHandler struct {
+	run       func(ctx context.Context, payload []byte) error
+	onFailure func(ctx context.Context, payload []byte, err error)
+	local     bool
+}
+
+// permanentJobError marks a job failure that retrying can't fix, such as a
+// malformed upload.
+type permanentJobError struct {
+	err error
+}
+
+func (e *permanentJobError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentJobError) Unwrap() error {
+	return e.err
+}
+
+type queueStats struct {
+	Depth                int     `json:"depth"`
+	Workers              int     `json:"workers"`
+	ActiveWorkers        int     `json:"active_workers"`
+	OldestPendingSeconds float64 `json:"oldest_pending_seconds"`
+	Pending              int     `json:"pending"`
+	Processing           int     `json:"processing"`
+	Retrying             int     `json:"retrying"`
+	Retried              int     `json:"retried"`
+	Failed               int     `json:"failed"`
+	// Scheduled counts jobs waiting for their run-after time.
+	Scheduled int `json:"scheduled"`
+	// Backfill is the latest reprocessing backfill, if any.
+	Backfill *backfillProgress `json:"backfill,omitempty"`
+}
+
+// jobQueue runs jobs on a fixed pool of workers. A failed job is retried
+// with exponential backoff until it has run maxAttempts times. Jobs are
+// persisted in the database until they're done, and a worker only runs a job
+// it managed to claim there, so several instances can share the table and
+// recover jobs a crashed instance left behind. Local jobs are the exception:
+// they are bound to the instance that enqueued them, named instance, and
+// only it claims them, after a restart as well. The bookkeeping behind stats
+// is guarded by mu since workers update it concurrently.
+type jobQueue struct {
+	db          database.Client
+	instance    string
+	handlers    map[string]jobHandler
+	jobs        chan *job
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+
+	mu      sync.Mutex
+	pending map[uuid.UUID]*job
+	// waiting holds the jobs waiting on a timer, for their run-after time
+	// or a retry, which the database lists as pending as well.
+	waiting   map[uuid.UUID]bool
+	active    int
+	retrying  int
+	retried   int
+	failed    int
+	scheduled int
+}
+
+func newJobQueue(db database.Client, instance string, workers, capacity, maxAttempts int, backoff time.Duration) *jobQueue {
+	return &jobQueue{
+		db:          db,
+		instance:    instance,
+		handlers:    map[string]jobHandler{},
+		jobs:        make(chan *job, capacity),
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		pending:     map[uuid.UUID]*job{},
+		waiting:     map[uuid.UUID]bool{},
+	}
+}
+
+// handle registers the handler for jobs of kind. Handlers must be registered
+// before the queue is started.
+func (q *jobQueue) handle(kind string, handler jobHandler) {
+	q.handlers[kind] = handler
+}
+
+func (q *jobQueue) start(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+}
+
+func (q *jobQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-q.jobs:
+			q.mu.Lock()
+			delete(q.pending, j.id)
+			q.mu.Unlock()
+
+			// Recovered jobs may be queued on more than one instance, only
+			// the one that claims a job runs it.
+			claimed, err := q.db.ClaimJob(j.id, q.instance)
+			if err != nil {
+				logWithRequestID(j.requestID, "Couldn't claim job %v (%s), leaving it for recovery: %v", j.id, j.kind, err)
+				continue
+			}
+			if !claimed {
+				// The database clock may be a little ahead of ours.
+				if j.runAfter != nil && time.Now().Before(*j.runAfter) {
+					q.schedule(j)
+				}
+				continue
+			}
+
+			q.mu.Lock()
+			q.active++
+			q.mu.Unlock()
+
+			j.attempt++
+			err = q.run(withRequestID(ctx, j.requestID), j)
+
+			q.mu.Lock()
+			q.active--
+			q.mu.Unlock()
+
+			if err != nil {
+				q.handleFailure(j, err)
+				continue
+			}
+			q.finish(j)
+		}
+	}
+}
+
+func (q *jobQueue) run(ctx context.Context, j *job) error {
+	handler, ok := q.handlers[j.kind]
+	if !ok {
+		return &permanentJobError{err: fmt.Errorf("no handler for job kind %q", j.kind)}
+	}
+	return handler.run(ctx, j.payload)
+}
+
+// finish drops a job that is done with, successfully or not, from the
+// database.
+func (q *jobQueue) finish(j *job) {
+	err := q.db.DeleteJob(j.id)
+	if err != nil {
+		logWithRequestID(j.requestID, "Couldn't delete finished job %v (%s): %v", j.id, j.kind, err)
+	}
+}
+
+// handleFailure schedules another attempt of j after a backoff doubling with
+// every attempt, or gives up on it once attempts are exhausted or the error
+// is permanent. The retry time is persisted with the job, so neither a
+// restart nor another instance runs it any sooner.
+func (q *jobQueue) handleFailure(j *job, err error) {
+	var permanent *permanentJobError
+	if j.attempt >= q.maxAttempts || errors.As(err, &permanent) {
+		q.fail(j, err)
+		return
+	}
+
+	delay := q.retryDelay(j.attempt)
+	logWithRequestID(j.requestID, "Job %v (%s) failed on attempt %d/%d, retrying in %v: %v", j.id, j.kind, j.attempt, q.maxAttempts, delay, err)
+
+	runAfter := time.Now().Add(delay)
+	j.runAfter = &runAfter
+	releaseErr := q.db.ReleaseJob(j.id, runAfter)
+	if releaseErr != nil {
+		q.fail(j, fmt.Errorf("%w (retry not scheduled: %v)", err, releaseErr))
+		return
+	}
+
+	q.mu.Lock()
+	q.retrying++
+	q.retried++
+	q.waiting[j.id] = true
+	q.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		q.retrying--
+		delete(q.waiting, j.id)
+		q.mu.Unlock()
+
+		pushErr := q.push(j)
+		if pushErr != nil {
+			q.fail(j, fmt.Errorf("%w (retry not scheduled: %v)", err, pushErr))
+		}
+	})
+}
+
+// retryDelay is the backoff before the attempt after attempt, doubling from
+// q.backoff up to maxRetryBackoff.
+func (q *jobQueue) retryDelay(attempt int) time.Duration {
+	delay := q.backoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+func (q *jobQueue) fail(j *job, err error) {
+	q.mu.Lock()
+	q.failed++
+	q.mu.Unlock()
+
+	logWithRequestID(j.requestID, "Job %v (%s) failed after %d attempt(s): %v", j.id, j.kind, j.attempt, err)
+	q.finish(j)
+	if handler, ok := q.handlers[j.kind]; ok && handler.onFailure != nil {
+		handler.onFailure(withRequestID(context.Background(), j.requestID), j.payload, err)
+	}
+}
+
+// enqueue persists a job of kind with payload encoded as JSON and schedules
+// it on the next free worker. It doesn't block: when the queue is at capacity
+// errQueueFull is returned instead and nothing is persisted. The request ID
+// in ctx is carried over to the context the handler gets, ctx itself isn't
+// kept.
+func (q *jobQueue) enqueue(ctx context.Context, kind string, payload any) error {
+	_, err := q.enqueueJob(ctx, kind, payload, nil)
+	return err
+}
+
+// enqueueAfter persists a job like enqueue does, but no worker runs it
+// before runAfter. Until it's due the job waits on a timer rather than in the
+// queue, so it takes up no capacity, and recover schedules it again after a
+// restart. It returns the job's ID, for database.Client.CancelJob.
+func (q *jobQueue) enqueueAfter(ctx context.Context, kind string, payload any, runAfter time.Time) (uuid.UUID, error) {
+	return q.enqueueJob(ctx, kind, payload, &runAfter)
+}
+
+func (q *jobQueue) enqueueJob(ctx context.Context, kind string, payload any, runAfter *time.Time) (uuid.UUID, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("couldn't encode job payload: %w", err)
+	}
+
+	j := &job{
+		id:        uuid.New(),
+		kind:      kind,
+		payload:   data,
+		requestID: requestIDFromContext(ctx),
+		runAfter:  runAfter,
+	}
+	var instance string
+	if q.handlers[kind].local {
+		instance = q.instance
+	}
+	err = q.db.CreateJob(database.Job{
+		ID:        j.id,
+		Kind:      j.kind,
+		Payload:   j.payload,
+		RequestID: j.requestID,
+		Instance:  instance,
+		RunAfter:  j.runAfter,
+	})
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("couldn't persist job: %w", err)
+	}
+
+	if runAfter != nil {
+		q.schedule(j)
+		return j.id, nil
+	}
+
+	err = q.push(j)
+	if err != nil {
+		q.finish(j)
+		return uuid.Nil, err
+	}
+	return j.id, nil
+}
+
+// recover queues the jobs persisted by earlier runs that this instance may
+// claim. Jobs claimed more than staleAfter ago are assumed to belong to an
+// instance that crashed and are released first; pass a threshold comfortably
+// above the longest a job can run, or a slow job on a live instance may run
+// twice. Jobs that don't fit in the queue stay pending until recoverStale
+// queues them.
+func (q *jobQueue) recover(staleAfter time.Duration) error {
+	released, err := q.db.ReleaseStaleJobs(time.Now().Add(-staleAfter), q.instance)
+	if err != nil {
+		return fmt.Errorf("couldn't release stale jobs: %w", err)
+	}
+	if len(released) > 0 {
+		log.Printf("Released %d stale job(s) left processing by an earlier run", len(released))
+	}
+
+	pending, err := q.db.GetPendingJobs(q.instance)
+	if err != nil {
+		return fmt.Errorf("couldn't list pending jobs: %w", err)
+	}
+	for i, pj := range pending {
+		j := newPersistedJob(pj)
+		if j.runAfter != nil && time.Now().Before(*j.runAfter) {
+			q.schedule(j)
+			continue
+		}
+		err := q.push(j)
+		if err != nil {
+			log.Printf("Recovered %d of %d pending job(s), the rest stay pending: %v", i, len(pending), err)
+			return nil
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Recovered %d pending job(s)", len(pending))
+	}
+	return nil
+}
+
+// pendingSweepInterval is the longest recoverStale waits between looking
+// for pending jobs nothing is holding.
+const pendingSweepInterval = time.Minute
+
+// recoverStale releases the jobs claimed more than staleAfter ago every
+// half staleAfter, or every pendingSweepInterval if that's sooner, until ctx
+// is done, and queues every due pending job this instance isn't holding:
+// the released ones, so a job whose instance crashed or hung is retried
+// without waiting for a restart, and the ones that didn't fit in the queue
+// when they were recovered. The same caveat as for recover applies to
+// staleAfter.
+func (q *jobQueue) recoverStale(ctx context.Context, staleAfter time.Duration) {
+	ticker := time.NewTicker(min(staleAfter/2, pendingSweepInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		released, err := q.db.ReleaseStaleJobs(time.Now().Add(-staleAfter), q.instance)
+		if err != nil {
+			log.Printf("Couldn't release stale jobs: %v", err)
+			continue
+		}
+		for _, pj := range released {
+			logWithRequestID(pj.RequestID, "Job %v (%s) was claimed over %v ago, queueing it again", pj.ID, pj.Kind, staleAfter)
+		}
+
+		q.requeuePending()
+	}
+}
+
+// requeuePending queues the pending jobs in the database that aren't queued
+// or waiting on a timer here, scheduling those that aren't due yet. Jobs
+// another instance is holding may be queued on both, only one of them
+// claims each.
+func (q *jobQueue) requeuePending() {
+	pending, err := q.db.GetPendingJobs(q.instance)
+	if err != nil {
+		log.Printf("Couldn't list pending jobs: %v", err)
+		return
+	}
+	for _, pj := range pending {
+		if q.holds(pj.ID) {
+			continue
+		}
+		j := newPersistedJob(pj)
+		if j.runAfter != nil && time.Now().Before(*j.runAfter) {
+			q.schedule(j)
+			continue
+		}
+		err := q.push(j)
+		if err != nil {
+			logWithRequestID(j.requestID, "Couldn't queue job %v (%s), it stays pending: %v", j.id, j.kind, err)
+			return
+		}
+	}
+}
+
+// holds reports whether the job with id is queued or waiting on a timer.
+func (q *jobQueue) holds(id uuid.UUID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, queued := q.pending[id]
+	return queued || q.waiting[id]
+}
+
+// newPersistedJob is the job to queue for one read back from the database.
+func newPersistedJob(pj database.Job) *job {
+	return &job{
+		id:        pj.ID,
+		kind:      pj.Kind,
+		payload:   pj.Payload,
+		attempt:   pj.Attempts,
+		requestID: pj.RequestID,
+		runAfter:  pj.RunAfter,
+	}
+}
+
+// schedule pushes j once its run-after time has come. Should the queue be
+// full by then, it tries again after the retry backoff; the job stays
+// persisted meanwhile.
+func (q *jobQueue) schedule(j *job) {
+	q.mu.Lock()
+	q.scheduled++
+	q.waiting[j.id] = true
+	q.mu.Unlock()
+
+	var fire func()
+	fire = func() {
+		if q.push(j) != nil {
+			time.AfterFunc(q.backoff, fire)
+			return
+		}
+		q.mu.Lock()
+		q.scheduled--
+		delete(q.waiting, j.id)
+		q.mu.Unlock()
+	}
+	time.AfterFunc(time.Until(*j.runAfter), fire)
+}
+
+func (q *jobQueue) push(j *job) error {
+	j.enqueuedAt = time.Now()
+
+	q.mu.Lock()
+	q.pending[j.id] = j
+	q.mu.Unlock()
+
+	select {
+	case q.jobs <- j:
+		return nil
+	default:
+		q.mu.Lock()
+		delete(q.pending, j.id)
+		q.mu.Unlock()
+		return errQueueFull
+	}
+}
+
+func (q *jobQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := queueStats{
+		Depth:         len(q.pending),
+		Workers:       q.workers,
+		ActiveWorkers: q.active,
+		Pending:       len(q.pending),
+		Processing:    q.active,
+		Retrying:      q.retrying,
+		Retried:       q.retried,
+		Failed:        q.failed,
+		Scheduled:     q.scheduled,
+	}
+	for _, j := range q.pending {
+		age := time.Since(j.enqueuedAt).Seconds()
+		if age > stats.OldestPendingSeconds {
+			stats.OldestPendingSeconds = age
+		}
+	}
+	return stats
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestJobQueueRecoverStale(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	q := newJobQueue(cfg.db, "test", 1, 10, 3, time.Millisecond)
+	ran := make(chan struct{}, 1)
+	q.handle("test", jobHandler{run: func(ctx context.Context, payload []byte) error {
+		ran <- struct{}{}
+		return nil
+	}})
+
+	// Claimed by an instance that hung while the server kept running.
+	id := uuid.New()
+	if err := cfg.db.CreateJob(database.Job{ID: id, Kind: "test", Payload: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := cfg.db.ClaimJob(id, "test"); err != nil || !claimed {
+		t.Fatalf("ClaimJob = %v, %v", claimed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+	go q.recoverStale(ctx, 50*time.Millisecond)
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stale job wasn't run again")
+	}
+}
+
+func TestJobQueueRecoverOverflow(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	q := newJobQueue(cfg.db, "test", 1, 1, 3, time.Millisecond)
+	var mu sync.Mutex
+	runs := map[string]int{}
+	ran := make(chan struct{}, 10)
+	q.handle("test", jobHandler{run: func(ctx context.Context, payload []byte) error {
+		mu.Lock()
+		runs[string(payload)]++
+		mu.Unlock()
+		ran <- struct{}{}
+		return nil
+	}})
+
+	// More pending jobs than the queue holds, as left by an earlier run.
+	for i := range 3 {
+		err := cfg.db.CreateJob(database.Job{ID: uuid.New(), Kind: "test", Payload: []byte(fmt.Sprint(i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.recover(time.Hour); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+	go q.recoverStale(ctx, 50*time.Millisecond)
+
+	for range 3 {
+		select {
+		case <-ran:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("jobs run = %v, want all 3", runs)
+		}
+	}
+	// Give the sweep a few more rounds to queue anything twice.
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, payload := range []string{"0", "1", "2"} {
+		if runs[payload] != 1 {
+			t.Errorf("job %s ran %d times, want once", payload, runs[payload])
+		}
+	}
+	if pending, err := cfg.db.GetPendingJobs("test"); err != nil || len(pending) != 0 {
+		t.Errorf("pending jobs = %v, %v, want none", pending, err)
+	}
+}
+
+func TestJobQueueLocalJobs(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	ran := make(chan string, 4)
+	newQueue := func(instance string) *jobQueue {
+		q := newJobQueue(cfg.db, instance, 1, 10, 3, time.Millisecond)
+		for _, kind := range []string{"local", "shared"} {
+			q.handle(kind, jobHandler{run: func(ctx context.Context, payload []byte) error {
+				ran <- instance + "/" + kind
+				return nil
+			}, local: kind == "local"})
+		}
+		return q
+	}
+	a, b := newQueue("a"), newQueue("b")
+
+	// Enqueued on a, which crashes before running them.
+	for _, kind := range []string{"local", "shared"} {
+		if err := a.enqueue(context.Background(), kind, struct{}{}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.recover(time.Hour); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	b.start(ctx)
+	select {
+	case got := <-ran:
+		if got != "b/shared" {
+			t.Fatalf("b ran %q, want only the shared job", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b didn't run the shared job")
+	}
+	select {
+	case got := <-ran:
+		t.Fatalf("b ran %q, a local job of a", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a picks its local job back up once it restarts.
+	a = newQueue("a")
+	if err := a.recover(time.Hour); err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	a.start(ctx)
+	select {
+	case got := <-ran:
+		if got != "a/local" {
+			t.Errorf("a ran %q, want its local job", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a didn't run its local job")
+	}
+}
+
+func TestJobQueueRetryDelay(t *testing.T) {
+	q := newJobQueue(database.Client{}, "test", 1, 1, maxProcessingAttempts, 5*time.Second)
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{11, maxRetryBackoff},
+		// Shifting would have overflowed by then.
+		{100, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := q.retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestJobQueueRetryPersistsRunAfter(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	q := newJobQueue(cfg.db, "test", 1, 10, 3, time.Hour)
+	q.handle("test", jobHandler{run: func(ctx context.Context, payload []byte) error {
+		return errors.New("transient")
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+	start := time.Now()
+	if err := q.enqueue(context.Background(), "test", struct{}{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	// A restart must not retry the job any sooner than this run would.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := cfg.db.GetPendingJobs("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 1 && pending[0].Attempts == 1 {
+			if runAfter := pending[0].RunAfter; runAfter == nil || runAfter.Before(start.Add(time.Hour)) {
+				t.Errorf("run_after = %v, want an hour after the attempt", runAfter)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending jobs = %+v, want the failed job released", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
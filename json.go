@@ -7,11 +7,14 @@ import (
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	// The request ID middleware has already set the response header, which
+	// is the only place it can be read from here.
+	requestID := w.Header().Get(requestIDHeader)
 	if err != nil {
-		log.Println(err)
+		logWithRequestID(requestID, "%v", err)
 	}
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		logWithRequestID(requestID, "Responding with 5XX error: %s", msg)
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// validateJWT checks an access token signed either by this server with the
+// shared secret or, when JWT_PUBLIC_KEY_FILE is set, by another service with
+// the matching RSA private key. Expiry and not-before times are checked with
+// JWT_LEEWAY to spare.
+func (cfg *apiConfig) validateJWT(token string) (uuid.UUID, error) {
+	return auth.ValidateJWTWithKeys(token, auth.VerificationKeys{
+		HMACSecret:   cfg.jwtSecret,
+		RSAPublicKey: cfg.jwtPublicKey,
+		Leeway:       cfg.jwtLeeway,
+	})
+}
+
+// requireActiveUser closes the window in which a valid token outlives its
+// user, answering 401 for deleted and 403 for disabled users. The check costs
+// a query, so it only runs when VERIFY_ACTIVE_USER is set. It reports whether
+// the request may go on.
+func (cfg *apiConfig) requireActiveUser(w http.ResponseWriter, userID uuid.UUID) bool {
+	if !cfg.verifyActiveUser {
+		return true
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return false
+	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "User no longer exists", nil)
+		return false
+	}
+	if user.Disabled {
+		respondWithError(w, http.StatusForbidden, "User is disabled", nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequireActiveUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		verify     bool
+		user       string
+		wantOK     bool
+		wantStatus int
+	}{
+		{"active", true, "active", true, http.StatusOK},
+		{"disabled", true, "disabled", false, http.StatusForbidden},
+		{"deleted", true, "deleted", false, http.StatusUnauthorized},
+		{"disabled, unchecked", false, "disabled", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			cfg.verifyActiveUser = tt.verify
+			userID, _ := createTestUser(t, cfg)
+			switch tt.user {
+			case "disabled":
+				if err := cfg.db.SetUserDisabled(userID, true); err != nil {
+					t.Fatalf("SetUserDisabled: %v", err)
+				}
+			case "deleted":
+				userID = uuid.New()
+			}
+
+			w := httptest.NewRecorder()
+			if ok := cfg.requireActiveUser(w, userID); ok != tt.wantOK {
+				t.Fatalf("requireActiveUser = %v, want %v", ok, tt.wantOK)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoDisabledUser(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.verifyActiveUser = true
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	if err := cfg.db.SetUserDisabled(userID, true); err != nil {
+		t.Fatalf("SetUserDisabled: %v", err)
+	}
+
+	// The token is still valid, only the user behind it isn't.
+	if _, err := cfg.validateJWT(token); err != nil {
+		t.Fatalf("validateJWT: %v", err)
+	}
+	w := httptest.NewRecorder()
+	cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403, body %s", w.Code, w.Body)
+	}
+	if puts := store.callsTo("PutObject"); len(puts) != 0 {
+		t.Errorf("PutObject calls = %q, want none", puts)
+	}
+	if saved := getTestVideo(t, cfg, video.ID); saved.VideoURL != nil {
+		t.Errorf("video_url = %q, want none", *saved.VideoURL)
+	}
+}
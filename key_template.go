@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultKeyTemplate is the layout keys had before templates existed.
+	defaultKeyTemplate = "{ratio}/{random}.{ext}"
+	// userPrefixKeyTemplate is the layout S3_USER_PREFIX selects.
+	userPrefixKeyTemplate = "users/{userID}/{ratio}/{random}.{ext}"
+)
+
+// keyTemplatePlaceholders renders each placeholder a key template may use.
+// Everything they produce is S3 safe, so a template whose literal parts are
+// renders to a safe key.
+var keyTemplatePlaceholders = map[string]func(keyTemplateValues) string{
+	"year":   func(v keyTemplateValues) string { return v.now.Format("2006") },
+	"month":  func(v keyTemplateValues) string { return v.now.Format("01") },
+	"day":    func(v keyTemplateValues) string { return v.now.Format("02") },
+	"userID": func(v keyTemplateValues) string { return v.userID.String() },
+	"ratio":  func(v keyTemplateValues) string { return v.ratio },
+	"ext":    func(v keyTemplateValues) string { return strings.TrimPrefix(v.ext, ".") },
+	"uuid":   func(keyTemplateValues) string { return uuid.NewString() },
+	"random": func(keyTemplateValues) string { return getAssetPath("") },
+}
+
+// keyTemplateLiteralPattern is what the text between placeholders may
+// contain. ':' is there for the aspect ratios keys have always held.
+var keyTemplateLiteralPattern = regexp.MustCompile(`^[A-Za-z0-9/._:-]*$`)
+
+type keyTemplateValues struct {
+	now    time.Time
+	userID uuid.UUID
+	ratio  string
+	ext    string
+}
+
+// keyTemplate is a parsed S3_KEY_TEMPLATE such as
+// "{year}/{month}/{userID}/{ratio}/{uuid}.{ext}": literal text alternating
+// with placeholders.
+type keyTemplate struct {
+	literals     []string
+	placeholders []string
+}
+
+// parseKeyTemplate parses a key template, rejecting unknown placeholders,
+// unsafe characters and templates that would give two videos the same key.
+func parseKeyTemplate(template string) (keyTemplate, error) {
+	var t keyTemplate
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return keyTemplate{}, errors.New("unclosed '{'")
+		}
+		name := rest[start+1 : start+end]
+		if _, ok := keyTemplatePlaceholders[name]; !ok {
+			return keyTemplate{}, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		t.literals = append(t.literals, rest[:start])
+		t.placeholders = append(t.placeholders, name)
+		rest = rest[start+end+1:]
+	}
+	t.literals = append(t.literals, rest)
+
+	for _, literal := range t.literals {
+		if !keyTemplateLiteralPattern.MatchString(literal) {
+			return keyTemplate{}, fmt.Errorf("%q may only contain letters, digits, placeholders, '/', '.', '_', ':' and '-'", template)
+		}
+	}
+	if !t.uses("uuid") && !t.uses("random") {
+		return keyTemplate{}, errors.New("must contain {uuid} or {random} so keys are unique")
+	}
+
+	sample := t.render(keyTemplateValues{now: time.Now(), userID: uuid.New(), ratio: "16:9", ext: ".mp4"})
+	err := checkRenderedKey(sample)
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	return t, nil
+}
+
+func (t keyTemplate) uses(placeholder string) bool {
+	for _, name := range t.placeholders {
+		if name == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+func (t keyTemplate) render(values keyTemplateValues) string {
+	var b strings.Builder
+	for i, name := range t.placeholders {
+		b.WriteString(t.literals[i])
+		b.WriteString(keyTemplatePlaceholders[name](values))
+	}
+	b.WriteString(t.literals[len(t.literals)-1])
+	return b.String()
+}
+
+// checkRenderedKey rejects keys S3 would take but that turn into surprises
+// later: leading slashes and empty, '.' or '..' path segments.
+func checkRenderedKey(key string) error {
+	if len(key) > maxCustomKeyLength {
+		return fmt.Errorf("renders keys longer than %d characters", maxCustomKeyLength)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("renders %q, which has an empty, '.' or '..' path segment", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestKeyTemplateRender(t *testing.T) {
+	userID := uuid.MustParse("0b4f2a52-5d43-4c59-9b4e-9a7a1c0f3e21")
+	values := keyTemplateValues{
+		now:    time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC),
+		userID: userID,
+		ratio:  "landscape",
+		ext:    ".mp4",
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{defaultKeyTemplate, `^landscape/[A-Za-z0-9_-]{43}\.mp4$`},
+		{userPrefixKeyTemplate, `^users/` + userID.String() + `/landscape/[A-Za-z0-9_-]{43}\.mp4$`},
+		{"{year}/{month}/{day}/{uuid}.{ext}", `^2026/03/07/[0-9a-f-]{36}\.mp4$`},
+		{"videos/{ratio}-{uuid}", `^videos/landscape-[0-9a-f-]{36}$`},
+	}
+	for _, tt := range tests {
+		template, err := parseKeyTemplate(tt.template)
+		if err != nil {
+			t.Errorf("parseKeyTemplate(%q): %v", tt.template, err)
+			continue
+		}
+		first, second := template.render(values), template.render(values)
+		if !regexp.MustCompile(tt.want).MatchString(first) {
+			t.Errorf("%q rendered %q, want it to match %s", tt.template, first, tt.want)
+		}
+		if first == second {
+			t.Errorf("%q rendered %q twice", tt.template, first)
+		}
+	}
+}
+
+func TestParseKeyTemplateInvalid(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{"{ratio}/{random}.{extension}", "unknown placeholder {extension}"},
+		{"{Random}.{ext}", "unknown placeholder {Random}"},
+		{"{}/{random}", "unknown placeholder {}"},
+		{"{ratio}/{random", "unclosed '{'"},
+		{"{ratio}/{year}.{ext}", "must contain {uuid} or {random}"},
+		{"videos /{random}", "may only contain"},
+		{"videos/}{random}", "may only contain"},
+		{"/{random}.{ext}", "empty, '.' or '..' path segment"},
+		{"videos//{random}", "empty, '.' or '..' path segment"},
+		{"../{random}", "empty, '.' or '..' path segment"},
+		{strings.Repeat("a", maxCustomKeyLength) + "{random}", "longer than"},
+	}
+	for _, tt := range tests {
+		_, err := parseKeyTemplate(tt.template)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseKeyTemplate(%.40q) error = %v, want one containing %q", tt.template, err, tt.wantErr)
+		}
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
 	"github.com/joho/godotenv"
@@ -15,89 +17,219 @@ import (
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	db                    database.Client
+	jwtSecret             string
+	jwtPublicKey          *rsa.PublicKey
+	jwtLeeway             time.Duration
+	allowQueryToken       bool
+	verifyActiveUser      bool
+	adminAPIKey           string
+	platform              string
+	filepathRoot          string
+	assetsRoot            string
+	assetsMaxBytes        int64
+	s3Bucket              string
+	s3Region              string
+	s3CfDistribution      string
+	s3ConditionalPut      bool
+	port                  string
+	store                 objectStore
+	keyTemplate           keyTemplate
+	s3CustomKeyPrefix     string
+	s3ObjectTags          []string
+	presignExpiry         time.Duration
+	presignExpiryByRatio  map[string]time.Duration
+	presignCache          *presignCache
+	objectInfoCache       *objectInfoCache
+	shareMaxTTL           time.Duration
+	shareRestrictions     string
+	listMaxLimit          int
+	maxVideosPerUser      int
+	defaultVisibility     database.VideoVisibility
+	accountImportMaxBytes int64
+	maxVideoUploadSize    int64
+	maxImageUploadSize    int64
+	verifyDeclaredSize    bool
+	declaredSizeTolerance int64
+	cacheControl          string
+
+	allowedReferrers     []string
+	allowMissingReferrer bool
+
+	moderator          contentModerator
+	moderationFailOpen bool
+
+	skipVideoProcessing bool
+	uploadPassthrough   bool
+	hdrPolicy           string
+	autoOrient          bool
+	aspectRatioFallback string
+	squareTolerance     float64
+	detectSilence       bool
+	verifyDecode        bool
+	minDuration         time.Duration
+	maxDuration         time.Duration
+	minWidth            int
+	minHeight           int
+	ffmpeg              ffmpegOptions
+	faststartFallback   bool
+	failedUploadsDir    string
+	maxVideoRetries     int
+	commands            commandRunner
+	ffmpegPool          *ffmpegPool
+	jobs                *jobQueue
+	objectDeleteGrace   time.Duration
+	orphanMinAge        time.Duration
+
+	previewEnabled  bool
+	previewStart    time.Duration
+	previewDuration time.Duration
+	proxyEnabled    bool
+
+	storyboardInterval time.Duration
+
+	idempotencyTTL   time.Duration
+	idempotencyLocks *keyedMutex
+
+	thumbnailAspectRatio    string
+	thumbnailFit            string
+	thumbnailSceneThreshold float64
+	thumbnailCandidateTTL   time.Duration
+	trimReplace             bool
+
+	maintenance *maintenanceMode
+	backfill    *backfill
+	orphans     *orphanCleanup
+
+	rateLimiter    *ipRateLimiter
+	trustedProxies []netip.Prefix
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	conf, err := loadConfig(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(conf.dbPath)
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	var moderator contentModerator
+	if conf.moderationURL != "" {
+		moderator = newHTTPModerator(conf.moderationURL, 30*time.Second)
 	}
 
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
+	// With no workers configured uploads are processed within the request.
+	var jobs *jobQueue
+	if conf.processingWorkers > 0 {
+		jobs = newJobQueue(db, conf.processingInstance, conf.processingWorkers, conf.processingQueueSize, conf.processingMaxAttempts, conf.processingRetryBackoff)
 	}
 
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
-	}
+	ffmpegPool := newFFmpegPool(execCommandRunner{logStderr: conf.logCommandStderr}, conf.ffmpegMaxProcesses)
 
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
+	var rateLimiter *ipRateLimiter
+	if conf.rateLimitPerMinute > 0 {
+		rateLimiter = newIPRateLimiter(conf.rateLimitPerMinute, conf.rateLimitBurst)
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
-	}
-
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
-	}
-
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
-	}
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
-	}
+	httpClient := newS3HTTPClient(conf.s3MaxIdleConns, conf.s3MaxIdleConnsPerHost, conf.s3IdleConnTimeout)
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(conf.s3Region), config.WithHTTPClient(httpClient))
 
 	if err != nil {
 		log.Fatalf("Couldn't create s3 config %v", err)
 	}
 
-	s3Client := s3.NewFromConfig(s3Config)
+	s3Client := newS3Client(s3Config, conf.s3UseAccelerate)
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+		db:                    db,
+		jwtSecret:             conf.jwtSecret,
+		jwtPublicKey:          conf.jwtPublicKey,
+		jwtLeeway:             conf.jwtLeeway,
+		allowQueryToken:       conf.allowQueryToken,
+		verifyActiveUser:      conf.verifyActiveUser,
+		adminAPIKey:           conf.adminAPIKey,
+		platform:              conf.platform,
+		filepathRoot:          conf.filepathRoot,
+		assetsRoot:            conf.assetsRoot,
+		assetsMaxBytes:        conf.assetsMaxBytes,
+		s3Bucket:              conf.s3Bucket,
+		s3Region:              conf.s3Region,
+		s3CfDistribution:      conf.s3CfDistribution,
+		s3ConditionalPut:      conf.s3ConditionalPut,
+		port:                  conf.port,
+		store:                 newS3ObjectStore(s3Client, conf.s3UploadConcurrency),
+		keyTemplate:           conf.keyTemplate,
+		s3CustomKeyPrefix:     conf.s3CustomKeyPrefix,
+		s3ObjectTags:          conf.s3ObjectTags,
+		presignExpiry:         conf.presignExpiry,
+		presignExpiryByRatio:  conf.presignExpiryByRatio,
+		presignCache:          newPresignCache(conf.presignRefresh),
+		objectInfoCache:       newObjectInfoCache(),
+		shareMaxTTL:           conf.shareMaxTTL,
+		shareRestrictions:     conf.shareRestrictions,
+		listMaxLimit:          conf.listMaxLimit,
+		maxVideosPerUser:      conf.maxVideosPerUser,
+		defaultVisibility:     conf.defaultVisibility,
+		accountImportMaxBytes: conf.accountImportMaxBytes,
+		maxVideoUploadSize:    conf.maxVideoUploadSize,
+		maxImageUploadSize:    conf.maxImageUploadSize,
+		verifyDeclaredSize:    conf.verifyDeclaredSize,
+		declaredSizeTolerance: conf.declaredSizeTolerance,
+		cacheControl:          conf.cacheControl,
+
+		allowedReferrers:     conf.allowedReferrers,
+		allowMissingReferrer: conf.allowMissingReferrer,
+
+		moderator:          moderator,
+		moderationFailOpen: conf.moderationFailOpen,
+
+		skipVideoProcessing: conf.skipVideoProcessing,
+		uploadPassthrough:   conf.uploadPassthrough,
+		hdrPolicy:           conf.hdrPolicy,
+		autoOrient:          conf.autoOrient,
+		aspectRatioFallback: conf.aspectRatioFallback,
+		squareTolerance:     conf.squareTolerance,
+		detectSilence:       conf.detectSilence,
+		verifyDecode:        conf.verifyDecode,
+		minDuration:         conf.minDuration,
+		maxDuration:         conf.maxDuration,
+		minWidth:            conf.minWidth,
+		minHeight:           conf.minHeight,
+		ffmpeg:              conf.ffmpeg,
+		faststartFallback:   conf.faststartFallback,
+		failedUploadsDir:    conf.failedUploadsDir,
+		maxVideoRetries:     conf.maxVideoRetries,
+		commands:            ffmpegPool,
+		ffmpegPool:          ffmpegPool,
+		jobs:                jobs,
+		objectDeleteGrace:   conf.objectDeleteGrace,
+		orphanMinAge:        conf.orphanMinAge,
+
+		previewEnabled:  conf.previewEnabled,
+		previewStart:    conf.previewStart,
+		previewDuration: conf.previewDuration,
+		proxyEnabled:    conf.proxyEnabled,
+
+		storyboardInterval: conf.storyboardInterval,
+
+		idempotencyTTL:   conf.idempotencyTTL,
+		idempotencyLocks: newKeyedMutex(),
+
+		thumbnailAspectRatio:    conf.thumbnailAspectRatio,
+		thumbnailFit:            conf.thumbnailFit,
+		thumbnailSceneThreshold: conf.thumbnailSceneThreshold,
+		thumbnailCandidateTTL:   conf.thumbnailCandidateTTL,
+		trimReplace:             conf.trimReplace,
+		maintenance:             newMaintenanceMode(conf.maintenanceMode, conf.maintenanceRetryAfter),
+		backfill:                &backfill{},
+		orphans:                 &orphanCleanup{},
+		rateLimiter:             rateLimiter,
+		trustedProxies:          conf.trustedProxies,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -105,33 +237,100 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.ensureFailedUploadsDir()
+	if err != nil {
+		log.Fatalf("Couldn't create failed uploads directory: %v", err)
+	}
+
+	err = cfg.checkBucket(context.Background(), conf.s3StartupCheck)
+	if err != nil {
+		log.Fatalf("S3 startup check failed: %v", err)
+	}
+
+	if cfg.jobs != nil {
+		cfg.jobs.handle(jobKindProcessVideo, cfg.processVideoJobHandler())
+		cfg.jobs.handle(jobKindTrimVideo, cfg.trimVideoJobHandler())
+		cfg.jobs.handle(jobKindReplaceVideo, cfg.replaceVideoJobHandler())
+		cfg.jobs.handle(jobKindReprocessVideo, cfg.reprocessVideoJobHandler())
+		cfg.jobs.handle(jobKindDeleteObjects, cfg.deleteObjectsJobHandler())
+		err = cfg.jobs.recover(conf.processingStaleAfter)
+		if err != nil {
+			log.Fatalf("Couldn't recover processing jobs: %v", err)
+		}
+		cfg.jobs.start(context.Background())
+		if conf.processingStaleAfter > 0 {
+			go cfg.jobs.recoverStale(context.Background(), conf.processingStaleAfter)
+		}
+	}
+
+	go cfg.sweepThumbnailCandidates(context.Background())
+
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(cfg.assetsRoot)))
+	if cfg.cacheControl != "" {
+		mux.Handle("/assets/", cacheControlMiddleware(cfg.cacheControl, assetsHandler))
+	} else {
+		mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	}
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.Handle("POST /api/login", cfg.rateLimit(cfg.handlerLogin))
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.Handle("POST /api/users", cfg.rateLimit(cfg.handlerUsersCreate))
+
+	mux.HandleFunc("GET /api/account/stats", cfg.handlerAccountStats)
+	mux.HandleFunc("POST /api/account/export", cfg.handlerAccountExport)
+	mux.Handle("POST /api/account/import", cfg.blockDuringMaintenance(cfg.handlerAccountImport))
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.Handle("POST /api/thumbnail_upload/{videoID}", cfg.blockDuringMaintenance(cfg.handlerUploadThumbnail))
+	mux.Handle("POST /api/videos/{videoID}/thumbnail/candidates", cfg.blockDuringMaintenance(cfg.handlerThumbnailCandidatesCreate))
+	mux.Handle("POST /api/videos/{videoID}/thumbnail/select", cfg.blockDuringMaintenance(cfg.handlerThumbnailCandidateSelect))
+	mux.Handle("POST /api/video_upload/{videoID}", cfg.blockDuringMaintenance(cfg.handlerUploadVideo))
+	mux.Handle("POST /api/video_upload/{videoID}/json", cfg.blockDuringMaintenance(cfg.handlerUploadVideoJSON))
+	mux.Handle("POST /api/videos/{videoID}/upload_policy", cfg.blockDuringMaintenance(cfg.handlerUploadPolicyCreate))
+	mux.Handle("POST /api/videos/{videoID}/upload_policy/finalize", cfg.blockDuringMaintenance(cfg.handlerUploadPolicyFinalize))
+	mux.HandleFunc("POST /api/videos/presign", cfg.handlerVideosPresign)
+	mux.HandleFunc("POST /api/videos/{videoID}/share", cfg.handlerVideoShare)
+	mux.Handle("GET /api/shares/{shareID}", cfg.rateLimit(cfg.handlerShareFollow))
+	mux.Handle("GET /api/videos/{videoID}/embed", cfg.rateLimit(cfg.handlerVideoEmbed))
+	mux.Handle("GET /api/videos/{videoID}/play", cfg.rateLimit(cfg.handlerVideoPlay))
+	mux.HandleFunc("GET /api/videos/{videoID}/metadata", cfg.handlerVideoMetadataExport)
+	mux.HandleFunc("PATCH /api/videos/{videoID}/visibility", cfg.handlerVideoVisibilityUpdate)
+	mux.HandleFunc("PATCH /api/videos/{videoID}/attributes", cfg.handlerVideoAttributesUpdate)
+	mux.Handle("POST /api/videos/{videoID}/duplicate", cfg.blockDuringMaintenance(cfg.handlerVideoDuplicate))
+	mux.Handle("POST /api/videos/{videoID}/retry", cfg.blockDuringMaintenance(cfg.handlerVideoRetry))
+	mux.Handle("POST /api/videos/{videoID}/trim", cfg.blockDuringMaintenance(cfg.handlerVideoTrim))
+	mux.Handle("PUT /api/videos/{videoID}/content", cfg.blockDuringMaintenance(cfg.handlerVideoContentReplace))
+	mux.HandleFunc("POST /api/videos/{videoID}/access", cfg.handlerVideoAccessGrant)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/access/{userID}", cfg.handlerVideoAccessRevoke)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.Handle("GET /api/videos/{videoID}", cfg.rateLimit(cfg.handlerVideoGet))
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /api/admin/queue", cfg.handlerAdminQueue)
+	mux.HandleFunc("GET /api/admin/maintenance", cfg.handlerAdminMaintenanceGet)
+	mux.HandleFunc("PUT /api/admin/maintenance", cfg.handlerAdminMaintenanceUpdate)
+	mux.HandleFunc("POST /api/admin/audit", cfg.handlerAdminAudit)
+	mux.HandleFunc("GET /api/admin/audit-log", cfg.handlerAdminAuditLog)
+	mux.HandleFunc("PATCH /api/admin/users/{userID}", cfg.handlerAdminUserUpdate)
+	mux.HandleFunc("GET /api/admin/videos/{videoID}/probe", cfg.handlerAdminVideoProbe)
+	mux.HandleFunc("POST /api/admin/videos/{videoID}/restore", cfg.handlerAdminVideoRestore)
+	mux.HandleFunc("POST /api/admin/reprocess-all", cfg.handlerAdminReprocessAll)
+	mux.HandleFunc("POST /api/admin/orphans/cleanup", cfg.handlerAdminOrphanCleanupStart)
+	mux.HandleFunc("GET /api/admin/orphans/cleanup", cfg.handlerAdminOrphanCleanupGet)
+	mux.HandleFunc("DELETE /api/admin/orphans/cleanup", cfg.handlerAdminOrphanCleanupCancel)
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:    ":" + cfg.port,
+		Handler: requestIDMiddleware(mux),
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
+	log.Printf("Serving on: http://localhost:%s/app/\n", cfg.port)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+// mp4Fixture starts like an MP4 file, which is all the upload handlers look
+// at when video processing is skipped.
+var mp4Fixture = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{0}, 1000)...)
+
+// webmFixture starts with the EBML magic WebM files are sniffed by.
+var webmFixture = append([]byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), bytes.Repeat([]byte{0}, 1000)...)
+
+// newTestAPIConfig returns an apiConfig on a fresh database and an
+// in-memory object store, with ffmpeg processing skipped and the defaults
+// loadConfig would use otherwise.
+func newTestAPIConfig(t *testing.T) (*apiConfig, *fakeObjectStore) {
+	t.Helper()
+
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	template, err := parseKeyTemplate(defaultKeyTemplate)
+	if err != nil {
+		t.Fatalf("parseKeyTemplate: %v", err)
+	}
+
+	store := newFakeObjectStore()
+	cfg := &apiConfig{
+		db:                    db,
+		jwtSecret:             testJWTSecret,
+		jwtLeeway:             30 * time.Second,
+		platform:              "dev",
+		assetsRoot:            t.TempDir(),
+		s3Bucket:              "tubely-test",
+		s3Region:              "us-east-1",
+		s3CfDistribution:      "cdn.tubely.test",
+		s3ConditionalPut:      true,
+		store:                 store,
+		keyTemplate:           template,
+		s3CustomKeyPrefix:     "custom",
+		presignExpiry:         15 * time.Minute,
+		presignCache:          newPresignCache(0),
+		objectInfoCache:       newObjectInfoCache(),
+		shareMaxTTL:           maxPresignDuration,
+		shareRestrictions:     shareRestrictionsOptional,
+		listMaxLimit:          50,
+		defaultVisibility:     database.VideoVisibilityPrivate,
+		accountImportMaxBytes: 10 << 30,
+		maxVideoUploadSize:    1 << 20,
+		maxImageUploadSize:    1 << 20,
+		skipVideoProcessing:   true,
+		aspectRatioFallback:   aspectRatioFallbackOther,
+		squareTolerance:       0.01,
+		hdrPolicy:             hdrPolicyAllow,
+		thumbnailFit:          thumbnailFitCrop,
+		idempotencyTTL:        24 * time.Hour,
+		idempotencyLocks:      newKeyedMutex(),
+		orphanMinAge:          24 * time.Hour,
+		maintenance:           newMaintenanceMode(false, 5*time.Minute),
+		backfill:              &backfill{},
+		orphans:               &orphanCleanup{},
+	}
+	return cfg, store
+}
+
+// createTestUser adds a user and returns its ID and an access token.
+func createTestUser(t *testing.T, cfg *apiConfig) (uuid.UUID, string) {
+	t.Helper()
+
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@tubely.test",
+		Password: "unused",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	return user.ID, token
+}
+
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  "Test video",
+		UserID: userID,
+	}, database.VideoVisibilityPrivate)
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
+
+func getTestVideo(t *testing.T, cfg *apiConfig, id uuid.UUID) database.Video {
+	t.Helper()
+
+	video, err := cfg.db.GetVideo(id)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	return video
+}
+
+// formPart is a field of a multipart test request, a file when filename
+// is set.
+type formPart struct {
+	name        string
+	filename    string
+	contentType string
+	data        []byte
+}
+
+func newMultipartRequest(t *testing.T, method, target, token string, parts ...formPart) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		disposition := `form-data; name="` + part.name + `"`
+		if part.filename != "" {
+			disposition += `; filename="` + part.filename + `"`
+		}
+		header.Set("Content-Disposition", disposition)
+		if part.contentType != "" {
+			header.Set("Content-Type", part.contentType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatalf("CreatePart: %v", err)
+		}
+		w.Write(part.data)
+	}
+	writer.Close()
+
+	r := httptest.NewRequest(method, target, &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// newUploadRequest builds a video upload of parts for videoID, the way
+// handlerUploadVideo is routed.
+func newUploadRequest(t *testing.T, videoID uuid.UUID, token string, parts ...formPart) *http.Request {
+	t.Helper()
+
+	r := newMultipartRequest(t, http.MethodPost, "/api/video_upload/"+videoID.String(), token, parts...)
+	r.SetPathValue("videoID", videoID.String())
+	return r
+}
+
+func videoPart(data []byte) formPart {
+	return formPart{name: "video", filename: "clip.mp4", contentType: "video/mp4", data: data}
+}
+
+// decodeResponse decodes a JSON response body into v.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+}
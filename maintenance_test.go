@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockDuringMaintenance(t *testing.T) {
+	tests := []struct {
+		name           string
+		enabled        bool
+		retryAfter     time.Duration
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{"off", false, 5 * time.Minute, http.StatusNoContent, ""},
+		{"on", true, 5 * time.Minute, http.StatusServiceUnavailable, "300"},
+		{"rounds up", true, 1500 * time.Millisecond, http.StatusServiceUnavailable, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestAPIConfig(t)
+			cfg.maintenance = newMaintenanceMode(tt.enabled, tt.retryAfter)
+			called := false
+			handler := cfg.blockDuringMaintenance(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/video_upload/x", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if called == tt.enabled {
+				t.Errorf("handler called = %v during maintenance %v", called, tt.enabled)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestMaintenanceBlocksUploadsOnly(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.adminAPIKey = "admin-key"
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+	upload := cfg.blockDuringMaintenance(cfg.handlerUploadVideo)
+
+	setMaintenance := func(enabled string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPut, "/api/admin/maintenance", strings.NewReader(`{"enabled": `+enabled+`}`))
+		r.Header.Set("Authorization", "ApiKey admin-key")
+		w := httptest.NewRecorder()
+		cfg.handlerAdminMaintenanceUpdate(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("switching maintenance %s: status = %d, body %s", enabled, w.Code, w.Body)
+		}
+	}
+
+	setMaintenance("true")
+	w := httptest.NewRecorder()
+	upload.ServeHTTP(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("upload status = %d, want 503, body %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is missing")
+	}
+	if puts := store.callsTo("PutObject"); len(puts) != 0 {
+		t.Errorf("PutObject calls = %q, want none", puts)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	cfg.handlerVideoGet(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("read status = %d during maintenance, want 200, body %s", w.Code, w.Body)
+	}
+
+	setMaintenance("false")
+	w = httptest.NewRecorder()
+	upload.ServeHTTP(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+	if w.Code != http.StatusOK {
+		t.Errorf("upload status = %d after maintenance, want 200, body %s", w.Code, w.Body)
+	}
+}
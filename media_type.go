@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// sniffLength is how many leading bytes http.DetectContentType looks at.
+const sniffLength = 512
+
+// mediaTypeAliases maps nonstandard spellings to the type used internally.
+var mediaTypeAliases = map[string]string{
+	"image/jpeg": "image/jpg",
+}
+
+// mediaTypeValidator checks uploads of one category of media against the
+// types allowed for it. Supporting a new format means adding it to allowed.
+type mediaTypeValidator struct {
+	category string
+	allowed  []string
+}
+
+var (
+	videoTypes     = mediaTypeValidator{category: "video", allowed: []string{"video/mp4", "video/webm"}}
+	thumbnailTypes = mediaTypeValidator{category: "thumbnail", allowed: []string{"image/jpg", "image/png"}}
+)
+
+// validate checks the Content-Type a client declared and returns the
+// canonical media type. sniffed is what http.DetectContentType made of the
+// content; when it recognized the format, it must agree with the declared
+// type. Pass "" to skip that check. Errors are *uploadError values.
+func (v mediaTypeValidator) validate(declared, sniffed string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return "", &uploadError{http.StatusBadRequest, fmt.Sprintf("Invalid %s Content-Type", v.category), err}
+	}
+	mediaType = canonicalMediaType(mediaType)
+	if !slices.Contains(v.allowed, mediaType) {
+		msg := fmt.Sprintf("Invalid %s file type, must be one of %s", v.category, strings.Join(v.allowed, ", "))
+		return "", &uploadError{http.StatusBadRequest, msg, nil}
+	}
+
+	if sniffed == "" {
+		return mediaType, nil
+	}
+	sniffedType, _, err := mime.ParseMediaType(sniffed)
+	// DetectContentType falls back to octet-stream for formats it doesn't
+	// know, which says nothing either way.
+	if err != nil || sniffedType == "application/octet-stream" {
+		return mediaType, nil
+	}
+	if canonicalMediaType(sniffedType) != mediaType {
+		msg := fmt.Sprintf("The %s content doesn't match its Content-Type %s", v.category, mediaType)
+		return "", &uploadError{http.StatusBadRequest, msg, nil}
+	}
+	return mediaType, nil
+}
+
+func canonicalMediaType(mediaType string) string {
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// sniffMediaType detects the media type of content from its first bytes.
+func sniffMediaType(head []byte) string {
+	if len(head) > sniffLength {
+		head = head[:sniffLength]
+	}
+	return http.DetectContentType(head)
+}
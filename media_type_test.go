@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestMediaTypeValidatorValidate(t *testing.T) {
+	jpegHead := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	png := pngFixture(t, 16, 16)
+
+	tests := []struct {
+		name      string
+		validator mediaTypeValidator
+		declared  string
+		content   []byte
+		want      string
+		wantErr   string
+	}{
+		{"mp4", videoTypes, "video/mp4", mp4Fixture, "video/mp4", ""},
+		{"WebM", videoTypes, "video/webm", webmFixture, "video/webm", ""},
+		{"mp4 with parameters", videoTypes, "video/mp4; codecs=avc1", mp4Fixture, "video/mp4", ""},
+		{"PNG", thumbnailTypes, "image/png", png, "image/png", ""},
+		{"JPEG", thumbnailTypes, "image/jpeg", jpegHead, "image/jpg", ""},
+		{"JPEG alias", thumbnailTypes, "image/jpg", jpegHead, "image/jpg", ""},
+		{"unrecognized content", videoTypes, "video/mp4", []byte("\x00\x01\x02\x03"), "video/mp4", ""},
+		{"content not sniffed", videoTypes, "video/webm", nil, "video/webm", ""},
+		{"unsupported type", videoTypes, "video/quicktime", mp4Fixture, "", "Invalid video file type, must be one of video/mp4, video/webm"},
+		{"image as video", videoTypes, "image/png", png, "", "Invalid video file type, must be one of video/mp4, video/webm"},
+		{"invalid Content-Type", thumbnailTypes, "", png, "", "Invalid thumbnail Content-Type"},
+		{"mismatched video", videoTypes, "video/mp4", webmFixture, "", "The video content doesn't match its Content-Type video/mp4"},
+		{"mismatched thumbnail", thumbnailTypes, "image/png", jpegHead, "", "The thumbnail content doesn't match its Content-Type image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sniffed := ""
+			if tt.content != nil {
+				sniffed = sniffMediaType(tt.content)
+			}
+			got, err := tt.validator.validate(tt.declared, sniffed)
+			if tt.wantErr != "" {
+				var uploadErr *uploadError
+				if !errors.As(err, &uploadErr) || uploadErr.code != http.StatusBadRequest || uploadErr.msg != tt.wantErr {
+					t.Fatalf("err = %v, want a 400 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("media type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type moderationVerdict string
+
+const (
+	moderationAllow  moderationVerdict = "allow"
+	moderationFlag   moderationVerdict = "flag"
+	moderationReject moderationVerdict = "reject"
+)
+
+type moderationRequest struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	VideoURL  string    `json:"video_url"`
+	MediaType string    `json:"media_type"`
+}
+
+type contentModerator interface {
+	Moderate(ctx context.Context, req moderationRequest) (moderationVerdict, error)
+}
+
+// httpModerator posts a moderationRequest as JSON to an external classifier
+// and expects a {"verdict": "allow" | "flag" | "reject"} response.
+type httpModerator struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newHTTPModerator(endpoint string, timeout time.Duration) *httpModerator {
+	return &httpModerator{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (m *httpModerator) Moderate(ctx context.Context, req moderationRequest) (moderationVerdict, error) {
+	type response struct {
+		Verdict moderationVerdict `json:"verdict"`
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := m.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("moderation service responded with status %d", res.StatusCode)
+	}
+
+	var dat response
+	err = json.NewDecoder(res.Body).Decode(&dat)
+	if err != nil {
+		return "", fmt.Errorf("could not decode moderation response: %w", err)
+	}
+
+	switch dat.Verdict {
+	case moderationAllow, moderationFlag, moderationReject:
+		return dat.Verdict, nil
+	default:
+		return "", fmt.Errorf("unknown moderation verdict %q", dat.Verdict)
+	}
+}
+
+// moderateVideo returns the status an uploaded video should be published
+// with. When no moderator is configured every upload is considered ready.
+func (cfg *apiConfig) moderateVideo(ctx context.Context, videoID uuid.UUID, videoURL, mediaType string) (database.VideoStatus, error) {
+	if cfg.moderator == nil {
+		return database.VideoStatusReady, nil
+	}
+
+	verdict, err := cfg.moderator.Moderate(ctx, moderationRequest{
+		VideoID:   videoID,
+		VideoURL:  videoURL,
+		MediaType: mediaType,
+	})
+	if err != nil {
+		if cfg.moderationFailOpen {
+			logf(ctx, "Moderation failed for video %v, publishing anyway: %v", videoID, err)
+			return database.VideoStatusReady, nil
+		}
+		return "", err
+	}
+
+	switch verdict {
+	case moderationReject:
+		return database.VideoStatusRejected, nil
+	case moderationFlag:
+		return database.VideoStatusFlagged, nil
+	default:
+		return database.VideoStatusReady, nil
+	}
+}
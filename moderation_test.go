@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// verdictModerator answers every request with the same verdict.
+type verdictModerator moderationVerdict
+
+func (m verdictModerator) Moderate(ctx context.Context, req moderationRequest) (moderationVerdict, error) {
+	return moderationVerdict(m), nil
+}
+
+func TestPublishVideoModeration(t *testing.T) {
+	tests := []struct {
+		verdict     moderationVerdict
+		wantStatus  database.VideoStatus
+		wantObjects int
+	}{
+		{moderationAllow, database.VideoStatusReady, 1},
+		{moderationFlag, database.VideoStatusFlagged, 1},
+		{moderationReject, database.VideoStatusRejected, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.verdict), func(t *testing.T) {
+			cfg, store := newTestAPIConfig(t)
+			cfg.moderator = verdictModerator(tt.verdict)
+			userID, token := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, userID)
+
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(t, video.ID, token, videoPart(mp4Fixture)))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+			}
+			saved := getTestVideo(t, cfg, video.ID)
+			if saved.Status != tt.wantStatus {
+				t.Errorf("video status = %q, want %q", saved.Status, tt.wantStatus)
+			}
+			if rejected := tt.wantStatus == database.VideoStatusRejected; rejected != (saved.VideoURL == nil) {
+				t.Errorf("video_url = %v for a %s video", saved.VideoURL, saved.Status)
+			}
+			if keys := store.keys(); len(keys) != tt.wantObjects {
+				t.Errorf("objects in the bucket = %q, want %d", keys, tt.wantObjects)
+			}
+		})
+	}
+}
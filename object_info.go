@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// objectInfoTTL is how long HeadObject results are reused. Objects are
+// replaced under new keys rather than overwritten, so staleness only matters
+// for deleted ones.
+const objectInfoTTL = time.Minute
+
+// maxObjectInfoCacheEntries bounds the object info cache, which is only
+// pruned of the keys that are looked up again.
+const maxObjectInfoCacheEntries = 10000
+
+// objectInfo is what players need to know about an object before fetching
+// it.
+type objectInfo struct {
+	ContentLength int64
+	ContentType   string
+	AcceptRanges  string
+	fetchedAt     time.Time
+}
+
+// objectInfoCache holds HeadObject results for objectInfoTTL. Once
+// maxEntries are cached, expired entries are swept out, and failing that
+// the oldest is evicted.
+type objectInfoCache struct {
+	mu         sync.Mutex
+	entries    map[string]objectInfo
+	maxEntries int
+}
+
+func newObjectInfoCache() *objectInfoCache {
+	return &objectInfoCache{
+		entries:    map[string]objectInfo{},
+		maxEntries: maxObjectInfoCacheEntries,
+	}
+}
+
+func (c *objectInfoCache) get(key string) (objectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return objectInfo{}, false
+	}
+	if time.Since(entry.fetchedAt) > objectInfoTTL {
+		delete(c.entries, key)
+		return objectInfo{}, false
+	}
+	return entry, true
+}
+
+func (c *objectInfoCache) set(key string, entry objectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var oldest string
+		for k, e := range c.entries {
+			if time.Since(e.fetchedAt) > objectInfoTTL {
+				delete(c.entries, k)
+			} else if oldest == "" || e.fetchedAt.Before(c.entries[oldest].fetchedAt) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *objectInfoCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// headObject returns the size and type of the object at key, from the cache
+// when it was looked up recently.
+func (cfg *apiConfig) headObject(ctx context.Context, key string) (objectInfo, error) {
+	if entry, ok := cfg.objectInfoCache.get(key); ok {
+		return entry, nil
+	}
+
+	head, err := cfg.store.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return objectInfo{}, err
+	}
+
+	entry := objectInfo{fetchedAt: time.Now()}
+	if head.ContentLength != nil {
+		entry.ContentLength = *head.ContentLength
+	}
+	if head.ContentType != nil {
+		entry.ContentType = *head.ContentType
+	}
+	if head.AcceptRanges != nil {
+		entry.AcceptRanges = *head.AcceptRanges
+	}
+	cfg.objectInfoCache.set(key, entry)
+	return entry, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectStore is the part of S3 the server uses. Handlers depend on it rather
+// than *s3.Client so tests can swap in an in-memory store.
+type objectStore interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+
+	// Upload stores a body of unknown length, such as a request stream,
+	// which PutObject can't take.
+	Upload(ctx context.Context, params *s3.PutObjectInput) error
+	// PresignGetObject returns a URL granting GET access for expires.
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, expires time.Duration) (string, error)
+	// PresignHeadObject returns a URL granting HEAD access for expires.
+	PresignHeadObject(ctx context.Context, params *s3.HeadObjectInput, expires time.Duration) (string, error)
+	// PresignPostObject returns the URL and form fields for a browser to
+	// POST an object directly, under a policy limited by conditions.
+	PresignPostObject(ctx context.Context, params *s3.PutObjectInput, expires time.Duration, conditions []any) (*s3.PresignedPostRequest, error)
+	// Copy duplicates the object at srcKey to dstKey within bucket, along
+	// with its headers and tags, without the bytes passing through the
+	// server.
+	Copy(ctx context.Context, bucket, srcKey, dstKey string) error
+}
+
+// s3ObjectStore is the objectStore backed by a real bucket.
+type s3ObjectStore struct {
+	*s3.Client
+	presigner         *s3.PresignClient
+	uploadConcurrency int
+}
+
+// newS3Client returns a client for s3Config that sends requests to the
+// bucket's transfer acceleration endpoint when useAccelerate is set.
+// Presigned URLs come from a client derived from this one, so they use the
+// accelerate endpoint too.
+func newS3Client(s3Config aws.Config, useAccelerate bool) *s3.Client {
+	return s3.NewFromConfig(s3Config, func(o *s3.Options) {
+		o.UseAccelerate = useAccelerate
+	})
+}
+
+// newS3HTTPClient is the HTTP client S3 requests go through, its connection
+// pool sized by the S3_MAX_IDLE_CONNS settings. Bursts of uploads need more
+// pooled connections than Go's defaults keep.
+func newS3HTTPClient(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.MaxIdleConns = maxIdleConns
+		tr.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		tr.IdleConnTimeout = idleConnTimeout
+	})
+}
+
+func newS3ObjectStore(client *s3.Client, uploadConcurrency int) *s3ObjectStore {
+	return &s3ObjectStore{
+		Client:            client,
+		presigner:         s3.NewPresignClient(client),
+		uploadConcurrency: uploadConcurrency,
+	}
+}
+
+// Upload streams the body to S3 in multipart chunks, sending up to
+// uploadConcurrency parts at once.
+func (s *s3ObjectStore) Upload(ctx context.Context, params *s3.PutObjectInput) error {
+	uploader := manager.NewUploader(s.Client, func(u *manager.Uploader) {
+		u.Concurrency = s.uploadConcurrency
+	})
+	_, err := uploader.Upload(ctx, params)
+	return err
+}
+
+func (s *s3ObjectStore) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, expires time.Duration) (string, error) {
+	req, err := s.presigner.PresignGetObject(ctx, params, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3ObjectStore) PresignHeadObject(ctx context.Context, params *s3.HeadObjectInput, expires time.Duration) (string, error) {
+	req, err := s.presigner.PresignHeadObject(ctx, params, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *s3ObjectStore) PresignPostObject(ctx context.Context, params *s3.PutObjectInput, expires time.Duration, conditions []any) (*s3.PresignedPostRequest, error) {
+	return s.presigner.PresignPostObject(ctx, params, func(o *s3.PresignPostOptions) {
+		o.Expires = expires
+		o.Conditions = conditions
+	})
+}
+
+const (
+	// maxCopyObjectSize is the largest object a single CopyObject request
+	// can copy.
+	maxCopyObjectSize = 5 << 30
+	copyPartSize      = 512 << 20
+)
+
+// Copy uses CopyObject, switching to a multipart copy for objects
+// CopyObject can't take.
+func (s *s3ObjectStore) Copy(ctx context.Context, bucket, srcKey, dstKey string) error {
+	head, err := s.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &srcKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	source := (&url.URL{Path: bucket + "/" + srcKey}).EscapedPath()
+	size := aws.ToInt64(head.ContentLength)
+	if size <= maxCopyObjectSize {
+		_, err = s.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &bucket,
+			Key:        &dstKey,
+			CopySource: &source,
+		})
+		return err
+	}
+	return s.copyMultipart(ctx, bucket, srcKey, dstKey, source, size, head)
+}
+
+// copyMultipart copies an object in copyPartSize ranges, up to
+// uploadConcurrency at once. Unlike CopyObject, a multipart upload starts
+// out without the source's headers and tags, so they're carried over
+// explicitly.
+func (s *s3ObjectStore) copyMultipart(ctx context.Context, bucket, srcKey, dstKey, source string, size int64, head *s3.HeadObjectOutput) error {
+	tags, err := s.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &srcKey,
+	})
+	if err != nil {
+		return err
+	}
+	var tagging *string
+	if len(tags.TagSet) > 0 {
+		values := url.Values{}
+		for _, tag := range tags.TagSet {
+			values.Set(aws.ToString(tag.Key), aws.ToString(tag.Value))
+		}
+		encoded := values.Encode()
+		tagging = &encoded
+	}
+
+	upload, err := s.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             &bucket,
+		Key:                &dstKey,
+		ContentType:        head.ContentType,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		Metadata:           head.Metadata,
+		Tagging:            tagging,
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := make([]types.CompletedPart, (size+copyPartSize-1)/copyPartSize)
+	errs := make([]error, len(parts))
+	sem := make(chan struct{}, s.uploadConcurrency)
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := int64(i) * copyPartSize
+			end := min(start+copyPartSize, size) - 1
+			byteRange := fmt.Sprintf("bytes=%d-%d", start, end)
+			partNumber := int32(i + 1)
+			out, err := s.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:          &bucket,
+				Key:             &dstKey,
+				UploadId:        upload.UploadId,
+				PartNumber:      &partNumber,
+				CopySource:      &source,
+				CopySourceRange: &byteRange,
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			parts[i] = types.CompletedPart{
+				ETag:       out.CopyPartResult.ETag,
+				PartNumber: &partNumber,
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	if err == nil {
+		_, err = s.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          &bucket,
+			Key:             &dstKey,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		// Parts of an unfinished upload are billed until it is aborted.
+		s.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   &bucket,
+			Key:      &dstKey,
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+// isMissingObject reports whether err is S3 saying the key doesn't exist.
+// GetObject fails with NoSuchKey, while HeadObject responses have no body to
+// carry an error code and fail with NotFound instead.
+func isMissingObject(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+// isExistingObject reports whether a put with If-None-Match: * was refused
+// because an object is already at its key: 412 once it's there, 409 while a
+// concurrent conditional write to the key is still in progress.
+func isExistingObject(err error) bool {
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	status := respErr.HTTPStatusCode()
+	return status == http.StatusPreconditionFailed || status == http.StatusConflict
+}
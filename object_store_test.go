@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// fakeObject is an object held by fakeObjectStore.
+type fakeObject struct {
+	data         []byte
+	contentType  string
+	cacheControl string
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+// fakeObjectStore is an in-memory objectStore. It records the operations
+// made on it, and the err hooks, when set, can fail any of them.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	calls   []string
+
+	putErr        func(params *s3.PutObjectInput) error
+	getErr        func(key string) error
+	deleteErr     func(key string) error
+	headBucketErr error
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: map[string]fakeObject{}}
+}
+
+func (s *fakeObjectStore) record(op, key string) {
+	s.calls = append(s.calls, op+" "+key)
+}
+
+// callsTo returns the keys op was called with, in order.
+func (s *fakeObjectStore) callsTo(op string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for _, call := range s.calls {
+		if name, key, _ := strings.Cut(call, " "); name == op {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *fakeObjectStore) object(key string) (fakeObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// putObject stores data at key as if it was uploaded at lastModified.
+func (s *fakeObjectStore) putObject(key string, data []byte, lastModified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = fakeObject{data: data, lastModified: lastModified}
+}
+
+func (s *fakeObjectStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *fakeObjectStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("PutObject", key)
+	if s.putErr != nil {
+		if err := s.putErr(params); err != nil {
+			return nil, err
+		}
+	}
+	if aws.ToString(params.IfNoneMatch) == "*" {
+		if _, ok := s.objects[key]; ok {
+			return nil, fakeResponseError(http.StatusPreconditionFailed)
+		}
+	}
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.objects[key] = fakeObject{
+		data:         data,
+		contentType:  aws.ToString(params.ContentType),
+		cacheControl: aws.ToString(params.CacheControl),
+		metadata:     params.Metadata,
+		lastModified: time.Now(),
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(fmt.Sprintf("%q", key))}, nil
+}
+
+func (s *fakeObjectStore) Upload(ctx context.Context, params *s3.PutObjectInput) error {
+	_, err := s.PutObject(ctx, params)
+	return err
+}
+
+func (s *fakeObjectStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("GetObject", key)
+	if s.getErr != nil {
+		if err := s.getErr(key); err != nil {
+			return nil, err
+		}
+	}
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(object.data)),
+		ContentType:   aws.String(object.contentType),
+		ContentLength: aws.Int64(int64(len(object.data))),
+		LastModified:  aws.Time(object.lastModified),
+	}, nil
+}
+
+func (s *fakeObjectStore) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("DeleteObject", key)
+	if s.deleteErr != nil {
+		if err := s.deleteErr(key); err != nil {
+			return nil, err
+		}
+	}
+	delete(s.objects, key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (s *fakeObjectStore) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("HeadObject", key)
+	if s.getErr != nil {
+		if err := s.getErr(key); err != nil {
+			return nil, err
+		}
+	}
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentType:   aws.String(object.contentType),
+		ContentLength: aws.Int64(int64(len(object.data))),
+		LastModified:  aws.Time(object.lastModified),
+		ETag:          aws.String(fmt.Sprintf("%q", key)),
+		Metadata:      object.metadata,
+	}, nil
+}
+
+func (s *fakeObjectStore) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("HeadBucket", aws.ToString(params.Bucket))
+	if s.headBucketErr != nil {
+		return nil, s.headBucketErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+// ListObjectsV2 lists keys in order, a page of MaxKeys (default 1000) at a
+// time, the continuation token being the last key of the previous page.
+func (s *fakeObjectStore) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	keys := s.keys()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("ListObjectsV2", aws.ToString(params.Prefix))
+
+	after := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		after = *params.ContinuationToken
+	}
+	limit := int(aws.ToInt32(params.MaxKeys))
+	if limit == 0 {
+		limit = 1000
+	}
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, key := range keys {
+		if key <= after || !strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			continue
+		}
+		if len(out.Contents) == limit {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = out.Contents[limit-1].Key
+			break
+		}
+		object := s.objects[key]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.data))),
+			LastModified: aws.Time(object.lastModified),
+		})
+	}
+	return out, nil
+}
+
+func (s *fakeObjectStore) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, expires time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("PresignGetObject", key)
+	return fakePresignedURL(aws.ToString(params.Bucket), key, expires), nil
+}
+
+func (s *fakeObjectStore) PresignHeadObject(ctx context.Context, params *s3.HeadObjectInput, expires time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("PresignHeadObject", key)
+	return fakePresignedURL(aws.ToString(params.Bucket), key, expires), nil
+}
+
+func (s *fakeObjectStore) PresignPostObject(ctx context.Context, params *s3.PutObjectInput, expires time.Duration, conditions []any) (*s3.PresignedPostRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := aws.ToString(params.Key)
+	s.record("PresignPostObject", key)
+	return &s3.PresignedPostRequest{
+		URL:    "https://" + aws.ToString(params.Bucket) + ".s3.test",
+		Values: map[string]string{"key": key},
+	}, nil
+}
+
+func (s *fakeObjectStore) Copy(ctx context.Context, bucket, srcKey, dstKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record("Copy", srcKey)
+	object, ok := s.objects[srcKey]
+	if !ok {
+		return &types.NotFound{}
+	}
+	object.lastModified = time.Now()
+	s.objects[dstKey] = object
+	return nil
+}
+
+func fakePresignedURL(bucket, key string, expires time.Duration) string {
+	query := url.Values{"X-Amz-Expires": {fmt.Sprint(int(expires.Seconds()))}}
+	return fmt.Sprintf("https://%s.s3.test/%s?%s", bucket, key, query.Encode())
+}
+
+// fakeResponseError is the error the SDK returns for a response with the
+// given status code.
+func fakeResponseError(status int) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      fmt.Errorf("http %d", status),
+		},
+	}
+}
+
+// hostRecorder is an HTTP client that records the host of each request
+// instead of sending it.
+type hostRecorder struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (h *hostRecorder) Do(r *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hosts = append(h.hosts, r.URL.Host)
+	return nil, errors.New("not sent")
+}
+
+func TestNewS3ClientAccelerate(t *testing.T) {
+	tests := []struct {
+		name          string
+		useAccelerate bool
+		wantHost      string
+	}{
+		{"on", true, "tubely-test.s3-accelerate.amazonaws.com"},
+		{"off", false, "tubely-test.s3.us-west-2.amazonaws.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := &hostRecorder{}
+			client := newS3Client(aws.Config{
+				Region:      "us-west-2",
+				Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+				HTTPClient:  httpClient,
+				Retryer:     func() aws.Retryer { return aws.NopRetryer{} },
+			}, tt.useAccelerate)
+			store := newS3ObjectStore(client, 1)
+			ctx := context.Background()
+			bucket, key := "tubely-test", "landscape/clip.mp4"
+
+			if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key}); err == nil {
+				t.Fatal("HeadObject succeeded without sending")
+			}
+			if !slices.Equal(httpClient.hosts, []string{tt.wantHost}) {
+				t.Errorf("requests went to %q, want %q", httpClient.hosts, tt.wantHost)
+			}
+
+			get, err := store.PresignGetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key}, time.Minute)
+			if err != nil {
+				t.Fatalf("PresignGetObject: %v", err)
+			}
+			head, err := store.PresignHeadObject(ctx, &s3.HeadObjectInput{Bucket: &bucket, Key: &key}, time.Minute)
+			if err != nil {
+				t.Fatalf("PresignHeadObject: %v", err)
+			}
+			for _, presigned := range []string{get, head} {
+				u, err := url.Parse(presigned)
+				if err != nil {
+					t.Fatalf("presigned URL %q: %v", presigned, err)
+				}
+				if u.Host != tt.wantHost {
+					t.Errorf("presigned URL host = %q, want %q", u.Host, tt.wantHost)
+				}
+			}
+		})
+	}
+}
+
+// newBenchS3Server stands in for S3 behind latency, answering PutObject and
+// the calls of a multipart upload. It's served over TLS like S3, so a new
+// connection costs a handshake.
+func newBenchS3Server(b *testing.B, latency time.Duration) *httptest.Server {
+	b.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(latency)
+		query := r.URL.Query()
+		switch {
+		case query.Has("uploads"):
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>bench</UploadId></InitiateMultipartUploadResult>")
+		case query.Has("uploadId") && r.Method == http.MethodPost:
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"bench"</ETag></CompleteMultipartUploadResult>`)
+		default:
+			w.Header().Set("ETag", `"bench"`)
+		}
+	}))
+	b.Cleanup(srv.Close)
+	return srv
+}
+
+// newBenchS3Client is an S3 client for srv going through httpClient, which
+// is made to trust srv's certificate.
+func newBenchS3Client(srv *httptest.Server, httpClient *awshttp.BuildableClient) *s3.Client {
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	return s3.NewFromConfig(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", ""),
+		HTTPClient: httpClient.WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = tlsConfig.Clone()
+		}),
+		BaseEndpoint: aws.String(srv.URL),
+		Retryer:      func() aws.Retryer { return aws.NopRetryer{} },
+	}, func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+}
+
+// BenchmarkS3ConnectionPool sends bursts of small PUT requests through the
+// HTTP client S3 requests go through, more at once than the SDK's default
+// pool keeps connections for. Between bursts the connections past the
+// pool's size are closed, and the next burst opens them again, TLS handshake
+// included, which a pool sized for the bursts saves. It bypasses the SDK,
+// whose own overhead would hide the difference on small machines.
+func BenchmarkS3ConnectionPool(b *testing.B) {
+	const burst = 50
+	srv := newBenchS3Server(b, 10*time.Millisecond)
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	body := make([]byte, 4<<10)
+
+	tests := []struct {
+		name                string
+		maxIdleConns        int
+		maxIdleConnsPerHost int
+	}{
+		{"default", awshttp.DefaultHTTPTransportMaxIdleConns, awshttp.DefaultHTTPTransportMaxIdleConnsPerHost},
+		{"tuned", awshttp.DefaultHTTPTransportMaxIdleConns, burst},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			httpClient := newS3HTTPClient(tt.maxIdleConns, tt.maxIdleConnsPerHost, awshttp.DefaultHTTPTransportIdleConnTimeout).
+				WithTransportOptions(func(tr *http.Transport) {
+					tr.TLSClientConfig = tlsConfig.Clone()
+				})
+			put := func() error {
+				r, err := http.NewRequest(http.MethodPut, srv.URL+"/tubely-bench/landscape/clip.mp4", bytes.NewReader(body))
+				if err != nil {
+					return err
+				}
+				res, err := httpClient.Do(r)
+				if err != nil {
+					return err
+				}
+				defer res.Body.Close()
+				_, err = io.Copy(io.Discard, res.Body)
+				return err
+			}
+			b.SetBytes(burst * int64(len(body)))
+			b.ResetTimer()
+
+			for range b.N {
+				var wg sync.WaitGroup
+				for range burst {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := put(); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkS3UploadConcurrency streams a video in multipart chunks, sending
+// S3_UPLOAD_CONCURRENCY parts at once.
+func BenchmarkS3UploadConcurrency(b *testing.B) {
+	srv := newBenchS3Server(b, 20*time.Millisecond)
+	body := make([]byte, 10*manager.MinUploadPartSize)
+
+	for _, concurrency := range []int{1, manager.DefaultUploadConcurrency, 10} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			httpClient := newS3HTTPClient(awshttp.DefaultHTTPTransportMaxIdleConns, awshttp.DefaultHTTPTransportMaxIdleConnsPerHost, awshttp.DefaultHTTPTransportIdleConnTimeout)
+			store := newS3ObjectStore(newBenchS3Client(srv, httpClient), concurrency)
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+
+			for range b.N {
+				err := store.Upload(context.Background(), &s3.PutObjectInput{
+					Bucket: aws.String("tubely-bench"),
+					Key:    aws.String("landscape/clip.mp4"),
+					Body:   bytes.NewReader(body),
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	objectTagUserID      = "userID"
+	objectTagAspectRatio = "aspectRatio"
+	objectTagMediaKind   = "mediaKind"
+)
+
+var supportedObjectTags = []string{objectTagUserID, objectTagAspectRatio, objectTagMediaKind}
+
+// parseObjectTags validates a comma separated list of tag names.
+func parseObjectTags(list string) ([]string, error) {
+	tags := []string{}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !slices.Contains(supportedObjectTags, tag) {
+			return nil, fmt.Errorf("unsupported object tag %q, must be one of %v", tag, supportedObjectTags)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// getObjectTagging builds the URL-encoded Tagging value for PutObject from
+// the configured tag set. It returns nil when tagging is disabled.
+func (cfg apiConfig) getObjectTagging(userID uuid.UUID, ratio, mediaType string) *string {
+	if len(cfg.s3ObjectTags) == 0 {
+		return nil
+	}
+
+	values := url.Values{}
+	for _, tag := range cfg.s3ObjectTags {
+		switch tag {
+		case objectTagUserID:
+			values.Set(tag, userID.String())
+		case objectTagAspectRatio:
+			values.Set(tag, ratio)
+		case objectTagMediaKind:
+			values.Set(tag, strings.Split(mediaType, "/")[0])
+		}
+	}
+	tagging := values.Encode()
+	return &tagging
+}
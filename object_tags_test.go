@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGetObjectTagging(t *testing.T) {
+	userID := uuid.MustParse("5f8f1c3e-2b1a-4c5d-9e7f-0a1b2c3d4e5f")
+	tests := []struct {
+		name      string
+		tags      []string
+		ratio     string
+		mediaType string
+		want      string
+	}{
+		{"every tag, in key order", []string{objectTagUserID, objectTagAspectRatio, objectTagMediaKind}, "landscape", "video/mp4",
+			"aspectRatio=landscape&mediaKind=video&userID=5f8f1c3e-2b1a-4c5d-9e7f-0a1b2c3d4e5f"},
+		{"one tag", []string{objectTagMediaKind}, "landscape", "image/png", "mediaKind=image"},
+		{"special characters", []string{objectTagAspectRatio}, "16:9 & more=/?", "video/mp4", "aspectRatio=16%3A9+%26+more%3D%2F%3F"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{s3ObjectTags: tt.tags}
+
+			got := cfg.getObjectTagging(userID, tt.ratio, tt.mediaType)
+			if got == nil {
+				t.Fatal("tagging = nil")
+			}
+			if *got != tt.want {
+				t.Errorf("tagging = %q, want %q", *got, tt.want)
+			}
+			values, err := url.ParseQuery(*got)
+			if err != nil {
+				t.Fatalf("tagging doesn't decode: %v", err)
+			}
+			if _, ok := values[objectTagAspectRatio]; ok && values.Get(objectTagAspectRatio) != tt.ratio {
+				t.Errorf("aspectRatio decodes to %q, want %q", values.Get(objectTagAspectRatio), tt.ratio)
+			}
+		})
+	}
+}
+
+func TestGetObjectTaggingDisabled(t *testing.T) {
+	cfg := apiConfig{}
+	if got := cfg.getObjectTagging(uuid.New(), "landscape", "video/mp4"); got != nil {
+		t.Errorf("tagging = %q, want nil", *got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// parsePagination reads the limit and offset query parameters. Out of range
+// values are clamped rather than rejected: limit to [1, maxLimit] and offset
+// to >= 0. A missing limit defaults to maxLimit.
+func parsePagination(query url.Values, maxLimit int) (limit, offset int, err error) {
+	limit = maxLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, errors.New("limit must be an integer")
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, errors.New("offset must be an integer")
+		}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	return limit, offset, nil
+}
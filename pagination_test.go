@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParsePagination(t *testing.T) {
+	const maxLimit = 50
+	tests := []struct {
+		name       string
+		query      string
+		wantLimit  int
+		wantOffset int
+		wantErr    string
+	}{
+		{"missing", "", maxLimit, 0, ""},
+		{"within range", "limit=10&offset=20", 10, 20, ""},
+		{"zero limit", "limit=0", 1, 0, ""},
+		{"negative limit", "limit=-5", 1, 0, ""},
+		{"limit over the max", "limit=500", maxLimit, 0, ""},
+		{"limit at the max", "limit=50", maxLimit, 0, ""},
+		{"zero offset", "offset=0", maxLimit, 0, ""},
+		{"negative offset", "offset=-10", maxLimit, 0, ""},
+		{"non-numeric limit", "limit=ten", 0, 0, "limit must be an integer"},
+		{"fractional limit", "limit=1.5", 0, 0, "limit must be an integer"},
+		{"non-numeric offset", "offset=next", 0, 0, "offset must be an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit, offset, err := parsePagination(query, maxLimit)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if limit != tt.wantLimit || offset != tt.wantOffset {
+				t.Errorf("limit, offset = %d, %d, want %d, %d", limit, offset, tt.wantLimit, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestHandlerVideosRetrieveInvalidPagination(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	_, token := createTestUser(t, cfg)
+
+	for _, query := range []string{"?limit=ten", "?offset=next"} {
+		w := httptest.NewRecorder()
+		cfg.handlerVideosRetrieve(w, newVideosRequest(t, token, query, ""))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400, body %s", query, w.Code, w.Body)
+		}
+	}
+}
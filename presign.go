@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// presignOptions override response headers S3 sends for a presigned GET, so
+// one stored object can be served inline in one place and as a named
+// download in another. Empty fields keep the object's own headers.
+type presignOptions struct {
+	ContentDisposition string
+	ContentType        string
+}
+
+func generatePresignedURL(store objectStore, bucket, key string, expireTime time.Duration, opts presignOptions) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if opts.ContentDisposition != "" {
+		input.ResponseContentDisposition = &opts.ContentDisposition
+	}
+	if opts.ContentType != "" {
+		input.ResponseContentType = &opts.ContentType
+	}
+
+	return store.PresignGetObject(context.Background(), input, expireTime)
+}
+
+// generatePresignedHeadURL presigns a HEAD request for key, letting clients
+// check an object's existence and size without downloading it.
+func generatePresignedHeadURL(store objectStore, bucket, key string, expireTime time.Duration) (string, error) {
+	return store.PresignHeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, expireTime)
+}
+
+type presignedURL struct {
+	URL       string
+	ExpiresAt time.Time
+}
+
+// maxPresignCacheEntries bounds the presign cache. Keys that are signed once
+// and never asked for again would otherwise pile up for as long as the
+// server runs.
+const maxPresignCacheEntries = 10000
+
+// presignCache keeps presigned URLs around so repeated requests for the same
+// key don't have to sign again. An entry is reused, with whatever lifetime
+// it has left, until less than refreshThreshold of it remains, or half of it
+// when refreshThreshold is 0. Once maxEntries are cached, expired entries
+// are swept out, and failing that the one expiring soonest is evicted.
+type presignCache struct {
+	mu               sync.Mutex
+	entries          map[string]presignedURL
+	refreshThreshold time.Duration
+	maxEntries       int
+}
+
+func newPresignCache(refreshThreshold time.Duration) *presignCache {
+	return &presignCache{
+		entries:          map[string]presignedURL{},
+		refreshThreshold: refreshThreshold,
+		maxEntries:       maxPresignCacheEntries,
+	}
+}
+
+func (c *presignCache) get(key string, expireTime time.Duration) (presignedURL, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return presignedURL{}, false
+	}
+	threshold := c.refreshThreshold
+	if threshold == 0 {
+		threshold = expireTime / 2
+	}
+	if time.Until(entry.ExpiresAt) < threshold {
+		delete(c.entries, key)
+		return presignedURL{}, false
+	}
+	return entry, true
+}
+
+func (c *presignCache) set(key string, entry presignedURL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		var soonest string
+		for k, e := range c.entries {
+			if !e.ExpiresAt.After(now) {
+				delete(c.entries, k)
+			} else if soonest == "" || e.ExpiresAt.Before(c.entries[soonest].ExpiresAt) {
+				soonest = k
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, soonest)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// presignExpiryFor returns how long links to video should stay valid: the
+// override for its aspect ratio bucket if one is configured, otherwise
+// presignExpiry.
+func (cfg *apiConfig) presignExpiryFor(video database.Video) time.Duration {
+	if expiry, ok := cfg.presignExpiryByRatio[video.AspectRatio]; ok {
+		return expiry
+	}
+	return cfg.presignExpiry
+}
+
+// parsePresignExpiries parses a comma separated list of ratio=duration
+// pairs such as "9:16=5m,16:9=1h" into per aspect ratio bucket expiries,
+// keyed by the name videos in the bucket are stored under, such as
+// "portrait".
+func parsePresignExpiries(list string) (map[string]time.Duration, error) {
+	expiries := map[string]time.Duration{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ratio, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q must be in ratio=duration form", pair)
+		}
+		ratio = strings.TrimSpace(ratio)
+		if !slices.Contains(aspectRatioBuckets, ratio) {
+			return nil, fmt.Errorf("unknown aspect ratio %q, must be one of %v", ratio, aspectRatioBuckets)
+		}
+		expiry, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || expiry <= 0 || expiry > maxPresignDuration {
+			return nil, fmt.Errorf("expiry for %v must be a positive duration of at most %v, got %q", ratio, maxPresignDuration, value)
+		}
+		expiries[aspectRatioNames[ratio]] = expiry
+	}
+	return expiries, nil
+}
+
+// presignObject returns a presigned GET URL for key valid for expiry,
+// reusing a cached one when it is still fresh enough.
+func (cfg *apiConfig) presignObject(key string, expiry time.Duration, opts presignOptions) (presignedURL, error) {
+	cacheKey := key
+	if opts != (presignOptions{}) {
+		cacheKey = strings.Join([]string{key, opts.ContentDisposition, opts.ContentType}, "\x00")
+	}
+	if entry, ok := cfg.presignCache.get(cacheKey, expiry); ok {
+		return entry, nil
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	url, err := generatePresignedURL(cfg.store, cfg.s3Bucket, key, expiry, opts)
+	if err != nil {
+		return presignedURL{}, err
+	}
+
+	entry := presignedURL{URL: url, ExpiresAt: expiresAt}
+	cfg.presignCache.set(cacheKey, entry)
+	return entry, nil
+}
+
+// presignHeadObject is presignObject for HEAD requests.
+func (cfg *apiConfig) presignHeadObject(key string, expiry time.Duration) (presignedURL, error) {
+	cacheKey := "HEAD\x00" + key
+	if entry, ok := cfg.presignCache.get(cacheKey, expiry); ok {
+		return entry, nil
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	url, err := generatePresignedHeadURL(cfg.store, cfg.s3Bucket, key, expiry)
+	if err != nil {
+		return presignedURL{}, err
+	}
+
+	entry := presignedURL{URL: url, ExpiresAt: expiresAt}
+	cfg.presignCache.set(cacheKey, entry)
+	return entry, nil
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
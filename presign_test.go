@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestPresignCacheBounded(t *testing.T) {
+	c := newPresignCache(0)
+	c.maxEntries = 3
+	now := time.Now()
+
+	c.set("expired", presignedURL{URL: "expired", ExpiresAt: now.Add(-time.Second)})
+	c.set("soonest", presignedURL{URL: "soonest", ExpiresAt: now.Add(time.Minute)})
+	c.set("later", presignedURL{URL: "later", ExpiresAt: now.Add(time.Hour)})
+
+	// Full: the expired entry is swept out to make room.
+	c.set("a", presignedURL{URL: "a", ExpiresAt: now.Add(time.Hour)})
+	if _, ok := c.entries["expired"]; ok || len(c.entries) != 3 {
+		t.Fatalf("entries = %v, want the expired one swept", c.entries)
+	}
+
+	// Nothing expired: the entry expiring soonest goes.
+	c.set("b", presignedURL{URL: "b", ExpiresAt: now.Add(time.Hour)})
+	if _, ok := c.entries["soonest"]; ok || len(c.entries) != 3 {
+		t.Fatalf("entries = %v, want the soonest to expire evicted", c.entries)
+	}
+
+	// Updating a cached key evicts nothing.
+	c.set("b", presignedURL{URL: "b2", ExpiresAt: now.Add(time.Hour)})
+	if len(c.entries) != 3 {
+		t.Errorf("entries = %v, want 3", c.entries)
+	}
+}
+
+func TestObjectInfoCacheBounded(t *testing.T) {
+	c := newObjectInfoCache()
+	c.maxEntries = 10
+	for i := range 100 {
+		c.set(fmt.Sprint(i), objectInfo{fetchedAt: time.Now().Add(time.Duration(i) * time.Millisecond)})
+	}
+	if len(c.entries) != 10 {
+		t.Fatalf("%d entries cached, want at most 10", len(c.entries))
+	}
+	if _, ok := c.get("99"); !ok {
+		t.Error("latest entry was evicted")
+	}
+	if _, ok := c.get("0"); ok {
+		t.Error("oldest entry wasn't evicted")
+	}
+}
+
+func TestPresignObjectCache(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	cfg.presignCache = newPresignCache(5 * time.Minute)
+	const expiry = 15 * time.Minute
+
+	first, err := cfg.presignObject("landscape/a.mp4", expiry, presignOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit, err := cfg.presignObject("landscape/a.mp4", expiry, presignOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit != first {
+		t.Errorf("cache hit = %+v, want the first URL %+v", hit, first)
+	}
+	if presigns := store.callsTo("PresignGetObject"); len(presigns) != 1 {
+		t.Errorf("presigned %d times, want once with a cache hit", len(presigns))
+	}
+
+	// Less than the threshold left: signed again.
+	nearExpiry := presignedURL{URL: "near-expiry", ExpiresAt: time.Now().Add(4 * time.Minute)}
+	cfg.presignCache.set("landscape/a.mp4", nearExpiry)
+	refreshed, err := cfg.presignObject("landscape/a.mp4", expiry, presignOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.URL == nearExpiry.URL || time.Until(refreshed.ExpiresAt) < expiry-time.Minute {
+		t.Errorf("near expiry got %+v, want a fresh URL", refreshed)
+	}
+
+	// Other keys and other response headers are misses.
+	if _, err := cfg.presignObject("landscape/b.mp4", expiry, presignOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.presignObject("landscape/a.mp4", expiry, presignOptions{ContentDisposition: "attachment"}); err != nil {
+		t.Fatal(err)
+	}
+	if presigns := store.callsTo("PresignGetObject"); len(presigns) != 4 {
+		t.Errorf("presigned %d times, want 4", len(presigns))
+	}
+}
+
+func TestPresignExpiryFor(t *testing.T) {
+	expiries, err := parsePresignExpiries("9:16=5m, 16:9=1h")
+	if err != nil {
+		t.Fatalf("parsePresignExpiries: %v", err)
+	}
+	cfg := &apiConfig{presignExpiry: 15 * time.Minute, presignExpiryByRatio: expiries}
+
+	tests := []struct {
+		aspectRatio string
+		want        time.Duration
+	}{
+		{"portrait", 5 * time.Minute},
+		{"landscape", time.Hour},
+		{"square", 15 * time.Minute},
+		{"other", 15 * time.Minute},
+		{"", 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := cfg.presignExpiryFor(database.Video{AspectRatio: tt.aspectRatio}); got != tt.want {
+			t.Errorf("presignExpiryFor(%q) = %v, want %v", tt.aspectRatio, got, tt.want)
+		}
+	}
+}
+
+func TestParsePresignExpiries(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"empty", "", map[string]time.Duration{}, false},
+		{"every bucket", "16:9=1h,9:16=5m,1:1=10m,other=2m", map[string]time.Duration{
+			"landscape": time.Hour, "portrait": 5 * time.Minute, "square": 10 * time.Minute, "other": 2 * time.Minute,
+		}, false},
+		{"unknown ratio", "4:3=1h", nil, true},
+		{"bucket name instead of ratio", "portrait=1h", nil, true},
+		{"not a pair", "16:9", nil, true},
+		{"invalid duration", "16:9=long", nil, true},
+		{"above the presign maximum", "16:9=169h", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePresignExpiries(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("expiries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newPresignRequest builds a POST /api/videos/presign request for videoIDs.
+func newPresignRequest(t *testing.T, token string, includeHead bool, videoIDs ...uuid.UUID) *http.Request {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{"video_ids": videoIDs, "include_head": includeHead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/videos/presign", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestHandlerVideosPresignExpiryOverride(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+	if video.AspectRatio == "" {
+		t.Fatal("uploaded video has no aspect ratio")
+	}
+	cfg.presignExpiryByRatio = map[string]time.Duration{video.AspectRatio: 5 * time.Minute}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideosPresign(w, newPresignRequest(t, token, false, video.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	var res map[uuid.UUID]struct {
+		VideoURL string `json:"video_url"`
+	}
+	decodeResponse(t, w, &res)
+	if want := fakePresignedURL(cfg.s3Bucket, key, 5*time.Minute); res[video.ID].VideoURL != want {
+		t.Errorf("video_url = %q, want %q", res[video.ID].VideoURL, want)
+	}
+}
+
+func TestPresignHeadObject(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+
+	before := time.Now()
+	head, err := cfg.presignHeadObject("landscape/clip.mp4", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("presignHeadObject: %v", err)
+	}
+	if want := fakePresignedURL(cfg.s3Bucket, "landscape/clip.mp4", 10*time.Minute); head.URL != want {
+		t.Errorf("url = %q, want %q", head.URL, want)
+	}
+	if head.ExpiresAt.Before(before.Add(10*time.Minute)) || head.ExpiresAt.After(time.Now().Add(10*time.Minute)) {
+		t.Errorf("expires_at = %v, want 10m from now", head.ExpiresAt)
+	}
+
+	// A GET URL for the same key is signed on its own, not taken from the
+	// HEAD one's cache entry, and the HEAD one is reused.
+	if _, err := cfg.presignObject("landscape/clip.mp4", 10*time.Minute, presignOptions{}); err != nil {
+		t.Fatalf("presignObject: %v", err)
+	}
+	if _, err := cfg.presignHeadObject("landscape/clip.mp4", 10*time.Minute); err != nil {
+		t.Fatalf("presignHeadObject: %v", err)
+	}
+	if heads := store.callsTo("PresignHeadObject"); len(heads) != 1 {
+		t.Errorf("PresignHeadObject calls = %q, want one", heads)
+	}
+	if gets := store.callsTo("PresignGetObject"); len(gets) != 1 {
+		t.Errorf("PresignGetObject calls = %q, want one", gets)
+	}
+}
+
+func TestHandlerVideosPresignIncludeHead(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+	cfg.presignExpiryByRatio = map[string]time.Duration{video.AspectRatio: 5 * time.Minute}
+
+	for _, includeHead := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		cfg.handlerVideosPresign(w, newPresignRequest(t, token, includeHead, video.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("include_head=%v: status = %d, want 200, body %s", includeHead, w.Code, w.Body)
+		}
+		var res map[uuid.UUID]struct {
+			VideoHeadURL *string `json:"video_head_url"`
+		}
+		decodeResponse(t, w, &res)
+
+		if !includeHead {
+			if res[video.ID].VideoHeadURL != nil {
+				t.Errorf("video_head_url = %q without include_head", *res[video.ID].VideoHeadURL)
+			}
+			continue
+		}
+		if want := fakePresignedURL(cfg.s3Bucket, key, 5*time.Minute); res[video.ID].VideoHeadURL == nil || *res[video.ID].VideoHeadURL != want {
+			t.Errorf("video_head_url = %v, want %q", res[video.ID].VideoHeadURL, want)
+		}
+	}
+	if heads := store.callsTo("PresignHeadObject"); !slices.Equal(heads, []string{key}) {
+		t.Errorf("PresignHeadObject calls = %q, want [%q]", heads, key)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipRateLimiter keeps a token bucket per client IP. Each bucket holds up to
+// burst tokens and refills at rate tokens per second; a request takes one.
+type ipRateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newIPRateLimiter(perMinute, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: map[netip.Addr]*tokenBucket{},
+	}
+}
+
+// allow takes a token from ip's bucket. When it's empty, it reports how long
+// until the next token instead.
+func (l *ipRateLimiter) allow(ip netip.Addr, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, which behave the same
+// as no bucket at all, so the map doesn't grow with every IP ever seen.
+func (l *ipRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// clientIP returns the IP a request came from. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and then only up
+// to the first hop that isn't one: whatever is left of that was written by
+// the client and could be anything.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip = ip.Unmap()
+
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip, true
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A mangled entry ends the chain, the proxy before it is the
+			// last address known to be genuine.
+			break
+		}
+		ip = hop.Unmap()
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip, true
+}
+
+func isTrustedProxy(ip netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimit wraps a handler reachable without authentication so that each
+// client IP gets at most RATE_LIMIT_PER_MINUTE requests, with bursts of
+// RATE_LIMIT_BURST, answering 429 beyond that.
+func (cfg *apiConfig) rateLimit(handler http.HandlerFunc) http.Handler {
+	if cfg.rateLimiter == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ok := clientIP(r, cfg.trustedProxies)
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		allowed, wait := cfg.rateLimiter.allow(ip, time.Now())
+		if !allowed {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// parseTrustedProxies parses a comma separated list of IPs and CIDR ranges
+// of the proxies in front of the server.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q", entry)
+		}
+		ip = ip.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
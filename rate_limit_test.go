@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	limiter := newIPRateLimiter(60, 2)
+	ip := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow(ip, now); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := limiter.allow(ip, now)
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("wait = %v, want 1s at 60 per minute", wait)
+	}
+	if ok, _ := limiter.allow(other, now); !ok {
+		t.Error("another IP was refused")
+	}
+	if ok, _ := limiter.allow(ip, now.Add(time.Second)); !ok {
+		t.Error("request refused after a token refilled")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"forwarded header from an untrusted peer", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"through a trusted proxy", "10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"through a chain of trusted proxies", "10.1.2.3:1234", []string{"198.51.100.1, 192.0.2.10"}, "198.51.100.1"},
+		{"spoofed entries before the first untrusted hop", "10.1.2.3:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"split across headers", "10.1.2.3:1234", []string{"1.1.1.1", "198.51.100.1"}, "198.51.100.1"},
+		{"mangled entry", "10.1.2.3:1234", []string{"198.51.100.1, garbage, 10.9.9.9"}, "10.9.9.9"},
+		{"no header from a trusted proxy", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"IPv4-mapped IPv6", "[::ffff:203.0.113.5]:1234", nil, "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			got, ok := clientIP(r, proxies)
+			if !ok || got.String() != tt.want {
+				t.Errorf("clientIP = %v, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := &apiConfig{rateLimiter: newIPRateLimiter(60, 1)}
+	handler := cfg.rateLimit(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve("203.0.113.5:1234"); w.Code != http.StatusNoContent {
+		t.Fatalf("first request: status = %d, want 204", w.Code)
+	}
+	w := serve("203.0.113.5:1234")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request: status = %d, Retry-After %q, want 429 after 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve("203.0.113.6:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("another client: status = %d, want 204", w.Code)
+	}
+}
+
+func TestLoadConfigRateLimitOff(t *testing.T) {
+	conf, err := loadConfig(testEnv(nil))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if conf.rateLimitPerMinute != 0 {
+		t.Errorf("rateLimitPerMinute = %d, want rate limiting off by default", conf.rateLimitPerMinute)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// parseAllowedReferrers parses a comma separated list of sites allowed to
+// link to media, each given as a host such as "example.com" or an origin such
+// as "https://example.com:8443". Only the host and port are kept.
+func parseAllowedReferrers(list string) ([]string, error) {
+	hosts := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host := entry
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid origin %q", entry)
+			}
+			host = u.Host
+		}
+		if strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("invalid host %q", entry)
+		}
+		hosts = append(hosts, strings.ToLower(host))
+	}
+	return hosts, nil
+}
+
+// referrerAllowed reports whether a browser request for media comes from a
+// permitted site, judged by its Origin header or, failing that, its
+// Referer. The server's own pages are always permitted, and requests with
+// neither header, typically not from a browser, are permitted when
+// allowMissingReferrer is set. With no allowed referrers configured every
+// request is.
+func (cfg *apiConfig) referrerAllowed(r *http.Request) bool {
+	if len(cfg.allowedReferrers) == 0 {
+		return true
+	}
+
+	host, ok := referrerHost(r)
+	if !ok {
+		return host == "" && cfg.allowMissingReferrer
+	}
+	return host == strings.ToLower(r.Host) || slices.Contains(cfg.allowedReferrers, host)
+}
+
+// referrerHost returns the lowercased host of the site a browser request
+// comes from, taken from its Origin header or, failing that, its Referer.
+// It reports false both when there is neither, returning an empty host, and
+// when the header can't be parsed.
+func referrerHost(r *http.Request) (string, bool) {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return "", false
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source, false
+	}
+	return strings.ToLower(u.Host), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseAllowedReferrers(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", []string{}, false},
+		{"hosts and origins", "Example.com, https://cdn.example.com:8443,", []string{"example.com", "cdn.example.com:8443"}, false},
+		{"origin without host", "https://", nil, true},
+		{"host with path", "example.com/page", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAllowedReferrers(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("referrers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReferrerAllowed(t *testing.T) {
+	allowed := []string{"example.com", "cdn.example.com:8443"}
+	tests := []struct {
+		name         string
+		referrers    []string
+		allowMissing bool
+		headers      map[string]string
+		want         bool
+	}{
+		{"empty allowlist, other site", nil, false, map[string]string{"Referer": "https://elsewhere.test/"}, true},
+		{"empty allowlist, missing", nil, false, nil, true},
+		{"allowed Referer", allowed, false, map[string]string{"Referer": "https://example.com/page"}, true},
+		{"allowed Origin", allowed, false, map[string]string{"Origin": "https://EXAMPLE.com"}, true},
+		{"allowed origin with port", allowed, false, map[string]string{"Origin": "https://cdn.example.com:8443"}, true},
+		{"Origin wins over Referer", allowed, false, map[string]string{"Origin": "https://elsewhere.test", "Referer": "https://example.com/"}, false},
+		{"null Origin falls back to Referer", allowed, false, map[string]string{"Origin": "null", "Referer": "https://example.com/"}, true},
+		{"own pages", allowed, false, map[string]string{"Referer": "http://tubely.test/app"}, true},
+		{"other site", allowed, false, map[string]string{"Referer": "https://elsewhere.test/"}, false},
+		{"allowed host on another port", allowed, false, map[string]string{"Origin": "https://example.com:8443"}, false},
+		{"missing", allowed, false, nil, false},
+		{"missing, allowed", allowed, true, nil, true},
+		{"unparseable", allowed, true, map[string]string{"Referer": "not a url"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := apiConfig{allowedReferrers: tt.referrers, allowMissingReferrer: tt.allowMissing}
+			r := httptest.NewRequest(http.MethodGet, "http://tubely.test/api/videos", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := cfg.referrerAllowed(r); got != tt.want {
+				t.Errorf("referrerAllowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerVideoPlayReferrer(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	cfg.allowedReferrers = []string{"example.com"}
+	userID, token := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, userID, token)
+
+	tests := []struct {
+		name       string
+		referrer   string
+		wantStatus int
+	}{
+		{"allowed", "https://example.com/page", http.StatusOK},
+		{"disallowed", "https://elsewhere.test/", http.StatusForbidden},
+		{"missing", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newPlayRequest(t, video.ID, token, "?format=json")
+			if tt.referrer != "" {
+				r.Header.Set("Referer", tt.referrer)
+			}
+			w := httptest.NewRecorder()
+			cfg.handlerVideoPlay(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// qualityOriginal is the video as uploaded and stored.
+const qualityOriginal = "original"
+
+// renditionQualities are the qualities a video can be requested in besides
+// the original, highest first.
+var renditionQualities = []string{"2160p", "1440p", "1080p", "720p", "480p", "360p", "240p"}
+
+// validQuality reports whether quality is qualityOriginal or one of
+// renditionQualities.
+func validQuality(quality string) bool {
+	if quality == qualityOriginal {
+		return true
+	}
+	for _, q := range renditionQualities {
+		if q == quality {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyQuality is the quality of the editing proxy stored when
+// PROXY_ENABLED is set, see generateProxy.
+const proxyQuality = "360p"
+
+// availableQualities lists the qualities video is stored in: the original
+// and, when it has one, its editing proxy, the only rendition made so far.
+func availableQualities(video database.Video) []string {
+	qualities := []string{qualityOriginal}
+	if video.ProxyURL != nil {
+		qualities = append(qualities, proxyQuality)
+	}
+	return qualities
+}
+
+// qualityURL returns the URL of video in quality, one of
+// availableQualities(video).
+func qualityURL(video database.Video, quality string) *string {
+	if quality == proxyQuality {
+		return video.ProxyURL
+	}
+	return video.VideoURL
+}
+
+// resolveQuality picks the quality to serve for requested out of available:
+// requested itself when it's there, otherwise the available rendition
+// closest in height, preferring the lower one on a tie, and the original
+// when there are no renditions at all.
+func resolveQuality(requested string, available []string) string {
+	best, bestDiff := qualityOriginal, -1
+	for _, quality := range available {
+		if quality == requested {
+			return quality
+		}
+		if quality == qualityOriginal || requested == qualityOriginal {
+			continue
+		}
+		diff := qualityHeight(quality) - qualityHeight(requested)
+		lower := diff < 0
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff == -1 || diff < bestDiff || (diff == bestDiff && lower) {
+			best, bestDiff = quality, diff
+		}
+	}
+	return best
+}
+
+// qualityHeight is the frame height of a rendition quality such as "720p".
+func qualityHeight(quality string) int {
+	height, _ := strconv.Atoi(strings.TrimSuffix(quality, "p"))
+	return height
+}
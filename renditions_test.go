@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestResolveQuality(t *testing.T) {
+	renditions := []string{qualityOriginal, "1080p", "720p", "360p"}
+
+	tests := []struct {
+		name      string
+		requested string
+		available []string
+		want      string
+	}{
+		{"exact rendition", "720p", renditions, "720p"},
+		{"exact original", qualityOriginal, renditions, qualityOriginal},
+		{"closest below", "480p", renditions, "360p"},
+		{"closest above", "1440p", renditions, "1080p"},
+		{"highest for more than there is", "2160p", renditions, "1080p"},
+		{"lower on a tie", "900p", []string{"1080p", "720p"}, "720p"},
+		{"original only", "720p", []string{qualityOriginal}, qualityOriginal},
+		{"nothing available", "720p", nil, qualityOriginal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveQuality(tt.requested, tt.available); got != tt.want {
+				t.Errorf("resolveQuality(%q, %q) = %q, want %q", tt.requested, tt.available, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidQuality(t *testing.T) {
+	for _, quality := range append([]string{qualityOriginal}, renditionQualities...) {
+		if !validQuality(quality) {
+			t.Errorf("validQuality(%q) = false, want true", quality)
+		}
+	}
+	for _, quality := range []string{"", "1080", "1080P", "999p", "best"} {
+		if validQuality(quality) {
+			t.Errorf("validQuality(%q) = true, want false", quality)
+		}
+	}
+}
+
+func TestHandlerVideoPlayQuality(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, _ := uploadTestVideo(t, cfg, userID, token)
+
+	tests := []struct {
+		query       string
+		wantStatus  int
+		wantQuality string
+	}{
+		{"", http.StatusFound, qualityOriginal},
+		{"?quality=720p", http.StatusFound, qualityOriginal},
+		{"?quality=original", http.StatusFound, qualityOriginal},
+		{"?quality=best", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, token, tt.query))
+		if w.Code != tt.wantStatus || w.Header().Get("X-Video-Quality") != tt.wantQuality {
+			t.Errorf("%q: status = %d, X-Video-Quality %q, want %d and %q", tt.query, w.Code, w.Header().Get("X-Video-Quality"), tt.wantStatus, tt.wantQuality)
+		}
+	}
+}
+
+func TestAvailableQualities(t *testing.T) {
+	proxyURL := "https://tubely-test.s3.us-east-1.amazonaws.com/proxy/landscape/a.mp4"
+	tests := []struct {
+		name  string
+		video database.Video
+		want  []string
+	}{
+		{"original only", database.Video{}, []string{qualityOriginal}},
+		{"with proxy", database.Video{ProxyURL: &proxyURL}, []string{qualityOriginal, proxyQuality}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := availableQualities(tt.video); !slices.Equal(got, tt.want) {
+				t.Errorf("availableQualities = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerVideoPlayQualityProxy(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video, key := uploadTestVideo(t, cfg, userID, token)
+	proxyKey := getProxyKey(key)
+	store.putObject(proxyKey, []byte("proxy"), time.Now())
+	video.ProxyURL = aws.String(cfg.getVideoURL(proxyKey))
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query       string
+		wantQuality string
+		wantKey     string
+	}{
+		{"", qualityOriginal, key},
+		{"?quality=original", qualityOriginal, key},
+		{"?quality=360p", proxyQuality, proxyKey},
+		{"?quality=720p", proxyQuality, proxyKey},
+		{"?variant=download&quality=240p", proxyQuality, proxyKey},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, token, tt.query))
+		if w.Code != http.StatusFound || w.Header().Get("X-Video-Quality") != tt.wantQuality {
+			t.Errorf("%q: status = %d, X-Video-Quality %q, want 302 and %q", tt.query, w.Code, w.Header().Get("X-Video-Quality"), tt.wantQuality)
+		}
+		if want := fakePresignedURL(cfg.s3Bucket, tt.wantKey, cfg.presignExpiry); w.Header().Get("Location") != want {
+			t.Errorf("%q: Location = %q, want %q", tt.query, w.Header().Get("Location"), want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	cfg.handlerVideoPlay(w, newPlayRequest(t, video.ID, token, "?format=json"))
+	var res struct {
+		Qualities []string `json:"qualities"`
+	}
+	decodeResponse(t, w, &res)
+	if want := []string{qualityOriginal, proxyQuality}; !slices.Equal(res.Qualities, want) {
+		t.Errorf("qualities = %q, want %q", res.Qualities, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware tags every request with an ID, taken from the incoming
+// X-Request-ID header when it looks sane and generated otherwise. The ID is
+// stored in the request context and echoed back in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), requestID)))
+	})
+}
+
+// isValidRequestID accepts IDs from other services as long as they can't
+// forge or break up log lines.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		isAlnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !isAlnum && c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// logf logs like log.Printf, prefixed with the request ID carried by ctx.
+func logf(ctx context.Context, format string, args ...any) {
+	logWithRequestID(requestIDFromContext(ctx), format, args...)
+}
+
+func logWithRequestID(requestID, format string, args ...any) {
+	if requestID != "" {
+		format = "request_id=%s " + format
+		args = append([]any{requestID}, args...)
+	}
+	log.Printf(format, args...)
+}
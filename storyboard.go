@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	storyboardTileWidth = 160
+	storyboardColumns   = 10
+	// maxStoryboardTiles bounds the sprite sheet of long videos: the
+	// interval is stretched so the whole video still fits.
+	maxStoryboardTiles = 100
+	// maxStoryboardTrackSize comfortably fits the track of
+	// maxStoryboardTiles cues.
+	maxStoryboardTrackSize = 1 << 20
+)
+
+// storyboardLayout returns the interval and number of tiles covering a video
+// of the given duration, at the configured interval unless that would take
+// more than maxStoryboardTiles.
+func storyboardLayout(duration, interval time.Duration) (time.Duration, int) {
+	tiles := int(math.Ceil(float64(duration) / float64(interval)))
+	if tiles > maxStoryboardTiles {
+		// Rounded up to whole milliseconds, which is what VTT timestamps
+		// can express, without going over the limit.
+		step := maxStoryboardTiles * time.Millisecond
+		interval = (duration + step - 1) / step * time.Millisecond
+		tiles = int(math.Ceil(float64(duration) / float64(interval)))
+	}
+	return interval, max(tiles, 1)
+}
+
+// buildStoryboardVTT writes a WebVTT thumbnail track: one cue per tile of the
+// sprite at spriteURL, each pointing at its tile with a #xywh media fragment.
+// The last cue ends with the video.
+func buildStoryboardVTT(spriteURL string, duration, interval time.Duration, tiles, columns, tileWidth, tileHeight int) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < tiles; i++ {
+		start := time.Duration(i) * interval
+		if start >= duration {
+			break
+		}
+		end := min(start+interval, duration)
+		x := (i % columns) * tileWidth
+		y := (i / columns) * tileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end), spriteURL, x, y, tileWidth, tileHeight)
+	}
+	return b.String()
+}
+
+// formatVTTTimestamp formats d as a WebVTT hh:mm:ss.ttt timestamp.
+func formatVTTTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// uploadStoryboard stores a sprite sheet of frames and the WebVTT track
+// mapping playback times onto it next to the video object at videoKey, when
+// STORYBOARD_INTERVAL is set. The track references the sprite by its
+// CloudFront URL. Like previews, storyboards are a nicety, so failures are
+// only logged and leave the video without one.
+func (cfg *apiConfig) uploadStoryboard(ctx context.Context, video database.Video, tmpPath, videoKey, ratio string) database.Video {
+	video.StoryboardURL = nil
+	if cfg.storyboardInterval == 0 || cfg.skipVideoProcessing || video.Duration <= 0 {
+		return video
+	}
+
+	duration := time.Duration(video.Duration * float64(time.Second))
+	interval, tiles := storyboardLayout(duration, cfg.storyboardInterval)
+	columns := min(storyboardColumns, tiles)
+
+	spritePath, err := generateStoryboard(ctx, cfg.commands, tmpPath, cfg.ffmpeg, interval, storyboardTileWidth, columns, tiles)
+	if err != nil {
+		logf(ctx, "Couldn't generate storyboard for video %v: %v", video.ID, err)
+		return video
+	}
+	defer os.Remove(spritePath)
+
+	sprite, err := os.ReadFile(spritePath)
+	if err != nil {
+		logf(ctx, "Couldn't read storyboard for video %v: %v", video.ID, err)
+		return video
+	}
+	// Tiles are as tall as the video's aspect ratio makes them, so their
+	// size is taken from the sheet ffmpeg produced.
+	sheet, _, err := image.DecodeConfig(bytes.NewReader(sprite))
+	if err != nil {
+		logf(ctx, "Couldn't read storyboard for video %v: %v", video.ID, err)
+		return video
+	}
+	rows := (tiles + columns - 1) / columns
+	tileWidth, tileHeight := sheet.Width/columns, sheet.Height/rows
+
+	key := getStoryboardKey(videoKey)
+	spriteKey := getStoryboardSpriteKey(key)
+	spriteType := "image/jpeg"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &spriteKey,
+		Body:         bytes.NewReader(sprite),
+		ContentType:  &spriteType,
+		Tagging:      cfg.getObjectTagging(video.UserID, ratio, spriteType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		logf(ctx, "Couldn't upload storyboard for video %v: %v", video.ID, err)
+		return video
+	}
+
+	vtt := buildStoryboardVTT(cfg.getVideoURL(spriteKey), duration, interval, tiles, columns, tileWidth, tileHeight)
+	vttType := "text/vtt"
+	_, err = cfg.store.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &key,
+		Body:         strings.NewReader(vtt),
+		ContentType:  &vttType,
+		Tagging:      cfg.getObjectTagging(video.UserID, ratio, vttType),
+		CacheControl: cfg.getCacheControl(),
+	})
+	if err != nil {
+		cfg.deleteObject(ctx, spriteKey)
+		logf(ctx, "Couldn't upload storyboard for video %v: %v", video.ID, err)
+		return video
+	}
+
+	storyboardURL := cfg.getVideoURL(key)
+	video.StoryboardURL = &storyboardURL
+	return video
+}
+
+// storyboardKeys returns the keys of the track and sprite behind
+// storyboardURL, or nil when it doesn't point into the bucket.
+func (cfg *apiConfig) storyboardKeys(storyboardURL *string) []string {
+	if storyboardURL == nil {
+		return nil
+	}
+	key, ok := cfg.getVideoKeyFromURL(*storyboardURL)
+	if !ok {
+		return nil
+	}
+	return []string{key, getStoryboardSpriteKey(key)}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestBuildStoryboardVTT(t *testing.T) {
+	got := buildStoryboardVTT("https://cdn.tubely.test/a-storyboard.jpg", 25*time.Second, 10*time.Second, 3, 2, 160, 90)
+	want := `WEBVTT
+
+00:00:00.000 --> 00:00:10.000
+https://cdn.tubely.test/a-storyboard.jpg#xywh=0,0,160,90
+
+00:00:10.000 --> 00:00:20.000
+https://cdn.tubely.test/a-storyboard.jpg#xywh=160,0,160,90
+
+00:00:20.000 --> 00:00:25.000
+https://cdn.tubely.test/a-storyboard.jpg#xywh=0,90,160,90
+`
+	if got != want {
+		t.Errorf("buildStoryboardVTT =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStoryboardLayout(t *testing.T) {
+	tests := []struct {
+		duration, interval time.Duration
+		wantInterval       time.Duration
+		wantTiles          int
+	}{
+		{25 * time.Second, 10 * time.Second, 10 * time.Second, 3},
+		{time.Second, 10 * time.Second, 10 * time.Second, 1},
+		// Stretched to keep within maxStoryboardTiles.
+		{2 * time.Hour, 10 * time.Second, 72 * time.Second, 100},
+		{1001 * time.Second, time.Second, 10010 * time.Millisecond, 100},
+	}
+	for _, tt := range tests {
+		interval, tiles := storyboardLayout(tt.duration, tt.interval)
+		if interval != tt.wantInterval || tiles != tt.wantTiles {
+			t.Errorf("storyboardLayout(%v, %v) = %v, %d, want %v, %d", tt.duration, tt.interval, interval, tiles, tt.wantInterval, tt.wantTiles)
+		}
+	}
+}
+
+func TestFormatVTTTimestamp(t *testing.T) {
+	got := formatVTTTimestamp(time.Hour + 2*time.Minute + 3*time.Second + 45*time.Millisecond)
+	if got != "01:02:03.045" {
+		t.Errorf("formatVTTTimestamp = %q, want 01:02:03.045", got)
+	}
+}
+
+func TestHandlerVideoPlayStoryboard(t *testing.T) {
+	cfg, store := newTestAPIConfig(t)
+	userID, token := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	spriteURL := cfg.getVideoURL("landscape/a-storyboard.jpg")
+	store.putObject("landscape/a-storyboard.vtt", []byte(buildStoryboardVTT(spriteURL, 20*time.Second, 10*time.Second, 2, 2, 160, 90)), time.Now())
+	store.putObject("landscape/a-storyboard.jpg", []byte("sprite"), time.Now())
+	video.StoryboardURL = aws.String(cfg.getVideoURL("landscape/a-storyboard.vtt"))
+	if err := cfg.db.UpdateVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, storyboardPath(video.ID), nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoPlay(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/vtt" {
+		t.Errorf("Content-Type = %q, want text/vtt", ct)
+	}
+	body := w.Body.String()
+	presigned := "https://tubely-test.s3.test/landscape/a-storyboard.jpg?X-Amz-Expires=900#xywh="
+	if strings.Contains(body, spriteURL) || strings.Count(body, presigned) != 2 {
+		t.Errorf("track doesn't point at the presigned sprite:\n%s", body)
+	}
+}
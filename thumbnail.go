@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	thumbnailFitCrop = "crop"
+	thumbnailFitPad  = "pad"
+)
+
+// parseAspectRatio parses a "W:H" ratio such as "16:9".
+func parseAspectRatio(ratio string) (int, int, error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("aspect ratio %q must be in W:H form", ratio)
+	}
+	w, err := strconv.Atoi(parts[0])
+	if err != nil || w <= 0 {
+		return 0, 0, fmt.Errorf("aspect ratio %q must use positive integers", ratio)
+	}
+	h, err := strconv.Atoi(parts[1])
+	if err != nil || h <= 0 {
+		return 0, 0, fmt.Errorf("aspect ratio %q must use positive integers", ratio)
+	}
+	return w, h, nil
+}
+
+// fitImageToAspectRatio center-crops img to ratioW:ratioH, or with pad set,
+// letterboxes it onto a black canvas of that ratio instead. Both portrait and
+// landscape sources are handled.
+func fitImageToAspectRatio(img image.Image, ratioW, ratioH int, pad bool) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	targetW, targetH := w, h
+	tooWide := w*ratioH > h*ratioW
+	switch {
+	case tooWide && !pad:
+		targetW = h * ratioW / ratioH
+	case tooWide && pad:
+		targetH = w * ratioH / ratioW
+	case !tooWide && !pad:
+		targetH = w * ratioH / ratioW
+	default:
+		targetW = h * ratioW / ratioH
+	}
+
+	if targetW == w && targetH == h {
+		return img
+	}
+
+	if !pad {
+		x0 := bounds.Min.X + (w-targetW)/2
+		y0 := bounds.Min.Y + (h-targetH)/2
+		return cropImage(img, image.Rect(x0, y0, x0+targetW, y0+targetH))
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, targetW, targetH))
+	draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+	offset := image.Pt((targetW-w)/2, (targetH-h)/2)
+	draw.Draw(dst, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// cropImage returns the part of img within rect, which must lie within its
+// bounds.
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+// orientImage transforms img so it displays upright given its EXIF
+// orientation, undoing the rotation and mirroring cameras record instead of
+// applying.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+
+	// source maps a destination pixel to the source pixel it comes from.
+	source := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return w - 1 - x, y },
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		4: func(x, y int) (int, int) { return x, h - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, h - 1 - x },
+		7: func(x, y int) (int, int) { return w - 1 - y, h - 1 - x },
+		8: func(x, y int) (int, int) { return w - 1 - y, x },
+	}[orientation]
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			sx, sy := source(x, y)
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+const (
+	placeholderWidth    = 16
+	maxPlaceholderBytes = 1024
+)
+
+// encodePlaceholder renders img as a tiny JPEG data URL clients can show,
+// blurred, while the full thumbnail loads. Quality is lowered until the URL
+// fits in maxPlaceholderBytes; an empty string is returned if it never does.
+func encodePlaceholder(img image.Image) (string, error) {
+	small := downscaleImage(img, placeholderWidth)
+
+	for _, quality := range []int{60, 40, 20} {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return "", err
+		}
+
+		dataURL := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		if len(dataURL) <= maxPlaceholderBytes {
+			return dataURL, nil
+		}
+	}
+	return "", nil
+}
+
+// downscaleImage shrinks img to the given width, keeping its aspect ratio,
+// by averaging each block of source pixels. Images already narrower are
+// returned as is.
+func downscaleImage(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= width {
+		return img
+	}
+
+	height := max(1, h*width/w)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*h/height, max((y+1)*h/height, y*h/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*w/width, max((x+1)*w/width, x*w/width+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, mediaType string) error {
+	switch mediaType {
+	case "image/jpg", "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	case "image/png":
+		return png.Encode(w, img)
+	default:
+		return errors.New("unsupported image type " + mediaType)
+	}
+}
@@ -66,11 +66,19 @@ type VideoMeta struct {
 			VendorID    string `json:"vendor_id"`
 			Encoder     string `json:"encoder"`
 			Timecode    string `json:"timecode"`
+			Rotate      string `json:"rotate,omitempty"`
 		} `json:"tags,omitempty"`
+		SideDataList []struct {
+			SideDataType string `json:"side_data_type"`
+			Rotation     int    `json:"rotation,omitempty"`
+		} `json:"side_data_list,omitempty"`
 		SampleFmt     string `json:"sample_fmt,omitempty"`
 		SampleRate    string `json:"sample_rate,omitempty"`
 		Channels      int    `json:"channels,omitempty"`
 		ChannelLayout string `json:"channel_layout,omitempty"`
 		BitsPerSample int    `json:"bits_per_sample,omitempty"`
 	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
 }
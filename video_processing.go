@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandRunner runs external tools such as ffmpeg and ffprobe and returns
+// their stdout, or with RunCombined, stdout and stderr together for the
+// ffmpeg filters that only report on stderr. ctx carries the request ID
+// what they log is tagged with. Tests can substitute canned output or
+// failures without the real binaries being installed.
+type commandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	RunCombined(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// execCommandRunner runs the real binaries. Run captures stderr and, when a
+// command fails, puts its tail in the error, with the whole of it logged
+// when logStderr is set.
+type execCommandRunner struct {
+	logStderr bool
+}
+
+// maxStderrInError is how much of a failed command's stderr its error keeps.
+// The tail is kept, it's where ffmpeg explains why it gave up.
+const maxStderrInError = 1 << 10
+
+// commandError is a failed command along with what it wrote to stderr.
+type commandError struct {
+	name   string
+	err    error
+	stderr string
+}
+
+func (e *commandError) Error() string {
+	stderr := strings.TrimSpace(e.stderr)
+	if stderr == "" {
+		return fmt.Sprintf("%s: %v", e.name, e.err)
+	}
+	if len(stderr) > maxStderrInError {
+		stderr = "..." + stderr[len(stderr)-maxStderrInError:]
+	}
+	return fmt.Sprintf("%s: %v: %s", e.name, e.err, stderr)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+func (r execCommandRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	command := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	err := command.Run()
+	if err != nil {
+		if r.logStderr {
+			logf(ctx, "%s %s failed: %v\n%s", name, strings.Join(args, " "), err, stderr.String())
+		}
+		return stdout.Bytes(), &commandError{name: name, err: err, stderr: stderr.String()}
+	}
+	return stdout.Bytes(), nil
+}
+
+func (execCommandRunner) RunCombined(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+const (
+	hdrPolicyAllow     = "allow"
+	hdrPolicyReject    = "reject"
+	hdrPolicyTranscode = "transcode"
+)
+
+type videoStreamInfo struct {
+	AspectRatio string
+	CodecName   string
+	// Width and Height are the coded frame size, before any rotation.
+	Width         int
+	Height        int
+	PixFmt        string
+	ColorTransfer string
+	// Rotation is how many degrees clockwise players should rotate the
+	// stored frames by: 0, 90, 180 or 270.
+	Rotation int
+	HasAudio bool
+	// AudioCodec is the codec of the first audio stream.
+	AudioCodec string
+	Duration   time.Duration
+}
+
+// isHDR reports whether the stream uses a 10/12-bit pixel format or an HDR
+// transfer function, both of which most browsers can't render correctly.
+func (info videoStreamInfo) isHDR() bool {
+	if strings.Contains(info.PixFmt, "p10") || strings.Contains(info.PixFmt, "p12") {
+		return true
+	}
+	return info.hasHDRTransfer()
+}
+
+// hasHDRTransfer reports whether the stream is PQ or HLG encoded, as opposed
+// to merely stored at a higher bit depth.
+func (info videoStreamInfo) hasHDRTransfer() bool {
+	return info.ColorTransfer == "smpte2084" || info.ColorTransfer == "arib-std-b67"
+}
+
+var errInvalidVideoMetadata = errors.New("could not parse video metadata")
+
+const (
+	aspectRatioFallbackOther   = "other"
+	aspectRatioFallbackReject  = "reject"
+	aspectRatioFallbackCompute = "compute"
+)
+
+var errUnknownAspectRatio = errors.New("could not determine video aspect ratio")
+
+// aspectRatioTolerance is how far a computed width/height ratio may be from
+// 16:9 or 9:16 and still count as one, so coded sizes padded to a multiple
+// of 16 such as 1920x1088 match.
+const aspectRatioTolerance = 0.02
+
+// aspectRatioBuckets are the aspect ratios videos are grouped under.
+var aspectRatioBuckets = []string{"16:9", "9:16", "1:1", "other"}
+
+// aspectRatioNames maps each bucket to the name videos in it are stored and
+// keyed under.
+var aspectRatioNames = map[string]string{
+	"16:9":  "landscape",
+	"9:16":  "portrait",
+	"1:1":   "square",
+	"other": "other",
+}
+
+// isAspectRatioName reports whether name is one of aspectRatioNames.
+func isAspectRatioName(name string) bool {
+	for _, n := range aspectRatioNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isSquare reports whether a width x height frame is 1:1 give or take
+// tolerance, a fraction of the ratio, so near-square sizes such as
+// 1080x1082 count.
+func isSquare(width, height int, tolerance float64) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	return math.Abs(float64(width)/float64(height)-1) <= tolerance
+}
+
+// computeAspectRatio buckets a frame size as "16:9", "9:16" or "other".
+func computeAspectRatio(width, height int) string {
+	if width <= 0 || height <= 0 {
+		return "other"
+	}
+	ratio := float64(width) / float64(height)
+	switch {
+	case math.Abs(ratio-16.0/9.0) <= 16.0/9.0*aspectRatioTolerance:
+		return "16:9"
+	case math.Abs(ratio-9.0/16.0) <= 9.0/16.0*aspectRatioTolerance:
+		return "9:16"
+	default:
+		return "other"
+	}
+}
+
+// parseVideoMeta decodes ffprobe's JSON output, ignoring anything printed
+// around the JSON object such as warnings, and checks it lists at least one
+// stream.
+func parseVideoMeta(ctx context.Context, output []byte) (VideoMeta, error) {
+	var meta VideoMeta
+
+	start := bytes.IndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start == -1 || end < start {
+		logf(ctx, "ffprobe output contains no JSON object: %q", output)
+		return VideoMeta{}, errInvalidVideoMetadata
+	}
+
+	err := json.Unmarshal(output[start:end+1], &meta)
+	if err != nil {
+		logf(ctx, "Couldn't decode ffprobe output: %v", err)
+		return VideoMeta{}, errInvalidVideoMetadata
+	}
+
+	if len(meta.Streams) == 0 {
+		return VideoMeta{}, fmt.Errorf("%w: no streams found", errInvalidVideoMetadata)
+	}
+
+	return meta, nil
+}
+
+// probeVideo reads a video's stream info. Videos whose frame is square within
+// squareTolerance are bucketed as 1:1. When the display aspect ratio is
+// anything but 16:9 or 9:16 otherwise, fallback decides what happens: bucket
+// it as "other", fail with errUnknownAspectRatio, or work it out from the
+// coded frame size.
+func probeVideo(ctx context.Context, runner commandRunner, filepath, fallback string, squareTolerance float64) (videoStreamInfo, error) {
+	output, err := runner.Run(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filepath)
+
+	if err != nil {
+		return videoStreamInfo{}, err
+	}
+
+	meta, err := parseVideoMeta(ctx, output)
+
+	if err != nil {
+		return videoStreamInfo{}, err
+	}
+
+	info := videoStreamInfo{AspectRatio: "other"}
+
+	for _, streamInfo := range meta.Streams {
+		if streamInfo.CodecType == "audio" && !info.HasAudio {
+			info.HasAudio = true
+			info.AudioCodec = streamInfo.CodecName
+		}
+	}
+
+	for _, streamInfo := range meta.Streams {
+		if streamInfo.CodecType != "video" {
+			continue
+		}
+
+		info.CodecName = streamInfo.CodecName
+		info.Width = streamInfo.Width
+		info.Height = streamInfo.Height
+		info.PixFmt = streamInfo.PixFmt
+		info.ColorTransfer = streamInfo.ColorTransfer
+
+		// WebM streams usually carry no duration, only the container does.
+		info.Duration = parseSeconds(streamInfo.Duration)
+		if info.Duration == 0 {
+			info.Duration = parseSeconds(meta.Format.Duration)
+		}
+
+		squarePixels := streamInfo.SampleAspectRatio == "" || streamInfo.SampleAspectRatio == "1:1"
+		if streamInfo.DisplayAspectRatio == "1:1" || (squarePixels && isSquare(streamInfo.Width, streamInfo.Height, squareTolerance)) {
+			info.AspectRatio = "1:1"
+		} else if streamInfo.DisplayAspectRatio == "16:9" || streamInfo.DisplayAspectRatio == "9:16" {
+			info.AspectRatio = streamInfo.DisplayAspectRatio
+		} else {
+			logf(ctx, "Falling back to %q for display aspect ratio %q, ffprobe output: %s", fallback, streamInfo.DisplayAspectRatio, output)
+			switch fallback {
+			case aspectRatioFallbackReject:
+				return videoStreamInfo{}, errUnknownAspectRatio
+			case aspectRatioFallbackCompute:
+				info.AspectRatio = computeAspectRatio(streamInfo.CodedWidth, streamInfo.CodedHeight)
+			}
+		}
+
+		// Older muxers write a "rotate" tag, newer ffprobe versions report
+		// a display matrix whose rotation is counter-clockwise instead.
+		rotation, _ := strconv.Atoi(streamInfo.Tags.Rotate)
+		for _, sideData := range streamInfo.SideDataList {
+			if sideData.SideDataType == "Display Matrix" {
+				rotation = -sideData.Rotation
+			}
+		}
+		info.Rotation = ((rotation%360 + 360) % 360) / 90 * 90
+		break
+	}
+
+	return info, nil
+}
+
+const (
+	audioWarningMissing     = "missing"
+	audioWarningUndecodable = "undecodable"
+	audioWarningNearSilent  = "near_silent"
+)
+
+// silenceThresholdDB is the peak volume under which an audio track is
+// considered near-silent.
+const silenceThresholdDB = -50.0
+
+var maxVolumePattern = regexp.MustCompile(`max_volume: (-?[0-9.]+|-inf) dB`)
+
+// detectSilentAudio decodes the first audio track through ffmpeg's
+// volumedetect filter and returns an audio warning, or "" if it sounds fine.
+func detectSilentAudio(ctx context.Context, runner commandRunner, filepath string) string {
+	output, err := runner.RunCombined(ctx, "ffmpeg", "-nostdin", "-hide_banner", "-i", filepath,
+		"-map", "0:a:0", "-af", "volumedetect", "-f", "null", "-")
+
+	if err != nil {
+		logf(ctx, "Couldn't decode audio: %v: %s", err, output)
+		return audioWarningUndecodable
+	}
+
+	match := maxVolumePattern.FindSubmatch(output)
+	if match == nil {
+		return audioWarningUndecodable
+	}
+	if string(match[1]) == "-inf" {
+		return audioWarningNearSilent
+	}
+
+	maxVolume, err := strconv.ParseFloat(string(match[1]), 64)
+	if err != nil {
+		return audioWarningUndecodable
+	}
+	if maxVolume < silenceThresholdDB {
+		return audioWarningNearSilent
+	}
+	return ""
+}
+
+var errCorruptVideo = errors.New("video does not decode cleanly")
+
+// maxDecodeErrorLog caps how much of ffmpeg's complaints end up in the error.
+const maxDecodeErrorLog = 512
+
+// verifyVideoDecodes decodes the whole file without writing anything, and
+// fails with errCorruptVideo if ffmpeg reports any error, which catches
+// truncated or damaged uploads ffprobe alone lets through.
+func verifyVideoDecodes(ctx context.Context, runner commandRunner, filepath string) error {
+	output, err := runner.RunCombined(ctx, "ffmpeg", "-nostdin", "-v", "error", "-i", filepath, "-f", "null", "-")
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+
+	output = bytes.TrimSpace(output)
+	if err == nil && len(output) == 0 {
+		return nil
+	}
+	if len(output) > maxDecodeErrorLog {
+		output = append(output[:maxDecodeErrorLog:maxDecodeErrorLog], "..."...)
+	}
+	return fmt.Errorf("%w: %s", errCorruptVideo, output)
+}
+
+var ffmpegPresets = []string{
+	"ultrafast", "superfast", "veryfast", "faster", "fast",
+	"medium", "slow", "slower", "veryslow", "placebo",
+}
+
+// ffmpegOptions limits how much CPU ffmpeg is allowed to use. Preset only
+// applies to steps that re-encode; the faststart step copies streams as-is so
+// only Threads has an effect there.
+type ffmpegOptions struct {
+	Threads int
+	Preset  string
+}
+
+// createOutputPath reserves a uniquely named file next to input for ffmpeg to
+// overwrite. pattern is appended to input's name, with its "*" replaced by a
+// random string, so concurrent runs on the same input never share an output.
+func createOutputPath(input, pattern string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(input), filepath.Base(input)+pattern)
+	if err != nil {
+		return "", fmt.Errorf("could not create output file: %v", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func processVideoForFastStart(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions, _ videoStreamInfo) (string, error) {
+	output, err := createOutputPath(filepath, ".processing-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-i", filepath, "-threads", strconv.Itoa(opts.Threads),
+		"-c", "copy", "-movflags", "faststart", "-f", "mp4", output)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat processed file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("processed file is empty")
+	}
+
+	return output, nil
+}
+
+// mp4AudioCodecs are the audio codecs that can be copied into an mp4 as is.
+var mp4AudioCodecs = map[string]bool{"aac": true, "mp3": true, "alac": true, "ac3": true, "eac3": true}
+
+// mp4AudioArgs are the ffmpeg arguments for the audio of an mp4 made from a
+// source described by info. Audio an mp4 can't carry, such as the Vorbis or
+// Opus of a WebM, is transcoded to AAC.
+func mp4AudioArgs(info videoStreamInfo) []string {
+	if !info.HasAudio || mp4AudioCodecs[info.AudioCodec] {
+		return []string{"-c:a", "copy"}
+	}
+	return []string{"-c:a", "aac", "-b:a", "192k"}
+}
+
+// autoOrientVideo re-encodes a video with its rotation applied to the frames
+// and the rotation metadata cleared, so it displays upright even in players
+// that ignore the metadata. ffmpeg rotates automatically whenever it
+// re-encodes, so only the leftover tag needs clearing explicitly.
+func autoOrientVideo(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions, info videoStreamInfo) (string, error) {
+	output, err := createOutputPath(filepath, ".oriented-*")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-y", "-i", filepath, "-threads", strconv.Itoa(opts.Threads), "-c:v", "libx264", "-preset", opts.Preset}
+	args = append(args, mp4AudioArgs(info)...)
+	args = append(args, "-metadata:s:v:0", "rotate=0", "-movflags", "faststart", "-f", "mp4", output)
+	_, err = runner.Run(ctx, "ffmpeg", args...)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat oriented file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("oriented file is empty")
+	}
+
+	return output, nil
+}
+
+// extractThumbnailFrame grabs a representative frame of a video as a JPEG,
+// letting ffmpeg's thumbnail filter skip black or blurry frames.
+func extractThumbnailFrame(ctx context.Context, runner commandRunner, filepath string) ([]byte, error) {
+	output, err := createOutputPath(filepath, ".thumbnail-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(output)
+
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-i", filepath, "-vf", "thumbnail", "-frames:v", "1", output)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(output)
+}
+
+// errNoSceneChange means scene detection found no frame above its threshold.
+var errNoSceneChange = errors.New("no scene change found")
+
+// extractSceneFrame grabs the first frame that differs from the one before by
+// more than threshold, on ffmpeg's 0-1 scene score, as a JPEG. That skips
+// black intros and fades a fixed grab tends to land on.
+func extractSceneFrame(ctx context.Context, runner commandRunner, filepath string, threshold float64) ([]byte, error) {
+	output, err := createOutputPath(filepath, ".scene-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(output)
+
+	filter := fmt.Sprintf("select='gt(scene,%s)'", strconv.FormatFloat(threshold, 'f', -1, 64))
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-i", filepath, "-vf", filter, "-frames:v", "1", output)
+
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := os.ReadFile(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) == 0 {
+		return nil, errNoSceneChange
+	}
+	return frame, nil
+}
+
+// extractFrameAt grabs the frame of a video at a timestamp as a JPEG. input
+// may also be a URL, which ffmpeg reads with range requests instead of
+// downloading the whole video.
+func extractFrameAt(ctx context.Context, runner commandRunner, input string, at time.Duration) ([]byte, error) {
+	file, err := os.CreateTemp("", "tubely-frame-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-ss", formatSeconds(at), "-i", input, "-frames:v", "1", "-q:v", "2", file.Name())
+
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := os.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("no frame at %v", at)
+	}
+	return frame, nil
+}
+
+// errEmptyTrim means a trim range held no frames ffmpeg could copy.
+var errEmptyTrim = errors.New("trimmed video is empty")
+
+// trimVideo cuts the part of a video from start lasting length into a new
+// file with extension ext. Streams are copied rather than re-encoded, so the
+// cut snaps to the keyframe at or before start. input may also be a URL.
+func trimVideo(ctx context.Context, runner commandRunner, input string, start, length time.Duration, ext string) (string, error) {
+	file, err := os.CreateTemp("", "tubely-trim-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	output := file.Name()
+
+	args := []string{"-y", "-ss", formatSeconds(start), "-i", input, "-t", formatSeconds(length),
+		"-map", "0", "-c", "copy", "-avoid_negative_ts", "make_zero"}
+	if ext == ".mp4" {
+		args = append(args, "-movflags", "faststart")
+	}
+	_, err = runner.Run(ctx, "ffmpeg", append(args, output)...)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		os.Remove(output)
+		return "", fmt.Errorf("could not stat trimmed file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", errEmptyTrim
+	}
+
+	return output, nil
+}
+
+// generatePreview encodes a short, small, silent animated WebP clip of a
+// video for hover previews.
+func generatePreview(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions, start, duration time.Duration) (string, error) {
+	output, err := createOutputPath(filepath, ".preview-*.webp")
+	if err != nil {
+		return "", err
+	}
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-ss", formatSeconds(start), "-t", formatSeconds(duration),
+		"-i", filepath, "-threads", strconv.Itoa(opts.Threads),
+		"-vf", "fps=10,scale=320:-2", "-an", "-c:v", "libwebp", "-quality", "50", "-loop", "0", output)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat preview file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("preview file is empty")
+	}
+
+	return output, nil
+}
+
+// generateProxy encodes a low-bitrate 360p MP4 of a video for editors to
+// scrub. Its short side is scaled to 360 pixels, and it has a keyframe
+// every second so seeking lands quickly without decoding far back.
+func generateProxy(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions) (string, error) {
+	output, err := createOutputPath(filepath, ".proxy-*.mp4")
+	if err != nil {
+		return "", err
+	}
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-i", filepath, "-threads", strconv.Itoa(opts.Threads),
+		"-vf", "scale='if(gt(iw,ih),-2,360)':'if(gt(iw,ih),360,-2)',fps=24",
+		"-c:v", "libx264", "-preset", "veryfast", "-b:v", "400k", "-maxrate", "500k", "-bufsize", "1000k",
+		"-g", "24", "-keyint_min", "24", "-sc_threshold", "0", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "64k", "-ac", "2", "-movflags", "faststart", output)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat proxy file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("proxy file is empty")
+	}
+
+	return output, nil
+}
+
+// generateStoryboard renders a frame every interval into a sprite sheet of
+// tiles tileWidth pixels wide, laid out columns to a row. ffmpeg stops
+// once tiles frames are in or the video ends.
+func generateStoryboard(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions, interval time.Duration, tileWidth, columns, tiles int) (string, error) {
+	output, err := createOutputPath(filepath, ".storyboard-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	rows := (tiles + columns - 1) / columns
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:-2,tile=%dx%d", formatSeconds(interval), tileWidth, columns, rows)
+	_, err = runner.Run(ctx, "ffmpeg", "-y", "-i", filepath, "-threads", strconv.Itoa(opts.Threads),
+		"-vf", filter, "-frames:v", "1", "-an", "-q:v", "5", output)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat storyboard file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("storyboard file is empty")
+	}
+
+	return output, nil
+}
+
+// parseSeconds parses ffprobe's fractional seconds, returning 0 for missing
+// or "N/A" values.
+func parseSeconds(v string) time.Duration {
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// toneMapFilter converts PQ or HLG video to bt709 SDR: it goes through linear
+// light, where hable tone mapping compresses the highlights, before
+// converting to bt709 primaries and transfer. zscale needs an ffmpeg built
+// with libzimg, as most distribution and static builds are.
+const toneMapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=hable,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// sdrFilter is the filter turning a source described by info into 8-bit
+// bt709. 10-bit video without an HDR transfer is already SDR and only needs
+// its bit depth reduced; tone mapping it would dull it.
+func sdrFilter(info videoStreamInfo) string {
+	if info.hasHDRTransfer() {
+		return toneMapFilter
+	}
+	return "format=yuv420p"
+}
+
+// transcodeToSDR re-encodes a video to 8-bit h264 so HDR and 10-bit sources
+// play in browsers. The output is written with faststart already applied.
+func transcodeToSDR(ctx context.Context, runner commandRunner, filepath string, opts ffmpegOptions, info videoStreamInfo) (string, error) {
+	output, err := createOutputPath(filepath, ".sdr-*")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"-y", "-i", filepath, "-threads", strconv.Itoa(opts.Threads),
+		"-vf", sdrFilter(info), "-c:v", "libx264", "-preset", opts.Preset, "-pix_fmt", "yuv420p",
+		"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709"}
+	args = append(args, mp4AudioArgs(info)...)
+	args = append(args, "-movflags", "faststart", "-f", "mp4", output)
+	_, err = runner.Run(ctx, "ffmpeg", args...)
+
+	if err != nil {
+		os.Remove(output)
+		return "", err
+	}
+
+	fileInfo, err := os.Stat(output)
+	if err != nil {
+		return "", fmt.Errorf("could not stat transcoded file: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		os.Remove(output)
+		return "", fmt.Errorf("transcoded file is empty")
+	}
+
+	return output, nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCommandRunner stands in for ffmpeg and ffprobe. respond decides what a
+// command outputs; commands it's nil for succeed without output.
+type fakeCommandRunner struct {
+	mu      sync.Mutex
+	calls   [][]string
+	respond func(name string, args []string) ([]byte, error)
+}
+
+func (f *fakeCommandRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+	respond := f.respond
+	f.mu.Unlock()
+
+	if respond == nil {
+		return nil, nil
+	}
+	return respond(name, args)
+}
+
+func (f *fakeCommandRunner) RunCombined(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f.Run(ctx, name, args...)
+}
+
+// callsTo returns the arguments of each run of the command name.
+func (f *fakeCommandRunner) callsTo(name string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls [][]string
+	for _, call := range f.calls {
+		if call[0] == name {
+			calls = append(calls, slices.Clone(call[1:]))
+		}
+	}
+	return calls
+}
+
+// fakeStream is the part of an ffprobe stream the code under test reads.
+type fakeStream struct {
+	CodecType          string `json:"codec_type"`
+	CodecName          string `json:"codec_name,omitempty"`
+	Width              int    `json:"width,omitempty"`
+	Height             int    `json:"height,omitempty"`
+	CodedWidth         int    `json:"coded_width,omitempty"`
+	CodedHeight        int    `json:"coded_height,omitempty"`
+	SampleAspectRatio  string `json:"sample_aspect_ratio,omitempty"`
+	DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
+	PixFmt             string `json:"pix_fmt,omitempty"`
+	ColorTransfer      string `json:"color_transfer,omitempty"`
+	Duration           string `json:"duration,omitempty"`
+	Tags               struct {
+		Rotate string `json:"rotate,omitempty"`
+	} `json:"tags"`
+	SideDataList []fakeSideData `json:"side_data_list,omitempty"`
+}
+
+type fakeSideData struct {
+	SideDataType string `json:"side_data_type"`
+	Rotation     int    `json:"rotation"`
+}
+
+// ffprobeOutput returns what ffprobe prints for a file with streams.
+func ffprobeOutput(t *testing.T, duration string, streams ...fakeStream) []byte {
+	t.Helper()
+
+	output, err := json.Marshal(map[string]any{
+		"streams": streams,
+		"format":  map[string]string{"duration": duration},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// ffprobeResponder answers ffprobe with output and any other command with
+// nothing.
+func ffprobeResponder(output []byte) func(string, []string) ([]byte, error) {
+	return func(name string, args []string) ([]byte, error) {
+		if name == "ffprobe" {
+			return output, nil
+		}
+		return nil, nil
+	}
+}
+
+// ffmpegOutputResponder answers ffmpeg by writing data to its output file,
+// the last argument, and any other command with nothing.
+func ffmpegOutputResponder(data []byte) func(string, []string) ([]byte, error) {
+	return func(name string, args []string) ([]byte, error) {
+		if name == "ffmpeg" {
+			return nil, os.WriteFile(args[len(args)-1], data, 0o600)
+		}
+		return nil, nil
+	}
+}
+
+// processingResponder answers ffprobe with probe and ffmpeg by writing
+// output to its output file, as a full processing run needs.
+func processingResponder(probe, output []byte) func(string, []string) ([]byte, error) {
+	process := ffmpegOutputResponder(output)
+	return func(name string, args []string) ([]byte, error) {
+		if name == "ffprobe" {
+			return probe, nil
+		}
+		return process(name, args)
+	}
+}
+
+func TestExtractSceneFrame(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(input, mp4Fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	runner := &fakeCommandRunner{respond: ffmpegOutputResponder([]byte("jpeg data"))}
+
+	frame, err := extractSceneFrame(context.Background(), runner, input, 0.4)
+	if err != nil {
+		t.Fatalf("extractSceneFrame: %v", err)
+	}
+	if string(frame) != "jpeg data" {
+		t.Errorf("frame = %q, want what ffmpeg wrote", frame)
+	}
+
+	calls := runner.callsTo("ffmpeg")
+	if len(calls) != 1 {
+		t.Fatalf("ffmpeg runs = %q, want one", calls)
+	}
+	args := calls[0]
+	want := []string{"-y", "-i", input, "-vf", "select='gt(scene,0.4)'", "-frames:v", "1"}
+	if !slices.Equal(args[:len(args)-1], want) {
+		t.Errorf("args = %q, want %q followed by the output", args, want)
+	}
+	output := args[len(args)-1]
+	if filepath.Ext(output) != ".jpg" {
+		t.Errorf("output = %q, want a .jpg", output)
+	}
+	if _, err := os.Stat(output); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("output %q was left behind: %v", output, err)
+	}
+}
+
+func TestExtractSceneFrameNoSceneChange(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "upload.mp4")
+	runner := &fakeCommandRunner{respond: ffmpegOutputResponder(nil)}
+
+	_, err := extractSceneFrame(context.Background(), runner, input, 0.4)
+	if !errors.Is(err, errNoSceneChange) {
+		t.Errorf("error = %v, want errNoSceneChange", err)
+	}
+}
+
+func TestExecCommandRunnerStderr(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	output, err := execCommandRunner{}.Run(context.Background(), "sh", "-c", "echo partial; echo 'Invalid data found when processing input' >&2; exit 1")
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("error = %v, want a commandError", err)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("error = %v, want it to wrap the exit status", err)
+	}
+	if want := "sh: exit status 1: Invalid data found when processing input"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+	if string(output) != "partial\n" {
+		t.Errorf("output = %q, want stdout only", output)
+	}
+
+	_, err = execCommandRunner{}.Run(context.Background(), "sh", "-c", "exit 2")
+	if want := "sh: exit status 2"; err == nil || err.Error() != want {
+		t.Errorf("error without stderr = %v, want %q", err, want)
+	}
+}
+
+func TestExecCommandRunnerLogsRequestID(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx := withRequestID(context.Background(), "req-123")
+	execCommandRunner{logStderr: true}.Run(ctx, "sh", "-c", "echo 'moov atom not found' >&2; exit 1")
+
+	if line := logged.String(); !strings.Contains(line, "request_id=req-123 sh -c") || !strings.Contains(line, "moov atom not found") {
+		t.Errorf("logged %q, want the stderr under the request's ID", line)
+	}
+}
+
+func TestCommandErrorKeepsStderrTail(t *testing.T) {
+	stderr := strings.Repeat("x", 2*maxStderrInError) + "the reason"
+	err := &commandError{name: "ffmpeg", err: errors.New("exit status 1"), stderr: stderr}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "ffmpeg: exit status 1: ...") || !strings.HasSuffix(msg, "the reason") {
+		t.Errorf("error = %.60q..., want the tail of stderr", msg)
+	}
+	if len(msg) > len("ffmpeg: exit status 1: ...")+maxStderrInError {
+		t.Errorf("error is %d bytes long, want stderr cut to %d", len(msg), maxStderrInError)
+	}
+}
+
+func TestIsSquare(t *testing.T) {
+	tests := []struct {
+		width, height int
+		tolerance     float64
+		want          bool
+	}{
+		{1080, 1080, 0, true},
+		{1080, 1080, 0.01, true},
+		{1080, 1082, 0.01, true},
+		{1082, 1080, 0.01, true},
+		{1080, 1082, 0, false},
+		{1080, 1100, 0.01, false},
+		{1920, 1080, 0.01, false},
+		{0, 0, 0.01, false},
+		{1080, 0, 0.01, false},
+	}
+	for _, tt := range tests {
+		if got := isSquare(tt.width, tt.height, tt.tolerance); got != tt.want {
+			t.Errorf("isSquare(%d, %d, %v) = %v, want %v", tt.width, tt.height, tt.tolerance, got, tt.want)
+		}
+	}
+}
+
+func TestProbeVideoSquare(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream fakeStream
+		want   string
+	}{
+		{"exact", fakeStream{Width: 1080, Height: 1080}, "1:1"},
+		{"exact with a 1:1 display ratio", fakeStream{Width: 1080, Height: 1080, DisplayAspectRatio: "1:1"}, "1:1"},
+		{"near square", fakeStream{Width: 1080, Height: 1082, DisplayAspectRatio: "540:541"}, "1:1"},
+		{"near square, square pixels", fakeStream{Width: 1082, Height: 1080, SampleAspectRatio: "1:1", DisplayAspectRatio: "541:540"}, "1:1"},
+		{"outside the tolerance", fakeStream{Width: 1080, Height: 1100, DisplayAspectRatio: "54:55"}, "other"},
+		// Square storage shown stretched to 16:9 isn't square on screen.
+		{"anamorphic", fakeStream{Width: 1080, Height: 1080, SampleAspectRatio: "16:9", DisplayAspectRatio: "16:9"}, "16:9"},
+		{"landscape", fakeStream{Width: 1920, Height: 1080, DisplayAspectRatio: "16:9"}, "16:9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stream.CodecType = "video"
+			runner := &fakeCommandRunner{respond: ffprobeResponder(ffprobeOutput(t, "10", tt.stream))}
+
+			info, err := probeVideo(context.Background(), runner, "video.mp4", aspectRatioFallbackOther, 0.01)
+			if err != nil {
+				t.Fatalf("probeVideo: %v", err)
+			}
+			if info.AspectRatio != tt.want {
+				t.Errorf("aspect ratio = %q, want %q", info.AspectRatio, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateOutputPath(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "upload.mp4")
+
+	a, err := createOutputPath(input, ".scene-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := createOutputPath(input, ".scene-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("createOutputPath returned %q twice", a)
+	}
+	for _, output := range []string{a, b} {
+		if filepath.Dir(output) != filepath.Dir(input) || !strings.HasPrefix(filepath.Base(output), "upload.mp4.scene-") || filepath.Ext(output) != ".jpg" {
+			t.Errorf("output = %q, want upload.mp4.scene-*.jpg next to the input", output)
+		}
+	}
+}
+
+func TestProcessVideoForFastStartConcurrent(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(input, mp4Fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Each run writes its own output path, so a run whose output another
+	// one overwrote reads back someone else's.
+	runner := &fakeCommandRunner{respond: func(name string, args []string) ([]byte, error) {
+		output := args[len(args)-1]
+		return nil, os.WriteFile(output, []byte(output), 0o600)
+	}}
+
+	const runs = 8
+	outputs := make([]string, runs)
+	errs := make([]error, runs)
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputs[i], errs[i] = processVideoForFastStart(context.Background(), runner, input, ffmpegOptions{Threads: 1}, videoStreamInfo{})
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i, output := range outputs {
+		if errs[i] != nil {
+			t.Fatalf("run %d: %v", i, errs[i])
+		}
+		if seen[output] {
+			t.Errorf("output %q was used by two runs", output)
+		}
+		seen[output] = true
+		data, err := os.ReadFile(output)
+		if err != nil || string(data) != output {
+			t.Errorf("output %q holds %q, %v, want what its own run wrote", output, data, err)
+		}
+	}
+}
+
+func TestProcessVideoForFastStartFailureRemovesOutput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "upload.mp4")
+	if err := os.WriteFile(input, mp4Fixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, respond := range map[string]func(string, []string) ([]byte, error){
+		"ffmpeg fails": func(string, []string) ([]byte, error) { return nil, errors.New("exit status 1") },
+		"empty output": ffmpegOutputResponder(nil),
+	} {
+		_, err := processVideoForFastStart(context.Background(), &fakeCommandRunner{respond: respond}, input, ffmpegOptions{Threads: 1}, videoStreamInfo{})
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: %d files next to the input, want only the input", name, len(entries))
+		}
+	}
+}
+
+func TestParseVideoMeta(t *testing.T) {
+	valid := `{"streams": [{"codec_type": "video", "width": 1920, "height": 1080}], "format": {"duration": "10.5"}}`
+	tests := []struct {
+		name       string
+		output     string
+		wantErr    bool
+		wantWidth  int
+		wantFormat string
+	}{
+		{"clean", valid, false, 1920, "10.5"},
+		{"warnings before", "[mov,mp4 @ 0x5581] stream 1, offset 0x30: partial file\n" + valid, false, 1920, "10.5"},
+		{"warnings after", valid + "\n[h264 @ 0x5581] mmco: unref short failure\n", false, 1920, "10.5"},
+		{"non-numeric duration", `{"streams": [{"codec_type": "video", "duration": "N/A"}], "format": {"duration": "N/A"}}`, false, 0, "N/A"},
+		{"truncated", `{"streams": [{"codec_type": "video", "width": 1920}`, true, 0, ""},
+		{"cut mid-string", `{"streams": [{"codec_type": "vid`, true, 0, ""},
+		{"missing streams", `{"format": {"duration": "10.5"}}`, true, 0, ""},
+		{"no streams", `{"streams": [], "format": {"duration": "10.5"}}`, true, 0, ""},
+		{"only warnings", "Invalid data found when processing input\n", true, 0, ""},
+		{"empty", "", true, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := parseVideoMeta(context.Background(), []byte(tt.output))
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidVideoMetadata) {
+					t.Fatalf("err = %v, want errInvalidVideoMetadata", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoMeta: %v", err)
+			}
+			if meta.Streams[0].Width != tt.wantWidth || meta.Format.Duration != tt.wantFormat {
+				t.Errorf("width %d, duration %q, want %d, %q", meta.Streams[0].Width, meta.Format.Duration, tt.wantWidth, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestProbeVideoDuration(t *testing.T) {
+	tests := []struct {
+		name           string
+		stream, format string
+		want           time.Duration
+	}{
+		{"stream", "12.5", "13", 12500 * time.Millisecond},
+		{"container only", "", "13", 13 * time.Second},
+		{"non-numeric stream", "N/A", "13", 13 * time.Second},
+		{"non-numeric everywhere", "N/A", "N/A", 0},
+		{"negative", "-1", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := fakeStream{CodecType: "video", Width: 1920, Height: 1080, DisplayAspectRatio: "16:9", Duration: tt.stream}
+			runner := &fakeCommandRunner{respond: ffprobeResponder(ffprobeOutput(t, tt.format, stream))}
+
+			info, err := probeVideo(context.Background(), runner, "video.mp4", aspectRatioFallbackOther, 0.01)
+			if err != nil {
+				t.Fatalf("probeVideo: %v", err)
+			}
+			if info.Duration != tt.want {
+				t.Errorf("duration = %v, want %v", info.Duration, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeVideoAspectRatioFallback(t *testing.T) {
+	// No display_aspect_ratio, as ffprobe reports for some containers.
+	frame := func(width, height int) fakeStream {
+		return fakeStream{CodecType: "video", Width: width, Height: height, CodedWidth: width, CodedHeight: height}
+	}
+	tests := []struct {
+		name     string
+		fallback string
+		stream   fakeStream
+		want     string
+		wantErr  error
+	}{
+		{"other", aspectRatioFallbackOther, frame(1920, 1080), "other", nil},
+		{"reject", aspectRatioFallbackReject, frame(1920, 1080), "", errUnknownAspectRatio},
+		{"compute landscape", aspectRatioFallbackCompute, frame(1920, 1080), "16:9", nil},
+		{"compute padded landscape", aspectRatioFallbackCompute, frame(1920, 1088), "16:9", nil},
+		{"compute portrait", aspectRatioFallbackCompute, frame(1080, 1920), "9:16", nil},
+		{"compute anything else", aspectRatioFallbackCompute, frame(1440, 1080), "other", nil},
+		{"compute without a size", aspectRatioFallbackCompute, frame(0, 0), "other", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeCommandRunner{respond: ffprobeResponder(ffprobeOutput(t, "10", tt.stream))}
+
+			info, err := probeVideo(context.Background(), runner, "video.mp4", tt.fallback, 0.01)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeVideo: %v", err)
+			}
+			if info.AspectRatio != tt.want {
+				t.Errorf("aspect ratio = %q, want %q", info.AspectRatio, tt.want)
+			}
+		})
+	}
+}
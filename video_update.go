@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxVideoUpdateAttempts bounds how often saveVideo re-reads a video that
+// keeps changing underneath it.
+const maxVideoUpdateAttempts = 3
+
+// saveVideo writes the changes made to video since it was read. Requests
+// such as a thumbnail upload and a finishing video upload read and write
+// the same row, so when another update got in first the row is read again
+// and the changes are reapplied on top, rather than overwriting fields the
+// other update set. When both changed the same field it fails with
+// database.ErrVideoConflict instead. video is left as saved.
+func (cfg *apiConfig) saveVideo(video *database.Video) error {
+	for attempt := 1; ; attempt++ {
+		err := cfg.db.UpdateVideo(video)
+		if !errors.Is(err, database.ErrVideoConflict) || attempt == maxVideoUpdateAttempts {
+			return err
+		}
+
+		current, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return err
+		}
+		if current.ID == uuid.Nil {
+			// Deleted in the meantime, there's nothing left to update.
+			return database.ErrVideoConflict
+		}
+		rebased, err := database.RebaseVideo(*video, current)
+		if err != nil {
+			return err
+		}
+		*video = rebased
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestSaveVideoParallelUpdates(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	// Each update reads the row before any of them saves, and sets a
+	// different field, so all of them must land.
+	updates := []func(*database.Video){
+		func(v *database.Video) { v.Title = "Renamed" },
+		func(v *database.Video) { v.Description = "Described" },
+		func(v *database.Video) { v.OriginalFilename = "clip.mp4" },
+	}
+	reads := make([]database.Video, len(updates))
+	for i := range updates {
+		reads[i] = getTestVideo(t, cfg, video.ID)
+		updates[i](&reads[i])
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(updates))
+	for i := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = cfg.saveVideo(&reads[i])
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("update %d: %v", i, err)
+		}
+	}
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.Title != "Renamed" || saved.Description != "Described" || saved.OriginalFilename != "clip.mp4" {
+		t.Errorf("saved = %+v, want every update", saved)
+	}
+}
+
+func TestSaveVideoConflictingUpdates(t *testing.T) {
+	cfg, _ := newTestAPIConfig(t)
+	userID, _ := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, userID)
+
+	first, second := getTestVideo(t, cfg, video.ID), getTestVideo(t, cfg, video.ID)
+	first.Status = database.VideoStatusReady
+	if err := cfg.saveVideo(&first); err != nil {
+		t.Fatal(err)
+	}
+	second.Status = database.VideoStatusFailed
+	second.FailureReason = "failed"
+	err := cfg.saveVideo(&second)
+	if !errors.Is(err, database.ErrVideoConflict) {
+		t.Fatalf("saveVideo = %v, want ErrVideoConflict", err)
+	}
+
+	saved := getTestVideo(t, cfg, video.ID)
+	if saved.Status != database.VideoStatusReady || saved.FailureReason != "" {
+		t.Errorf("saved = %s %q, want the first update kept", saved.Status, saved.FailureReason)
+	}
+}
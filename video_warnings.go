@@ -0,0 +1,38 @@
+package main
+
+import "github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+
+// Codes of the warnings processing attaches to videos that were accepted
+// but may not play well everywhere.
+const (
+	warningNoAudio            = "no_audio"
+	warningUndecodableAudio   = "undecodable_audio"
+	warningNearSilentAudio    = "near_silent_audio"
+	warningHEVC               = "hevc_codec"
+	warningHDR                = "hdr"
+	warningHDRTranscoded      = "hdr_transcoded"
+	warningUnusualAspectRatio = "unusual_aspect_ratio"
+	warningUnoptimized        = "unoptimized"
+)
+
+var warningMessages = map[string]string{
+	warningNoAudio:            "The video has no audio track",
+	warningUndecodableAudio:   "The audio track couldn't be decoded",
+	warningNearSilentAudio:    "The audio track is nearly silent",
+	warningHEVC:               "The video is HEVC encoded, which some browsers can't play",
+	warningHDR:                "The video is HDR or 10-bit and may look washed out in browsers without HDR support",
+	warningHDRTranscoded:      "The video was HDR or 10-bit and has been converted to SDR",
+	warningUnusualAspectRatio: "The video isn't 16:9 or 9:16 and is listed as other",
+	warningUnoptimized:        "The video couldn't be optimized for streaming, playback may only start once it is fully downloaded",
+}
+
+func videoWarning(code string) database.VideoWarning {
+	return database.VideoWarning{Code: code, Message: warningMessages[code]}
+}
+
+// audioWarningCodes maps the video's audio warning to its warning code.
+var audioWarningCodes = map[string]string{
+	audioWarningMissing:     warningNoAudio,
+	audioWarningUndecodable: warningUndecodableAudio,
+	audioWarningNearSilent:  warningNearSilentAudio,
+}